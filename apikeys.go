@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, followed by the key id and the secret:
+// uk_<id>_<secret>.
+const apiKeyPrefix = "uk_"
+
+// APIKey is an issued API key. Only a hash of its secret is stored.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      Role       `json:"role"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+
+	// UserID links the key to a user for the /me endpoints, 0 if none.
+	UserID uint `json:"user_id,omitempty"`
+	// Tenant restricts the key to the users of a tenant.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// apiKeyStore keeps API keys in a JSON file. The file is reloaded when it
+// changes, so keys issued with the apikeys command take effect without a
+// restart.
+type apiKeyStore struct {
+	mu   sync.Mutex
+	path string
+	// loaded is the file keys were read from, nil before the first load.
+	loaded os.FileInfo
+	keys   map[string]APIKey
+}
+
+func newAPIKeyStore(path string) *apiKeyStore {
+	return &apiKeyStore{path: path, keys: map[string]APIKey{}}
+}
+
+// load rereads the file if it changed since the last load. Every write
+// replaces the file, so a changed file is a different one.
+func (s *apiKeyStore) load() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys, s.loaded = map[string]APIKey{}, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.loaded != nil && os.SameFile(fi, s.loaded) && fi.ModTime().Equal(s.loaded.ModTime()) {
+		return nil
+	}
+
+	dat, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys := map[string]APIKey{}
+	if err := json.Unmarshal(dat, &keys); err != nil {
+		return fmt.Errorf("reading API keys: %w", err)
+	}
+	s.keys, s.loaded = keys, fi
+	return nil
+}
+
+func (s *apiKeyStore) save() error {
+	dat, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, dat, 0644); err != nil {
+		return err
+	}
+	// the next load rereads our own write, which is harmless
+	return os.Chmod(s.path, 0600)
+}
+
+// issue creates a key with the name, role, user and tenant of spec and
+// returns it together with the token, which is not stored and can't be shown
+// again.
+func (s *apiKeyStore) issue(spec APIKey) (key APIKey, token string, err error) {
+	if !spec.Role.Valid() {
+		return key, "", fmt.Errorf("%w: %q", InvalidRole, spec.Role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.load(); err != nil {
+		return
+	}
+
+	id := make([]byte, 4)
+	for key.ID == "" || s.keys[key.ID].ID != "" {
+		if _, err = rand.Read(id); err != nil {
+			return
+		}
+		key.ID = hex.EncodeToString(id)
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	key.Name = spec.Name
+	key.Role = spec.Role
+	key.UserID = spec.UserID
+	key.Tenant = spec.Tenant
+	key.Hash = hashAPIKeySecret(encodedSecret)
+	key.CreatedAt = time.Now()
+
+	s.keys[key.ID] = key
+	if err = s.save(); err != nil {
+		return
+	}
+	return key, apiKeyPrefix + key.ID + "_" + encodedSecret, nil
+}
+
+// revoke disables a key, it is kept for auditing.
+func (s *apiKeyStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	key, ok := s.keys[id]
+	if !ok {
+		return APIKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+		s.keys[id] = key
+	}
+	return s.save()
+}
+
+// revokeTenant revokes all keys of a tenant.
+func (s *apiKeyStore) revokeTenant(tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for id, key := range s.keys {
+		if key.Tenant == tenant && key.RevokedAt == nil {
+			key.RevokedAt = &now
+			s.keys[id] = key
+		}
+	}
+	return s.save()
+}
+
+// list returns all keys, oldest first.
+func (s *apiKeyStore) list() ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *apiKeyStore) authenticate(token string) (*Principal, error) {
+	id, secret, ok := parseAPIKey(token)
+	if !ok {
+		return nil, InvalidAPIKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	key, found := s.keys[id]
+	hash := hashAPIKeySecret(secret)
+	if !found || subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 || key.RevokedAt != nil {
+		return nil, InvalidAPIKey
+	}
+	return &Principal{Subject: "apikey:" + key.ID, Role: key.Role, UserID: key.UserID, Tenant: key.Tenant}, nil
+}
+
+func parseAPIKey(token string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// hashAPIKeySecret hashes a secret for storage. Secrets are random, so a
+// plain sha256 can't be brute forced.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type IssueAPIKeyRequest struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"role"`
+	UserID uint   `json:"user_id,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func (i *IssueAPIKeyRequest) Bind(r *http.Request) error {
+	if i.Name == "" {
+		return errors.New("name is required")
+	}
+	if !i.Role.Valid() {
+		return fmt.Errorf("%w: %q", InvalidRole, i.Role)
+	}
+	return nil
+}
+
+// APIKeyResponse describes a key. Token is only sent when the key is issued.
+type APIKeyResponse struct {
+	APIKey
+	// Hash shadows the hash of the key, which is never sent.
+	Hash  string `json:"hash,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+func (ar *APIKeyResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+func NewAPIKeysResponse(keys []APIKey) []render.Renderer {
+	list := []render.Renderer{}
+	for _, k := range keys {
+		list = append(list, &APIKeyResponse{APIKey: k})
+	}
+	return list
+}
+
+func setAPIKeyRoutes(keys *apiKeyStore) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			list, err := keys.list()
+			if err != nil {
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+
+			if err := render.RenderList(w, r, NewAPIKeysResponse(list)); err != nil {
+				render.Render(w, r, ErrRender(err))
+				return
+			}
+		})
+
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			request := IssueAPIKeyRequest{}
+			if err := render.Bind(r, &request); err != nil {
+				render.Render(w, r, ErrInvalidRequest(err))
+				return
+			}
+
+			ctx := r.Context()
+			if request.Tenant != "" {
+				t, err := openTenant(request.Tenant)
+				if err != nil {
+					if errors.Is(err, InvalidTenant) || errors.Is(err, TenantNotFound) {
+						render.Render(w, r, ErrInvalidRequest(err))
+						return
+					}
+
+					render.Render(w, r, ErrInternal(err))
+					return
+				}
+				ctx = withTenant(ctx, t)
+			}
+			if request.UserID != 0 {
+				if _, err := dbGetUser(ctx, request.UserID); err != nil {
+					if errors.Is(err, UserNotFound) {
+						render.Render(w, r, ErrInvalidRequest(err))
+						return
+					}
+
+					render.Render(w, r, ErrInternal(err))
+					return
+				}
+			}
+
+			key, token, err := keys.issue(APIKey{Name: request.Name, Role: request.Role, UserID: request.UserID, Tenant: request.Tenant})
+			if err != nil {
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+
+			render.Status(r, http.StatusCreated)
+			render.Render(w, r, &APIKeyResponse{APIKey: key, Token: token})
+		})
+
+		r.Delete("/{keyId}", func(w http.ResponseWriter, r *http.Request) {
+			if err := keys.revoke(chi.URLParam(r, "keyId")); err != nil {
+				if errors.Is(err, APIKeyNotFound) {
+					render.Render(w, r, ErrNotFound(err))
+					return
+				}
+
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
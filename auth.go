@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role grants access to operations, each role includes the ones before it.
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Includes reports whether r grants everything other does.
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject identifies the caller for auditing, "apikey:<id>" or
+	// "jwt:<sub>".
+	Subject string
+	Role    Role
+	// UserID is the user an API key is linked to, 0 if none.
+	UserID uint
+	// Email links a bearer token to the user with this email.
+	Email string
+	// Tenant restricts the caller to the users of a tenant, callers without
+	// one may only use the default store.
+	Tenant string
+}
+
+type principalCtxKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// principalFrom returns the caller of a request, nil for anonymous ones.
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalCtxKey{}).(*Principal)
+	return p
+}
+
+// authorize checks that the caller has role on the tenant of ctx. Anonymous
+// callers are allowed everything while config.AuthRequired is off.
+func authorize(ctx context.Context, role Role) error {
+	p := principalFrom(ctx)
+	if p == nil {
+		if config.AuthRequired {
+			return Unauthenticated
+		}
+		return nil
+	}
+	if p.Tenant != tenantFrom(ctx) {
+		return fmt.Errorf("%w: the credentials are not valid for this tenant", Forbidden)
+	}
+	if !p.Role.Includes(role) {
+		return fmt.Errorf("%w: the %s role is required", Forbidden, role)
+	}
+	return nil
+}
+
+// authenticator identifies callers by the API key or the bearer token they
+// send.
+type authenticator struct {
+	keys *apiKeyStore
+	// tokens is nil when bearer tokens aren't configured.
+	tokens *jwtVerifier
+}
+
+func newAuthenticator() *authenticator {
+	a := &authenticator{keys: newAPIKeyStore(config.APIKeysPath)}
+	if config.JWKSPath != "" {
+		a.tokens = newJWTVerifier(config.JWKSPath, config.JWTIssuer, config.JWTAudience)
+	}
+	return a
+}
+
+// principal returns the caller identified by an API key or the value of an
+// Authorization header, nil if there are neither. Authorization schemes
+// other than Bearer are ignored.
+func (a *authenticator) principal(apiKey, authorization string) (*Principal, error) {
+	if apiKey != "" {
+		return a.keys.authenticate(apiKey)
+	}
+
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+	// SCIM clients can only send bearer tokens, so API keys are accepted
+	// as ones too
+	if token = strings.TrimSpace(token); strings.HasPrefix(token, apiKeyPrefix) {
+		return a.keys.authenticate(token)
+	}
+	if a.tokens == nil {
+		return nil, fmt.Errorf("%w: bearer tokens are not accepted", InvalidToken)
+	}
+	return a.tokens.verify(token)
+}
+
+// authenticate identifies callers sending an API key or a bearer token.
+// Requests without credentials pass through anonymously, requireRole
+// decides about them.
+func authenticate(a *authenticator, renderError errorRenderer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.principal(r.Header.Get(apiKeyHeader), r.Header.Get("Authorization"))
+			if err != nil {
+				if errors.Is(err, InvalidToken) {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				}
+				renderError(w, r, err)
+				return
+			}
+			if p == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// requireRole rejects callers without role with 401 or 403.
+func requireRole(role Role) func(http.Handler) http.Handler {
+	return requireRoleRendering(role, renderAPIError)
+}
+
+// requireRoleRendering is requireRole answering the errors of authorize
+// with renderError, for APIs with an error format of their own.
+func requireRoleRendering(role Role, renderError errorRenderer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := authorize(r.Context(), role); err != nil {
+				renderError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
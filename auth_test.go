@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"refactoring/userspb"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRoleIncludes(t *testing.T) {
+	tests := []struct {
+		role, other Role
+		want        bool
+	}{
+		{RoleAdmin, RoleReader, true},
+		{RoleAdmin, RoleAdmin, true},
+		{RoleEditor, RoleReader, true},
+		{RoleEditor, RoleAdmin, false},
+		{RoleReader, RoleEditor, false},
+		{Role("root"), RoleReader, false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, tc.role.Includes(tc.other), "%s includes %s", tc.role, tc.other)
+	}
+}
+
+func TestAuthRequiredByDefault(t *testing.T) {
+	t.Setenv("USERS_AUTH_REQUIRED", "")
+	assert.True(t, loadConfig().AuthRequired)
+	t.Setenv("USERS_AUTH_REQUIRED", "false")
+	assert.False(t, loadConfig().AuthRequired)
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	keys := newAPIKeyStore(config.APIKeysPath)
+
+	key, token, err := keys.issue(APIKey{Name: "ci", Role: RoleEditor})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, apiKeyPrefix+key.ID+"_"))
+	assert.NotContains(t, token, key.Hash)
+
+	p, err := keys.authenticate(token)
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "apikey:" + key.ID, Role: RoleEditor}, p)
+
+	for _, bad := range []string{"", "secret", apiKeyPrefix + key.ID + "_wrong", apiKeyPrefix + "ffffffff_" + token[len(apiKeyPrefix+key.ID+"_"):]} {
+		_, err = keys.authenticate(bad)
+		assert.ErrorIs(t, err, InvalidAPIKey, bad)
+	}
+
+	_, _, err = keys.issue(APIKey{Name: "ci", Role: Role("root")})
+	assert.ErrorIs(t, err, InvalidRole)
+
+	// keys issued elsewhere, e.g. by the apikeys command, are picked up
+	other, otherToken, err := newAPIKeyStore(config.APIKeysPath).issue(APIKey{Name: "cli", Role: RoleAdmin})
+	require.NoError(t, err)
+	p, err = keys.authenticate(otherToken)
+	require.NoError(t, err)
+	assert.Equal(t, RoleAdmin, p.Role)
+
+	require.NoError(t, keys.revoke(other.ID))
+	_, err = keys.authenticate(otherToken)
+	assert.ErrorIs(t, err, InvalidAPIKey)
+	assert.ErrorIs(t, keys.revoke("missing"), APIKeyNotFound)
+
+	list, err := newAPIKeyStore(config.APIKeysPath).list()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, key.ID, list[0].ID)
+	assert.NotNil(t, list[1].RevokedAt)
+}
+
+func TestAuthorization(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+		},
+	})
+	config.AuthRequired = true
+
+	keys := newAPIKeyStore(config.APIKeysPath)
+	tokens := map[Role]string{}
+	for _, role := range []Role{RoleReader, RoleEditor, RoleAdmin} {
+		_, token, err := keys.issue(APIKey{Name: string(role), Role: role})
+		require.NoError(t, err)
+		tokens[role] = token
+	}
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+		status int
+	}{
+		{"anonymous", "GET", "/api/v1/users/", "", "", 401},
+		{"invalid key", "GET", "/api/v1/users/", "", "uk_nope_nope", 401},
+		{"reader lists", "GET", "/api/v1/users/", "", tokens[RoleReader], 200},
+		{"reader gets", "GET", "/api/v1/users/1", "", tokens[RoleReader], 200},
+		{"reader creates", "POST", "/api/v1/users/", `{"display_name":"Carol","email":"carol@email.com"}`, tokens[RoleReader], 403},
+		{"editor creates", "POST", "/api/v1/users/", `{"display_name":"Carol","email":"carol@email.com"}`, tokens[RoleEditor], 201},
+		{"editor updates", "PATCH", "/api/v1/users/1", `{"display_name":"Alicia"}`, tokens[RoleEditor], 200},
+		{"editor suspends", "POST", "/api/v1/users/1:suspend", "", tokens[RoleEditor], 200},
+		{"editor deletes", "DELETE", "/api/v1/users/2", "", tokens[RoleEditor], 403},
+		{"admin deletes", "DELETE", "/api/v1/users/2", "", tokens[RoleAdmin], 200},
+		{"editor lists backups", "GET", "/api/v1/admin/backups/", "", tokens[RoleEditor], 403},
+		{"admin lists backups", "GET", "/api/v1/admin/backups/", "", tokens[RoleAdmin], 200},
+		{"editor lists keys", "GET", "/api/v1/admin/api-keys/", "", tokens[RoleEditor], 403},
+		{"reader queries graphql", "POST", "/api/graphql", `{"query":"{ user(id: 1) { id } }"}`, tokens[RoleReader], 200},
+		{"anonymous queries graphql", "POST", "/api/graphql", `{"query":"{ user(id: 1) { id } }"}`, "", 401},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if tc.token != "" {
+				req.Header.Set(apiKeyHeader, tc.token)
+			}
+			resp, body := testRequest(t, ts, req)
+			require.Equal(t, tc.status, resp.StatusCode, string(body))
+
+			if tc.status >= 400 {
+				errResp := ErrResponse{}
+				require.NoError(t, json.Unmarshal(body, &errResp))
+				assert.NotEmpty(t, errResp.ErrorText)
+			}
+		})
+	}
+
+	t.Run("graphql mutations check roles", func(t *testing.T) {
+		req, err := http.NewRequest("POST", ts.URL+"/api/graphql", strings.NewReader(`{"query":"mutation { deleteUser(id: 1) }"}`))
+		require.NoError(t, err)
+		req.Header.Set(apiKeyHeader, tokens[RoleEditor])
+		_, body := testRequest(t, ts, req)
+		assert.Contains(t, string(body), `"code":"FORBIDDEN"`)
+	})
+}
+
+func TestAPIKeyManagement(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.AuthRequired = true
+	_, adminToken, err := newAPIKeyStore(config.APIKeysPath).issue(APIKey{Name: "bootstrap", Role: RoleAdmin})
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, body, token string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(apiKeyHeader, token)
+		return testRequest(t, ts, req)
+	}
+
+	resp, body := request("POST", "/api/v1/admin/api-keys/", `{"name":"dashboard","role":"reader"}`, adminToken)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	issued := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(body, &issued))
+	assert.NotContains(t, issued, "hash")
+	token := issued["token"].(string)
+
+	resp, _ = request("POST", "/api/v1/admin/api-keys/", `{"name":"x","role":"root"}`, adminToken)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = request("GET", "/api/v1/users/", "", token)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = request("GET", "/api/v1/admin/api-keys/", "", adminToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, string(body), "hash")
+	assert.NotContains(t, string(body), "token")
+
+	resp, _ = request("DELETE", "/api/v1/admin/api-keys/"+issued["id"].(string), "", adminToken)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = request("DELETE", "/api/v1/admin/api-keys/missing", "", adminToken)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = request("GET", "/api/v1/users/", "", token)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestGRPCAuthorization(t *testing.T) {
+	c := newGRPCTestClient(t, UserStore{
+		Increment: 1,
+		List:      UserList{1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}},
+	})
+	config.AuthRequired = true
+	_, token, err := newAPIKeyStore(config.APIKeysPath).issue(APIKey{Name: "svc", Role: RoleReader})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	_, err = c.GetUser(ctx, &userspb.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", token)
+	_, err = c.GetUser(ctx, &userspb.GetUserRequest{Id: 1})
+	assert.NoError(t, err)
+	_, err = c.DeleteUser(ctx, &userspb.DeleteUserRequest{Id: 1})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "uk_nope_nope")
+	_, err = c.GetUser(ctx, &userspb.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
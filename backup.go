@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+var backupNameRe = regexp.MustCompile(`^users-\d{8}T\d{6}\.\d{9}Z\.json$`)
+
+type Backup struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+}
+
+// createBackup snapshots the store of the tenant of ctx into its backup
+// directory, see backupDirFrom, together with a sha256 checksum file, then
+// applies the retention policy. Snapshots use the JSON store format whatever
+// the backend is.
+func createBackup(ctx context.Context) (b Backup, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := storeFrom(ctx).Load()
+	if err != nil {
+		return
+	}
+	dat, err := encodeUserStore(us)
+	if err != nil {
+		return
+	}
+
+	dir := backupDirFrom(ctx)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	b.CreatedAt = time.Now().UTC()
+	b.Name = "users-" + b.CreatedAt.Format(backupTimeFormat) + ".json"
+	b.Size = int64(len(dat))
+	b.Checksum = checksum(dat)
+
+	// snapshots hold the users, readable only by the owner like exports
+	path := filepath.Join(dir, b.Name)
+	if err = writeFileAtomic(path, dat, 0600); err != nil {
+		return
+	}
+	if err = writeFileAtomic(path+".sha256", []byte(b.Checksum+"  "+b.Name+"\n"), 0600); err != nil {
+		os.Remove(path)
+		return
+	}
+	log.Infof("Created backup %s", path)
+
+	err = pruneBackups(ctx)
+	return
+}
+
+// listBackups returns the snapshots of the store of the tenant of ctx,
+// newest first.
+func listBackups(ctx context.Context) (backups []Backup, err error) {
+	backups = []Backup{}
+
+	entries, err := ioutil.ReadDir(backupDirFrom(ctx))
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !backupNameRe.MatchString(e.Name()) {
+			continue
+		}
+		b, err := readBackupInfo(ctx, e.Name())
+		if err != nil {
+			log.Warnf("Skipping backup %s: %v", e.Name(), err)
+			continue
+		}
+		backups = append(backups, b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return
+}
+
+// restoreBackup verifies the named snapshot and replaces the store of the
+// tenant of ctx with it. Snapshots taken by older binaries are migrated
+// first.
+func restoreBackup(ctx context.Context, name string) (err error) {
+	dat, err := readBackup(ctx, name)
+	if err != nil {
+		return
+	}
+
+	us, err := decodeBackup(dat)
+	if err != nil {
+		if errors.Is(err, StoreCorrupted) {
+			return fmt.Errorf("%w: %v", BackupCorrupted, err)
+		}
+		return
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if err = storeFrom(ctx).Save(us); err != nil {
+		return
+	}
+	log.Infof("Restored store from backup %s", filepath.Join(backupDirFrom(ctx), name))
+	return
+}
+
+func decodeBackup(dat []byte) (us UserStore, err error) {
+	plain, err := openStoreData(dat)
+	if err != nil {
+		return
+	}
+	if plain, _, err = migrateDocument(plain); err != nil {
+		if !errors.Is(err, StoreVersionTooNew) {
+			err = fmt.Errorf("%w: %v", StoreCorrupted, err)
+		}
+		return
+	}
+	return decodeUserStore(plain)
+}
+
+// readBackup returns the contents of a snapshot after checking it against
+// its checksum file.
+func readBackup(ctx context.Context, name string) (dat []byte, err error) {
+	b, err := readBackupInfo(ctx, name)
+	if err != nil {
+		return
+	}
+
+	dat, err = ioutil.ReadFile(filepath.Join(backupDirFrom(ctx), name))
+	if err != nil {
+		return
+	}
+	if checksum(dat) != b.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch for %s", BackupCorrupted, name)
+	}
+	return
+}
+
+func readBackupInfo(ctx context.Context, name string) (b Backup, err error) {
+	if !backupNameRe.MatchString(name) {
+		return b, BackupNotFound
+	}
+
+	path := filepath.Join(backupDirFrom(ctx), name)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return b, BackupNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	sum, err := ioutil.ReadFile(path + ".sha256")
+	if os.IsNotExist(err) {
+		return b, fmt.Errorf("%w: missing checksum for %s", BackupCorrupted, name)
+	}
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(sum))
+	if len(fields) == 0 {
+		return b, fmt.Errorf("%w: empty checksum for %s", BackupCorrupted, name)
+	}
+
+	createdAt, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, "users-"), ".json"))
+	if err != nil {
+		return
+	}
+
+	return Backup{
+		Name:      name,
+		CreatedAt: createdAt,
+		Size:      fi.Size(),
+		Checksum:  fields[0],
+	}, nil
+}
+
+// pruneBackups removes snapshots exceeding config.BackupKeep or older than
+// config.BackupMaxAge. The newest snapshot is always kept.
+func pruneBackups(ctx context.Context) (err error) {
+	backups, err := listBackups(ctx)
+	if err != nil {
+		return
+	}
+
+	for i, b := range backups {
+		if i == 0 {
+			continue
+		}
+		tooMany := config.BackupKeep > 0 && i >= config.BackupKeep
+		tooOld := config.BackupMaxAge > 0 && time.Since(b.CreatedAt) > config.BackupMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		path := filepath.Join(backupDirFrom(ctx), b.Name)
+		if err = os.Remove(path); err != nil {
+			return
+		}
+		if err = os.Remove(path + ".sha256"); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		log.Infof("Removed backup %s", path)
+	}
+	return nil
+}
+
+func checksum(dat []byte) string {
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])
+}
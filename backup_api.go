@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type BackupResponse struct {
+	Backup
+}
+
+func (br *BackupResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+func NewBackupsResponse(backups []Backup) []render.Renderer {
+	list := []render.Renderer{}
+	for _, b := range backups {
+		list = append(list, &BackupResponse{Backup: b})
+	}
+	return list
+}
+
+func setBackupRoutes(r chi.Router) {
+	r.Get("/", listBackupsHandler)
+	r.Post("/", createBackupHandler)
+	r.Post("/{name}:restore", restoreBackupHandler)
+}
+
+func listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	backups, err := listBackups(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewBackupsResponse(backups)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func createBackupHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := createBackup(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &BackupResponse{Backup: b})
+}
+
+func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if err := restoreBackup(r.Context(), name); err != nil {
+		if errors.Is(err, BackupNotFound) {
+			render.Render(w, r, ErrNotFound(err))
+			return
+		}
+		if errors.Is(err, BackupCorrupted) || errors.Is(err, StoreVersionTooNew) {
+			render.Render(w, r, ErrConflict(err))
+			return
+		}
+
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
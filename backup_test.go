@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTempStore points the store, backups, idempotency and API keys at a
+// temporary directory for the duration of the test.
+func useTempStore(t *testing.T, us UserStore) {
+	savedConfig, savedDB := config, db
+	t.Cleanup(func() { config, db = savedConfig, savedDB })
+
+	dir := t.TempDir()
+	config.StorePath = filepath.Join(dir, "users.json")
+	config.BackupDir = filepath.Join(dir, "backups")
+	config.IdempotencyPath = filepath.Join(dir, "idempotency.json")
+	config.APIKeysPath = filepath.Join(dir, "api_keys.json")
+	config.TenantsDir = filepath.Join(dir, "tenants")
+	// tests call the API anonymously unless they are about authentication
+	config.AuthRequired = false
+	db = &jsonStore{path: config.StorePath}
+
+	require.NoError(t, overwriteUserStore(us))
+}
+
+func TestBackupRestore(t *testing.T) {
+	alice := User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: alice}})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, mustRequest(t, "POST", ts.URL+"/api/v1/admin/backups/"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	created := Backup{}
+	require.NoError(t, json.Unmarshal(body, &created))
+	assert.NotEmpty(t, created.Checksum)
+
+	resp, body = testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/admin/backups/"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	listed := []Backup{}
+	require.NoError(t, json.Unmarshal(body, &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, created.Name, listed[0].Name)
+
+	_, err := dbCreateUser(context.Background(), "Bob", "bob@email.com", StatusActive)
+	require.NoError(t, err)
+
+	resp, _ = testRequest(t, ts, mustRequest(t, "POST", ts.URL+"/api/v1/admin/backups/"+created.Name+":restore"))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, UserList{1: alice}, us.List)
+
+	resp, _ = testRequest(t, ts, mustRequest(t, "POST", ts.URL+"/api/v1/admin/backups/users-20000101T000000.000000000Z.json:restore"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRestoreCorruptedBackup(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	b, err := createBackup(context.Background())
+	require.NoError(t, err)
+	for _, name := range []string{b.Name, b.Name + ".sha256"} {
+		fi, err := os.Stat(filepath.Join(config.BackupDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "backups hold the users, only their owner may read them")
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(config.BackupDir, b.Name), []byte(`{"list":{}}`), 0644))
+
+	err = restoreBackup(context.Background(), b.Name)
+	assert.ErrorIs(t, err, BackupCorrupted)
+}
+
+func TestBackupRetention(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.BackupKeep = 2
+
+	for i := 0; i < 4; i++ {
+		_, err := createBackup(context.Background())
+		require.NoError(t, err)
+	}
+
+	backups, err := listBackups(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, backups, 2)
+
+	config.BackupKeep = 0
+	config.BackupMaxAge = time.Nanosecond
+	newest, err := createBackup(context.Background())
+	require.NoError(t, err)
+
+	backups, err = listBackups(context.Background())
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, newest.Name, backups[0].Name)
+}
+
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	return req
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+const usageText = `usage: refactoring <command> [arguments]
+
+Commands:
+  serve          start the REST and gRPC servers (default when no command is given)
+  users          list, get, create, update or delete users
+  store          export, import, verify or compact the store
+  backup         create, list or restore store backups
+  fsck           check the store and optionally repair it
+  migrate-store  copy users between store backends
+  apikeys        issue, list or revoke API keys
+  import-ldif    create, update and delete users from an LDIF file
+
+The store is selected with USERS_STORE_BACKEND and USERS_STORE.
+Run "refactoring <command> -h" for the arguments of a command.
+`
+
+type command func(args []string, stdout, stderr io.Writer) int
+
+var commands = map[string]command{
+	"serve":         runServeCommand,
+	"users":         runUsersCommand,
+	"store":         withStore(runStoreCommand),
+	"backup":        withStore(runBackupCommand),
+	"fsck":          withStore(runFsckCommand),
+	"migrate-store": runMigrateStoreCommand,
+	"apikeys":       runAPIKeysCommand,
+	"import-ldif":   withStore(runImportLDIFCommand),
+}
+
+// run executes the command named by args[0] and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if err := loadStoreKeys(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if err := loadFieldKey(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	if len(args) == 0 {
+		return runServeCommand(nil, stdout, stderr)
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usageText)
+		return exitOK
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usageText)
+		return exitUsage
+	}
+	return cmd(args[1:], stdout, stderr)
+}
+
+func runServeCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", ":3333", "address to listen on")
+	grpcAddr := fs.String("grpc-addr", ":3334", "address to serve gRPC on, empty to disable")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if err := serve(*addr, *grpcAddr); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+// withStore opens the configured store for the duration of cmd.
+func withStore(cmd command) command {
+	return func(args []string, stdout, stderr io.Writer) int {
+		store, err := openStore(config.StoreBackend, config.StorePath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		defer store.Close()
+		db = store
+
+		return cmd(args, stdout, stderr)
+	}
+}
+
+// tenantContext returns a context selecting the store of the named tenant,
+// or the default store when name is empty.
+func tenantContext(name string) (context.Context, error) {
+	ctx := context.Background()
+	if name == "" {
+		return ctx, nil
+	}
+	t, err := openTenant(name)
+	if err != nil {
+		return nil, err
+	}
+	return withTenant(ctx, t), nil
+}
+
+func runBackupCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	tenantName := fs.String("tenant", "", "back up the store of this tenant instead of the default store")
+	usage := func() int {
+		fmt.Fprintln(stderr, "usage: backup [-tenant name] create | list | restore <name>")
+		return exitUsage
+	}
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		return usage()
+	}
+
+	ctx, err := tenantContext(*tenantName)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	switch args[0] {
+	case "create":
+		b, err := createBackup(ctx)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintln(stdout, b.Name)
+
+	case "list":
+		backups, err := listBackups(ctx)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATED\tSIZE\tSHA256")
+		for _, b := range backups {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", b.Name, b.CreatedAt.Format("2006-01-02 15:04:05"), b.Size, b.Checksum)
+		}
+		tw.Flush()
+
+	case "restore":
+		if len(args) != 2 {
+			return usage()
+		}
+		if err := restoreBackup(ctx, args[1]); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+
+	default:
+		return usage()
+	}
+	return exitOK
+}
+
+func runFsckCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	repair := fs.Bool("repair", false, "fix the problems found and recover a corrupted store from backups")
+	tenantName := fs.String("tenant", "", "check the store of this tenant instead of the default store")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	ctx, err := tenantContext(*tenantName)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	if *repair && config.StoreBackend == backendJSON {
+		if err := recoverUserStore(ctx); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	problems := fsckUserStore(&us, *repair)
+	unrepaired := 0
+	for _, p := range problems {
+		if p.Repaired {
+			fmt.Fprintln(stdout, "repaired:", p.Description)
+		} else {
+			fmt.Fprintln(stdout, "problem:", p.Description)
+			unrepaired++
+		}
+	}
+
+	if *repair && len(problems) > 0 {
+		if err := saveUserStore(ctx, us); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+
+	if unrepaired > 0 {
+		return exitError
+	}
+	fmt.Fprintln(stdout, "ok")
+	return exitOK
+}
+
+func runMigrateStoreCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate-store", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	force := fs.Bool("force", false, "replace the contents of a non-empty destination")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: migrate-store [-force] <backend:path> <backend:path>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	stores := make([]Store, 2)
+	for i, location := range fs.Args() {
+		backend, path, err := parseStoreLocation(location)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		if stores[i], err = openStore(backend, path); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		defer stores[i].Close()
+	}
+
+	n, err := migrateStore(stores[0], stores[1], *force)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "copied %d users\n", n)
+	return exitOK
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+const apiKeysUsageText = `usage: apikeys <subcommand>
+
+Subcommands:
+  issue -name NAME -role reader|editor|admin [-user ID] [-tenant NAME]
+  list
+  revoke <id>
+
+Keys are kept in USERS_API_KEYS, a running server picks up changes.
+`
+
+func runAPIKeysCommand(args []string, stdout, stderr io.Writer) int {
+	usage := func() int {
+		fmt.Fprint(stderr, apiKeysUsageText)
+		return exitUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	keys := newAPIKeyStore(config.APIKeysPath)
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	switch args[0] {
+	case "issue":
+		name := fs.String("name", "", "what the key is used for")
+		role := fs.String("role", string(RoleReader), "reader, editor or admin")
+		userId := fs.Uint("user", 0, "id of the user the key acts as on /me")
+		tenant := fs.String("tenant", "", "tenant the key is restricted to")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if *name == "" {
+			return usage()
+		}
+		if *tenant != "" {
+			if _, err := openTenant(*tenant); err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+		}
+		key, token, err := keys.issue(APIKey{Name: *name, Role: Role(*role), UserID: *userId, Tenant: *tenant})
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stderr, "issued key %s, the token is shown only once:\n", key.ID)
+		fmt.Fprintln(stdout, token)
+
+	case "list":
+		list, err := keys.list()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tROLE\tTENANT\tCREATED\tREVOKED")
+		for _, k := range list {
+			revoked := ""
+			if k.RevokedAt != nil {
+				revoked = k.RevokedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Role, k.Tenant, k.CreatedAt.Format("2006-01-02 15:04:05"), revoked)
+		}
+		tw.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return usage()
+		}
+		if err := keys.revoke(args[1]); err != nil {
+			fmt.Fprintln(stderr, err)
+			if errors.Is(err, APIKeyNotFound) {
+				return exitNotFound
+			}
+			return exitError
+		}
+
+	default:
+		return usage()
+	}
+	return exitOK
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const ldifImportUsageText = `usage: import-ldif [-map MAPPING] [-dry-run] [-o table|json] FILE
+
+Applies the add, modify, delete and modrdn records of an LDIF file, "-" reads
+stdin. Users are matched by the DN they were imported from, so importing a
+directory again updates them. MAPPING lists the attributes fields are read
+from, as in "display_name=displayName,cn;email=mail".
+`
+
+func runImportLDIFCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import-ldif", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	mappingFlag := fs.String("map", config.LDIFMapping, "attribute mapping, defaults to USERS_LDIF_MAPPING")
+	dryRun := fs.Bool("dry-run", false, "report what would change without changing anything")
+	output := fs.String("o", "table", "output format: table or json")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, ldifImportUsageText)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 || (*output != "table" && *output != "json") {
+		fs.Usage()
+		return exitUsage
+	}
+	mapping, err := parseLDIFMapping(*mappingFlag)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	in := io.Reader(os.Stdin)
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		defer f.Close()
+		in = f
+	}
+	records, err := readLDIF(in)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	report, err := dbImportLDIF(context.Background(), records, mapping, *dryRun)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if err := printLDIFReport(stdout, *output, report); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	if report.Failed > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+func printLDIFReport(w io.Writer, format string, report *LDIFImportResponse) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tDN\tACTION\tID\tDETAILS")
+	for _, e := range report.Entries {
+		details := strings.Join(e.Changes, ", ")
+		if e.Error != "" {
+			details = e.Error
+		}
+		id := ""
+		if e.Id != 0 {
+			id = fmt.Sprint(e.Id)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", e.Line, e.DN, e.Action, id, details)
+	}
+	for _, u := range report.NotInSource {
+		fmt.Fprintf(tw, "\t%s\tnot in source\t%d\t\n", u.DN, u.Id)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("%d created, %d updated, %d linked, %d renamed, %d deleted, %d unchanged, %d failed",
+		report.Created, report.Updated, report.Linked, report.Renamed, report.Deleted, report.Unchanged, report.Failed)
+	if report.DryRun {
+		summary += " (dry run, nothing was changed)"
+	}
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const storeUsageText = `usage: store <subcommand>
+
+Subcommands:
+  export [-file FILE]     write all users as plain JSON, to stdout by default
+  import [-force] FILE    replace the store with an exported file
+  verify                  check integrity and consistency without changing anything
+  compact                 rewrite the store to reclaim space
+`
+
+// compacter is implemented by backends that can reclaim unused space.
+type compacter interface {
+	Compact() error
+}
+
+func runStoreCommand(args []string, stdout, stderr io.Writer) int {
+	usage := func() int {
+		fmt.Fprint(stderr, storeUsageText)
+		return exitUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	switch args[0] {
+	case "export":
+		file := fs.String("file", "", "file to write instead of stdout")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if err := exportStore(stdout, *file); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+
+	case "import":
+		force := fs.Bool("force", false, "replace the contents of a non-empty store")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if fs.NArg() != 1 {
+			return usage()
+		}
+		n, err := importStore(fs.Arg(0), *force)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "imported %d users\n", n)
+
+	case "verify":
+		// fsck without -repair, verify never changes the store
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if fs.NArg() != 0 {
+			return usage()
+		}
+		return runFsckCommand(nil, stdout, stderr)
+
+	case "compact":
+		if err := compactStore(); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+
+	default:
+		return usage()
+	}
+	return exitOK
+}
+
+func exportStore(stdout io.Writer, file string) (err error) {
+	us, err := getUserStore()
+	if err != nil {
+		return
+	}
+	dat, err := json.MarshalIndent(us, "", "  ")
+	if err != nil {
+		return
+	}
+	dat = append(dat, '\n')
+
+	if file == "" {
+		_, err = stdout.Write(dat)
+		return
+	}
+	return ioutil.WriteFile(file, dat, 0600)
+}
+
+// importStore loads an exported file, or a JSON store file of any older
+// schema version, into the configured store.
+func importStore(file string, force bool) (n int, err error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	us, err := decodeBackup(dat)
+	if err != nil {
+		return
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	return len(us.List), replaceStore(db, us, force)
+}
+
+func compactStore() error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if c, ok := db.(compacter); ok {
+		return c.Compact()
+	}
+
+	us, err := db.Load()
+	if err != nil {
+		return err
+	}
+	return db.Save(us)
+}
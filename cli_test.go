@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runCLI(t *testing.T, args ...string) (code int, stdout, stderr string) {
+	out, errOut := &strings.Builder{}, &strings.Builder{}
+	code = run(args, out, errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestUsersCommand(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	for _, mode := range []struct {
+		name string
+		args []string
+	}{
+		{name: "local"},
+		{name: "remote", args: []string{"-url", ts.URL}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			require.NoError(t, overwriteUserStore(UserStore{List: UserList{}}))
+			users := func(args ...string) (int, string, string) {
+				return runCLI(t, append(append([]string{"users"}, mode.args...), args...)...)
+			}
+
+			code, stdout, stderr := users("-o", "json", "create", "-name", "Alice", "-email", "alice@email.com")
+			require.Equal(t, exitOK, code, stderr)
+			created := []UserResponse{}
+			require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+			require.Len(t, created, 1)
+			assert.Equal(t, uint(1), created[0].Id)
+			assert.Equal(t, StatusActive, created[0].Status)
+
+			code, _, stderr = users("create", "-name", "Alice2", "-email", "alice@email.com")
+			assert.Equal(t, exitError, code)
+			assert.NotEmpty(t, stderr)
+
+			code, stdout, _ = users("update", "1", "-name", "Alicia")
+			require.Equal(t, exitOK, code)
+			assert.Contains(t, stdout, "Alicia")
+			assert.Contains(t, stdout, "alice@email.com")
+
+			code, stdout, _ = users("list")
+			require.Equal(t, exitOK, code)
+			assert.Equal(t, 2, strings.Count(stdout, "\n"))
+			assert.True(t, strings.HasPrefix(stdout, "ID"))
+
+			code, _, _ = users("delete", "1")
+			assert.Equal(t, exitOK, code)
+
+			code, _, _ = users("get", "1")
+			assert.Equal(t, exitNotFound, code)
+
+			code, _, _ = users("get", "abc")
+			assert.Equal(t, exitUsage, code)
+		})
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	code, _, stderr := runCLI(t, "frobnicate")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "unknown command")
+
+	code, stdout, _ := runCLI(t, "help")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "migrate-store")
+}
+
+func TestStoreCommand(t *testing.T) {
+	alice := User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}
+
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			useTempStore(t, UserStore{Increment: 1, List: UserList{1: alice}})
+			exported := filepath.Join(t.TempDir(), "export.json")
+
+			code, _, stderr := runCLI(t, "store", "export", "-file", exported)
+			require.Equal(t, exitOK, code, stderr)
+
+			config.StoreBackend = backend
+			config.StorePath = filepath.Join(t.TempDir(), "users."+backend)
+
+			code, stdout, stderr := runCLI(t, "store", "import", exported)
+			require.Equal(t, exitOK, code, stderr)
+			assert.Equal(t, "imported 1 users\n", stdout)
+
+			code, _, stderr = runCLI(t, "store", "import", exported)
+			assert.Equal(t, exitError, code)
+			assert.Contains(t, stderr, StoreNotEmpty.Error())
+
+			code, _, stderr = runCLI(t, "store", "compact")
+			require.Equal(t, exitOK, code, stderr)
+
+			code, stdout, _ = runCLI(t, "store", "verify")
+			assert.Equal(t, exitOK, code)
+			assert.Equal(t, "ok\n", stdout)
+			code, _, _ = runCLI(t, "store", "verify", "-repair")
+			assert.Equal(t, exitUsage, code)
+
+			code, stdout, _ = runCLI(t, "users", "-o", "json", "get", "1")
+			require.Equal(t, exitOK, code)
+			got := []UserResponse{}
+			require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+			assert.Equal(t, alice, *got[0].User)
+		})
+	}
+}
+
+func TestAPIKeysCommand(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	code, token, stderr := runCLI(t, "apikeys", "issue", "-name", "ci", "-role", "editor")
+	require.Equal(t, exitOK, code, stderr)
+	p, err := newAPIKeyStore(config.APIKeysPath).authenticate(strings.TrimSpace(token))
+	require.NoError(t, err)
+	assert.Equal(t, RoleEditor, p.Role)
+	id := strings.TrimPrefix(p.Subject, "apikey:")
+
+	code, stdout, _ := runCLI(t, "apikeys", "list")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, id)
+	assert.Contains(t, stdout, "editor")
+
+	code, _, _ = runCLI(t, "apikeys", "revoke", id)
+	assert.Equal(t, exitOK, code)
+	code, _, _ = runCLI(t, "apikeys", "revoke", "missing")
+	assert.Equal(t, exitNotFound, code)
+	code, _, _ = runCLI(t, "apikeys", "issue", "-name", "ci", "-role", "root")
+	assert.Equal(t, exitError, code)
+}
+
+func TestImportLDIFCommand(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	file := filepath.Join(t.TempDir(), "people.ldif")
+	require.NoError(t, os.WriteFile(file, []byte(strings.Join([]string{
+		"dn: uid=ada,ou=people,dc=example,dc=com",
+		"cn: Ada Lovelace",
+		"mail: ada@email.com",
+		"",
+		"dn: uid=mallory,ou=people,dc=example,dc=com",
+		"changetype: delete",
+	}, "\n")), 0o600))
+
+	code, stdout, _ := runCLI(t, "import-ldif", "-dry-run", file)
+	assert.Equal(t, exitError, code, "mallory was never imported")
+	assert.Contains(t, stdout, "1 created")
+	assert.Contains(t, stdout, "dry run")
+	list, err := dbGetUserList(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, *list)
+
+	code, stdout, _ = runCLI(t, "import-ldif", "-o", "json", file)
+	assert.Equal(t, exitError, code)
+	report := LDIFImportResponse{}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Failed)
+	u, err := dbGetUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada Lovelace", u.DisplayName)
+
+	code, _, _ = runCLI(t, "import-ldif", "-map", "phone=telephoneNumber", file)
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runCLI(t, "import-ldif")
+	assert.Equal(t, exitUsage, code)
+}
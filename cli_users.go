@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"refactoring/client"
+
+	"github.com/go-chi/render"
+)
+
+// userService is what the users command operates on: the local store or a
+// running instance.
+type userService interface {
+	List() ([]UserResponse, error)
+	Get(id uint) (UserResponse, error)
+	Create(request CreateUserRequest) (UserResponse, error)
+	Update(id uint, request UpdateUserRequest) (UserResponse, error)
+	Delete(id uint) error
+	Close() error
+}
+
+const usersUsageText = `usage: users [-url URL] [-api-key KEY] [-o table|json] <subcommand>
+
+Subcommands:
+  list
+  get <id>
+  create -name NAME [-email EMAIL] [-status invited|active]
+  update <id> [-name NAME] [-email EMAIL]
+  delete <id>
+
+Without -url (or USERS_API_URL) the configured store is used directly.
+-api-key (or USERS_API_KEY) authenticates against a running instance.
+`
+
+func runUsersCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("users", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	url := fs.String("url", envString("USERS_API_URL", ""), "base URL of a running instance")
+	apiKey := fs.String("api-key", envString("USERS_API_KEY", ""), "API key for the running instance")
+	output := fs.String("o", "table", "output format: table or json")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usersUsageText)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 || (*output != "table" && *output != "json") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var svc userService
+	if *url != "" {
+		svc = newRemoteUserService(*url, *apiKey)
+	} else {
+		store, err := openStore(config.StoreBackend, config.StorePath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		db = store
+		svc = localUserService{store: store}
+	}
+	defer svc.Close()
+
+	users, err := runUsersSubcommand(svc, fs.Arg(0), fs.Args()[1:], stderr)
+	if errors.Is(err, flag.ErrHelp) || errors.Is(err, errUsage) {
+		fs.Usage()
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		if errors.Is(err, UserNotFound) {
+			return exitNotFound
+		}
+		return exitError
+	}
+
+	if users != nil {
+		if err := printUsers(stdout, *output, users); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	return exitOK
+}
+
+var errUsage = errors.New("invalid usage")
+
+func runUsersSubcommand(svc userService, name string, args []string, stderr io.Writer) ([]UserResponse, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	var id uint
+	switch name {
+	case "get", "update", "delete":
+		if len(args) == 0 {
+			return nil, errUsage
+		}
+		id64, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid user id %q", errUsage, args[0])
+		}
+		id, args = uint(id64), args[1:]
+	}
+
+	switch name {
+	case "list":
+		return svc.List()
+
+	case "get":
+		u, err := svc.Get(id)
+		return []UserResponse{u}, err
+
+	case "create":
+		request := CreateUserRequest{}
+		fs.StringVar(&request.DisplayName, "name", "", "display name")
+		fs.StringVar(&request.Email, "email", "", "email")
+		fs.Var((*statusFlag)(&request.Status), "status", "initial status: invited or active")
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		u, err := svc.Create(request)
+		return []UserResponse{u}, err
+
+	case "update":
+		request := UpdateUserRequest{}
+		fs.Var(optionalString{&request.DisplayName}, "name", "new display name")
+		fs.Var(optionalString{&request.Email}, "email", "new email")
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		u, err := svc.Update(id, request)
+		return []UserResponse{u}, err
+
+	case "delete":
+		return nil, svc.Delete(id)
+	}
+
+	return nil, fmt.Errorf("%w: unknown subcommand %q", errUsage, name)
+}
+
+func printUsers(w io.Writer, format string, users []UserResponse) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tEMAIL\tSTATUS\tCREATED")
+	for _, u := range users {
+		if u.User == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", u.Id, u.DisplayName, u.Email, u.Status, u.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+type statusFlag UserStatus
+
+func (s *statusFlag) String() string     { return string(*s) }
+func (s *statusFlag) Set(v string) error { *s = statusFlag(v); return nil }
+
+// optionalString sets the pointer only when the flag is given, so update
+// leaves omitted fields untouched.
+type optionalString struct{ p **string }
+
+func (o optionalString) String() string {
+	if o.p == nil || *o.p == nil {
+		return ""
+	}
+	return **o.p
+}
+
+func (o optionalString) Set(v string) error {
+	*o.p = &v
+	return nil
+}
+
+// localUserService operates on the store directly.
+type localUserService struct {
+	store Store
+}
+
+func (s localUserService) List() ([]UserResponse, error) {
+	userList, err := dbGetUserList(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return userResponses(NewUsersResopnse(context.Background(), userList)), nil
+}
+
+func (s localUserService) Get(id uint) (UserResponse, error) {
+	u, err := dbGetUser(context.Background(), id)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	return UserResponse{User: u, Id: id}, nil
+}
+
+func (s localUserService) Create(request CreateUserRequest) (UserResponse, error) {
+	if err := request.Bind(nil); err != nil {
+		return UserResponse{}, err
+	}
+	id, err := dbCreateUser(context.Background(), request.DisplayName, request.Email, request.Status)
+	if err != nil {
+		return UserResponse{}, err
+	}
+	return s.Get(id)
+}
+
+func (s localUserService) Update(id uint, request UpdateUserRequest) (UserResponse, error) {
+	if err := dbUpdateUser(context.Background(), id, request.DisplayName, request.Email); err != nil {
+		return UserResponse{}, err
+	}
+	return s.Get(id)
+}
+
+func (s localUserService) Delete(id uint) error { return dbDeleteUser(context.Background(), id) }
+
+func (s localUserService) Close() error { return s.store.Close() }
+
+func userResponses(list []render.Renderer) []UserResponse {
+	users := []UserResponse{}
+	for _, r := range list {
+		if ur, ok := r.(*UserResponse); ok {
+			users = append(users, *ur)
+		}
+	}
+	return users
+}
+
+// remoteUserService operates on a running instance through the API client.
+type remoteUserService struct {
+	client *client.Client
+}
+
+func newRemoteUserService(baseURL, apiKey string) remoteUserService {
+	return remoteUserService{client: client.New(baseURL, client.WithAPIKey(apiKey))}
+}
+
+func (s remoteUserService) List() ([]UserResponse, error) {
+	users, err := s.client.ListUsers(context.Background(), &client.ListOptions{PageSize: maxPageLimit}).All()
+	if err != nil {
+		return nil, remoteError(err)
+	}
+
+	list := []UserResponse{}
+	for _, u := range users {
+		list = append(list, userResponseOf(u))
+	}
+	return list, nil
+}
+
+func (s remoteUserService) Get(id uint) (UserResponse, error) {
+	u, err := s.client.GetUser(context.Background(), id)
+	if err != nil {
+		return UserResponse{}, remoteError(err)
+	}
+	return userResponseOf(*u), nil
+}
+
+func (s remoteUserService) Create(request CreateUserRequest) (UserResponse, error) {
+	u, err := s.client.CreateUser(context.Background(), client.CreateUserParams{
+		DisplayName: request.DisplayName,
+		Email:       request.Email,
+		Status:      string(request.Status),
+	})
+	if err != nil {
+		return UserResponse{}, remoteError(err)
+	}
+	return userResponseOf(*u), nil
+}
+
+func (s remoteUserService) Update(id uint, request UpdateUserRequest) (UserResponse, error) {
+	u, err := s.client.UpdateUser(context.Background(), id, client.UpdateUserParams{
+		DisplayName: request.DisplayName,
+		Email:       request.Email,
+	})
+	if err != nil {
+		return UserResponse{}, remoteError(err)
+	}
+	return userResponseOf(*u), nil
+}
+
+func (s remoteUserService) Delete(id uint) error {
+	return remoteError(s.client.DeleteUser(context.Background(), id))
+}
+
+func (s remoteUserService) Close() error { return nil }
+
+func userResponseOf(u client.User) UserResponse {
+	return UserResponse{
+		User: &User{
+			CreatedAt:   u.CreatedAt,
+			UpdatedAt:   u.UpdatedAt,
+			DisplayName: u.DisplayName,
+			Email:       u.Email,
+			Status:      UserStatus(u.Status),
+		},
+		Id: u.ID,
+	}
+}
+
+// remoteError maps client errors onto the errors of this package, so both
+// user services report failures alike.
+func remoteError(err error) error {
+	if errors.Is(err, client.ErrNotFound) {
+		return fmt.Errorf("%w: %v", UserNotFound, err)
+	}
+	return err
+}
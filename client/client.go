@@ -0,0 +1,233 @@
+// Package client is a Go client for the users API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	usersPath            = "/api/v1/users"
+	idempotencyKeyHeader = "Idempotency-Key"
+	apiKeyHeader         = "X-API-Key"
+)
+
+// Client calls the users API of a single instance. It is safe for
+// concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey authenticates requests with an API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithRetries sets how many times idempotent calls are retried after a
+// network error or a 429/5xx response, and the initial delay between
+// attempts, which doubles after each retry. A longer Retry-After sent by the
+// server takes precedence over the delay.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client for the instance at baseURL, e.g.
+// "http://localhost:3333".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// User is a user as returned by the API.
+type User struct {
+	ID          uint      `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	Status      string    `json:"status"`
+}
+
+// CreateUserParams are the fields of a new user. Status may be "invited" or
+// "active", the server defaults to active.
+type CreateUserParams struct {
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	Status      string `json:"status,omitempty"`
+	// IdempotencyKey identifies the creation, so it can be retried without
+	// creating duplicates. A random key is used when it is empty.
+	IdempotencyKey string `json:"-"`
+}
+
+// UpdateUserParams holds the fields to change, nil fields are left as is.
+type UpdateUserParams struct {
+	DisplayName *string `json:"display_name,omitempty"`
+	Email       *string `json:"email,omitempty"`
+}
+
+// CreateUser creates a user. Retries send the same Idempotency-Key, so the
+// server creates the user only once.
+func (c *Client) CreateUser(ctx context.Context, params CreateUserParams) (*User, error) {
+	key := params.IdempotencyKey
+	if key == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		key = hex.EncodeToString(b)
+	}
+
+	u := &User{}
+	if err := c.do(ctx, http.MethodPost, usersPath+"/", params, u, http.Header{idempotencyKeyHeader: {key}}, nil); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUser returns the user with the given id.
+func (c *Client) GetUser(ctx context.Context, id uint) (*User, error) {
+	u := &User{}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("%s/%d", usersPath, id), nil, u, nil, nil); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UpdateUser changes the given fields and returns the updated user.
+func (c *Client) UpdateUser(ctx context.Context, id uint, params UpdateUserParams) (*User, error) {
+	if err := c.do(ctx, http.MethodPatch, fmt.Sprintf("%s/%d", usersPath, id), params, nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return c.GetUser(ctx, id)
+}
+
+// DeleteUser deletes the user with the given id.
+func (c *Client) DeleteUser(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("%s/%d", usersPath, id), nil, nil, nil, nil)
+}
+
+// do sends a request and decodes a JSON response into out. Idempotent
+// methods and requests with an Idempotency-Key are retried on transient
+// failures.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}, reqHeader http.Header, respHeader *http.Header) (err error) {
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return
+		}
+	}
+
+	attempts := 1
+	if idempotent(method) || reqHeader.Get(idempotencyKeyHeader) != "" {
+		attempts += c.maxRetries
+	}
+
+	delay := c.backoff
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = c.attempt(ctx, method, path, body, out, reqHeader, respHeader)
+		if !retry || attempt >= attempts {
+			return
+		}
+
+		wait := delay
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+			wait = apiErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, out interface{}, reqHeader http.Header, respHeader *http.Header) (retry bool, err error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range reqHeader {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set(apiKeyHeader, c.apiKey)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := newAPIError(resp)
+		return apiErr.Temporary(), apiErr
+	}
+
+	if respHeader != nil {
+		*respHeader = resp.Header
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return false, nil
+	}
+	dat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	if len(dat) == 0 {
+		return false, nil
+	}
+	return false, json.Unmarshal(dat, out)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
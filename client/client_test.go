@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer fails the first failures requests with status and then
+// answers with an empty user.
+func flakyServer(t *testing.T, failures int32, status int) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"status":"Internal server error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"display_name":"Alice"}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func TestRetriesIdempotentCalls(t *testing.T) {
+	ts, calls := flakyServer(t, 2, http.StatusServiceUnavailable)
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	u, err := c.GetUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", u.DisplayName)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	ts, calls := flakyServer(t, 10, http.StatusInternalServerError)
+	c := New(ts.URL, WithRetries(2, time.Millisecond))
+
+	_, err := c.GetUser(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrServer)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+}
+
+func TestRetriesCreateWithIdempotencyKey(t *testing.T) {
+	keys := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1,"display_name":"Alice"}`))
+	}))
+	defer ts.Close()
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	_, err := c.CreateUser(context.Background(), CreateUserParams{DisplayName: "Alice"})
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+
+	keys = nil
+	_, err = c.CreateUser(context.Background(), CreateUserParams{DisplayName: "Alice", IdempotencyKey: "key-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key-1", "key-1"}, keys)
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	ts, calls := flakyServer(t, 1, http.StatusNotFound)
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	_, err := c.GetUser(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestContextCancelsRetries(t *testing.T) {
+	ts, _ := flakyServer(t, 10, http.StatusServiceUnavailable)
+	c := New(ts.URL, WithRetries(10, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.GetUser(ctx, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestHonoursRetryAfter(t *testing.T) {
+	var calls int32
+	var retried time.Duration
+	start := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		retried = time.Since(start)
+		w.Write([]byte(`{"id":1,"display_name":"Alice"}`))
+	}))
+	defer ts.Close()
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	_, err := c.GetUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.GreaterOrEqual(t, retried, time.Second)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for h, want := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Wed, 01 May 2024 12:00:30 GMT": 30 * time.Second,
+		"Wed, 01 May 2024 11:00:00 GMT": 0,
+	} {
+		assert.Equal(t, want, parseRetryAfter(h, now), h)
+	}
+}
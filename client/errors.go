@@ -0,0 +1,94 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Errors matched by APIError.Is, so callers can use errors.Is(err, ErrNotFound).
+var (
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrUnauthorized   = errors.New("unauthorized")
+	ErrForbidden      = errors.New("forbidden")
+	ErrNotFound       = errors.New("not found")
+	ErrConflict       = errors.New("conflict")
+	ErrRateLimited    = errors.New("rate limited")
+	ErrServer         = errors.New("server error")
+)
+
+// APIError is returned for any non-2xx response and carries the decoded
+// error body of the API.
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Status     string `json:"status"`
+	Code       int64  `json:"code,omitempty"`
+	Message    string `json:"error,omitempty"`
+	// RetryAfter is how long the server asked to wait before retrying, from
+	// the Retry-After header of 429 and 503 responses.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	e := &APIError{StatusCode: resp.StatusCode}
+	e.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	json.NewDecoder(resp.Body).Decode(e)
+	if e.Status == "" {
+		e.Status = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("users api: %d %s", e.StatusCode, e.Status)
+	}
+	return fmt.Sprintf("users api: %d %s: %s", e.StatusCode, e.Status, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidRequest:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// Temporary reports whether retrying the request may succeed.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// parseRetryAfter parses a Retry-After header, either delay seconds or an
+// HTTP date. It returns 0 for a missing or malformed header and for dates
+// in the past.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// ListOptions filters and pages ListUsers.
+type ListOptions struct {
+	// PageSize is the number of users fetched per request, 0 fetches all
+	// users at once.
+	PageSize int
+	// Email restricts the list to the user with this email.
+	Email string
+}
+
+// UserIterator walks the users returned by ListUsers, fetching pages as
+// needed:
+//
+//	it := c.ListUsers(ctx, &client.ListOptions{PageSize: 100})
+//	for it.Next() {
+//		u := it.User()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type UserIterator struct {
+	c    *Client
+	ctx  context.Context
+	next string
+	page []User
+	user User
+	err  error
+}
+
+// ListUsers returns an iterator over users ordered by id.
+func (c *Client) ListUsers(ctx context.Context, opts *ListOptions) *UserIterator {
+	q := url.Values{}
+	if opts != nil {
+		if opts.PageSize > 0 {
+			q.Set("limit", strconv.Itoa(opts.PageSize))
+		}
+		if opts.Email != "" {
+			q.Set("email", opts.Email)
+		}
+	}
+
+	next := usersPath + "/"
+	if len(q) > 0 {
+		next += "?" + q.Encode()
+	}
+	return &UserIterator{c: c, ctx: ctx, next: next}
+}
+
+// Next advances to the next user and reports whether there is one.
+func (it *UserIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.next == "" {
+			return false
+		}
+		it.fetch()
+	}
+
+	it.user, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// User returns the current user.
+func (it *UserIterator) User() User { return it.user }
+
+// Err returns the error that stopped the iteration, if any.
+func (it *UserIterator) Err() error { return it.err }
+
+// All drains the iterator into a slice.
+func (it *UserIterator) All() ([]User, error) {
+	users := []User{}
+	for it.Next() {
+		users = append(users, it.User())
+	}
+	return users, it.Err()
+}
+
+var nextLinkRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+func (it *UserIterator) fetch() {
+	header := http.Header{}
+	page := []User{}
+	if it.err = it.c.do(it.ctx, http.MethodGet, it.next, nil, &page, nil, &header); it.err != nil {
+		return
+	}
+
+	it.page, it.next = page, ""
+	if m := nextLinkRe.FindStringSubmatch(header.Get("Link")); m != nil {
+		it.next = m[1]
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"refactoring/client"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) *client.Client {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+
+	return client.New(ts.URL)
+}
+
+func TestClientCRUD(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateUser(ctx, client.CreateUserParams{DisplayName: "Alice", Email: "alice@email.com"})
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), created.ID)
+	assert.Equal(t, "active", created.Status)
+
+	_, err = c.CreateUser(ctx, client.CreateUserParams{DisplayName: "Alice2", Email: "alice@email.com"})
+	assert.ErrorIs(t, err, client.ErrConflict)
+
+	_, err = c.CreateUser(ctx, client.CreateUserParams{DisplayName: "Eve", Status: "suspended"})
+	assert.ErrorIs(t, err, client.ErrInvalidRequest)
+
+	got, err := c.GetUser(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, created, got)
+
+	name := "Alicia"
+	updated, err := c.UpdateUser(ctx, created.ID, client.UpdateUserParams{DisplayName: &name})
+	require.NoError(t, err)
+	assert.Equal(t, "Alicia", updated.DisplayName)
+	assert.Equal(t, "alice@email.com", updated.Email)
+
+	require.NoError(t, c.DeleteUser(ctx, created.ID))
+
+	_, err = c.GetUser(ctx, created.ID)
+	assert.ErrorIs(t, err, client.ErrNotFound)
+	apiErr := &client.APIError{}
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 404, apiErr.StatusCode)
+
+	assert.ErrorIs(t, c.DeleteUser(ctx, created.ID), client.ErrNotFound)
+}
+
+func TestClientListUsers(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		_, err := c.CreateUser(ctx, client.CreateUserParams{
+			DisplayName: fmt.Sprint("User", i),
+			Email:       fmt.Sprintf("user%d@email.com", i),
+		})
+		require.NoError(t, err)
+	}
+
+	for _, pageSize := range []int{0, 1, 2, 5, 10} {
+		t.Run(fmt.Sprint("page size ", pageSize), func(t *testing.T) {
+			users, err := c.ListUsers(ctx, &client.ListOptions{PageSize: pageSize}).All()
+			require.NoError(t, err)
+			require.Len(t, users, 5)
+			for i, u := range users {
+				assert.Equal(t, uint(i+1), u.ID)
+			}
+		})
+	}
+
+	users, err := c.ListUsers(ctx, &client.ListOptions{Email: "USER3@email.com"}).All()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, uint(3), users[0].ID)
+}
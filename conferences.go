@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// conflictHorizon limits how far ahead recurring conferences are checked
+// for double bookings, series without an end would never finish otherwise.
+const conflictHorizon = 366 * 24 * time.Hour
+
+type (
+	Conference struct {
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+		Title     string    `json:"title"`
+		// Owner is the id of the user who organizes the conference, they
+		// attend it as well.
+		Owner uint `json:"owner"`
+		// Participants are the ids of the other users attending it.
+		Participants []uint    `json:"participants,omitempty"`
+		Start        time.Time `json:"start"`
+		End          time.Time `json:"end"`
+		// Recurrence is an RRULE repeating the conference, see
+		// parseRecurrence.
+		Recurrence string `json:"recurrence,omitempty"`
+	}
+	ConferenceList map[uint]Conference
+)
+
+// attendees returns the owner and the participants of c.
+func (c Conference) attendees() []uint {
+	if containsId(c.Participants, c.Owner) {
+		return c.Participants
+	}
+	return insertId(append([]uint{}, c.Participants...), c.Owner)
+}
+
+// occurrences returns the occurrences of c overlapping [from, to).
+func (c Conference) occurrences(from, to time.Time) ([]occurrence, error) {
+	var rc *recurrence
+	if c.Recurrence != "" {
+		var err error
+		if rc, err = parseRecurrence(c.Recurrence); err != nil {
+			return nil, err
+		}
+	}
+	return expandOccurrences(c.Start, c.End.Sub(c.Start), rc, from, to), nil
+}
+
+// conferenceUpdate holds the fields of a conference to change, nil ones
+// are kept.
+type conferenceUpdate struct {
+	Title        *string
+	Owner        *uint
+	Participants *[]uint
+	Start        *time.Time
+	End          *time.Time
+	Recurrence   *string
+}
+
+func (cu conferenceUpdate) apply(c *Conference) {
+	if cu.Title != nil {
+		c.Title = *cu.Title
+	}
+	if cu.Owner != nil {
+		c.Owner = *cu.Owner
+	}
+	if cu.Participants != nil {
+		c.Participants = *cu.Participants
+	}
+	if cu.Start != nil {
+		c.Start = *cu.Start
+	}
+	if cu.End != nil {
+		c.End = *cu.End
+	}
+	if cu.Recurrence != nil {
+		c.Recurrence = *cu.Recurrence
+	}
+}
+
+func dbGetConference(ctx context.Context, id uint) (conference *Conference, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	c, ok := us.Conferences[id]
+	if !ok {
+		return nil, ConferenceNotFound
+	}
+	return &c, nil
+}
+
+func dbGetConferenceList(ctx context.Context) (conferenceList *ConferenceList, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	conferences := us.Conferences
+	if conferences == nil {
+		conferences = ConferenceList{}
+	}
+	return &conferences, nil
+}
+
+// dbGetUserConferences returns the ids of the conferences a user attends.
+func dbGetUserConferences(ctx context.Context, userId uint) (ids []uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return nil, UserNotFound
+	}
+
+	conferences := map[uint]bool{}
+	for id, c := range us.Conferences {
+		if containsId(c.attendees(), userId) {
+			conferences[id] = true
+		}
+	}
+	return sortedIds(conferences), nil
+}
+
+// dbCreateConference stores a new conference. It fails with
+// ConferenceConflict when one of its attendees is booked for another
+// conference at the same time.
+func dbCreateConference(ctx context.Context, c Conference) (id uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = checkConference(us, 0, &c); err != nil {
+		return
+	}
+
+	us.ConferenceIncrement++
+	id = us.ConferenceIncrement
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	if us.Conferences == nil {
+		us.Conferences = ConferenceList{}
+	}
+	us.Conferences[id] = c
+
+	err = saveUserStore(ctx, us)
+	return
+}
+
+func dbUpdateConference(ctx context.Context, id uint, update conferenceUpdate) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	c, ok := us.Conferences[id]
+	if !ok {
+		return ConferenceNotFound
+	}
+
+	update.apply(&c)
+	if err = checkConference(us, id, &c); err != nil {
+		return
+	}
+	c.UpdatedAt = time.Now()
+	us.Conferences[id] = c
+
+	return saveUserStore(ctx, us)
+}
+
+func dbDeleteConference(ctx context.Context, id uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.Conferences[id]; !ok {
+		return ConferenceNotFound
+	}
+	delete(us.Conferences, id)
+
+	return saveUserStore(ctx, us)
+}
+
+// removeUserFromConferences drops a deleted user from all conferences of
+// us, the conferences they own are deleted.
+func removeUserFromConferences(us *UserStore, userId uint) {
+	for id, c := range us.Conferences {
+		if c.Owner == userId {
+			delete(us.Conferences, id)
+			continue
+		}
+		if participants, removed := removeId(c.Participants, userId); removed {
+			c.Participants = participants
+			c.UpdatedAt = time.Now()
+			us.Conferences[id] = c
+		}
+	}
+}
+
+// checkConference validates c, stored under id or new when id is 0, and
+// normalizes its participants and recurrence rule.
+func checkConference(us UserStore, id uint, c *Conference) error {
+	c.Title = strings.TrimSpace(c.Title)
+	if c.Title == "" {
+		return fmt.Errorf("%w: title is required", InvalidConference)
+	}
+	if c.Start.IsZero() || !c.End.After(c.Start) {
+		return fmt.Errorf("%w: end must be after start", InvalidConference)
+	}
+	if c.Recurrence != "" {
+		rc, err := parseRecurrence(c.Recurrence)
+		if err != nil {
+			return err
+		}
+		c.Recurrence = rc.String()
+	}
+
+	if _, ok := us.List[c.Owner]; !ok {
+		return fmt.Errorf("%w: owner %d", UserNotFound, c.Owner)
+	}
+	participants := map[uint]bool{}
+	for _, uid := range c.Participants {
+		if _, ok := us.List[uid]; !ok {
+			return fmt.Errorf("%w: participant %d", UserNotFound, uid)
+		}
+		if uid != c.Owner {
+			participants[uid] = true
+		}
+	}
+	c.Participants = nil
+	if len(participants) > 0 {
+		c.Participants = sortedIds(participants)
+	}
+
+	return checkDoubleBooking(us, id, *c)
+}
+
+// checkDoubleBooking fails with ConferenceConflict when an attendee of c
+// attends another conference at the same time within conflictHorizon after
+// c starts.
+func checkDoubleBooking(us UserStore, id uint, c Conference) error {
+	from, to := c.Start, c.Start.Add(conflictHorizon)
+	own, err := c.occurrences(from, to)
+	if err != nil {
+		return err
+	}
+	attendees := c.attendees()
+
+	conflicts := []string{}
+	for _, otherId := range sortedConferenceIds(&us.Conferences) {
+		other := us.Conferences[otherId]
+		if otherId == id {
+			continue
+		}
+		shared := []string{}
+		for _, uid := range other.attendees() {
+			if containsId(attendees, uid) {
+				shared = append(shared, fmt.Sprint(uid))
+			}
+		}
+		if len(shared) == 0 {
+			continue
+		}
+
+		occurrences, err := other.occurrences(from, to)
+		if err != nil {
+			return err
+		}
+		if o, ok := overlap(own, occurrences); ok {
+			who := "user " + shared[0] + " attends"
+			if len(shared) > 1 {
+				who = "users " + strings.Join(shared, ", ") + " attend"
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%s conference %d at %s", who, otherId, o.Start.Format(time.RFC3339)))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", ConferenceConflict, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+func sortedConferenceIds(conferenceList *ConferenceList) []uint {
+	ids := make([]uint, 0, len(*conferenceList))
+	for k := range *conferenceList {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
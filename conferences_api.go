@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// defaultOccurrenceRange is the range occurrences are listed for when the
+// request doesn't end it.
+const defaultOccurrenceRange = 30 * 24 * time.Hour
+
+type CreateConferenceRequest struct {
+	Title        string    `json:"title"`
+	Owner        uint      `json:"owner"`
+	Participants []uint    `json:"participants,omitempty"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Recurrence   string    `json:"recurrence,omitempty"`
+}
+
+func (c *CreateConferenceRequest) Bind(r *http.Request) error {
+	if c.Owner == 0 {
+		return errors.New("owner is required")
+	}
+	if c.Start.IsZero() || c.End.IsZero() {
+		return errors.New("start and end are required")
+	}
+	return nil
+}
+
+type UpdateConferenceRequest struct {
+	Title        *string    `json:"title,omitempty"`
+	Owner        *uint      `json:"owner,omitempty"`
+	Participants *[]uint    `json:"participants,omitempty"`
+	Start        *time.Time `json:"start,omitempty"`
+	End          *time.Time `json:"end,omitempty"`
+	// Recurrence set to "" stops repeating the conference.
+	Recurrence *string `json:"recurrence,omitempty"`
+}
+
+func (u *UpdateConferenceRequest) Bind(r *http.Request) error { return nil }
+
+type ConferenceResponse struct {
+	*Conference
+	Id uint `json:"id"`
+
+	// uid and users are only written in iCalendar responses.
+	uid   string
+	users UserList
+}
+
+func (cr *ConferenceResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if cr.Conference == nil {
+		return ConferenceNotFound
+	}
+	return nil
+}
+
+func NewConferenceResponse(ctx context.Context, id uint) *ConferenceResponse {
+	users := UserList{}
+	if list, _ := dbGetUserList(ctx); list != nil {
+		users = *list
+	}
+	return newConferenceResponse(ctx, id, users)
+}
+
+func newConferenceResponse(ctx context.Context, id uint, users UserList) *ConferenceResponse {
+	resp := &ConferenceResponse{Id: id, uid: fmt.Sprintf("conference-%d", id), users: users}
+	if tenant := tenantFrom(ctx); tenant != "" {
+		resp.uid = tenant + "-" + resp.uid
+	}
+	if conference, _ := dbGetConference(ctx, id); conference != nil {
+		resp.Conference = conference
+	}
+	return resp
+}
+
+func NewConferenceListResponse(ctx context.Context, ids []uint) []render.Renderer {
+	users := UserList{}
+	if list, _ := dbGetUserList(ctx); list != nil {
+		users = *list
+	}
+
+	list := []render.Renderer{}
+	for _, id := range ids {
+		list = append(list, newConferenceResponse(ctx, id, users))
+	}
+	return list
+}
+
+type OccurrenceResponse struct {
+	occurrence
+}
+
+func (or *OccurrenceResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+// setConferenceRoutes serves the conferences of the default store, or of a
+// tenant when mounted below tenantScope. Conferences are available as
+// iCalendar with Accept: text/calendar or below a .ics path.
+func setConferenceRoutes(r chi.Router) {
+	reader, editor, admin := requireRole(RoleReader), requireRole(RoleEditor), requireRole(RoleAdmin)
+
+	r.With(reader).Get("/", listConferences)
+	r.With(editor).Post("/", createConference)
+
+	r.With(reader).Get("/{conferenceId}.ics", asCalendar(getConference))
+	r.Route("/{conferenceId}", func(r chi.Router) {
+		r.With(reader).Get("/", getConference)
+		r.With(editor).Patch("/", updateConference)
+		r.With(admin).Delete("/", deleteConference)
+
+		r.With(reader).Get("/occurrences", listOccurrences)
+	})
+}
+
+// asCalendar serves h as iCalendar whatever the request accepts, for
+// calendar clients subscribing to a URL.
+func asCalendar(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept", calendarMediaType)
+		h(w, r)
+	}
+}
+
+// renderConferenceError renders the errors of conference operations.
+func renderConferenceError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ConferenceNotFound):
+		render.Render(w, r, ErrNotFound(err))
+	case errors.Is(err, InvalidConference), errors.Is(err, InvalidRecurrence):
+		render.Render(w, r, ErrInvalidRequest(err))
+	case errors.Is(err, UserNotFound):
+		render.Render(w, r, ErrUnprocessable(err))
+	case errors.Is(err, ConferenceConflict):
+		render.Render(w, r, ErrConflict(err))
+	default:
+		render.Render(w, r, ErrInternal(err))
+	}
+}
+
+func listConferences(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePage(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	conferenceList, err := dbGetConferenceList(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	ids, more := p.apply(sortedConferenceIds(conferenceList))
+	if more {
+		w.Header().Set("Link", p.nextLink(r, ids[len(ids)-1]))
+	}
+
+	if err := render.RenderList(w, r, NewConferenceListResponse(r.Context(), ids)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func createConference(w http.ResponseWriter, r *http.Request) {
+	request := CreateConferenceRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	id, err := dbCreateConference(r.Context(), Conference{
+		Title:        request.Title,
+		Owner:        request.Owner,
+		Participants: request.Participants,
+		Start:        request.Start,
+		End:          request.End,
+		Recurrence:   request.Recurrence,
+	})
+	if err != nil {
+		renderConferenceError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, NewConferenceResponse(r.Context(), id))
+}
+
+func getConference(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIdParam(r, "conferenceId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := render.Render(w, r, NewConferenceResponse(r.Context(), id)); err != nil {
+		if errors.Is(err, ConferenceNotFound) {
+			render.Render(w, r, ErrNotFound(err))
+			return
+		}
+
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func updateConference(w http.ResponseWriter, r *http.Request) {
+	request := UpdateConferenceRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	id, err := parseIdParam(r, "conferenceId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	err = dbUpdateConference(r.Context(), id, conferenceUpdate{
+		Title:        request.Title,
+		Owner:        request.Owner,
+		Participants: request.Participants,
+		Start:        request.Start,
+		End:          request.End,
+		Recurrence:   request.Recurrence,
+	})
+	if err != nil {
+		renderConferenceError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, NewConferenceResponse(r.Context(), id))
+}
+
+func deleteConference(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIdParam(r, "conferenceId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := dbDeleteConference(r.Context(), id); err != nil {
+		renderConferenceError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listOccurrences expands a conference into its occurrences overlapping
+// ?from= until ?to=, both RFC 3339 times. The range starts now and lasts
+// defaultOccurrenceRange unless given, and can't exceed conflictHorizon.
+func listOccurrences(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIdParam(r, "conferenceId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	c, err := dbGetConference(r.Context(), id)
+	if err != nil {
+		renderConferenceError(w, r, err)
+		return
+	}
+	occurrences, err := c.occurrences(from, to)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, o := range occurrences {
+		list = append(list, &OccurrenceResponse{o})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func parseTimeRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	from = time.Now()
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	to = from.Add(defaultOccurrenceRange)
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	if !to.After(from) {
+		return from, to, errors.New("to must be after from")
+	}
+	if to.Sub(from) > conflictHorizon {
+		return from, to, fmt.Errorf("the range can't exceed %d days", conflictHorizon/(24*time.Hour))
+	}
+	return
+}
+
+// getUserConferences lists the conferences a user owns or participates in.
+func getUserConferences(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	ids, err := dbGetUserConferences(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, UserNotFound) {
+			render.Render(w, r, ErrNotFound(err))
+			return
+		}
+
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewConferenceListResponse(r.Context(), ids)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
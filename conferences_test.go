@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConferences(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 3,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+			3: {DisplayName: "Carol, Jr.", Email: "carol@email.com", Status: StatusActive},
+		},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, ts, req)
+	}
+
+	// a standup on weekdays at 9:00 UTC, Monday October 19th 2026 first
+	resp, body := request("POST", "/conferences/", `{
+		"title": "Standup", "owner": 1, "participants": [2, 1, 2],
+		"start": "2026-10-19T09:00:00Z", "end": "2026-10-19T09:15:00Z",
+		"recurrence": "FREQ=WEEKLY;BYDAY=FR,MO,TU,WE,TH"
+	}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	standup := ConferenceResponse{}
+	require.NoError(t, json.Unmarshal(body, &standup))
+	assert.Equal(t, uint(1), standup.Id)
+	assert.Equal(t, []uint{2}, standup.Participants, "the owner and duplicates are dropped")
+	assert.Equal(t, "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR", standup.Recurrence)
+
+	t.Run("invalid conferences", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			body   string
+			status int
+		}{
+			{"no owner", `{"title":"x","start":"2026-10-20T10:00:00Z","end":"2026-10-20T11:00:00Z"}`, 400},
+			{"no title", `{"title":" ","owner":1,"start":"2026-10-20T10:00:00Z","end":"2026-10-20T11:00:00Z"}`, 400},
+			{"ends before it starts", `{"title":"x","owner":1,"start":"2026-10-20T10:00:00Z","end":"2026-10-20T09:00:00Z"}`, 400},
+			{"invalid rule", `{"title":"x","owner":1,"start":"2026-10-20T10:00:00Z","end":"2026-10-20T11:00:00Z","recurrence":"FREQ=SECONDLY"}`, 400},
+			{"unknown owner", `{"title":"x","owner":42,"start":"2026-10-20T10:00:00Z","end":"2026-10-20T11:00:00Z"}`, 422},
+			{"unknown participant", `{"title":"x","owner":1,"participants":[42],"start":"2026-10-20T10:00:00Z","end":"2026-10-20T11:00:00Z"}`, 422},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, body := request("POST", "/conferences/", tc.body)
+				assert.Equal(t, tc.status, resp.StatusCode, string(body))
+			})
+		}
+	})
+
+	t.Run("double bookings", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			body     string
+			conflict string
+		}{
+			{
+				name:     "overlapping a later occurrence",
+				body:     `{"title":"1:1","owner":3,"participants":[2],"start":"2026-10-22T09:10:00Z","end":"2026-10-22T09:40:00Z"}`,
+				conflict: "user 2 attends conference 1 at 2026-10-22T09:00:00Z",
+			},
+			{
+				name:     "recurring series meeting the series",
+				body:     `{"title":"Sync","owner":1,"participants":[2],"start":"2026-10-01T09:00:00Z","end":"2026-10-01T10:00:00Z","recurrence":"FREQ=MONTHLY"}`,
+				conflict: "users 1, 2 attend conference 1 at 2026-12-01T09:00:00Z",
+			},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, body := request("POST", "/conferences/", tc.body)
+				assert.Equal(t, http.StatusConflict, resp.StatusCode)
+				assert.Contains(t, string(body), tc.conflict)
+			})
+		}
+
+		for _, body := range []string{
+			// right after, on a weekend, or without shared attendees
+			`{"title":"Review","owner":2,"start":"2026-10-22T09:15:00Z","end":"2026-10-22T10:00:00Z"}`,
+			`{"title":"Hackathon","owner":1,"start":"2026-10-24T08:00:00Z","end":"2026-10-24T18:00:00Z"}`,
+			`{"title":"Interview","owner":3,"start":"2026-10-22T09:00:00Z","end":"2026-10-22T10:00:00Z"}`,
+		} {
+			resp, respBody := request("POST", "/conferences/", body)
+			assert.Equal(t, http.StatusCreated, resp.StatusCode, string(respBody))
+		}
+
+		// moving the interview onto the standup and adding Bob
+		resp, body := request("PATCH", "/conferences/4", `{"participants":[2]}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, string(body))
+		resp, body = request("PATCH", "/conferences/4", `{"participants":[2],"start":"2026-10-22T11:00:00Z","end":"2026-10-22T12:00:00Z"}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		// running late would overlap with Bob's review on Thursday
+		resp, body = request("PATCH", "/conferences/1", `{"end":"2026-10-19T09:20:00Z"}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, string(body))
+		assert.Contains(t, string(body), "user 2 attends conference 2 at 2026-10-22T09:15:00Z")
+		// a conference doesn't conflict with itself
+		resp, body = request("PATCH", "/conferences/1", `{"start":"2026-10-19T09:00:00Z"}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	})
+
+	t.Run("occurrences", func(t *testing.T) {
+		resp, body := request("GET", "/conferences/1/occurrences?from=2026-10-23T00:00:00Z&to=2026-10-27T00:00:00Z", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		assert.JSONEq(t, `[
+			{"start":"2026-10-23T09:00:00Z","end":"2026-10-23T09:15:00Z"},
+			{"start":"2026-10-26T09:00:00Z","end":"2026-10-26T09:15:00Z"}
+		]`, string(body))
+
+		for _, query := range []string{"from=yesterday", "from=2026-10-23T00:00:00Z&to=2026-10-22T00:00:00Z", "from=2026-01-01T00:00:00Z&to=2028-01-01T00:00:00Z"} {
+			resp, _ := request("GET", "/conferences/1/occurrences?"+query, "")
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		}
+		resp, _ = request("GET", "/conferences/99/occurrences", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("icalendar", func(t *testing.T) {
+		req := mustRequest(t, "GET", ts.URL+"/api/v1/conferences/1")
+		req.Header.Set("Accept", "text/calendar")
+		resp, body := testRequest(t, ts, req)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		assert.Equal(t, "text/calendar; charset=utf-8", resp.Header.Get("Content-Type"))
+		ics := string(body)
+		for _, line := range []string{
+			"BEGIN:VCALENDAR\r\n",
+			"UID:conference-1\r\n",
+			"DTSTART:20261019T090000Z\r\n",
+			"DTEND:20261019T091500Z\r\n",
+			"RRULE:FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR\r\n",
+			"SUMMARY:Standup\r\n",
+			"ORGANIZER;CN=\"Alice\":mailto:alice@email.com\r\n",
+			"ATTENDEE;CN=\"Bob\";ROLE=REQ-PARTICIPANT:mailto:bob@email.com\r\n",
+			"END:VCALENDAR\r\n",
+		} {
+			assert.Contains(t, ics, line)
+		}
+
+		resp, body = request("GET", "/conferences/1.ics", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, ics, string(body))
+
+		// per user, in JSON or as a calendar
+		resp, body = request("GET", "/users/3/conferences", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, string(body), `"title":"Interview"`)
+		resp, body = request("GET", "/users/2/conferences.ics", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 3, strings.Count(string(body), "BEGIN:VEVENT"))
+		resp, _ = request("GET", "/users/42/conferences.ics", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// only conferences are calendars
+		req = mustRequest(t, "GET", ts.URL+"/api/v1/users/1")
+		req.Header.Set("Accept", "text/calendar")
+		resp, _ = testRequest(t, ts, req)
+		assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	})
+
+	t.Run("deleting a user", func(t *testing.T) {
+		resp, _ := request("DELETE", "/users/2", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		c, err := dbGetConference(context.Background(), 1)
+		require.NoError(t, err)
+		assert.Empty(t, c.Participants)
+		// Bob's review is gone with him
+		_, err = dbGetConference(context.Background(), 2)
+		assert.ErrorIs(t, err, ConferenceNotFound)
+
+		resp, _ = request("DELETE", "/conferences/1", "")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp, _ = request("GET", "/conferences/1", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestCalendarLineFolding(t *testing.T) {
+	b := &strings.Builder{}
+	cw := &calendarWriter{w: b}
+	cw.line("SUMMARY:" + strings.Repeat("ä", 50))
+	require.NoError(t, cw.err)
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+	require.Len(t, lines, 2)
+	assert.LessOrEqual(t, len(lines[0]), calendarLineLength)
+	assert.True(t, strings.HasPrefix(lines[1], " "))
+	assert.Equal(t, "SUMMARY:"+strings.Repeat("ä", 50), lines[0]+lines[1][1:])
+}
+
+func TestCalendarAddressInjection(t *testing.T) {
+	evil := "eve@email.com\r\nATTENDEE:mailto:mallory@email.com"
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			// stored before emails were checked
+			2: {DisplayName: "Eve", Email: evil, Status: StatusActive},
+		},
+		ConferenceIncrement: 1,
+		Conferences: ConferenceList{
+			1: {
+				Title: "Standup", Owner: 2, Participants: []uint{1},
+				Start: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC), End: time.Date(2026, 10, 19, 9, 15, 0, 0, time.UTC),
+			},
+		},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/conferences/1.ics"))
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assert.NotContains(t, string(body), "mallory")
+	assert.NotContains(t, string(body), "ORGANIZER")
+	assert.Contains(t, string(body), "ATTENDEE;CN=\"Alice\";ROLE=REQ-PARTICIPANT:mailto:alice@email.com\r\n")
+
+	payload, err := json.Marshal(map[string]string{"display_name": "Eve", "email": evil})
+	require.NoError(t, err)
+	for _, tc := range []struct{ method, path string }{{"POST", "/users/"}, {"PATCH", "/users/1"}} {
+		req, err := http.NewRequest(tc.method, ts.URL+"/api/v1"+tc.path, strings.NewReader(string(payload)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, body := testRequest(t, ts, req)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "%s %s: %s", tc.method, tc.path, body)
+	}
+}
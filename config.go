@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config holds settings read from the environment at startup.
+type Config struct {
+	// StoreBackend selects the Store implementation: json, sqlite or bolt.
+	StoreBackend string
+	// StorePath is the location of the user store, defaults to users.json,
+	// users.sqlite or users.bolt depending on the backend.
+	StorePath string
+	// StoreKey holds base64 encoded AES keys for encryption at rest of the
+	// json backend, the current key first followed by keys still accepted for
+	// reading.
+	StoreKey string
+	// StoreKeyFile is read for the keys when StoreKey is empty.
+	StoreKeyFile string
+	// FieldKey is a base64 encoded master key for per-record encryption of
+	// emails, field encryption is disabled when it is empty.
+	FieldKey string
+	// FieldKeyFile is read for the key when FieldKey is empty.
+	FieldKeyFile string
+	// BackupDir is where store snapshots are written, those of tenants in
+	// tenants/<name> below it.
+	BackupDir string
+	// BackupKeep is the number of most recent snapshots to retain, 0 keeps all.
+	BackupKeep int
+	// BackupMaxAge removes snapshots older than this, 0 keeps them forever.
+	BackupMaxAge time.Duration
+	// IdempotencyPath is the file responses to requests with an
+	// Idempotency-Key are kept in.
+	IdempotencyPath string
+	// IdempotencyTTL is how long such responses are replayed.
+	IdempotencyTTL time.Duration
+	// RateLimitReads is the number of GET requests a client may send per
+	// minute, 0 disables the limit.
+	RateLimitReads int
+	// RateLimitWrites is the number of other requests a client may send per
+	// minute, 0 disables the limit.
+	RateLimitWrites int
+	// AuthRequired rejects anonymous requests, callers then need an API key
+	// with a role allowing the operation. It is on by default, turning it
+	// off gives anonymous callers every role and is meant for development
+	// only.
+	AuthRequired bool
+	// APIKeysPath is the file API keys are kept in.
+	APIKeysPath string
+	// JWKSPath is a JWKS file with the keys bearer tokens are signed with,
+	// bearer tokens are rejected when it is empty.
+	JWKSPath string
+	// JWTIssuer and JWTAudience must match the iss and aud claims of bearer
+	// tokens.
+	JWTIssuer   string
+	JWTAudience string
+	// TenantsDir holds a store per tenant, in the format of StoreBackend.
+	TenantsDir string
+	// RequestTimeout bounds the time a request may take, except for streams
+	// that stay open for as long as their clients listen.
+	RequestTimeout time.Duration
+	// PresenceTimeout is how long users stay online, away, busy or in a call
+	// without a heartbeat before they are offline.
+	PresenceTimeout time.Duration
+	// LDIFMapping maps User fields to the LDAP attributes LDIF imports read
+	// them from, as in "display_name=displayName,cn;email=mail".
+	LDIFMapping string
+}
+
+var config = loadConfig()
+
+func loadConfig() Config {
+	backend := envString("USERS_STORE_BACKEND", backendJSON)
+	defaultPath := map[string]string{
+		backendSQLite: "users.sqlite",
+		backendBolt:   "users.bolt",
+	}[backend]
+	if defaultPath == "" {
+		defaultPath = "users.json"
+	}
+
+	return Config{
+		StoreBackend: backend,
+		StorePath:    envString("USERS_STORE", defaultPath),
+		StoreKey:     envString("USERS_STORE_KEY", ""),
+		StoreKeyFile: envString("USERS_STORE_KEY_FILE", ""),
+		FieldKey:     envString("USERS_FIELD_KEY", ""),
+		FieldKeyFile: envString("USERS_FIELD_KEY_FILE", ""),
+		BackupDir:    envString("USERS_BACKUP_DIR", "backups"),
+		BackupKeep:   envInt("USERS_BACKUP_KEEP", 0),
+		BackupMaxAge: envDuration("USERS_BACKUP_MAX_AGE", 0),
+
+		IdempotencyPath: envString("USERS_IDEMPOTENCY_STORE", "idempotency.json"),
+		IdempotencyTTL:  envDuration("USERS_IDEMPOTENCY_TTL", 24*time.Hour),
+
+		RateLimitReads:  envInt("USERS_RATE_LIMIT_READS", 600),
+		RateLimitWrites: envInt("USERS_RATE_LIMIT_WRITES", 60),
+
+		AuthRequired: envBool("USERS_AUTH_REQUIRED", true),
+		APIKeysPath:  envString("USERS_API_KEYS", "api_keys.json"),
+
+		JWKSPath:    envString("USERS_JWKS_FILE", ""),
+		JWTIssuer:   envString("USERS_JWT_ISSUER", ""),
+		JWTAudience: envString("USERS_JWT_AUDIENCE", ""),
+
+		TenantsDir: envString("USERS_TENANTS_DIR", "tenants"),
+
+		RequestTimeout:  envDuration("USERS_REQUEST_TIMEOUT", 60*time.Second),
+		PresenceTimeout: envDuration("USERS_PRESENCE_TIMEOUT", 2*time.Minute),
+
+		LDIFMapping: envString("USERS_LDIF_MAPPING", ""),
+	}
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", key, v, err)
+		return fallback
+	}
+	return i
+}
+
+func envBool(key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", key, v, err)
+		return fallback
+	}
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Warnf("Ignoring %s=%q: %v", key, v, err)
+		return fallback
+	}
+	return d
+}
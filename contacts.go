@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxContactLabels      = 20
+	maxContactLabelLength = 50
+)
+
+type (
+	// AddressBook holds the contacts of a user, the requests other users
+	// sent them to become mutual contacts and the users they blocked.
+	AddressBook struct {
+		Contacts ContactList `json:"contacts,omitempty"`
+		// Requests maps the ids of users asking to become mutual contacts
+		// to when they asked.
+		Requests map[uint]time.Time `json:"requests,omitempty"`
+		Blocked  []uint             `json:"blocked,omitempty"`
+	}
+	Contact struct {
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+		Nickname  string    `json:"nickname,omitempty"`
+		Labels    []string  `json:"labels,omitempty"`
+		Favorite  bool      `json:"favorite,omitempty"`
+	}
+	ContactList map[uint]Contact
+)
+
+// ContactRequest is a request of From to become a mutual contact of To.
+type ContactRequest struct {
+	From      uint      `json:"from"`
+	To        uint      `json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// contactUpdate holds the fields of a contact to change, nil ones are kept.
+type contactUpdate struct {
+	Nickname *string
+	Labels   *[]string
+	Favorite *bool
+}
+
+func (cu contactUpdate) apply(c *Contact) {
+	if cu.Nickname != nil {
+		c.Nickname = strings.TrimSpace(*cu.Nickname)
+	}
+	if cu.Labels != nil {
+		c.Labels = normalizeLabels(*cu.Labels)
+	}
+	if cu.Favorite != nil {
+		c.Favorite = *cu.Favorite
+	}
+}
+
+// checkLabels validates the labels of a contact.
+func checkLabels(labels []string) error {
+	if len(labels) > maxContactLabels {
+		return fmt.Errorf("a contact can have up to %d labels", maxContactLabels)
+	}
+	for _, label := range labels {
+		if l := utf8.RuneCountInString(strings.TrimSpace(label)); l == 0 || l > maxContactLabelLength {
+			return fmt.Errorf("labels must have 1 to %d characters", maxContactLabelLength)
+		}
+	}
+	return nil
+}
+
+// normalizeLabels trims labels and sorts them without duplicates.
+func normalizeLabels(labels []string) []string {
+	set := map[string]bool{}
+	for _, label := range labels {
+		set[strings.TrimSpace(label)] = true
+	}
+	normalized := []string{}
+	for label := range set {
+		normalized = append(normalized, label)
+	}
+	sort.Strings(normalized)
+	if len(normalized) == 0 {
+		return nil
+	}
+	return normalized
+}
+
+// blocks reports whether either user blocked the other.
+func blocks(us UserStore, a, b uint) bool {
+	return containsId(us.AddressBooks[a].Blocked, b) || containsId(us.AddressBooks[b].Blocked, a)
+}
+
+// isMutual reports whether both users have each other as contacts.
+func isMutual(us UserStore, a, b uint) bool {
+	_, ab := us.AddressBooks[a].Contacts[b]
+	_, ba := us.AddressBooks[b].Contacts[a]
+	return ab && ba
+}
+
+// checkContactPair returns an error unless userId may have otherId as a
+// contact.
+func checkContactPair(us UserStore, userId, otherId uint) error {
+	if _, ok := us.List[userId]; !ok {
+		return UserNotFound
+	}
+	if _, ok := us.List[otherId]; !ok {
+		return fmt.Errorf("%w: %d", UserNotFound, otherId)
+	}
+	if userId == otherId {
+		return fmt.Errorf("%w: users can't be their own contacts", InvalidContact)
+	}
+	if blocks(us, userId, otherId) {
+		return ContactBlocked
+	}
+	return nil
+}
+
+// setAddressBook stores ab for userId, dropping it when it is empty so
+// users without contacts don't take up space.
+func setAddressBook(us *UserStore, userId uint, ab AddressBook) {
+	if len(ab.Contacts) == 0 && len(ab.Requests) == 0 && len(ab.Blocked) == 0 {
+		delete(us.AddressBooks, userId)
+		return
+	}
+	if us.AddressBooks == nil {
+		us.AddressBooks = map[uint]AddressBook{}
+	}
+	us.AddressBooks[userId] = ab
+}
+
+// addContact adds contactId to the contacts of userId unless they are
+// already.
+func addContact(us *UserStore, userId, contactId uint, now time.Time) {
+	ab := us.AddressBooks[userId]
+	if _, ok := ab.Contacts[contactId]; ok {
+		return
+	}
+	if ab.Contacts == nil {
+		ab.Contacts = ContactList{}
+	}
+	ab.Contacts[contactId] = Contact{CreatedAt: now, UpdatedAt: now}
+	setAddressBook(us, userId, ab)
+}
+
+func removeContact(us *UserStore, userId, contactId uint) bool {
+	ab := us.AddressBooks[userId]
+	if _, ok := ab.Contacts[contactId]; !ok {
+		return false
+	}
+	delete(ab.Contacts, contactId)
+	setAddressBook(us, userId, ab)
+	return true
+}
+
+func removeContactRequest(us *UserStore, userId, fromId uint) bool {
+	ab := us.AddressBooks[userId]
+	if _, ok := ab.Requests[fromId]; !ok {
+		return false
+	}
+	delete(ab.Requests, fromId)
+	setAddressBook(us, userId, ab)
+	return true
+}
+
+// dbGetAddressBook returns the address book of a user.
+func dbGetAddressBook(ctx context.Context, userId uint) (ab *AddressBook, mutual map[uint]bool, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return nil, nil, UserNotFound
+	}
+
+	book := us.AddressBooks[userId]
+	mutual = map[uint]bool{}
+	for id := range book.Contacts {
+		mutual[id] = isMutual(us, userId, id)
+	}
+	return &book, mutual, nil
+}
+
+// dbGetContactRequests returns the pending requests sent to and by a user,
+// oldest first.
+func dbGetContactRequests(ctx context.Context, userId uint) (incoming, outgoing []ContactRequest, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return nil, nil, UserNotFound
+	}
+
+	incoming, outgoing = []ContactRequest{}, []ContactRequest{}
+	for to, ab := range us.AddressBooks {
+		for from, at := range ab.Requests {
+			switch userId {
+			case to:
+				incoming = append(incoming, ContactRequest{From: from, To: to, CreatedAt: at})
+			case from:
+				outgoing = append(outgoing, ContactRequest{From: from, To: to, CreatedAt: at})
+			}
+		}
+	}
+	for _, list := range [][]ContactRequest{incoming, outgoing} {
+		sort.Slice(list, func(i, j int) bool {
+			if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+				return list[i].CreatedAt.Before(list[j].CreatedAt)
+			}
+			return list[i].From+list[i].To < list[j].From+list[j].To
+		})
+	}
+	return
+}
+
+// dbSetContact adds contactId to the contacts of userId or changes the
+// contact, and reports whether it was added.
+func dbSetContact(ctx context.Context, userId, contactId uint, update contactUpdate) (created bool, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = checkContactPair(us, userId, contactId); err != nil {
+		return
+	}
+
+	now := time.Now()
+	ab := us.AddressBooks[userId]
+	c, ok := ab.Contacts[contactId]
+	if !ok {
+		created = true
+		c.CreatedAt = now
+	}
+	update.apply(&c)
+	c.UpdatedAt = now
+	if ab.Contacts == nil {
+		ab.Contacts = ContactList{}
+	}
+	ab.Contacts[contactId] = c
+	setAddressBook(&us, userId, ab)
+
+	err = saveUserStore(ctx, us)
+	return
+}
+
+func dbRemoveContact(ctx context.Context, userId, contactId uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return UserNotFound
+	}
+	if !removeContact(&us, userId, contactId) {
+		return ContactNotFound
+	}
+
+	return saveUserStore(ctx, us)
+}
+
+// dbRequestContact asks toId to become a mutual contact of fromId. When
+// toId asked fromId already, that request is accepted right away instead,
+// which is reported by accepted. Asking again returns the pending request.
+func dbRequestContact(ctx context.Context, fromId, toId uint) (req ContactRequest, accepted bool, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = checkContactPair(us, fromId, toId); err != nil {
+		return
+	}
+	if isMutual(us, fromId, toId) {
+		return req, false, AlreadyContacts
+	}
+
+	now := time.Now()
+	req = ContactRequest{From: fromId, To: toId, CreatedAt: now}
+	if removeContactRequest(&us, fromId, toId) {
+		accepted = true
+		addContact(&us, fromId, toId, now)
+		addContact(&us, toId, fromId, now)
+	} else {
+		ab := us.AddressBooks[toId]
+		if at, ok := ab.Requests[fromId]; ok {
+			req.CreatedAt = at
+			return
+		}
+		if ab.Requests == nil {
+			ab.Requests = map[uint]time.Time{}
+		}
+		ab.Requests[fromId] = now
+		setAddressBook(&us, toId, ab)
+	}
+
+	err = saveUserStore(ctx, us)
+	return
+}
+
+// dbAnswerContactRequest accepts or declines the request of fromId to
+// userId. Accepting makes both contacts of each other.
+func dbAnswerContactRequest(ctx context.Context, userId, fromId uint, accept bool) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return UserNotFound
+	}
+	if !removeContactRequest(&us, userId, fromId) {
+		return ContactRequestNotFound
+	}
+	if accept {
+		now := time.Now()
+		addContact(&us, userId, fromId, now)
+		addContact(&us, fromId, userId, now)
+	}
+
+	return saveUserStore(ctx, us)
+}
+
+// dbBlockUser blocks blockedId for userId: their pending requests are
+// dropped, they are removed from each other's contacts and can't add each
+// other again until unblocked.
+func dbBlockUser(ctx context.Context, userId, blockedId uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return UserNotFound
+	}
+	if _, ok := us.List[blockedId]; !ok {
+		return fmt.Errorf("%w: %d", UserNotFound, blockedId)
+	}
+	if userId == blockedId {
+		return fmt.Errorf("%w: users can't block themselves", InvalidContact)
+	}
+
+	removeContactRequest(&us, userId, blockedId)
+	removeContactRequest(&us, blockedId, userId)
+	removeContact(&us, userId, blockedId)
+	removeContact(&us, blockedId, userId)
+	ab := us.AddressBooks[userId]
+	if !containsId(ab.Blocked, blockedId) {
+		ab.Blocked = insertId(ab.Blocked, blockedId)
+	}
+	setAddressBook(&us, userId, ab)
+
+	return saveUserStore(ctx, us)
+}
+
+func dbUnblockUser(ctx context.Context, userId, blockedId uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return UserNotFound
+	}
+	ab := us.AddressBooks[userId]
+	blocked, removed := removeId(ab.Blocked, blockedId)
+	if !removed {
+		return NotBlocked
+	}
+	ab.Blocked = blocked
+	setAddressBook(&us, userId, ab)
+
+	return saveUserStore(ctx, us)
+}
+
+// removeUserFromAddressBooks drops the address book of a deleted user and
+// every reference to them in the others.
+func removeUserFromAddressBooks(us *UserStore, userId uint) {
+	delete(us.AddressBooks, userId)
+	for id, ab := range us.AddressBooks {
+		delete(ab.Contacts, userId)
+		delete(ab.Requests, userId)
+		ab.Blocked, _ = removeId(ab.Blocked, userId)
+		setAddressBook(us, id, ab)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const maxNicknameLength = 100
+
+type SetContactRequest struct {
+	Nickname *string   `json:"nickname,omitempty"`
+	Labels   *[]string `json:"labels,omitempty"`
+	Favorite *bool     `json:"favorite,omitempty"`
+}
+
+func (s *SetContactRequest) Bind(r *http.Request) error {
+	if s.Nickname != nil && utf8.RuneCountInString(strings.TrimSpace(*s.Nickname)) > maxNicknameLength {
+		return fmt.Errorf("nickname can't be longer than %d characters", maxNicknameLength)
+	}
+	if s.Labels != nil {
+		return checkLabels(*s.Labels)
+	}
+	return nil
+}
+
+type SendContactRequest struct {
+	UserId uint `json:"user_id"`
+}
+
+func (s *SendContactRequest) Bind(r *http.Request) error {
+	if s.UserId == 0 {
+		return errors.New("user_id is required")
+	}
+	return nil
+}
+
+type ContactResponse struct {
+	UserId      uint   `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	Contact
+	// Mutual is set when the contact has the user as a contact too.
+	Mutual bool `json:"mutual"`
+}
+
+func (cr *ContactResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+type ContactRequestResponse struct {
+	ContactRequest
+	// Accepted is set when the request answered one the other user sent
+	// before, which makes both mutual contacts right away.
+	Accepted bool `json:"accepted,omitempty"`
+}
+
+func (cr *ContactRequestResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+// renderContactError renders the errors of contact operations.
+func renderContactError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, UserNotFound), errors.Is(err, ContactNotFound),
+		errors.Is(err, ContactRequestNotFound), errors.Is(err, NotBlocked):
+		render.Render(w, r, ErrNotFound(err))
+	case errors.Is(err, InvalidContact):
+		render.Render(w, r, ErrInvalidRequest(err))
+	case errors.Is(err, ContactBlocked), errors.Is(err, AlreadyContacts):
+		render.Render(w, r, ErrConflict(err))
+	default:
+		render.Render(w, r, ErrInternal(err))
+	}
+}
+
+// parseUserAndIdParam reads the {id} of the user and another id param of a
+// contact route.
+func parseUserAndIdParam(r *http.Request, name string) (userId, otherId uint, err error) {
+	if userId, err = parseUserId(r); err != nil {
+		return 0, 0, errors.New("invalid id")
+	}
+	otherId, err = parseIdParam(r, name)
+	return
+}
+
+// listContacts lists the contacts of a user by id, optionally only those
+// with a ?label= or with ?favorite=true.
+func listContacts(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	p, err := parsePage(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	q := r.URL.Query()
+	label := strings.TrimSpace(q.Get("label"))
+	var favorite *bool
+	if v := q.Get("favorite"); v != "" {
+		f, err := strconv.ParseBool(v)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(errors.New("invalid favorite, expected true or false")))
+			return
+		}
+		favorite = &f
+	}
+
+	ab, mutual, err := dbGetAddressBook(r.Context(), id)
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+	userList, err := dbGetUserList(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	ids := []uint{}
+	for cid, c := range ab.Contacts {
+		if label != "" && !containsLabel(c.Labels, label) {
+			continue
+		}
+		if favorite != nil && c.Favorite != *favorite {
+			continue
+		}
+		ids = append(ids, cid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	ids, more := p.apply(ids)
+	if more {
+		w.Header().Set("Link", p.nextLink(r, ids[len(ids)-1]))
+	}
+
+	list := []render.Renderer{}
+	for _, cid := range ids {
+		list = append(list, &ContactResponse{
+			UserId:      cid,
+			DisplayName: (*userList)[cid].DisplayName,
+			Contact:     ab.Contacts[cid],
+			Mutual:      mutual[cid],
+		})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func containsLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderContact renders the contact contactId of userId.
+func renderContact(w http.ResponseWriter, r *http.Request, userId, contactId uint) {
+	ab, mutual, err := dbGetAddressBook(r.Context(), userId)
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+	c, ok := ab.Contacts[contactId]
+	if !ok {
+		render.Render(w, r, ErrNotFound(ContactNotFound))
+		return
+	}
+	u, err := dbGetUser(r.Context(), contactId)
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, &ContactResponse{UserId: contactId, DisplayName: u.DisplayName, Contact: c, Mutual: mutual[contactId]})
+}
+
+// setContact adds a user to the contacts of another one, or changes the
+// nickname, labels or favorite flag of an existing contact.
+func setContact(w http.ResponseWriter, r *http.Request) {
+	request := SetContactRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	id, contactId, err := parseUserAndIdParam(r, "contactId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	created, err := dbSetContact(r.Context(), id, contactId, contactUpdate{
+		Nickname: request.Nickname,
+		Labels:   request.Labels,
+		Favorite: request.Favorite,
+	})
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	if created {
+		render.Status(r, http.StatusCreated)
+	}
+	renderContact(w, r, id, contactId)
+}
+
+func deleteContact(w http.ResponseWriter, r *http.Request) {
+	id, contactId, err := parseUserAndIdParam(r, "contactId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := dbRemoveContact(r.Context(), id, contactId); err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listContactRequests lists the pending requests sent to and by a user,
+// only one of them with ?direction=incoming or outgoing.
+func listContactRequests(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	direction := r.URL.Query().Get("direction")
+	if direction != "" && direction != "incoming" && direction != "outgoing" {
+		render.Render(w, r, ErrInvalidRequest(errors.New("invalid direction, expected incoming or outgoing")))
+		return
+	}
+
+	incoming, outgoing, err := dbGetContactRequests(r.Context(), id)
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	list := []render.Renderer{}
+	if direction != "outgoing" {
+		for _, req := range incoming {
+			list = append(list, &ContactRequestResponse{ContactRequest: req})
+		}
+	}
+	if direction != "incoming" {
+		for _, req := range outgoing {
+			list = append(list, &ContactRequestResponse{ContactRequest: req})
+		}
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// requestContact sends a request to become mutual contacts from the user
+// in the path to the one in the body.
+func requestContact(w http.ResponseWriter, r *http.Request) {
+	request := SendContactRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	req, accepted, err := dbRequestContact(r.Context(), id, request.UserId)
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	if !accepted {
+		render.Status(r, http.StatusCreated)
+	}
+	render.Render(w, r, &ContactRequestResponse{ContactRequest: req, Accepted: accepted})
+}
+
+func acceptContactRequest(w http.ResponseWriter, r *http.Request) {
+	id, fromId, err := parseUserAndIdParam(r, "fromId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := dbAnswerContactRequest(r.Context(), id, fromId, true); err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	renderContact(w, r, id, fromId)
+}
+
+func declineContactRequest(w http.ResponseWriter, r *http.Request) {
+	id, fromId, err := parseUserAndIdParam(r, "fromId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := dbAnswerContactRequest(r.Context(), id, fromId, false); err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	ab, _, err := dbGetAddressBook(r.Context(), id)
+	if err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	if err := render.RenderList(w, r, NewUserListResponse(r.Context(), ab.Blocked)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func blockUser(w http.ResponseWriter, r *http.Request) {
+	changeBlockedUser(w, r, dbBlockUser)
+}
+
+func unblockUser(w http.ResponseWriter, r *http.Request) {
+	changeBlockedUser(w, r, dbUnblockUser)
+}
+
+func changeBlockedUser(w http.ResponseWriter, r *http.Request, change func(ctx context.Context, userId, blockedId uint) error) {
+	id, blockedId, err := parseUserAndIdParam(r, "blockedId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := change(r.Context(), id, blockedId); err != nil {
+		renderContactError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireOwner only lets callers reach the address book of the user they
+// are linked to, see linkedUserId. Administrators reach every address book.
+func requireOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize(r.Context(), RoleAdmin) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := parseUserId(r)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		linked, err := linkedUserId(r.Context())
+		if err == nil && linked != id {
+			err = fmt.Errorf("%w: only the owner of an address book may use it", Forbidden)
+		}
+		if err != nil {
+			renderLinkedUserError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setContactRoutes serves the address book of the user in the {id} of the
+// path to that user and to administrators.
+func setContactRoutes(r chi.Router) {
+	reader, editor := requireRole(RoleReader), requireRole(RoleEditor)
+	r.Use(requireOwner)
+
+	r.With(reader).Get("/contacts", listContacts)
+	r.With(editor).Put("/contacts/{contactId}", setContact)
+	r.With(editor).Delete("/contacts/{contactId}", deleteContact)
+
+	r.With(reader).Get("/contact-requests", listContactRequests)
+	r.With(editor).Post("/contact-requests", requestContact)
+	r.With(editor).Post("/contact-requests/{fromId}:accept", acceptContactRequest)
+	r.With(editor).Post("/contact-requests/{fromId}:decline", declineContactRequest)
+
+	r.With(reader).Get("/blocked", listBlockedUsers)
+	r.With(editor).Put("/blocked/{blockedId}", blockUser)
+	r.With(editor).Delete("/blocked/{blockedId}", unblockUser)
+}
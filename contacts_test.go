@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContacts(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 4,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+			3: {DisplayName: "Carol", Email: "carol@email.com", Status: StatusActive},
+			4: {DisplayName: "Mallory", Email: "mallory@email.com", Status: StatusActive},
+		},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, ts, req)
+	}
+	must := func(status int, method, path, body string) []byte {
+		resp, respBody := request(method, path, body)
+		require.Equal(t, status, resp.StatusCode, "%s %s: %s", method, path, respBody)
+		return respBody
+	}
+	contacts := func(path string) []ContactResponse {
+		list := []ContactResponse{}
+		require.NoError(t, json.Unmarshal(must(http.StatusOK, "GET", path, ""), &list))
+		return list
+	}
+	requests := func(path string) []ContactRequest {
+		list := []ContactRequest{}
+		require.NoError(t, json.Unmarshal(must(http.StatusOK, "GET", path, ""), &list))
+		return list
+	}
+
+	t.Run("invalid requests", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			method string
+			path   string
+			body   string
+			status int
+		}{
+			{"yourself", "PUT", "/users/1/contacts/1", `{}`, 400},
+			{"empty label", "PUT", "/users/1/contacts/2", `{"labels":[" "]}`, 400},
+			{"too many labels", "PUT", "/users/1/contacts/2", `{"labels":["` + strings.Repeat(`x","`, maxContactLabels) + `x"]}`, 400},
+			{"long nickname", "PUT", "/users/1/contacts/2", `{"nickname":"` + strings.Repeat("x", maxNicknameLength+1) + `"}`, 400},
+			{"unknown contact", "PUT", "/users/1/contacts/42", `{}`, 404},
+			{"unknown user", "GET", "/users/42/contacts", ``, 404},
+			{"not a contact", "DELETE", "/users/1/contacts/3", ``, 404},
+			{"request without user", "POST", "/users/1/contact-requests", `{}`, 400},
+			{"request to yourself", "POST", "/users/1/contact-requests", `{"user_id":1}`, 400},
+			{"no pending request", "POST", "/users/1/contact-requests/2:accept", ``, 404},
+			{"invalid direction", "GET", "/users/1/contact-requests?direction=sideways", ``, 400},
+			{"not blocked", "DELETE", "/users/1/blocked/2", ``, 404},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, body := request(tc.method, tc.path, tc.body)
+				assert.Equal(t, tc.status, resp.StatusCode, string(body))
+			})
+		}
+	})
+
+	t.Run("nicknames and labels", func(t *testing.T) {
+		must(http.StatusCreated, "PUT", "/users/1/contacts/2", `{"nickname":" Bobby ","labels":["work","family","work"]}`)
+		must(http.StatusCreated, "PUT", "/users/1/contacts/3", `{"labels":["work"]}`)
+		body := must(http.StatusOK, "PUT", "/users/1/contacts/3", `{"favorite":true}`)
+		c := ContactResponse{}
+		require.NoError(t, json.Unmarshal(body, &c))
+		assert.Equal(t, []string{"work"}, c.Labels)
+		assert.True(t, c.Favorite)
+		assert.False(t, c.Mutual)
+
+		list := contacts("/users/1/contacts")
+		require.Len(t, list, 2)
+		assert.Equal(t, uint(2), list[0].UserId)
+		assert.Equal(t, "Bob", list[0].DisplayName)
+		assert.Equal(t, "Bobby", list[0].Nickname)
+		assert.Equal(t, []string{"family", "work"}, list[0].Labels)
+
+		assert.Len(t, contacts("/users/1/contacts?label=work"), 2)
+		assert.Len(t, contacts("/users/1/contacts?label=Family"), 1)
+		assert.Len(t, contacts("/users/1/contacts?favorite=true"), 1)
+		assert.Empty(t, contacts("/users/2/contacts"))
+
+		must(http.StatusNoContent, "DELETE", "/users/1/contacts/3", "")
+		assert.Len(t, contacts("/users/1/contacts"), 1)
+	})
+
+	t.Run("mutual contacts", func(t *testing.T) {
+		body := must(http.StatusCreated, "POST", "/users/1/contact-requests", `{"user_id":2}`)
+		req := ContactRequestResponse{}
+		require.NoError(t, json.Unmarshal(body, &req))
+		assert.Equal(t, ContactRequest{From: 1, To: 2, CreatedAt: req.CreatedAt}, req.ContactRequest)
+		assert.False(t, req.Accepted)
+		// asking again keeps the request
+		must(http.StatusCreated, "POST", "/users/1/contact-requests", `{"user_id":2}`)
+
+		assert.Len(t, requests("/users/2/contact-requests?direction=incoming"), 1)
+		assert.Empty(t, requests("/users/2/contact-requests?direction=outgoing"))
+		assert.Len(t, requests("/users/1/contact-requests"), 1)
+
+		body = must(http.StatusOK, "POST", "/users/2/contact-requests/1:accept", "")
+		c := ContactResponse{}
+		require.NoError(t, json.Unmarshal(body, &c))
+		assert.Equal(t, uint(1), c.UserId)
+		assert.True(t, c.Mutual)
+		assert.Empty(t, requests("/users/2/contact-requests"))
+
+		// the nickname Alice gave Bob is kept
+		list := contacts("/users/1/contacts")
+		require.Len(t, list, 1)
+		assert.Equal(t, "Bobby", list[0].Nickname)
+		assert.True(t, list[0].Mutual)
+
+		resp, _ := request("POST", "/users/2/contact-requests", `{"user_id":1}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		// requests crossing each other are accepted
+		must(http.StatusCreated, "POST", "/users/3/contact-requests", `{"user_id":1}`)
+		body = must(http.StatusOK, "POST", "/users/1/contact-requests", `{"user_id":3}`)
+		require.NoError(t, json.Unmarshal(body, &req))
+		assert.True(t, req.Accepted)
+		assert.True(t, contacts("/users/3/contacts")[0].Mutual)
+
+		must(http.StatusCreated, "POST", "/users/4/contact-requests", `{"user_id":2}`)
+		must(http.StatusNoContent, "POST", "/users/2/contact-requests/4:decline", "")
+		assert.Empty(t, requests("/users/4/contact-requests"))
+		assert.Empty(t, contacts("/users/4/contacts"))
+	})
+
+	t.Run("blocking", func(t *testing.T) {
+		must(http.StatusCreated, "PUT", "/users/4/contacts/2", `{}`)
+		must(http.StatusCreated, "POST", "/users/4/contact-requests", `{"user_id":2}`)
+
+		must(http.StatusNoContent, "PUT", "/users/2/blocked/4", "")
+		users := []UserResponse{}
+		require.NoError(t, json.Unmarshal(must(http.StatusOK, "GET", "/users/2/blocked", ""), &users))
+		require.Len(t, users, 1)
+		assert.Equal(t, uint(4), users[0].Id)
+		assert.Empty(t, requests("/users/2/contact-requests"))
+		assert.Empty(t, contacts("/users/4/contacts"))
+
+		for _, path := range []string{"/users/4/contacts/2", "/users/2/contacts/4"} {
+			resp, _ := request("PUT", path, `{}`)
+			assert.Equal(t, http.StatusConflict, resp.StatusCode, path)
+		}
+		resp, _ := request("POST", "/users/4/contact-requests", `{"user_id":2}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		must(http.StatusNoContent, "DELETE", "/users/2/blocked/4", "")
+		must(http.StatusCreated, "POST", "/users/4/contact-requests", `{"user_id":2}`)
+	})
+
+	t.Run("deleting users", func(t *testing.T) {
+		must(http.StatusNoContent, "PUT", "/users/3/blocked/4", "")
+		must(http.StatusOK, "DELETE", "/users/4", "")
+		assert.Empty(t, requests("/users/2/contact-requests"))
+		assert.Equal(t, "[]\n", string(must(http.StatusOK, "GET", "/users/3/blocked", "")))
+
+		must(http.StatusOK, "DELETE", "/users/1", "")
+		assert.Empty(t, contacts("/users/2/contacts"))
+		assert.Empty(t, contacts("/users/3/contacts"))
+
+		us, err := getUserStore()
+		require.NoError(t, err)
+		assert.Empty(t, us.AddressBooks)
+	})
+}
+
+func TestContactsOwnership(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+		},
+	})
+	config.AuthRequired = true
+	keys := newAPIKeyStore(config.APIKeysPath)
+	issue := func(role Role, userId uint) string {
+		_, token, err := keys.issue(APIKey{Name: "contacts", Role: role, UserID: userId})
+		require.NoError(t, err)
+		return token
+	}
+	alice, bob, unlinked, admin := issue(RoleEditor, 1), issue(RoleEditor, 2), issue(RoleEditor, 0), issue(RoleAdmin, 0)
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"anonymous", "GET", "/users/1/contacts", "", http.StatusUnauthorized},
+		{"owner lists", "GET", "/users/1/contacts", alice, http.StatusOK},
+		{"owner adds", "PUT", "/users/1/contacts/2", alice, http.StatusCreated},
+		{"other user lists", "GET", "/users/1/contacts", bob, http.StatusForbidden},
+		{"other user adds", "PUT", "/users/1/contacts/2", bob, http.StatusForbidden},
+		{"other user blocks", "PUT", "/users/1/blocked/2", bob, http.StatusForbidden},
+		{"other user accepts", "POST", "/users/1/contact-requests/2:accept", bob, http.StatusForbidden},
+		{"unlinked key", "GET", "/users/1/contacts", unlinked, http.StatusForbidden},
+		{"admin", "GET", "/users/1/contacts", admin, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL+"/api/v1"+tc.path, strings.NewReader(`{}`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if tc.token != "" {
+				req.Header.Set(apiKeyHeader, tc.token)
+			}
+			resp, body := testRequest(t, ts, req)
+			assert.Equal(t, tc.status, resp.StatusCode, string(body))
+		})
+	}
+}
@@ -1,63 +1,192 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const store = `users.json`
+// storeMu serializes access to the store file, every read-modify-write
+// cycle must hold it.
+var storeMu sync.Mutex
 
 type (
 	User struct {
-		CreatedAt   time.Time `json:"created_at"`
-		DisplayName string    `json:"display_name"`
-		Email       string    `json:"email"`
+		CreatedAt   time.Time  `json:"created_at"`
+		UpdatedAt   time.Time  `json:"updated_at"`
+		DisplayName string     `json:"display_name"`
+		Email       string     `json:"email"`
+		Status      UserStatus `json:"status"`
 	}
 	UserList  map[uint]User
 	UserStore struct {
-		Increment uint     `json:"increment"`
-		List      UserList `json:"list"`
+		SchemaVersion       int            `json:"schema_version"`
+		Increment           uint           `json:"increment"`
+		List                UserList       `json:"list"`
+		GroupIncrement      uint           `json:"group_increment,omitempty"`
+		Groups              GroupList      `json:"groups,omitempty"`
+		ConferenceIncrement uint           `json:"conference_increment,omitempty"`
+		Conferences         ConferenceList `json:"conferences,omitempty"`
+		// AddressBooks maps user ids to their contacts, only users that
+		// have any are in it.
+		AddressBooks map[uint]AddressBook `json:"address_books,omitempty"`
+		// ExternalIds maps user ids to the id a SCIM client knows them by.
+		ExternalIds map[uint]string `json:"external_ids,omitempty"`
+		// SourceDNs maps users imported from LDIF to the DN of their entry.
+		SourceDNs map[uint]string `json:"source_dns,omitempty"`
 	}
 )
 
+// storeFile is the on-disk layout of UserStore. Checksum covers the rest of
+// the document and is verified on every read.
+type storeFile struct {
+	UserStore
+	List     map[uint]storedUser `json:"list"`
+	Checksum string              `json:"checksum,omitempty"`
+}
+
+// storedUser is the on-disk layout of User. With field encryption enabled
+// Email holds the ciphertext and EmailIndex its blind index.
+type storedUser struct {
+	User
+	EmailIndex string `json:"email_index,omitempty"`
+}
+
 func getUserStore() (us UserStore, err error) {
+	return loadUserStore(context.Background())
+}
+
+func overwriteUserStore(us UserStore) (err error) {
+	return saveUserStore(context.Background(), us)
+}
 
-	f, err := ioutil.ReadFile(store)
+// loadUserStore loads the users of the tenant of ctx, see storeFrom.
+func loadUserStore(ctx context.Context) (us UserStore, err error) {
+	us, err = storeFrom(ctx).Load()
 	if err != nil {
+		log.Error(err)
 		return
 	}
 
-	err = json.Unmarshal(f, &us)
+	return
+}
+
+func saveUserStore(ctx context.Context, us UserStore) (err error) {
+	return storeFrom(ctx).Save(us)
+}
+
+func decodeUserStore(dat []byte) (us UserStore, err error) {
+	sf, err := decodeStoreFile(dat)
 	if err != nil {
-		log.Error(err)
 		return
 	}
 
+	us = sf.UserStore
+	if sf.List != nil {
+		us.List = make(UserList, len(sf.List))
+	}
+	for id, su := range sf.List {
+		if us.List[id], err = decodeStoredUser(su); err != nil {
+			return us, fmt.Errorf("user %d: %w", id, err)
+		}
+	}
+
 	return
 }
 
-func overwriteUserStore(us UserStore) (err error) {
-	f, err := os.OpenFile(store, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+// decodeStoreFile verifies the document without decrypting its fields.
+func decodeStoreFile(dat []byte) (sf storeFile, err error) {
+	dat, err = openStoreData(dat)
 	if err != nil {
 		return
 	}
-	defer f.Close()
 
-	dat, err := json.Marshal(us)
+	if err = json.Unmarshal(dat, &sf); err != nil {
+		return sf, fmt.Errorf("%w: %v", StoreCorrupted, err)
+	}
+
+	if sf.SchemaVersion > currentSchemaVersion {
+		return sf, StoreVersionTooNew
+	}
+
+	// files written before checksums were introduced have none
+	if sf.Checksum != "" && sf.Checksum != storeChecksum(sf) {
+		return sf, fmt.Errorf("%w: checksum mismatch", StoreCorrupted)
+	}
+
+	return
+}
+
+func encodeUserStore(us UserStore) (dat []byte, err error) {
+	us.SchemaVersion = currentSchemaVersion
+	sf := storeFile{UserStore: us}
+	if us.List != nil {
+		sf.List = make(map[uint]storedUser, len(us.List))
+	}
+	for id, u := range us.List {
+		if sf.List[id], err = encodeStoredUser(u); err != nil {
+			return
+		}
+	}
+	sf.Checksum = storeChecksum(sf)
+
+	dat, err = json.Marshal(sf)
+	if err != nil {
+		return nil, err
+	}
+	return sealStoreData(dat)
+}
+
+func storeChecksum(sf storeFile) string {
+	sf.Checksum = ""
+	dat, err := json.Marshal(sf)
+	if err != nil {
+		return ""
+	}
+	return checksum(dat)
+}
+
+// writeFileAtomic replaces path with dat so that readers never observe a
+// partially written file. The file gets the permissions perm.
+func writeFileAtomic(path string, dat []byte, perm os.FileMode) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
 		return
 	}
-	_, err = f.Write(dat)
-	log.Debugf("UserStore data: %v", string(dat))
-	return
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(dat); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), path)
 }
 
-func dbGetUser(id uint) (user *User, err error) {
-	s, err := getUserStore()
+func dbGetUser(ctx context.Context, id uint) (user *User, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	s, err := loadUserStore(ctx)
 	if err != nil {
 		return
 	}
@@ -70,8 +199,11 @@ func dbGetUser(id uint) (user *User, err error) {
 	return nil, UserNotFound
 }
 
-func dbGetUserList() (userList *UserList, err error) {
-	s, err := getUserStore()
+func dbGetUserList(ctx context.Context) (userList *UserList, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	s, err := loadUserStore(ctx)
 	if err != nil {
 		return
 	}
@@ -79,24 +211,38 @@ func dbGetUserList() (userList *UserList, err error) {
 	return &s.List, nil
 }
 
-func dbCreateUser(displayName, email string) (id uint, err error) {
+// dbCreateUser adds a user. Emails are unique, compared case-insensitively,
+// and creating a user with the email of another one fails with EmailTaken.
+func dbCreateUser(ctx context.Context, displayName, email string, status UserStatus) (id uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
 
-	s, err := getUserStore()
+	s, err := loadUserStore(ctx)
 	if err != nil {
 		return
 	}
 
+	if err = checkEmail(email); err != nil {
+		return
+	}
+	if emailTaken(s, email, 0) {
+		return 0, EmailTaken
+	}
+
 	s.Increment++
+	now := time.Now()
 	u := User{
-		CreatedAt:   time.Now(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
 		DisplayName: displayName,
 		Email:       email,
+		Status:      status,
 	}
 
 	id = s.Increment
 	s.List[id] = u
 
-	err = overwriteUserStore(s)
+	err = saveUserStore(ctx, s)
 	if err != nil {
 		return
 	}
@@ -104,8 +250,13 @@ func dbCreateUser(displayName, email string) (id uint, err error) {
 	return
 }
 
-func dbUpdateUser(id uint, displayName *string, email *string) (err error) {
-	us, err := getUserStore()
+// dbUpdateUser changes the fields that are set, an email another user has
+// fails with EmailTaken.
+func dbUpdateUser(ctx context.Context, id uint, displayName *string, email *string) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
 	if err != nil {
 		return
 	}
@@ -120,18 +271,28 @@ func dbUpdateUser(id uint, displayName *string, email *string) (err error) {
 		u.DisplayName = *displayName
 	}
 	if email != nil {
+		if err = checkEmail(*email); err != nil {
+			return
+		}
+		if emailTaken(us, *email, id) {
+			return EmailTaken
+		}
 		u.Email = *email
 	}
+	u.UpdatedAt = time.Now()
 
 	us.List[id] = u
 
-	err = overwriteUserStore(us)
+	err = saveUserStore(ctx, us)
 
 	return
 }
 
-func dbDeleteUser(id uint) (err error) {
-	us, err := getUserStore()
+func dbDeleteUser(ctx context.Context, id uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
 	if err != nil {
 		return
 	}
@@ -140,9 +301,79 @@ func dbDeleteUser(id uint) (err error) {
 		return UserNotFound
 	}
 
+	removeUser(&us, id)
+
+	err = saveUserStore(ctx, us)
+
+	return
+}
+
+// removeUser deletes the user id and everything referring to it.
+func removeUser(us *UserStore, id uint) {
 	delete(us.List, id)
+	removeUserFromGroups(us, id)
+	removeUserFromConferences(us, id)
+	removeUserFromAddressBooks(us, id)
+	delete(us.ExternalIds, id)
+	delete(us.SourceDNs, id)
+}
+
+func dbSetUserStatus(ctx context.Context, id uint, status UserStatus) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	u, ok := us.List[id]
+	if !ok {
+		return UserNotFound
+	}
 
-	err = overwriteUserStore(us)
+	if err = checkStatusTransition(u.Status, status); err != nil {
+		return
+	}
+
+	u.Status = status
+	u.UpdatedAt = time.Now()
+	us.List[id] = u
+
+	err = saveUserStore(ctx, us)
 
 	return
 }
+
+// dbFindUserByEmail looks the user up by the stored blind index, so no email
+// has to be decrypted.
+func dbFindUserByEmail(ctx context.Context, email string) (id uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	return storeFrom(ctx).FindUserByEmail(email)
+}
+
+// checkEmail rejects emails with control characters, they would break the
+// lines of the formats emails are written to, like iCalendar and vCard.
+func checkEmail(email string) error {
+	if strings.IndexFunc(email, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: %q contains control characters", InvalidEmail, email)
+	}
+	return nil
+}
+
+// emailTaken reports whether a user other than exceptId has the given email.
+func emailTaken(us UserStore, email string, exceptId uint) bool {
+	if email == "" {
+		return false
+	}
+
+	want := emailLookupKey(email)
+	for id, u := range us.List {
+		if id != exceptId && u.Email != "" && emailLookupKey(u.Email) == want {
+			return true
+		}
+	}
+	return false
+}
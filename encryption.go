@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const storeEncryption = "AES-GCM"
+
+type storeKey struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+// storeKeys is the keyring used for the store file. The first key encrypts
+// new writes, the rest are only used to read files written before a key
+// rotation. An empty keyring leaves the store in plain JSON.
+var storeKeys []storeKey
+
+// encryptedStoreFile is the on-disk layout of an encrypted store. The
+// decrypted ciphertext is the same JSON document an unencrypted store holds.
+type encryptedStoreFile struct {
+	Encryption string `json:"encryption"`
+	KeyID      string `json:"key_id"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// loadStoreKeys fills storeKeys from config.StoreKey or, if unset, from the
+// file at config.StoreKeyFile. Keys are base64 encoded AES keys separated by
+// commas or newlines, the current key first.
+func loadStoreKeys() (err error) {
+	keys := config.StoreKey
+	if keys == "" && config.StoreKeyFile != "" {
+		dat, err := ioutil.ReadFile(config.StoreKeyFile)
+		if err != nil {
+			return err
+		}
+		keys = string(dat)
+	}
+
+	storeKeys, err = parseStoreKeys(keys)
+	return
+}
+
+func parseStoreKeys(s string) (keys []storeKey, err error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	})
+
+	for i, f := range fields {
+		raw, err := base64.StdEncoding.DecodeString(f)
+		if err != nil {
+			return nil, fmt.Errorf("store key #%d: %w", i+1, err)
+		}
+		key, err := newStoreKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("store key #%d: %w", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func newStoreKey(raw []byte) (key storeKey, err error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return
+	}
+	key.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(raw)
+	key.ID = hex.EncodeToString(sum[:4])
+	return
+}
+
+// openStoreData returns the plain JSON document held in dat, decrypting it
+// if it was written encrypted.
+func openStoreData(dat []byte) ([]byte, error) {
+	ef, ok := parseEncryptedStoreFile(dat)
+	if !ok {
+		return dat, nil
+	}
+
+	if ef.Encryption != storeEncryption {
+		return nil, fmt.Errorf("%w: unsupported encryption %q", StoreKeyMismatch, ef.Encryption)
+	}
+	if len(storeKeys) == 0 {
+		return nil, fmt.Errorf("%w: store is encrypted with key %s but no key is configured", StoreKeyMismatch, ef.KeyID)
+	}
+
+	for _, key := range storeKeys {
+		if key.ID != ef.KeyID {
+			continue
+		}
+		plain, err := key.aead.Open(nil, ef.Nonce, ef.Ciphertext, []byte(ef.KeyID))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", StoreCorrupted, err)
+		}
+		return plain, nil
+	}
+
+	return nil, fmt.Errorf("%w: store is encrypted with key %s which is not configured", StoreKeyMismatch, ef.KeyID)
+}
+
+// sealStoreData encrypts plain with the current key, or returns it as is
+// when encryption is not configured.
+func sealStoreData(plain []byte) ([]byte, error) {
+	if len(storeKeys) == 0 {
+		return plain, nil
+	}
+
+	key := storeKeys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encryptedStoreFile{
+		Encryption: storeEncryption,
+		KeyID:      key.ID,
+		Nonce:      nonce,
+		Ciphertext: key.aead.Seal(nil, nonce, plain, []byte(key.ID)),
+	})
+}
+
+func parseEncryptedStoreFile(dat []byte) (ef encryptedStoreFile, ok bool) {
+	if !bytes.Contains(dat, []byte(`"ciphertext"`)) {
+		return ef, false
+	}
+	if err := json.Unmarshal(dat, &ef); err != nil {
+		return ef, false
+	}
+	return ef, ef.Ciphertext != nil
+}
+
+// rotateStoreKey rewrites the store of the tenant of ctx under the current
+// key when it is stored in plain JSON or encrypted with a previous key.
+func rotateStoreKey(ctx context.Context) (err error) {
+	if len(storeKeys) == 0 {
+		return nil
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	path := storePathFrom(ctx)
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	ef, encrypted := parseEncryptedStoreFile(dat)
+	if encrypted && ef.KeyID == storeKeys[0].ID {
+		return nil
+	}
+
+	plain, err := openStoreData(dat)
+	if err != nil {
+		return
+	}
+	dat, err = sealStoreData(plain)
+	if err != nil {
+		return
+	}
+	if err = writeFileAtomic(path, dat, 0644); err != nil {
+		return
+	}
+
+	log.Infof("Store %s re-encrypted with key %s", path, storeKeys[0].ID)
+	return
+}
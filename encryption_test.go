@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateStoreKey(t *testing.T) string {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func useStoreKeys(t *testing.T, keys string) {
+	saved := storeKeys
+	t.Cleanup(func() { storeKeys = saved })
+
+	var err error
+	storeKeys, err = parseStoreKeys(keys)
+	require.NoError(t, err)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	alice := User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}
+	useStoreKeys(t, generateStoreKey(t))
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: alice}})
+
+	dat, err := ioutil.ReadFile(config.StorePath)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(dat, []byte("alice@email.com")))
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, UserList{1: alice}, us.List)
+
+	plain, err := openStoreData(dat)
+	require.NoError(t, err)
+	doc := storeDocument{}
+	require.NoError(t, json.Unmarshal(plain, &doc))
+	assert.Contains(t, doc, "list")
+	assert.Contains(t, doc, "checksum")
+}
+
+func TestEncryptedStoreWrongKey(t *testing.T) {
+	useStoreKeys(t, generateStoreKey(t))
+	useTempStore(t, UserStore{List: UserList{}})
+
+	useStoreKeys(t, generateStoreKey(t))
+	_, err := getUserStore()
+	assert.ErrorIs(t, err, StoreKeyMismatch)
+	assert.ErrorIs(t, recoverUserStore(context.Background()), StoreKeyMismatch)
+
+	useStoreKeys(t, "")
+	_, err = getUserStore()
+	assert.ErrorIs(t, err, StoreKeyMismatch)
+}
+
+func TestRotateStoreKey(t *testing.T) {
+	alice := User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}
+	oldKey, newKey := generateStoreKey(t), generateStoreKey(t)
+
+	// a plain store gets encrypted
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: alice}})
+	useStoreKeys(t, oldKey)
+	require.NoError(t, rotateStoreKey(context.Background()))
+	dat, err := ioutil.ReadFile(config.StorePath)
+	require.NoError(t, err)
+	ef, ok := parseEncryptedStoreFile(dat)
+	require.True(t, ok)
+	assert.Equal(t, storeKeys[0].ID, ef.KeyID)
+
+	// the old key is still accepted for reading until the store is rewritten
+	useStoreKeys(t, newKey+","+oldKey)
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, UserList{1: alice}, us.List)
+
+	require.NoError(t, rotateStoreKey(context.Background()))
+
+	useStoreKeys(t, newKey)
+	us, err = getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, UserList{1: alice}, us.List)
+}
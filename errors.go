@@ -8,7 +8,51 @@ import (
 )
 
 var (
-	UserNotFound = errors.New("User not found")
+	UserNotFound            = errors.New("User not found")
+	EmailTaken              = errors.New("Email is already in use")
+	InvalidEmail            = errors.New("Invalid email")
+	InvalidStatus           = errors.New("Invalid user status")
+	InvalidStatusTransition = errors.New("Invalid status transition")
+	StoreVersionTooNew      = errors.New("Store schema version is newer than supported")
+	StoreCorrupted          = errors.New("Store is corrupted")
+	StoreKeyMismatch        = errors.New("Store encryption key mismatch")
+	StoreNotEmpty           = errors.New("Store is not empty")
+	BackupNotFound          = errors.New("Backup not found")
+	BackupCorrupted         = errors.New("Backup is corrupted")
+	NotAcceptable           = errors.New("None of the accepted media types can be produced")
+	UnsupportedMediaType    = errors.New("Unsupported media type")
+	InvalidIdempotencyKey   = errors.New("Invalid idempotency key")
+	IdempotencyKeyInUse     = errors.New("A request with this idempotency key is in progress")
+	IdempotencyKeyReused    = errors.New("Idempotency key was used for a different request")
+	RateLimited             = errors.New("Rate limit exceeded")
+	Unauthenticated         = errors.New("Authentication required")
+	InvalidAPIKey           = errors.New("Invalid API key")
+	InvalidToken            = errors.New("Invalid bearer token")
+	Forbidden               = errors.New("Permission denied")
+	InvalidRole             = errors.New("Invalid role")
+	APIKeyNotFound          = errors.New("API key not found")
+	NoLinkedUser            = errors.New("No user is linked to the caller")
+	InvalidTenant           = errors.New("Invalid tenant name")
+	TenantNotFound          = errors.New("Tenant not found")
+	TenantExists            = errors.New("Tenant already exists")
+	GroupNotFound           = errors.New("Group not found")
+	GroupNameTaken          = errors.New("Group name is already in use")
+	GroupCycle              = errors.New("Groups can't contain themselves")
+	MemberNotFound          = errors.New("Not a member of the group")
+	ConferenceNotFound      = errors.New("Conference not found")
+	InvalidConference       = errors.New("Invalid conference")
+	InvalidRecurrence       = errors.New("Invalid recurrence rule")
+	ConferenceConflict      = errors.New("Participants are double-booked")
+	ContactNotFound         = errors.New("Contact not found")
+	InvalidContact          = errors.New("Invalid contact")
+	ContactBlocked          = errors.New("Contact is blocked")
+	AlreadyContacts         = errors.New("Users are already mutual contacts")
+	ContactRequestNotFound  = errors.New("Contact request not found")
+	NotBlocked              = errors.New("User is not blocked")
+	InvalidFilter           = errors.New("Invalid filter")
+	InvalidSCIMValue        = errors.New("Invalid SCIM attribute value")
+	InvalidPatch            = errors.New("Invalid patch operation")
+	InvalidLDIFMapping      = errors.New("Invalid LDIF attribute mapping")
 )
 
 type ErrResponse struct {
@@ -25,6 +69,27 @@ func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// errorRenderer answers a request with err. The middlewares the REST and
+// the SCIM API share take one, so each API answers in its own format.
+type errorRenderer func(w http.ResponseWriter, r *http.Request, err error)
+
+// renderAPIError renders the errors of the middlewares in front of the REST
+// API.
+func renderAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, Unauthenticated), errors.Is(err, InvalidAPIKey), errors.Is(err, InvalidToken):
+		render.Render(w, r, ErrUnauthorized(err))
+	case errors.Is(err, Forbidden):
+		render.Render(w, r, ErrForbidden(err))
+	case errors.Is(err, RateLimited):
+		render.Render(w, r, ErrTooManyRequests(err))
+	case errors.Is(err, InvalidTenant), errors.Is(err, TenantNotFound):
+		render.Render(w, r, ErrNotFound(TenantNotFound))
+	default:
+		render.Render(w, r, ErrInternal(err))
+	}
+}
+
 func ErrInvalidRequest(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
@@ -34,6 +99,24 @@ func ErrInvalidRequest(err error) render.Renderer {
 	}
 }
 
+func ErrUnauthorized(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 401,
+		StatusText:     "Unauthorized",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrForbidden(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden",
+		ErrorText:      err.Error(),
+	}
+}
+
 func ErrNotFound(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
@@ -43,6 +126,60 @@ func ErrNotFound(err error) render.Renderer {
 	}
 }
 
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Conflict",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrNotAcceptable(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 406,
+		StatusText:     "Not acceptable",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrUnsupportedMediaType(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 415,
+		StatusText:     "Unsupported media type",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrUnprocessable(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 422,
+		StatusText:     "Unprocessable entity",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrTooLarge(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 413,
+		StatusText:     "Request entity too large",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrTooManyRequests(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 429,
+		StatusText:     "Too many requests",
+		ErrorText:      err.Error(),
+	}
+}
+
 func ErrRender(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const encryptedFieldPrefix = "enc:v1:"
+
+// fieldKeys encrypts individual fields of stored records. Both keys are
+// derived from a single master key; a nil aead disables field encryption.
+var fieldKeys struct {
+	aead  cipher.AEAD
+	index []byte
+}
+
+// loadFieldKey reads the base64 encoded master key from config.FieldKey or,
+// if unset, from the file at config.FieldKeyFile.
+func loadFieldKey() (err error) {
+	key := config.FieldKey
+	if key == "" && config.FieldKeyFile != "" {
+		dat, err := ioutil.ReadFile(config.FieldKeyFile)
+		if err != nil {
+			return err
+		}
+		key = string(dat)
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		fieldKeys.aead, fieldKeys.index = nil, nil
+		return nil
+	}
+
+	master, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("field key: %w", err)
+	}
+	return setFieldKey(master)
+}
+
+func setFieldKey(master []byte) (err error) {
+	block, err := aes.NewCipher(deriveKey(master, "email-encryption"))
+	if err != nil {
+		return
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	fieldKeys.aead = aead
+	fieldKeys.index = deriveKey(master, "email-index")
+	return nil
+}
+
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailIndex returns the blind index of email, a keyed hash that allows
+// equality lookups without decrypting stored emails. It is empty when field
+// encryption is disabled.
+func emailIndex(email string) string {
+	if fieldKeys.aead == nil || email == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, fieldKeys.index)
+	mac.Write([]byte(normalizeEmail(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailLookupKey returns the value emails are compared by: the blind index
+// with field encryption enabled, the normalized email otherwise.
+func emailLookupKey(email string) string {
+	if idx := emailIndex(email); idx != "" {
+		return idx
+	}
+	return normalizeEmail(email)
+}
+
+func encryptEmail(email string) (string, error) {
+	if fieldKeys.aead == nil || email == "" {
+		return email, nil
+	}
+
+	nonce := make([]byte, fieldKeys.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := fieldKeys.aead.Seal(nonce, nonce, []byte(email), nil)
+	return encryptedFieldPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// encryptStoredEmails rewrites the store when field encryption is enabled
+// but some emails are still stored in plain text, as they are when they were
+// saved before the field key was configured.
+func encryptStoredEmails(store Store) (err error) {
+	if fieldKeys.aead == nil {
+		return nil
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	n, err := store.PlaintextEmails()
+	if err != nil || n == 0 {
+		return
+	}
+
+	us, err := store.Load()
+	if err != nil {
+		return
+	}
+	if err = store.Save(us); err != nil {
+		return
+	}
+
+	log.Infof("Encrypted %d emails stored in plain text", n)
+	return
+}
+
+// decryptEmail reverses encryptEmail. Emails stored before field encryption
+// was enabled are returned as is.
+func decryptEmail(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedFieldPrefix) {
+		return stored, nil
+	}
+	if fieldKeys.aead == nil {
+		return "", fmt.Errorf("%w: email is encrypted but no field key is configured", StoreKeyMismatch)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedFieldPrefix))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", StoreCorrupted, err)
+	}
+	size := fieldKeys.aead.NonceSize()
+	if len(sealed) < size {
+		return "", fmt.Errorf("%w: encrypted email is too short", StoreCorrupted)
+	}
+
+	email, err := fieldKeys.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot decrypt email, is the field key correct?", StoreKeyMismatch)
+	}
+	return string(email), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func useFieldKey(t *testing.T) {
+	saved := fieldKeys
+	t.Cleanup(func() { fieldKeys = saved })
+
+	master := make([]byte, 32)
+	_, err := rand.Read(master)
+	require.NoError(t, err)
+	require.NoError(t, setFieldKey(master))
+}
+
+func TestEmailFieldEncryption(t *testing.T) {
+	alice := User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}
+	useFieldKey(t)
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: alice}})
+
+	dat, err := ioutil.ReadFile(config.StorePath)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(dat, []byte("alice@email.com")))
+	assert.True(t, bytes.Contains(dat, []byte(emailIndex("alice@email.com"))))
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, UserList{1: alice}, us.List)
+
+	useFieldKey(t)
+	_, err = getUserStore()
+	assert.ErrorIs(t, err, StoreKeyMismatch)
+}
+
+func TestEmailLookupAndUniqueness(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "encrypted"}[encrypted], func(t *testing.T) {
+			if encrypted {
+				useFieldKey(t)
+			}
+			useTempStore(t, UserStore{
+				Increment: 2,
+				List: UserList{
+					1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+					2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+				},
+			})
+
+			router := chi.NewRouter()
+			setRoutes(router)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			resp, body := testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/users/?email=Bob@Email.com"))
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			got := []UserResponse{}
+			require.NoError(t, json.Unmarshal(body, &got))
+			require.Len(t, got, 1)
+			assert.Equal(t, uint(2), got[0].Id)
+			assert.Equal(t, "bob@email.com", got[0].Email)
+
+			resp, body = testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/users/?email=carol@email.com"))
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.JSONEq(t, `[]`, string(body))
+
+			req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/",
+				strings.NewReader(`{"display_name": "Alice2", "email": "ALICE@email.com"}`))
+			require.NoError(t, err)
+			req.Header.Add("Content-Type", "application/json")
+			resp, _ = testRequest(t, ts, req)
+			assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+			req, err = http.NewRequest("PATCH", ts.URL+"/api/v1/users/2/",
+				strings.NewReader(`{"email": "alice@email.com"}`))
+			require.NoError(t, err)
+			req.Header.Add("Content-Type", "application/json")
+			resp, _ = testRequest(t, ts, req)
+			assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		})
+	}
+}
+
+func TestEncryptStoredEmails(t *testing.T) {
+	alice := User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			store, err := openStore(backend, filepath.Join(t.TempDir(), "users."+backend))
+			require.NoError(t, err)
+			defer store.Close()
+			require.NoError(t, store.Save(UserStore{Increment: 1, List: UserList{1: alice}}))
+
+			require.NoError(t, encryptStoredEmails(store), "nothing to do without a field key")
+			n, err := store.PlaintextEmails()
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+
+			useFieldKey(t)
+			require.NoError(t, encryptStoredEmails(store))
+			n, err = store.PlaintextEmails()
+			require.NoError(t, err)
+			assert.Equal(t, 0, n)
+
+			us, err := store.Load()
+			require.NoError(t, err)
+			assert.Equal(t, UserList{1: alice}, us.List)
+			id, err := store.FindUserByEmail("Alice@email.com")
+			require.NoError(t, err)
+			assert.Equal(t, uint(1), id)
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+	log "github.com/sirupsen/logrus"
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	user(id: ID!): User
+	users(filter: UserFilter, first: Int, after: String): UserConnection!
+}
+
+type Mutation {
+	createUser(input: CreateUserInput!): User!
+	updateUser(id: ID!, input: UpdateUserInput!): User!
+	deleteUser(id: ID!): Boolean!
+}
+
+type User {
+	id: ID!
+	displayName: String!
+	email: String!
+	status: String!
+	createdAt: Time!
+	updatedAt: Time!
+}
+
+input UserFilter {
+	email: String
+	status: String
+}
+
+type UserConnection {
+	edges: [UserEdge!]!
+	pageInfo: PageInfo!
+}
+
+type UserEdge {
+	cursor: String!
+	node: User!
+}
+
+type PageInfo {
+	hasNextPage: Boolean!
+	endCursor: String
+}
+
+input CreateUserInput {
+	displayName: String!
+	email: String!
+	status: String
+}
+
+input UpdateUserInput {
+	displayName: String
+	email: String
+}
+`
+
+// newGraphQLHandler serves the GraphQL API. Resolvers work on the same store
+// as the REST handlers.
+func newGraphQLHandler() *relay.Handler {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{})
+	return &relay.Handler{Schema: schema}
+}
+
+type graphqlResolver struct{}
+
+func (*graphqlResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := dbGetUser(ctx, id)
+	if errors.Is(err, UserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	return &userResolver{id: id, u: *u}, nil
+}
+
+type userFilter struct {
+	Email  *string
+	Status *string
+}
+
+func (*graphqlResolver) Users(ctx context.Context, args struct {
+	Filter *userFilter
+	First  *int32
+	After  *string
+}) (*userConnectionResolver, error) {
+	p := page{}
+	if args.First != nil {
+		if *args.First < 1 || *args.First > maxPageLimit {
+			return nil, graphqlError(fmt.Errorf("%w: first must be between 1 and %d", errInvalidArgument, maxPageLimit))
+		}
+		p.limit = int(*args.First)
+	}
+	if args.After != nil {
+		after, err := decodeCursor(*args.After)
+		if err != nil {
+			return nil, graphqlError(err)
+		}
+		p.after = after
+	}
+
+	userList, err := dbGetUserList(ctx)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+
+	ids := sortedUserIds(userList)
+	if f := args.Filter; f != nil {
+		if f.Email != nil {
+			ids = nil
+			id, err := dbFindUserByEmail(ctx, *f.Email)
+			if err != nil && !errors.Is(err, UserNotFound) {
+				return nil, graphqlError(err)
+			}
+			if err == nil {
+				ids = []uint{id}
+			}
+		}
+		if f.Status != nil {
+			matching := []uint{}
+			for _, id := range ids {
+				if (*userList)[id].Status == UserStatus(*f.Status) {
+					matching = append(matching, id)
+				}
+			}
+			ids = matching
+		}
+	}
+
+	ids, more := p.apply(ids)
+	c := &userConnectionResolver{hasNextPage: more}
+	for _, id := range ids {
+		c.edges = append(c.edges, &userEdgeResolver{&userResolver{id: id, u: (*userList)[id]}})
+	}
+	return c, nil
+}
+
+type createUserInput struct {
+	DisplayName string
+	Email       string
+	Status      *string
+}
+
+func (*graphqlResolver) CreateUser(ctx context.Context, args struct{ Input createUserInput }) (*userResolver, error) {
+	if err := authorize(ctx, RoleEditor); err != nil {
+		return nil, graphqlError(err)
+	}
+
+	request := CreateUserRequest{DisplayName: args.Input.DisplayName, Email: args.Input.Email}
+	if args.Input.Status != nil {
+		request.Status = UserStatus(*args.Input.Status)
+	}
+	if err := request.Bind(nil); err != nil {
+		return nil, graphqlError(err)
+	}
+
+	id, err := dbCreateUser(ctx, request.DisplayName, request.Email, request.Status)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	return resolveUser(ctx, id)
+}
+
+type updateUserInput struct {
+	DisplayName *string
+	Email       *string
+}
+
+func (*graphqlResolver) UpdateUser(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input updateUserInput
+}) (*userResolver, error) {
+	if err := authorize(ctx, RoleEditor); err != nil {
+		return nil, graphqlError(err)
+	}
+
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dbUpdateUser(ctx, id, args.Input.DisplayName, args.Input.Email); err != nil {
+		return nil, graphqlError(err)
+	}
+	return resolveUser(ctx, id)
+}
+
+func (*graphqlResolver) DeleteUser(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if err := authorize(ctx, RoleAdmin); err != nil {
+		return false, graphqlError(err)
+	}
+
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := dbDeleteUser(ctx, id); err != nil {
+		return false, graphqlError(err)
+	}
+	return true, nil
+}
+
+func resolveUser(ctx context.Context, id uint) (*userResolver, error) {
+	u, err := dbGetUser(ctx, id)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	return &userResolver{id: id, u: *u}, nil
+}
+
+type userResolver struct {
+	id uint
+	u  User
+}
+
+func (r *userResolver) ID() graphql.ID {
+	return graphql.ID(strconv.FormatUint(uint64(r.id), 10))
+}
+func (r *userResolver) DisplayName() string     { return r.u.DisplayName }
+func (r *userResolver) Email() string           { return r.u.Email }
+func (r *userResolver) Status() string          { return string(r.u.Status) }
+func (r *userResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.u.CreatedAt} }
+func (r *userResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.u.UpdatedAt} }
+
+type userConnectionResolver struct {
+	edges       []*userEdgeResolver
+	hasNextPage bool
+}
+
+func (r *userConnectionResolver) Edges() []*userEdgeResolver { return r.edges }
+
+func (r *userConnectionResolver) PageInfo() *pageInfoResolver {
+	p := &pageInfoResolver{hasNextPage: r.hasNextPage}
+	if len(r.edges) > 0 {
+		cursor := r.edges[len(r.edges)-1].Cursor()
+		p.endCursor = &cursor
+	}
+	return p
+}
+
+type userEdgeResolver struct {
+	node *userResolver
+}
+
+func (r *userEdgeResolver) Cursor() string      { return encodeCursor(r.node.id) }
+func (r *userEdgeResolver) Node() *userResolver { return r.node }
+
+type pageInfoResolver struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (r *pageInfoResolver) HasNextPage() bool  { return r.hasNextPage }
+func (r *pageInfoResolver) EndCursor() *string { return r.endCursor }
+
+// Cursors are opaque to clients, they encode the id of the user an edge
+// points at.
+const cursorPrefix = "user:"
+
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCursor(cursor string) (uint, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(dat), cursorPrefix) {
+		id, err := strconv.ParseUint(strings.TrimPrefix(string(dat), cursorPrefix), 10, 32)
+		if err == nil {
+			return uint(id), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: invalid cursor %q", errInvalidArgument, cursor)
+}
+
+func parseGraphQLID(id graphql.ID) (uint, error) {
+	id64, err := strconv.ParseUint(string(id), 10, 32)
+	if err != nil {
+		return 0, graphqlError(fmt.Errorf("%w: invalid user id %q", errInvalidArgument, id))
+	}
+	return uint(id64), nil
+}
+
+// errInvalidArgument marks malformed GraphQL arguments.
+var errInvalidArgument = errors.New("Invalid argument")
+
+// gqlError is a GraphQL error carrying a machine readable code in its
+// extensions, the counterpart of the Err* renderers of the REST API.
+type gqlError struct {
+	code    string
+	message string
+}
+
+func (e *gqlError) Error() string { return e.message }
+
+func (e *gqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func graphqlError(err error) error {
+	switch {
+	case errors.Is(err, UserNotFound):
+		return &gqlError{"NOT_FOUND", err.Error()}
+	case errors.Is(err, EmailTaken), errors.Is(err, InvalidStatusTransition):
+		return &gqlError{"CONFLICT", err.Error()}
+	case errors.Is(err, InvalidStatus), errors.Is(err, InvalidEmail), errors.Is(err, errInvalidArgument):
+		return &gqlError{"BAD_USER_INPUT", err.Error()}
+	case errors.Is(err, Unauthenticated):
+		return &gqlError{"UNAUTHENTICATED", err.Error()}
+	case errors.Is(err, Forbidden):
+		return &gqlError{"FORBIDDEN", err.Error()}
+	}
+
+	log.Error(err)
+	//don't send error text over the wire as it may contain sensitive information
+	return &gqlError{"INTERNAL", "Internal server error"}
+}
+
+// maxGraphQLPeekSize is how much of a GraphQL request graphqlQuery reads to
+// find its operation. Larger requests count as writes.
+const maxGraphQLPeekSize = 64 << 10
+
+// graphqlQuery tells whether a GraphQL request executes a query rather than
+// a mutation, for rate limiting. Requests it can't make sense of count as
+// mutations, the handler rejects them anyway. The body is left for the
+// handler.
+func graphqlQuery(r *http.Request) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxGraphQLPeekSize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) > maxGraphQLPeekSize {
+		return false
+	}
+
+	var params struct {
+		Query         string `json:"query"`
+		OperationName string `json:"operationName"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return false
+	}
+	return graphqlOperationType(params.Query, params.OperationName) == "query"
+}
+
+// graphqlOperationType returns the type of the operation a GraphQL document
+// executes, "query", "mutation" or "subscription", the named one when the
+// document has several. It only scans the top level of the document,
+// validation is left to the schema, and returns "" when it finds no such
+// operation.
+func graphqlOperationType(doc, operationName string) string {
+	type operation struct{ name, typ string }
+	var (
+		ops       []operation
+		depth     int
+		typ, name string
+		directive bool
+	)
+	for i := 0; i < len(doc); i++ {
+		c := doc[i]
+		switch {
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' && doc[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(doc[i:], `"""`):
+			end := strings.Index(strings.ReplaceAll(doc[i+3:], `\"""`, "____"), `"""`)
+			if end < 0 {
+				return ""
+			}
+			i += 3 + end + 2
+		case c == '"':
+			for i++; i < len(doc) && doc[i] != '"'; i++ {
+				if doc[i] == '\\' {
+					i++
+				}
+			}
+		case c == '{' || c == '(' || c == '[':
+			if depth == 0 && c == '{' {
+				switch typ {
+				case "":
+					ops = append(ops, operation{typ: "query"})
+				case "query", "mutation", "subscription":
+					ops = append(ops, operation{name: name, typ: typ})
+				}
+				typ, name = "", ""
+			}
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			if depth--; depth < 0 {
+				return ""
+			}
+		case c == '@':
+			directive = true
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			start := i
+			for i+1 < len(doc) && (doc[i+1] == '_' || 'a' <= doc[i+1] && doc[i+1] <= 'z' || 'A' <= doc[i+1] && doc[i+1] <= 'Z' || '0' <= doc[i+1] && doc[i+1] <= '9') {
+				i++
+			}
+			if depth > 0 {
+				continue
+			}
+			switch word := doc[start : i+1]; {
+			case directive:
+				directive = false
+			case typ == "":
+				typ = word
+			case name == "" && typ != "fragment":
+				name = word
+			}
+		}
+	}
+
+	for _, op := range ops {
+		if op.name == operationName || operationName == "" && len(ops) == 1 {
+			return op.typ
+		}
+	}
+	return ""
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code string `json:"code"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func graphqlRequest(t *testing.T, ts *httptest.Server, query string, variables map[string]interface{}) graphqlResponse {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", ts.URL+"/api/graphql", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp, respBody := testRequest(t, ts, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(respBody))
+
+	gr := graphqlResponse{}
+	require.NoError(t, json.Unmarshal(respBody, &gr), string(respBody))
+	return gr
+}
+
+func newGraphQLTestServer(t *testing.T, us UserStore) *httptest.Server {
+	useTempStore(t, us)
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	ts := newGraphQLTestServer(t, UserStore{
+		Increment: 3,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusSuspended},
+			3: {DisplayName: "Carol", Email: "carol@email.com", Status: StatusActive},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{
+			name:  "user",
+			query: `{ user(id: 2) { id displayName email status } }`,
+			want:  `{"user":{"id":"2","displayName":"Bob","email":"bob@email.com","status":"suspended"}}`,
+		},
+		{
+			name:  "missing user",
+			query: `{ user(id: 42) { id } }`,
+			want:  `{"user":null}`,
+		},
+		{
+			name:  "all users",
+			query: `{ users { edges { node { id } } pageInfo { hasNextPage } } }`,
+			want:  `{"users":{"edges":[{"node":{"id":"1"}},{"node":{"id":"2"}},{"node":{"id":"3"}}],"pageInfo":{"hasNextPage":false}}}`,
+		},
+		{
+			name:  "first page",
+			query: `{ users(first: 2) { edges { cursor node { displayName } } pageInfo { hasNextPage endCursor } } }`,
+			want: `{"users":{"edges":[` +
+				`{"cursor":"` + encodeCursor(1) + `","node":{"displayName":"Alice"}},` +
+				`{"cursor":"` + encodeCursor(2) + `","node":{"displayName":"Bob"}}],` +
+				`"pageInfo":{"hasNextPage":true,"endCursor":"` + encodeCursor(2) + `"}}}`,
+		},
+		{
+			name:      "next page",
+			query:     `query($after: String) { users(first: 2, after: $after) { edges { node { id } } pageInfo { hasNextPage } } }`,
+			variables: map[string]interface{}{"after": encodeCursor(2)},
+			want:      `{"users":{"edges":[{"node":{"id":"3"}}],"pageInfo":{"hasNextPage":false}}}`,
+		},
+		{
+			name:  "filter by status",
+			query: `{ users(filter: {status: "active"}) { edges { node { id } } } }`,
+			want:  `{"users":{"edges":[{"node":{"id":"1"}},{"node":{"id":"3"}}]}}`,
+		},
+		{
+			name:  "filter by email",
+			query: `{ users(filter: {email: "CAROL@email.com"}) { edges { node { id } } } }`,
+			want:  `{"users":{"edges":[{"node":{"id":"3"}}]}}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gr := graphqlRequest(t, ts, tc.query, tc.variables)
+			require.Empty(t, gr.Errors)
+			assert.JSONEq(t, tc.want, string(gr.Data))
+		})
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	ts := newGraphQLTestServer(t, UserStore{List: UserList{}})
+
+	gr := graphqlRequest(t, ts, `mutation { createUser(input: {displayName: "Alice", email: "alice@email.com"}) { id status } }`, nil)
+	require.Empty(t, gr.Errors)
+	assert.JSONEq(t, `{"createUser":{"id":"1","status":"active"}}`, string(gr.Data))
+
+	gr = graphqlRequest(t, ts, `mutation { updateUser(id: 1, input: {displayName: "Alicia"}) { displayName email } }`, nil)
+	require.Empty(t, gr.Errors)
+	assert.JSONEq(t, `{"updateUser":{"displayName":"Alicia","email":"alice@email.com"}}`, string(gr.Data))
+
+	gr = graphqlRequest(t, ts, `mutation { deleteUser(id: 1) }`, nil)
+	require.Empty(t, gr.Errors)
+	assert.JSONEq(t, `{"deleteUser":true}`, string(gr.Data))
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Empty(t, us.List)
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	ts := newGraphQLTestServer(t, UserStore{
+		Increment: 1,
+		List:      UserList{1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}},
+	})
+
+	tests := []struct {
+		name  string
+		query string
+		code  string
+	}{
+		{"update missing user", `mutation { updateUser(id: 42, input: {displayName: "x"}) { id } }`, "NOT_FOUND"},
+		{"delete missing user", `mutation { deleteUser(id: 42) }`, "NOT_FOUND"},
+		{"taken email", `mutation { createUser(input: {displayName: "A", email: "alice@email.com"}) { id } }`, "CONFLICT"},
+		{"invalid status", `mutation { createUser(input: {displayName: "A", email: "a@email.com", status: "suspended"}) { id } }`, "BAD_USER_INPUT"},
+		{"invalid id", `{ user(id: "abc") { id } }`, "BAD_USER_INPUT"},
+		{"invalid cursor", `{ users(after: "abc") { edges { cursor } } }`, "BAD_USER_INPUT"},
+		{"invalid page size", `{ users(first: 0) { edges { cursor } } }`, "BAD_USER_INPUT"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gr := graphqlRequest(t, ts, tc.query, nil)
+			require.Len(t, gr.Errors, 1)
+			assert.Equal(t, tc.code, gr.Errors[0].Extensions.Code)
+		})
+	}
+}
+
+func TestGraphQLOperationType(t *testing.T) {
+	tests := []struct {
+		name          string
+		doc           string
+		operationName string
+		want          string
+	}{
+		{name: "shorthand query", doc: `{ users { edges { node { id } } } }`, want: "query"},
+		{name: "named query", doc: `query Q($id: ID!) { user(id: $id) { id } }`, want: "query"},
+		{name: "mutation", doc: `mutation { deleteUser(id: 1) }`, want: "mutation"},
+		{name: "directives and comments", doc: "# mutation { deleteUser(id: 1) }\nquery @cached { user(id: 1) { id } }", want: "query"},
+		{name: "strings", doc: `mutation M($s: String = "query {") { createUser(input: {displayName: """}""", email: "a}b"}) { id } }`, want: "mutation"},
+		{name: "fragments", doc: `fragment F on User { id } query { user(id: 1) { ...F } }`, want: "query"},
+		{name: "selected operation", doc: `query A { user(id: 1) { id } } mutation B { deleteUser(id: 1) }`, operationName: "B", want: "mutation"},
+		{name: "unselected operation", doc: `query A { user(id: 1) { id } } mutation B { deleteUser(id: 1) }`, want: ""},
+		{name: "unknown operation", doc: `query A { user(id: 1) { id } }`, operationName: "B", want: ""},
+		{name: "unbalanced", doc: `} mutation { deleteUser(id: 1) }`, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, graphqlOperationType(test.doc, test.operationName))
+		})
+	}
+}
+
+func TestGraphQLRateLimit(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.RateLimitReads = 3
+	config.RateLimitWrites = 1
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	post := func(query string) *http.Response {
+		body, err := json.Marshal(map[string]interface{}{"query": query})
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", ts.URL+"/api/graphql", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp, respBody := testRequest(t, ts, req)
+		if resp.StatusCode == http.StatusOK {
+			gr := graphqlResponse{}
+			require.NoError(t, json.Unmarshal(respBody, &gr))
+			require.Empty(t, gr.Errors, "the body reaches the handler")
+		}
+		return resp
+	}
+
+	resp := post(`mutation { createUser(input: {displayName: "Alice", email: "alice@email.com"}) { id } }`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusTooManyRequests, post(`mutation { deleteUser(id: 1) }`).StatusCode)
+
+	for i := 0; i < 3; i++ {
+		resp := post(`{ user(id: 1) { id } }`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "queries have the reads limit")
+		assert.Equal(t, "3", resp.Header.Get("RateLimit-Limit"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, post(`{ user(id: 1) { id } }`).StatusCode)
+}
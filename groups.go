@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	Group struct {
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
+		Name        string    `json:"name"`
+		Description string    `json:"description,omitempty"`
+		// Members are the ids of the users in the group.
+		Members []uint `json:"members,omitempty"`
+		// Subgroups are the ids of groups nested in the group, their members
+		// belong to it as well.
+		Subgroups []uint `json:"subgroups,omitempty"`
+	}
+	GroupList map[uint]Group
+)
+
+// memberKind tells users and groups apart as members of a group.
+type memberKind string
+
+const (
+	memberUser  memberKind = "user"
+	memberGroup memberKind = "group"
+)
+
+func dbGetGroup(ctx context.Context, id uint) (group *Group, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	g, ok := us.Groups[id]
+	if !ok {
+		return nil, GroupNotFound
+	}
+	return &g, nil
+}
+
+func dbGetGroupList(ctx context.Context) (groupList *GroupList, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	groups := us.Groups
+	if groups == nil {
+		groups = GroupList{}
+	}
+	return &groups, nil
+}
+
+func dbCreateGroup(ctx context.Context, name, description string) (id uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if groupNameTaken(us, name, 0) {
+		return 0, GroupNameTaken
+	}
+
+	us.GroupIncrement++
+	now := time.Now()
+	id = us.GroupIncrement
+	if us.Groups == nil {
+		us.Groups = GroupList{}
+	}
+	us.Groups[id] = Group{
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Name:        name,
+		Description: description,
+	}
+
+	err = saveUserStore(ctx, us)
+	return
+}
+
+func dbUpdateGroup(ctx context.Context, id uint, name, description *string) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	g, ok := us.Groups[id]
+	if !ok {
+		return GroupNotFound
+	}
+
+	if name != nil {
+		if groupNameTaken(us, *name, id) {
+			return GroupNameTaken
+		}
+		g.Name = *name
+	}
+	if description != nil {
+		g.Description = *description
+	}
+	g.UpdatedAt = time.Now()
+	us.Groups[id] = g
+
+	return saveUserStore(ctx, us)
+}
+
+// dbDeleteGroup deletes a group and removes it from the groups it is nested
+// in. Its members and subgroups are kept.
+func dbDeleteGroup(ctx context.Context, id uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.Groups[id]; !ok {
+		return GroupNotFound
+	}
+
+	delete(us.Groups, id)
+	for gid, g := range us.Groups {
+		if subgroups, removed := removeId(g.Subgroups, id); removed {
+			g.Subgroups = subgroups
+			g.UpdatedAt = time.Now()
+			us.Groups[gid] = g
+		}
+	}
+
+	return saveUserStore(ctx, us)
+}
+
+// dbAddGroupMember adds a user or a group to the group with id, it is not
+// an error if it is a member already. Nesting a group in one of its own
+// subgroups fails with GroupCycle.
+func dbAddGroupMember(ctx context.Context, id uint, kind memberKind, memberId uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	g, ok := us.Groups[id]
+	if !ok {
+		return GroupNotFound
+	}
+
+	switch kind {
+	case memberUser:
+		if _, ok := us.List[memberId]; !ok {
+			return UserNotFound
+		}
+		if containsId(g.Members, memberId) {
+			return nil
+		}
+		g.Members = insertId(g.Members, memberId)
+	case memberGroup:
+		if _, ok := us.Groups[memberId]; !ok {
+			return GroupNotFound
+		}
+		if containsId(g.Subgroups, memberId) {
+			return nil
+		}
+		if memberId == id || groupReaches(us.Groups, memberId, id) {
+			return fmt.Errorf("%w: group %d contains group %d", GroupCycle, memberId, id)
+		}
+		g.Subgroups = insertId(g.Subgroups, memberId)
+	}
+	g.UpdatedAt = time.Now()
+	us.Groups[id] = g
+
+	return saveUserStore(ctx, us)
+}
+
+func dbRemoveGroupMember(ctx context.Context, id uint, kind memberKind, memberId uint) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	g, ok := us.Groups[id]
+	if !ok {
+		return GroupNotFound
+	}
+
+	removed := false
+	switch kind {
+	case memberUser:
+		g.Members, removed = removeId(g.Members, memberId)
+	case memberGroup:
+		g.Subgroups, removed = removeId(g.Subgroups, memberId)
+	}
+	if !removed {
+		return MemberNotFound
+	}
+	g.UpdatedAt = time.Now()
+	us.Groups[id] = g
+
+	return saveUserStore(ctx, us)
+}
+
+// dbGetGroupUsers returns the ids of the users in a group, with transitive
+// set including those of its subgroups.
+func dbGetGroupUsers(ctx context.Context, id uint, transitive bool) (ids []uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	g, ok := us.Groups[id]
+	if !ok {
+		return nil, GroupNotFound
+	}
+	if !transitive {
+		return append([]uint{}, g.Members...), nil
+	}
+
+	members := map[uint]bool{}
+	for _, gid := range append(groupDescendants(us.Groups, id), id) {
+		for _, uid := range us.Groups[gid].Members {
+			members[uid] = true
+		}
+	}
+	return sortedIds(members), nil
+}
+
+// dbGetUserGroups returns the ids of the groups a user is a member of, with
+// transitive set including the groups those are nested in.
+func dbGetUserGroups(ctx context.Context, userId uint, transitive bool) (ids []uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, ok := us.List[userId]; !ok {
+		return nil, UserNotFound
+	}
+
+	groups := map[uint]bool{}
+	for gid, g := range us.Groups {
+		if containsId(g.Members, userId) {
+			groups[gid] = true
+		}
+	}
+	if transitive {
+		for gid := range groups {
+			for _, ancestor := range groupAncestors(us.Groups, gid) {
+				groups[ancestor] = true
+			}
+		}
+	}
+	return sortedIds(groups), nil
+}
+
+// removeUserFromGroups drops a deleted user from all groups of us.
+func removeUserFromGroups(us *UserStore, userId uint) {
+	for gid, g := range us.Groups {
+		if members, removed := removeId(g.Members, userId); removed {
+			g.Members = members
+			g.UpdatedAt = time.Now()
+			us.Groups[gid] = g
+		}
+	}
+}
+
+// groupNameTaken reports whether a group other than exceptId has name,
+// ignoring case.
+func groupNameTaken(us UserStore, name string, exceptId uint) bool {
+	for id, g := range us.Groups {
+		if id != exceptId && strings.EqualFold(strings.TrimSpace(g.Name), strings.TrimSpace(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupReaches reports whether target is nested in from, directly or
+// through other groups.
+func groupReaches(groups GroupList, from, target uint) bool {
+	for _, id := range groupDescendants(groups, from) {
+		if id == target {
+			return true
+		}
+	}
+	return false
+}
+
+// groupDescendants returns the ids of all groups nested in the group with
+// id. It terminates on cycles, which only a damaged store can contain.
+func groupDescendants(groups GroupList, id uint) []uint {
+	seen := map[uint]bool{id: true}
+	queue := []uint{id}
+	for len(queue) > 0 {
+		for _, sub := range groups[queue[0]].Subgroups {
+			if !seen[sub] {
+				seen[sub] = true
+				queue = append(queue, sub)
+			}
+		}
+		queue = queue[1:]
+	}
+	delete(seen, id)
+	return sortedIds(seen)
+}
+
+// groupAncestors returns the ids of all groups the group with id is nested
+// in.
+func groupAncestors(groups GroupList, id uint) []uint {
+	parents := map[uint][]uint{}
+	for gid, g := range groups {
+		for _, sub := range g.Subgroups {
+			parents[sub] = append(parents[sub], gid)
+		}
+	}
+
+	seen := map[uint]bool{id: true}
+	queue := []uint{id}
+	for len(queue) > 0 {
+		for _, parent := range parents[queue[0]] {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+		queue = queue[1:]
+	}
+	delete(seen, id)
+	return sortedIds(seen)
+}
+
+func sortedGroupIds(groupList *GroupList) []uint {
+	ids := make([]uint, 0, len(*groupList))
+	for k := range *groupList {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func sortedIds(set map[uint]bool) []uint {
+	ids := make([]uint, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func containsId(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// insertId adds id to the sorted ids.
+func insertId(ids []uint, id uint) []uint {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func removeId(ids []uint, id uint) ([]uint, bool) {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i:i], ids[i+1:]...), true
+		}
+	}
+	return ids, false
+}
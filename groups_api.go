@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type CreateGroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func (c *CreateGroupRequest) Bind(r *http.Request) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+type UpdateGroupRequest struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+func (u *UpdateGroupRequest) Bind(r *http.Request) error {
+	if u.Name != nil && strings.TrimSpace(*u.Name) == "" {
+		return errors.New("name can't be empty")
+	}
+	return nil
+}
+
+type GroupResponse struct {
+	*Group
+	Id uint `json:"id"`
+}
+
+func (gr *GroupResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if gr.Group == nil {
+		return GroupNotFound
+	}
+	return nil
+}
+
+func NewGroupResponse(ctx context.Context, id uint) *GroupResponse {
+	resp := &GroupResponse{Id: id}
+	if group, _ := dbGetGroup(ctx, id); group != nil {
+		resp.Group = group
+	}
+	return resp
+}
+
+func NewGroupListResponse(ctx context.Context, ids []uint) []render.Renderer {
+	list := []render.Renderer{}
+	for _, id := range ids {
+		list = append(list, NewGroupResponse(ctx, id))
+	}
+	return list
+}
+
+// MemberResponse is a user or a group in a group.
+type MemberResponse struct {
+	Type memberKind `json:"type"`
+	Id   uint       `json:"id"`
+	// Name is the display name of users and the name of groups.
+	Name string `json:"name"`
+}
+
+func (mr *MemberResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+// memberKinds maps the path segments of member routes to member kinds.
+var memberKinds = map[string]memberKind{
+	"users":  memberUser,
+	"groups": memberGroup,
+}
+
+// setGroupRoutes serves the groups of the default store, or of a tenant when
+// mounted below tenantScope.
+func setGroupRoutes(r chi.Router) {
+	reader, editor, admin := requireRole(RoleReader), requireRole(RoleEditor), requireRole(RoleAdmin)
+
+	r.With(reader).Get("/", listGroups)
+	r.With(editor).Post("/", createGroup)
+
+	r.Route("/{groupId}", func(r chi.Router) {
+		r.With(reader).Get("/", getGroup)
+		r.With(editor).Patch("/", updateGroup)
+		r.With(admin).Delete("/", deleteGroup)
+
+		r.With(reader).Get("/members", listGroupMembers)
+		r.With(editor).Put("/members/{kind}/{memberId}", addGroupMember)
+		r.With(editor).Delete("/members/{kind}/{memberId}", removeGroupMember)
+	})
+}
+
+func parseIdParam(r *http.Request, name string) (uint, error) {
+	id, err := strconv.ParseUint(chi.URLParam(r, name), 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid " + name)
+	}
+	return uint(id), nil
+}
+
+// renderGroupError renders the errors of group operations.
+func renderGroupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, GroupNotFound), errors.Is(err, UserNotFound), errors.Is(err, MemberNotFound):
+		render.Render(w, r, ErrNotFound(err))
+	case errors.Is(err, GroupNameTaken), errors.Is(err, GroupCycle):
+		render.Render(w, r, ErrConflict(err))
+	default:
+		render.Render(w, r, ErrInternal(err))
+	}
+}
+
+func listGroups(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePage(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	groupList, err := dbGetGroupList(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	ids, more := p.apply(sortedGroupIds(groupList))
+	if more {
+		w.Header().Set("Link", p.nextLink(r, ids[len(ids)-1]))
+	}
+
+	if err := render.RenderList(w, r, NewGroupListResponse(r.Context(), ids)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func createGroup(w http.ResponseWriter, r *http.Request) {
+	request := CreateGroupRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	id, err := dbCreateGroup(r.Context(), request.Name, request.Description)
+	if err != nil {
+		renderGroupError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, NewGroupResponse(r.Context(), id))
+}
+
+func getGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIdParam(r, "groupId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := render.Render(w, r, NewGroupResponse(r.Context(), id)); err != nil {
+		if errors.Is(err, GroupNotFound) {
+			render.Render(w, r, ErrNotFound(err))
+			return
+		}
+
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func updateGroup(w http.ResponseWriter, r *http.Request) {
+	request := UpdateGroupRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	id, err := parseIdParam(r, "groupId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := dbUpdateGroup(r.Context(), id, request.Name, request.Description); err != nil {
+		renderGroupError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, NewGroupResponse(r.Context(), id))
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIdParam(r, "groupId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := dbDeleteGroup(r.Context(), id); err != nil {
+		renderGroupError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listGroupMembers lists the users and subgroups of a group. With
+// ?transitive=true it lists the users of the group and all its subgroups
+// instead.
+func listGroupMembers(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIdParam(r, "groupId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	transitive, err := parseTransitive(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	ctx := r.Context()
+	userIds, err := dbGetGroupUsers(ctx, id, transitive)
+	if err != nil {
+		renderGroupError(w, r, err)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, uid := range userIds {
+		if u, err := dbGetUser(ctx, uid); err == nil {
+			list = append(list, &MemberResponse{Type: memberUser, Id: uid, Name: u.DisplayName})
+		}
+	}
+	if !transitive {
+		g, err := dbGetGroup(ctx, id)
+		if err != nil {
+			renderGroupError(w, r, err)
+			return
+		}
+		for _, gid := range g.Subgroups {
+			if sub, err := dbGetGroup(ctx, gid); err == nil {
+				list = append(list, &MemberResponse{Type: memberGroup, Id: gid, Name: sub.Name})
+			}
+		}
+	}
+
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func addGroupMember(w http.ResponseWriter, r *http.Request) {
+	changeGroupMember(w, r, dbAddGroupMember)
+}
+
+func removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	changeGroupMember(w, r, dbRemoveGroupMember)
+}
+
+func changeGroupMember(w http.ResponseWriter, r *http.Request, change func(ctx context.Context, id uint, kind memberKind, memberId uint) error) {
+	kind, ok := memberKinds[chi.URLParam(r, "kind")]
+	if !ok {
+		render.Render(w, r, ErrNotFound(errors.New("members are users or groups")))
+		return
+	}
+	id, err := parseIdParam(r, "groupId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	memberId, err := parseIdParam(r, "memberId")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := change(r.Context(), id, kind, memberId); err != nil {
+		renderGroupError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUserGroups lists the groups a user is a member of, with
+// ?transitive=true including those they belong to through nested groups.
+func getUserGroups(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	transitive, err := parseTransitive(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	ids, err := dbGetUserGroups(r.Context(), id, transitive)
+	if err != nil {
+		renderGroupError(w, r, err)
+		return
+	}
+
+	if err := render.RenderList(w, r, NewGroupListResponse(r.Context(), ids)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func parseTransitive(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("transitive")
+	if v == "" {
+		return false, nil
+	}
+	transitive, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("invalid transitive, expected true or false")
+	}
+	return transitive, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroups(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 3,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+			3: {DisplayName: "Carol", Email: "carol@email.com", Status: StatusActive},
+		},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, ts, req)
+	}
+	must := func(status int, method, path, body string) []byte {
+		resp, respBody := request(method, path, body)
+		require.Equal(t, status, resp.StatusCode, "%s %s: %s", method, path, respBody)
+		return respBody
+	}
+	ids := func(body []byte) []uint {
+		var list []struct {
+			Type memberKind `json:"type"`
+			Id   uint       `json:"id"`
+		}
+		require.NoError(t, json.Unmarshal(body, &list))
+		got := []uint{}
+		for _, item := range list {
+			got = append(got, item.Id)
+		}
+		return got
+	}
+
+	for _, name := range []string{"engineering", "backend", "oncall"} {
+		must(http.StatusCreated, "POST", "/groups/", `{"name":"`+name+`"}`)
+	}
+	group := GroupResponse{}
+	require.NoError(t, json.Unmarshal(must(http.StatusOK, "GET", "/groups/2", ""), &group))
+	assert.Equal(t, "backend", group.Name)
+
+	t.Run("crud", func(t *testing.T) {
+		resp, _ := request("POST", "/groups/", `{"name":"Backend"}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		resp, _ = request("POST", "/groups/", `{"name":" "}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp, _ = request("GET", "/groups/99", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		body := must(http.StatusOK, "PATCH", "/groups/3", `{"description":"paged at night"}`)
+		assert.Contains(t, string(body), `"description":"paged at night"`)
+		resp, _ = request("PATCH", "/groups/3", `{"name":"engineering"}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		assert.Equal(t, []uint{1, 2, 3}, ids(must(http.StatusOK, "GET", "/groups/", "")))
+		resp, _ = request("GET", "/groups/?limit=2", "")
+		assert.Contains(t, resp.Header.Get("Link"), "after=2")
+	})
+
+	t.Run("members", func(t *testing.T) {
+		must(http.StatusNoContent, "PUT", "/groups/1/members/users/1", "")
+		must(http.StatusNoContent, "PUT", "/groups/2/members/users/2", "")
+		must(http.StatusNoContent, "PUT", "/groups/2/members/users/2", "")
+		must(http.StatusNoContent, "PUT", "/groups/3/members/users/3", "")
+		must(http.StatusNoContent, "PUT", "/groups/1/members/groups/2", "")
+		must(http.StatusNoContent, "PUT", "/groups/2/members/groups/3", "")
+
+		body := must(http.StatusOK, "GET", "/groups/1/members", "")
+		assert.JSONEq(t, `[{"type":"user","id":1,"name":"Alice"},{"type":"group","id":2,"name":"backend"}]`, string(body))
+		assert.Equal(t, []uint{1, 2, 3}, ids(must(http.StatusOK, "GET", "/groups/1/members?transitive=true", "")))
+
+		resp, _ := request("PUT", "/groups/1/members/users/42", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp, _ = request("PUT", "/groups/1/members/robots/1", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp, _ = request("DELETE", "/groups/1/members/users/3", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("cycles are rejected", func(t *testing.T) {
+		for _, path := range []string{"/groups/1/members/groups/1", "/groups/2/members/groups/1", "/groups/3/members/groups/1"} {
+			resp, body := request("PUT", path, "")
+			assert.Equal(t, http.StatusConflict, resp.StatusCode, path)
+			assert.Contains(t, string(body), GroupCycle.Error())
+		}
+	})
+
+	t.Run("reverse lookup", func(t *testing.T) {
+		assert.Equal(t, []uint{3}, ids(must(http.StatusOK, "GET", "/users/3/groups", "")))
+		assert.Equal(t, []uint{1, 2, 3}, ids(must(http.StatusOK, "GET", "/users/3/groups?transitive=true", "")))
+		resp, _ := request("GET", "/users/42/groups", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("deleting a user removes memberships", func(t *testing.T) {
+		must(http.StatusOK, "DELETE", "/users/2", "")
+		g, err := dbGetGroup(context.Background(), 2)
+		require.NoError(t, err)
+		assert.Empty(t, g.Members)
+		assert.Equal(t, []uint{1, 3}, ids(must(http.StatusOK, "GET", "/groups/1/members?transitive=true", "")))
+	})
+
+	t.Run("deleting a group removes it from its parents", func(t *testing.T) {
+		must(http.StatusNoContent, "DELETE", "/groups/2", "")
+		assert.Equal(t, []uint{1}, ids(must(http.StatusOK, "GET", "/groups/1/members", "")))
+		assert.Equal(t, []uint{3}, ids(must(http.StatusOK, "GET", "/users/3/groups?transitive=true", "")))
+
+		// groups nested in it are kept
+		must(http.StatusOK, "GET", "/groups/3", "")
+		resp, _ := request("DELETE", "/groups/2", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestGroupGraph(t *testing.T) {
+	groups := GroupList{
+		1: {Subgroups: []uint{2, 3}},
+		2: {Subgroups: []uint{4}},
+		3: {Subgroups: []uint{4}},
+		4: {},
+		// cycles only exist in damaged stores, walking them must terminate
+		5: {Subgroups: []uint{6}},
+		6: {Subgroups: []uint{5}},
+	}
+
+	assert.Equal(t, []uint{2, 3, 4}, groupDescendants(groups, 1))
+	assert.Equal(t, []uint{1, 2, 3}, groupAncestors(groups, 4))
+	assert.True(t, groupReaches(groups, 1, 4))
+	assert.False(t, groupReaches(groups, 4, 1))
+	assert.Equal(t, []uint{6}, groupDescendants(groups, 5))
+	assert.Equal(t, []uint{6}, groupAncestors(groups, 5))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"refactoring/userspb"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newGRPCServer returns a server for the gRPC UserService. It works on the
+// same stores and applies the same validation, authorization and rate limits
+// as the REST handlers, the limits are counted separately though. Tenants
+// are selected by the x-tenant metadata. Idempotency-Key isn't supported,
+// clients retrying CreateUser should look the user up by email first.
+func newGRPCServer() *grpc.Server {
+	reads, writes := newRateLimiters()
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		grpcRecoverer,
+		grpcLogger,
+		grpcTenant,
+		grpcAuth(newAuthenticator()),
+		grpcRateLimit(reads, writes),
+	))
+	userspb.RegisterUserServiceServer(s, userServer{})
+	return s
+}
+
+type userServer struct {
+	userspb.UnimplementedUserServiceServer
+}
+
+func (userServer) ListUsers(ctx context.Context, req *userspb.ListUsersRequest) (*userspb.ListUsersResponse, error) {
+	resp := &userspb.ListUsersResponse{Users: []*userspb.User{}}
+
+	if req.Email != "" {
+		id, err := dbFindUserByEmail(ctx, req.Email)
+		if errors.Is(err, UserNotFound) {
+			return resp, nil
+		}
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		u, err := getUserMessage(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		resp.Users = append(resp.Users, u)
+		return resp, nil
+	}
+
+	p, err := parsePageRequest(req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	userList, err := dbGetUserList(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	ids, more := p.apply(sortedUserIds(userList))
+	for _, id := range ids {
+		resp.Users = append(resp.Users, userMessage(id, (*userList)[id]))
+	}
+	if more {
+		resp.NextPageToken = strconv.FormatUint(uint64(ids[len(ids)-1]), 10)
+	}
+	return resp, nil
+}
+
+func (userServer) GetUser(ctx context.Context, req *userspb.GetUserRequest) (*userspb.User, error) {
+	return getUserMessage(ctx, uint(req.Id))
+}
+
+func (userServer) CreateUser(ctx context.Context, req *userspb.CreateUserRequest) (*userspb.User, error) {
+	request := CreateUserRequest{
+		DisplayName: req.DisplayName,
+		Email:       req.Email,
+		Status:      UserStatus(req.Status),
+	}
+	if err := request.Bind(nil); err != nil {
+		return nil, grpcError(err)
+	}
+
+	id, err := dbCreateUser(ctx, request.DisplayName, request.Email, request.Status)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return getUserMessage(ctx, id)
+}
+
+func (userServer) UpdateUser(ctx context.Context, req *userspb.UpdateUserRequest) (*userspb.User, error) {
+	if err := dbUpdateUser(ctx, uint(req.Id), req.DisplayName, req.Email); err != nil {
+		return nil, grpcError(err)
+	}
+	return getUserMessage(ctx, uint(req.Id))
+}
+
+func (userServer) DeleteUser(ctx context.Context, req *userspb.DeleteUserRequest) (*emptypb.Empty, error) {
+	if err := dbDeleteUser(ctx, uint(req.Id)); err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (userServer) SetUserStatus(ctx context.Context, req *userspb.SetUserStatusRequest) (*userspb.User, error) {
+	to := UserStatus(req.Status)
+	switch to {
+	case StatusActive, StatusSuspended, StatusDeactivated:
+	default:
+		return nil, grpcError(fmt.Errorf("%w: %q", InvalidStatus, req.Status))
+	}
+
+	if err := dbSetUserStatus(ctx, uint(req.Id), to); err != nil {
+		return nil, grpcError(err)
+	}
+	return getUserMessage(ctx, uint(req.Id))
+}
+
+// parsePageRequest is parsePage for gRPC, the page token is the id of the
+// last user on the previous page.
+func parsePageRequest(pageSize int32, pageToken string) (p page, err error) {
+	if pageToken != "" {
+		after, err := strconv.ParseUint(pageToken, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid page_token %q", pageToken)
+		}
+		p.after = uint(after)
+	}
+	if pageSize < 0 || pageSize > maxPageLimit {
+		return p, fmt.Errorf("page_size must be between 0 and %d", maxPageLimit)
+	}
+	p.limit = int(pageSize)
+	return
+}
+
+func getUserMessage(ctx context.Context, id uint) (*userspb.User, error) {
+	u, err := dbGetUser(ctx, id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return userMessage(id, *u), nil
+}
+
+func userMessage(id uint, u User) *userspb.User {
+	return &userspb.User{
+		Id:          uint32(id),
+		CreatedAt:   timestamppb.New(u.CreatedAt),
+		UpdatedAt:   timestamppb.New(u.UpdatedAt),
+		DisplayName: u.DisplayName,
+		Email:       u.Email,
+		Status:      string(u.Status),
+	}
+}
+
+// grpcError maps domain errors onto gRPC status codes, the counterpart of the
+// Err* renderers of the REST API.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, UserNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, EmailTaken):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, InvalidStatus), errors.Is(err, InvalidEmail):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, InvalidStatusTransition):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, Unauthenticated), errors.Is(err, InvalidAPIKey), errors.Is(err, InvalidToken):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, Forbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	log.Error(err)
+	//don't send error text over the wire as it may contain sensitive information
+	return status.Error(codes.Internal, "Internal server error")
+}
+
+const grpcTenantMetadata = "x-tenant"
+
+// grpcMethodRoles is the role each UserService method requires, like the
+// routes of the REST API.
+var grpcMethodRoles = map[string]Role{
+	userspb.UserService_ListUsers_FullMethodName:     RoleReader,
+	userspb.UserService_GetUser_FullMethodName:       RoleReader,
+	userspb.UserService_CreateUser_FullMethodName:    RoleEditor,
+	userspb.UserService_UpdateUser_FullMethodName:    RoleEditor,
+	userspb.UserService_SetUserStatus_FullMethodName: RoleEditor,
+	userspb.UserService_DeleteUser_FullMethodName:    RoleAdmin,
+}
+
+// grpcAuth authenticates the API key sent in the x-api-key metadata or the
+// bearer token in the authorization metadata and checks the role the method
+// requires.
+func grpcAuth(a *authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			first := func(key string) string {
+				if v := md.Get(key); len(v) > 0 {
+					return v[0]
+				}
+				return ""
+			}
+			p, err := a.principal(first(strings.ToLower(apiKeyHeader)), first("authorization"))
+			if err != nil {
+				return nil, grpcError(err)
+			}
+			if p != nil {
+				ctx = withPrincipal(ctx, p)
+			}
+		}
+
+		role, ok := grpcMethodRoles[info.FullMethod]
+		if !ok {
+			role = RoleAdmin
+		}
+		if err := authorize(ctx, role); err != nil {
+			return nil, grpcError(err)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcTenant serves calls with x-tenant metadata on the store of that
+// tenant, like tenantScope.
+func grpcTenant(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	name := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(grpcTenantMetadata); len(v) > 0 {
+			name = v[0]
+		}
+	}
+	if name == "" {
+		return handler(ctx, req)
+	}
+
+	t, err := openTenant(name)
+	if errors.Is(err, InvalidTenant) || errors.Is(err, TenantNotFound) {
+		return nil, status.Error(codes.NotFound, TenantNotFound.Error())
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return handler(withTenant(ctx, t), req)
+}
+
+// grpcRateLimit applies the reads limiter to the methods readers may call
+// and the writes limiter to all others, keyed like rateLimit. It has to run
+// after grpcAuth.
+func grpcRateLimit(reads, writes *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		l := writes
+		if grpcMethodRoles[info.FullMethod] == RoleReader {
+			l = reads
+		}
+		if l == nil {
+			return handler(ctx, req)
+		}
+
+		addr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+		res := l.allow(rateLimitKey(ctx, addr))
+		if !res.allowed {
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(ceilSeconds(res.retryAfter))))
+			return nil, status.Error(codes.ResourceExhausted, RateLimited.Error())
+		}
+		return handler(ctx, req)
+	}
+}
+
+func grpcLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	log.Infof("gRPC %s %s in %v", info.FullMethod, status.Code(err), time.Since(start))
+	return resp, err
+}
+
+func grpcRecoverer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if rvr := recover(); rvr != nil {
+			log.Errorf("gRPC %s panic: %v", info.FullMethod, rvr)
+			err = status.Error(codes.Internal, "Internal server error")
+		}
+	}()
+	return handler(ctx, req)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"refactoring/userspb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGRPCTestClient serves the UserService over an in-memory connection.
+func newGRPCTestClient(t *testing.T, us UserStore) userspb.UserServiceClient {
+	useTempStore(t, us)
+	return dialGRPCTestServer(t)
+}
+
+// dialGRPCTestServer starts a server with the current config.
+func dialGRPCTestServer(t *testing.T) userspb.UserServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return userspb.NewUserServiceClient(conn)
+}
+
+func TestGRPCUserService(t *testing.T) {
+	c := newGRPCTestClient(t, UserStore{List: UserList{}})
+	ctx := context.Background()
+
+	alice, err := c.CreateUser(ctx, &userspb.CreateUserRequest{DisplayName: "Alice", Email: "alice@email.com"})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), alice.Id)
+	assert.Equal(t, "active", alice.Status)
+	assert.False(t, alice.CreatedAt.AsTime().IsZero())
+
+	got, err := c.GetUser(ctx, &userspb.GetUserRequest{Id: alice.Id})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(alice, got))
+
+	updated, err := c.UpdateUser(ctx, &userspb.UpdateUserRequest{Id: alice.Id, DisplayName: proto.String("Alicia")})
+	require.NoError(t, err)
+	assert.Equal(t, "Alicia", updated.DisplayName)
+	assert.Equal(t, "alice@email.com", updated.Email)
+
+	suspended, err := c.SetUserStatus(ctx, &userspb.SetUserStatusRequest{Id: alice.Id, Status: "suspended"})
+	require.NoError(t, err)
+	assert.Equal(t, "suspended", suspended.Status)
+
+	found, err := c.ListUsers(ctx, &userspb.ListUsersRequest{Email: "ALICE@email.com"})
+	require.NoError(t, err)
+	require.Len(t, found.Users, 1)
+	assert.Equal(t, alice.Id, found.Users[0].Id)
+
+	_, err = c.DeleteUser(ctx, &userspb.DeleteUserRequest{Id: alice.Id})
+	require.NoError(t, err)
+
+	found, err = c.ListUsers(ctx, &userspb.ListUsersRequest{Email: "alice@email.com"})
+	require.NoError(t, err)
+	assert.Empty(t, found.Users)
+}
+
+func TestGRPCErrorCodes(t *testing.T) {
+	c := newGRPCTestClient(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusDeactivated},
+		},
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"get missing user", func() error {
+			_, err := c.GetUser(ctx, &userspb.GetUserRequest{Id: 42})
+			return err
+		}, codes.NotFound},
+		{"delete missing user", func() error {
+			_, err := c.DeleteUser(ctx, &userspb.DeleteUserRequest{Id: 42})
+			return err
+		}, codes.NotFound},
+		{"create with taken email", func() error {
+			_, err := c.CreateUser(ctx, &userspb.CreateUserRequest{DisplayName: "Alice2", Email: "alice@email.com"})
+			return err
+		}, codes.AlreadyExists},
+		{"update to taken email", func() error {
+			_, err := c.UpdateUser(ctx, &userspb.UpdateUserRequest{Id: 2, Email: proto.String("alice@email.com")})
+			return err
+		}, codes.AlreadyExists},
+		{"create suspended user", func() error {
+			_, err := c.CreateUser(ctx, &userspb.CreateUserRequest{DisplayName: "Eve", Status: "suspended"})
+			return err
+		}, codes.InvalidArgument},
+		{"set unknown status", func() error {
+			_, err := c.SetUserStatus(ctx, &userspb.SetUserStatusRequest{Id: 1, Status: "invited"})
+			return err
+		}, codes.InvalidArgument},
+		{"reactivate deactivated user", func() error {
+			_, err := c.SetUserStatus(ctx, &userspb.SetUserStatusRequest{Id: 2, Status: "active"})
+			return err
+		}, codes.FailedPrecondition},
+		{"invalid page size", func() error {
+			_, err := c.ListUsers(ctx, &userspb.ListUsersRequest{PageSize: maxPageLimit + 1})
+			return err
+		}, codes.InvalidArgument},
+		{"invalid page token", func() error {
+			_, err := c.ListUsers(ctx, &userspb.ListUsersRequest{PageToken: "x"})
+			return err
+		}, codes.InvalidArgument},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.code, status.Code(tc.call()))
+		})
+	}
+}
+
+func TestGRPCListUsersPagination(t *testing.T) {
+	c := newGRPCTestClient(t, UserStore{List: UserList{}})
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		_, err := dbCreateUser(context.Background(), fmt.Sprint("User", i), fmt.Sprintf("user%d@email.com", i), StatusActive)
+		require.NoError(t, err)
+	}
+
+	ids := []uint32{}
+	req := &userspb.ListUsersRequest{PageSize: 2}
+	for pages := 1; ; pages++ {
+		resp, err := c.ListUsers(ctx, req)
+		require.NoError(t, err)
+		for _, u := range resp.Users {
+			ids = append(ids, u.Id)
+		}
+		if resp.NextPageToken == "" {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	assert.Equal(t, []uint32{1, 2, 3, 4, 5}, ids)
+}
+
+func TestGRPCTenantsAndRateLimit(t *testing.T) {
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: {DisplayName: "Alice", Status: StatusActive}}})
+	config.RateLimitReads, config.RateLimitWrites = 2, 1
+	require.NoError(t, createTenant("acme"))
+	c := dialGRPCTestServer(t)
+
+	acme := metadata.AppendToOutgoingContext(context.Background(), grpcTenantMetadata, "acme")
+	_, err := c.CreateUser(acme, &userspb.CreateUserRequest{DisplayName: "Bob"})
+	require.NoError(t, err)
+	list, err := c.ListUsers(acme, &userspb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Users, 1)
+	assert.Equal(t, "Bob", list.Users[0].DisplayName)
+
+	_, err = c.CreateUser(acme, &userspb.CreateUserRequest{DisplayName: "Carol"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	list, err = c.ListUsers(context.Background(), &userspb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Users, 1)
+	assert.Equal(t, "Alice", list.Users[0].DisplayName)
+	var header metadata.MD
+	_, err = c.ListUsers(context.Background(), &userspb.ListUsersRequest{}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"30"}, header.Get("retry-after"))
+
+	missing := metadata.AppendToOutgoingContext(context.Background(), grpcTenantMetadata, "missing")
+	_, err = c.GetUser(missing, &userspb.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
 )
 
+const maxPageLimit = 1000
+
 func parseUserId(r *http.Request) (id uint, err error) {
 	stringId := chi.URLParam(r, "id")
 	id64, err := strconv.ParseUint(stringId, 10, 32)
@@ -15,3 +19,55 @@ func parseUserId(r *http.Request) (id uint, err error) {
 	}
 	return uint(id64), nil
 }
+
+// page selects a slice of a list ordered by id: up to limit items with an id
+// greater than after. A zero limit returns everything.
+type page struct {
+	after uint
+	limit int
+}
+
+func parsePage(r *http.Request) (p page, err error) {
+	q := r.URL.Query()
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid after: %w", err)
+		}
+		p.after = uint(after)
+	}
+	if v := q.Get("limit"); v != "" {
+		if p.limit, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("invalid limit: %w", err)
+		}
+		if p.limit < 1 || p.limit > maxPageLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return
+}
+
+// apply returns the ids on the page and whether more ids follow it.
+func (p page) apply(ids []uint) (pageIds []uint, more bool) {
+	start := 0
+	for start < len(ids) && ids[start] <= p.after {
+		start++
+	}
+	ids = ids[start:]
+
+	if p.limit > 0 && len(ids) > p.limit {
+		return ids[:p.limit], true
+	}
+	return ids, false
+}
+
+// nextLink returns a Link header value pointing at the page after lastId.
+func (p page) nextLink(r *http.Request, lastId uint) string {
+	q := url.Values{}
+	for k, v := range r.URL.Query() {
+		q[k] = v
+	}
+	q.Set("after", strconv.FormatUint(uint64(lastId), 10))
+	q.Set("limit", strconv.Itoa(p.limit))
+	return fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, q.Encode())
+}
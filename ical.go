@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	calendarMediaType = "text/calendar"
+	calendarProductId = "-//refactoring//users//EN"
+	// calendarLineLength is the length in octets lines are folded at.
+	calendarLineLength = 75
+)
+
+// isCalendar reports whether v is a conference or a list of them, which is
+// all the iCalendar format can represent.
+func isCalendar(v interface{}) bool {
+	switch v := v.(type) {
+	case *ConferenceResponse:
+		return true
+	case []render.Renderer:
+		for _, item := range v {
+			if _, ok := item.(*ConferenceResponse); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// encodeCalendar writes conferences as an RFC 5545 calendar with one event
+// each.
+func encodeCalendar(w io.Writer, v interface{}) error {
+	var conferences []*ConferenceResponse
+	switch v := v.(type) {
+	case *ConferenceResponse:
+		conferences = append(conferences, v)
+	case []render.Renderer:
+		for _, item := range v {
+			conferences = append(conferences, item.(*ConferenceResponse))
+		}
+	default:
+		return fmt.Errorf("icalendar can only represent conferences")
+	}
+
+	cw := &calendarWriter{w: w}
+	cw.line("BEGIN:VCALENDAR")
+	cw.line("VERSION:2.0")
+	cw.line("PRODID:" + calendarProductId)
+	cw.line("CALSCALE:GREGORIAN")
+	cw.line("METHOD:PUBLISH")
+	for _, c := range conferences {
+		cw.event(c)
+	}
+	cw.line("END:VCALENDAR")
+	return cw.err
+}
+
+type calendarWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *calendarWriter) event(c *ConferenceResponse) {
+	cw.line("BEGIN:VEVENT")
+	cw.line("UID:" + c.uid)
+	cw.line("DTSTAMP:" + calendarTime(c.UpdatedAt))
+	cw.line("CREATED:" + calendarTime(c.CreatedAt))
+	cw.line("LAST-MODIFIED:" + calendarTime(c.UpdatedAt))
+	cw.line("DTSTART:" + calendarTime(c.Start))
+	cw.line("DTEND:" + calendarTime(c.End))
+	if c.Recurrence != "" {
+		cw.line("RRULE:" + c.Recurrence)
+	}
+	cw.line("SUMMARY:" + calendarText(c.Title))
+	if owner, ok := c.users[c.Owner]; ok && calendarAddress(owner.Email) {
+		cw.line("ORGANIZER;CN=" + calendarParam(owner.DisplayName) + ":mailto:" + owner.Email)
+	}
+	for _, id := range c.Participants {
+		if u, ok := c.users[id]; ok && calendarAddress(u.Email) {
+			cw.line("ATTENDEE;CN=" + calendarParam(u.DisplayName) + ";ROLE=REQ-PARTICIPANT:mailto:" + u.Email)
+		}
+	}
+	cw.line("END:VEVENT")
+}
+
+// line writes a content line, folded after calendarLineLength octets
+// without splitting characters.
+func (cw *calendarWriter) line(s string) {
+	if cw.err != nil {
+		return
+	}
+	b := &strings.Builder{}
+	width := 0
+	for _, r := range s {
+		if n := utf8.RuneLen(r); width+n > calendarLineLength {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += utf8.RuneLen(r)
+	}
+	b.WriteString("\r\n")
+	_, cw.err = io.WriteString(cw.w, b.String())
+}
+
+// calendarAddress reports whether email can follow mailto: in a content
+// line. Users stored before emails were checked may have ones that can't.
+func calendarAddress(email string) bool {
+	return email != "" && checkEmail(email) == nil
+}
+
+func calendarTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+var calendarTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func calendarText(s string) string {
+	return calendarTextEscaper.Replace(s)
+}
+
+// calendarParam quotes a parameter value, which can't contain quotes or
+// control characters.
+func calendarParam(s string) string {
+	return `"` + strings.Map(func(r rune) rune {
+		if r == '"' || r < ' ' {
+			return -1
+		}
+		return r
+	}, s) + `"`
+}
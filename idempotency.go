@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// maxIdempotentBodySize is how much of a request is read to fingerprint
+	// it, enough for the largest request the idempotent routes accept.
+	maxIdempotentBodySize = maxImportSize
+)
+
+// idempotencyRecord is a response stored for replay on retries of the
+// request it answered.
+type idempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// idempotencyStore keeps idempotency records in a JSON file, so retries are
+// recognized across restarts. Records expire after ttl.
+type idempotencyStore struct {
+	mu       sync.Mutex
+	path     string
+	ttl      time.Duration
+	records  map[string]idempotencyRecord
+	inFlight map[string]bool
+}
+
+func newIdempotencyStore(path string, ttl time.Duration) *idempotencyStore {
+	s := &idempotencyStore{
+		path:     path,
+		ttl:      ttl,
+		records:  map[string]idempotencyRecord{},
+		inFlight: map[string]bool{},
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Reading idempotency keys: %v", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(dat, &s.records); err != nil {
+		log.Errorf("Reading idempotency keys: %v", err)
+	}
+	s.expire(time.Now())
+	return s
+}
+
+// begin returns the record stored for key, or reserves the key for a new
+// request when there is none.
+func (s *idempotencyStore) begin(key string) (rec idempotencyRecord, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	if rec, found = s.records[key]; found {
+		return
+	}
+	if s.inFlight[key] {
+		return rec, false, IdempotencyKeyInUse
+	}
+	s.inFlight[key] = true
+	return
+}
+
+// finish releases key and stores rec for it, unless rec is nil.
+func (s *idempotencyStore) finish(key string, rec *idempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inFlight, key)
+	if rec == nil {
+		return nil
+	}
+
+	s.records[key] = *rec
+	dat, err := json.Marshal(s.records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, dat, 0644)
+}
+
+func (s *idempotencyStore) expire(now time.Time) {
+	for key, rec := range s.records {
+		if now.Sub(rec.CreatedAt) > s.ttl {
+			delete(s.records, key)
+		}
+	}
+}
+
+// idempotencyFingerprint identifies a request, so a key reused for a
+// different request is detected. Accept is part of it, as the stored
+// response is in the media type negotiated for the first request.
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n%s\n%s\n", r.Method, r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Accept"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyScope namespaces a key by the tenant and the caller. Keys are
+// chosen by clients, so neither tenants nor callers within a tenant may
+// replay each other's responses. The parts are quoted, as subjects taken
+// from tokens may contain any separator.
+func idempotencyScope(ctx context.Context, key string) string {
+	subject := ""
+	if p := principalFrom(ctx); p != nil {
+		subject = p.Subject
+	}
+	return fmt.Sprintf("%q %q %q", tenantFrom(ctx), subject, key)
+}
+
+// idempotent makes requests carrying an Idempotency-Key header safe to
+// retry: the first response is stored and replayed for later requests with
+// the same key. Server errors aren't stored, so they can be retried.
+func (s *idempotencyStore) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength || strings.TrimSpace(key) != key {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("%w: must be 1 to %d characters without surrounding spaces", InvalidIdempotencyKey, maxIdempotencyKeyLength)))
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				render.Render(w, r, ErrTooLarge(fmt.Errorf("requests with an %s may be up to %d bytes", idempotencyKeyHeader, maxIdempotentBodySize)))
+				return
+			}
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := idempotencyFingerprint(r, body)
+
+		key = idempotencyScope(r.Context(), key)
+		rec, found, err := s.begin(key)
+		if errors.Is(err, IdempotencyKeyInUse) {
+			render.Render(w, r, ErrConflict(err))
+			return
+		}
+		if found {
+			if rec.Fingerprint != fingerprint {
+				render.Render(w, r, ErrUnprocessable(IdempotencyKeyReused))
+				return
+			}
+			for k, v := range rec.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		}
+
+		// released without a record if the handler fails or panics
+		var stored *idempotencyRecord
+		defer func() {
+			if err := s.finish(key, stored); err != nil {
+				log.Errorf("Storing idempotency key: %v", err)
+			}
+		}()
+
+		buf := &bytes.Buffer{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(buf)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= 500 {
+			return
+		}
+
+		header := http.Header{}
+		for _, k := range []string{"Content-Type", "Location", "Link"} {
+			if v := w.Header().Values(k); len(v) > 0 {
+				header[k] = v
+			}
+		}
+		stored = &idempotencyRecord{
+			Fingerprint: fingerprint,
+			CreatedAt:   time.Now(),
+			Status:      status,
+			Header:      header,
+			Body:        buf.Bytes(),
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newIdempotencyTestServer(t *testing.T) *httptest.Server {
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func createUserWithKey(t *testing.T, ts *httptest.Server, key, body string) (*http.Response, string) {
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	resp, respBody := testRequest(t, ts, req)
+	return resp, string(respBody)
+}
+
+func TestIdempotentCreateUser(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	ts := newIdempotencyTestServer(t)
+
+	alice := `{"display_name":"Alice","email":"alice@email.com"}`
+	resp, first := createUserWithKey(t, ts, "key-1", alice)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, first)
+	assert.Empty(t, resp.Header.Get(idempotentReplayedHeader))
+
+	resp, retried := createUserWithKey(t, ts, "key-1", alice)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, retried)
+	assert.Equal(t, "true", resp.Header.Get(idempotentReplayedHeader))
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, first, retried)
+
+	resp, body := createUserWithKey(t, ts, "key-1", `{"display_name":"Bob","email":"bob@email.com"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, body)
+
+	resp, body = createUserWithKey(t, ts, "key-2", `{"display_name":"Bob","email":"bob@email.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	resp, body = createUserWithKey(t, ts, "", `{"display_name":"Carol","email":"carol@email.com"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	resp, body = createUserWithKey(t, ts, strings.Repeat("k", maxIdempotencyKeyLength+1), alice)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Len(t, us.List, 3)
+}
+
+func TestIdempotencyKeysSurviveRestart(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	alice := `{"display_name":"Alice","email":"alice@email.com"}`
+	resp, first := createUserWithKey(t, newIdempotencyTestServer(t), "key-1", alice)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, first)
+
+	resp, retried := createUserWithKey(t, newIdempotencyTestServer(t), "key-1", alice)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, retried)
+	assert.Equal(t, "true", resp.Header.Get(idempotentReplayedHeader))
+	assert.Equal(t, first, retried)
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Len(t, us.List, 1)
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.IdempotencyTTL = time.Millisecond
+	ts := newIdempotencyTestServer(t)
+
+	resp, body := createUserWithKey(t, ts, "key-1", `{"display_name":"Alice","email":"alice@email.com"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+	time.Sleep(5 * time.Millisecond)
+
+	resp, body = createUserWithKey(t, ts, "key-1", `{"display_name":"Bob","email":"bob@email.com"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+	assert.Empty(t, resp.Header.Get(idempotentReplayedHeader))
+}
+
+func TestServerErrorsAreNotStored(t *testing.T) {
+	store := newIdempotencyStore(t.TempDir()+"/idempotency.json", time.Hour)
+	calls := 0
+	handler := store.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusCreated, http.StatusCreated} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Code)
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyKeysAreScopedToCallers(t *testing.T) {
+	store := newIdempotencyStore(t.TempDir()+"/idempotency.json", time.Hour)
+	calls := 0
+	handler := store.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	send := func(subject, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		req.Header.Set("Accept", accept)
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{Subject: subject, Role: RoleEditor}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusCreated, send("apikey:alice", "application/json").Code)
+	rec := send("apikey:alice", "application/json")
+	assert.Equal(t, "true", rec.Header().Get(idempotentReplayedHeader))
+	rec = send("apikey:bob", "application/json")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get(idempotentReplayedHeader), "callers don't replay each other's responses")
+	assert.Equal(t, 2, calls)
+
+	rec = send("apikey:alice", "application/xml")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "the response was negotiated for another media type")
+}
+
+func TestIdempotentRequestTooLarge(t *testing.T) {
+	store := newIdempotencyStore(t.TempDir()+"/idempotency.json", time.Hour)
+	handler := store.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler must not be called")
+	}))
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", maxIdempotentBodySize+1)))
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
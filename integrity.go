@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recoverUserStore checks the store file of the tenant of ctx on startup. A
+// corrupted file is moved aside and replaced by the newest of its backups
+// that passes verification.
+func recoverUserStore(ctx context.Context) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	path := storePathFrom(ctx)
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = decodeUserStore(dat)
+	if !errors.Is(err, StoreCorrupted) {
+		return
+	}
+	log.Errorf("Store integrity check failed: %v", err)
+
+	quarantine := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102T150405"))
+	if err = os.Rename(path, quarantine); err != nil {
+		return
+	}
+	log.Warnf("Corrupted store moved to %s", quarantine)
+
+	backups, err := listBackups(ctx)
+	if err != nil {
+		return
+	}
+	for _, b := range backups {
+		dat, err := readBackup(ctx, b.Name)
+		var us UserStore
+		if err == nil {
+			us, err = decodeBackup(dat)
+		}
+		if err != nil {
+			log.Warnf("Skipping backup %s: %v", b.Name, err)
+			continue
+		}
+
+		if err := (&jsonStore{path: path}).Save(us); err != nil {
+			return err
+		}
+		log.Warnf("Store recovered from backup %s", b.Name)
+		return nil
+	}
+
+	return fmt.Errorf("%w: no usable backup found in %s", StoreCorrupted, backupDirFrom(ctx))
+}
+
+type fsckProblem struct {
+	Description string
+	Repaired    bool
+}
+
+// fsckUserStore reports consistency problems in us. With repair set it
+// fixes them in place:
+//   - Increment lower than the highest id is raised to it;
+//   - an email used by several users is kept by the oldest one and cleared
+//     on the others;
+//   - an unknown status is replaced by active;
+//   - group members and subgroups that don't exist are removed;
+//   - conferences of owners that don't exist are deleted, participants
+//     that don't exist are removed;
+//   - users that don't exist are removed from address books, and their own
+//     address books are deleted;
+//   - external ids and source DNs of users that don't exist are deleted.
+func fsckUserStore(us *UserStore, repair bool) (problems []fsckProblem) {
+	ids := make([]uint, 0, len(us.List))
+	for id := range us.List {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > 0 && us.Increment < ids[len(ids)-1] {
+		problems = append(problems, fsckProblem{
+			Description: fmt.Sprintf("increment %d is lower than the highest user id %d", us.Increment, ids[len(ids)-1]),
+			Repaired:    repair,
+		})
+		if repair {
+			us.Increment = ids[len(ids)-1]
+		}
+	}
+
+	emailOwners := map[string]uint{}
+	for _, id := range ids {
+		u := us.List[id]
+
+		if !u.Status.Valid() {
+			problems = append(problems, fsckProblem{
+				Description: fmt.Sprintf("user %d has invalid status %q", id, u.Status),
+				Repaired:    repair,
+			})
+			if repair {
+				u.Status = StatusActive
+			}
+		}
+
+		email := normalizeEmail(u.Email)
+		if email != "" {
+			if owner, ok := emailOwners[email]; ok {
+				problems = append(problems, fsckProblem{
+					Description: fmt.Sprintf("user %d has the same email %q as user %d", id, u.Email, owner),
+					Repaired:    repair,
+				})
+				if repair {
+					u.Email = ""
+				}
+			} else {
+				emailOwners[email] = id
+			}
+		}
+
+		us.List[id] = u
+	}
+
+	for _, gid := range sortedGroupIds(&us.Groups) {
+		g := us.Groups[gid]
+		for _, ref := range []struct {
+			kind   memberKind
+			ids    *[]uint
+			exists func(id uint) bool
+		}{
+			{memberUser, &g.Members, func(id uint) bool { _, ok := us.List[id]; return ok }},
+			{memberGroup, &g.Subgroups, func(id uint) bool { _, ok := us.Groups[id]; return ok }},
+		} {
+			for _, id := range *ref.ids {
+				if ref.exists(id) {
+					continue
+				}
+				problems = append(problems, fsckProblem{
+					Description: fmt.Sprintf("group %d contains missing %s %d", gid, ref.kind, id),
+					Repaired:    repair,
+				})
+				if repair {
+					*ref.ids, _ = removeId(*ref.ids, id)
+				}
+			}
+		}
+		if repair {
+			us.Groups[gid] = g
+		}
+	}
+
+	for _, cid := range sortedConferenceIds(&us.Conferences) {
+		c := us.Conferences[cid]
+		if _, ok := us.List[c.Owner]; !ok {
+			problems = append(problems, fsckProblem{
+				Description: fmt.Sprintf("conference %d is owned by missing user %d", cid, c.Owner),
+				Repaired:    repair,
+			})
+			if repair {
+				delete(us.Conferences, cid)
+			}
+			continue
+		}
+		for _, uid := range c.Participants {
+			if _, ok := us.List[uid]; ok {
+				continue
+			}
+			problems = append(problems, fsckProblem{
+				Description: fmt.Sprintf("conference %d has missing participant %d", cid, uid),
+				Repaired:    repair,
+			})
+			if repair {
+				c.Participants, _ = removeId(c.Participants, uid)
+			}
+		}
+		if repair {
+			us.Conferences[cid] = c
+		}
+	}
+
+	missing := map[uint]bool{}
+	for uid, ab := range us.AddressBooks {
+		refs := []uint{uid}
+		for id := range ab.Contacts {
+			refs = append(refs, id)
+		}
+		for id := range ab.Requests {
+			refs = append(refs, id)
+		}
+		refs = append(refs, ab.Blocked...)
+		for _, id := range refs {
+			if _, ok := us.List[id]; !ok {
+				missing[id] = true
+			}
+		}
+	}
+	for _, id := range sortedIds(missing) {
+		problems = append(problems, fsckProblem{
+			Description: fmt.Sprintf("address books reference missing user %d", id),
+			Repaired:    repair,
+		})
+		if repair {
+			removeUserFromAddressBooks(us, id)
+		}
+	}
+
+	externalIdUsers := map[uint]bool{}
+	for id := range us.ExternalIds {
+		externalIdUsers[id] = true
+	}
+	for _, id := range sortedIds(externalIdUsers) {
+		if _, ok := us.List[id]; ok {
+			continue
+		}
+		problems = append(problems, fsckProblem{
+			Description: fmt.Sprintf("external id %q belongs to missing user %d", us.ExternalIds[id], id),
+			Repaired:    repair,
+		})
+		if repair {
+			delete(us.ExternalIds, id)
+		}
+	}
+
+	sourceDNUsers := map[uint]bool{}
+	for id := range us.SourceDNs {
+		sourceDNUsers[id] = true
+	}
+	for _, id := range sortedIds(sourceDNUsers) {
+		if _, ok := us.List[id]; ok {
+			continue
+		}
+		problems = append(problems, fsckProblem{
+			Description: fmt.Sprintf("source DN %q belongs to missing user %d", us.SourceDNs[id], id),
+			Repaired:    repair,
+		})
+		if repair {
+			delete(us.SourceDNs, id)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumMismatchIsDetected(t *testing.T) {
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: {DisplayName: "Alice", Status: StatusActive}}})
+
+	dat, err := ioutil.ReadFile(config.StorePath)
+	require.NoError(t, err)
+	dat = bytes.Replace(dat, []byte("Alice"), []byte("Mallory"), 1)
+	require.NoError(t, ioutil.WriteFile(config.StorePath, dat, 0644))
+
+	_, err = getUserStore()
+	assert.ErrorIs(t, err, StoreCorrupted)
+}
+
+func TestRecoverUserStore(t *testing.T) {
+	alice := User{DisplayName: "Alice", Status: StatusActive}
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: alice}})
+
+	_, err := createBackup(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(config.StorePath, []byte(`{"increment":1,"list":{`), 0644))
+
+	require.NoError(t, recoverUserStore(context.Background()))
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, UserList{1: alice}, us.List)
+
+	quarantined, err := filepath.Glob(config.StorePath + ".corrupt-*")
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+}
+
+func TestRecoverUserStoreWithoutBackups(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	require.NoError(t, ioutil.WriteFile(config.StorePath, []byte(`not json`), 0644))
+
+	assert.ErrorIs(t, recoverUserStore(context.Background()), StoreCorrupted)
+}
+
+func TestFsck(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 1,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Alice2", Email: "Alice@email.com", Status: StatusActive},
+			3: {DisplayName: "Bob", Email: "bob@email.com", Status: "unknown"},
+		},
+		GroupIncrement:      1,
+		Groups:              GroupList{1: {Name: "Team", Members: []uint{1, 9}, Subgroups: []uint{7}}},
+		ConferenceIncrement: 2,
+		Conferences: ConferenceList{
+			1: {Title: "Standup", Owner: 1, Participants: []uint{2, 8}},
+			2: {Title: "Retro", Owner: 8},
+		},
+		AddressBooks: map[uint]AddressBook{
+			1: {Contacts: ContactList{2: {}, 6: {}}, Blocked: []uint{5}},
+			6: {Contacts: ContactList{1: {}}},
+		},
+		ExternalIds: map[uint]string{1: "00u1", 6: "00u6"},
+		SourceDNs:   map[uint]string{1: "uid=alice,ou=people,dc=example,dc=com", 7: "uid=gone,ou=people,dc=example,dc=com"},
+	})
+
+	stdout, stderr := &strings.Builder{}, &strings.Builder{}
+	assert.Equal(t, exitError, runFsckCommand(nil, stdout, stderr))
+	assert.Contains(t, stdout.String(), "increment 1 is lower than the highest user id 3")
+	assert.Contains(t, stdout.String(), "user 2 has the same email")
+	assert.Contains(t, stdout.String(), `user 3 has invalid status "unknown"`)
+	assert.Contains(t, stdout.String(), "group 1 contains missing user 9")
+	assert.Contains(t, stdout.String(), "group 1 contains missing group 7")
+	assert.Contains(t, stdout.String(), "conference 1 has missing participant 8")
+	assert.Contains(t, stdout.String(), "conference 2 is owned by missing user 8")
+	assert.Contains(t, stdout.String(), "address books reference missing user 5")
+	assert.Contains(t, stdout.String(), "address books reference missing user 6")
+	assert.Contains(t, stdout.String(), `external id "00u6" belongs to missing user 6`)
+	assert.Contains(t, stdout.String(), `source DN "uid=gone,ou=people,dc=example,dc=com" belongs to missing user 7`)
+
+	stdout.Reset()
+	assert.Equal(t, exitOK, runFsckCommand([]string{"-repair"}, stdout, stderr))
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Equal(t, uint(3), us.Increment)
+	assert.Equal(t, "alice@email.com", us.List[1].Email)
+	assert.Equal(t, "", us.List[2].Email)
+	assert.Equal(t, StatusActive, us.List[3].Status)
+	assert.Equal(t, []uint{1}, us.Groups[1].Members)
+	assert.Empty(t, us.Groups[1].Subgroups)
+	assert.Equal(t, []uint{2}, us.Conferences[1].Participants)
+	assert.NotContains(t, us.Conferences, uint(2))
+	assert.Equal(t, map[uint]AddressBook{1: {Contacts: ContactList{2: {}}}}, us.AddressBooks)
+	assert.Equal(t, map[uint]string{1: "00u1"}, us.ExternalIds)
+	assert.Equal(t, map[uint]string{1: "uid=alice,ou=people,dc=example,dc=com"}, us.SourceDNs)
+
+	stdout.Reset()
+	assert.Equal(t, exitOK, runFsckCommand(nil, stdout, stderr))
+	assert.Equal(t, "ok\n", stdout.String())
+}
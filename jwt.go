@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+// jwtLeeway allows for clock skew between us and the identity provider.
+const jwtLeeway = time.Minute
+
+// jwtAlgorithms are the signature algorithms accepted for bearer tokens.
+var jwtAlgorithms = []jose.SignatureAlgorithm{jose.RS256, jose.ES256}
+
+// scopeRoles maps the scopes of a token to the role they grant, a token
+// gets the highest role of its scopes.
+var scopeRoles = map[string]Role{
+	"users:read":  RoleReader,
+	"users:write": RoleEditor,
+	"users:admin": RoleAdmin,
+}
+
+// jwtClaims are the claims read from bearer tokens.
+type jwtClaims struct {
+	jwt.Claims
+	// Scope is a space separated list of scopes, as in RFC 8693.
+	Scope string `json:"scope"`
+	// Email links the caller to the user with this address.
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	// Tenant restricts the token to the users of a tenant.
+	Tenant string `json:"tenant"`
+}
+
+// jwtVerifier validates bearer tokens issued by our identity provider
+// against the keys of a JWKS file. Like the API keys the file is reloaded
+// when it changes, so keys can be rotated without a restart.
+type jwtVerifier struct {
+	mu       sync.Mutex
+	path     string
+	issuer   string
+	audience string
+	// loaded is the file keys were read from, nil before the first load.
+	loaded os.FileInfo
+	keys   jose.JSONWebKeySet
+	now    func() time.Time
+}
+
+func newJWTVerifier(path, issuer, audience string) *jwtVerifier {
+	return &jwtVerifier{path: path, issuer: issuer, audience: audience, now: time.Now}
+}
+
+// load rereads the JWKS file if it changed since the last load.
+func (v *jwtVerifier) load() error {
+	fi, err := os.Stat(v.path)
+	if err != nil {
+		return err
+	}
+	if v.loaded != nil && os.SameFile(fi, v.loaded) && fi.ModTime().Equal(v.loaded.ModTime()) {
+		return nil
+	}
+	// not retried until the file changes again
+	v.loaded = fi
+
+	dat, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+	keys := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(dat, &keys); err != nil {
+		return fmt.Errorf("reading JWKS: %w", err)
+	}
+	for i, k := range keys.Keys {
+		// files may hold the private keys, only their public half is used
+		keys.Keys[i] = k.Public()
+		if !keys.Keys[i].Valid() {
+			return fmt.Errorf("reading JWKS: key %q is not an RSA or EC key", k.KeyID)
+		}
+	}
+	v.keys = keys
+	return nil
+}
+
+// keySet returns the current keys. A broken file is logged and the keys
+// loaded before are kept, so a bad rotation doesn't lock everyone out.
+func (v *jwtVerifier) keySet() jose.JSONWebKeySet {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.load(); err != nil {
+		log.Errorf("Loading JWKS from %s: %v", v.path, err)
+	}
+	return v.keys
+}
+
+// verify checks the signature, issuer, audience and expiry of token and
+// returns the caller it identifies.
+func (v *jwtVerifier) verify(token string) (*Principal, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidToken, err)
+	}
+
+	keys := v.keySet()
+	candidates := keys.Keys
+	if kid := tok.Headers[0].KeyID; kid != "" {
+		candidates = keys.Key(kid)
+	}
+
+	claims := jwtClaims{}
+	verified := false
+	for _, k := range candidates {
+		if k.Use == "enc" {
+			continue
+		}
+		if err := tok.Claims(k.Key, &claims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature not made by a known key", InvalidToken)
+	}
+
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("%w: no expiry", InvalidToken)
+	}
+	expected := jwt.Expected{Issuer: v.issuer, AnyAudience: jwt.Audience{v.audience}, Time: v.now()}
+	if err := claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", InvalidToken)
+	}
+
+	p := &Principal{Subject: "jwt:" + claims.Subject, Role: scopesRole(claims.Scope), Tenant: claims.Tenant}
+	// only an email the issuer says it verified proves who the caller is
+	if claims.EmailVerified != nil && *claims.EmailVerified {
+		p.Email = claims.Email
+	}
+	return p, nil
+}
+
+// scopesRole returns the highest role granted by scopes, none if no scope
+// is known.
+func scopesRole(scopes string) Role {
+	var role Role
+	for _, scope := range strings.Fields(scopes) {
+		if r, ok := scopeRoles[scope]; ok && !role.Includes(r) {
+			role = r
+		}
+	}
+	return role
+}
+
+// checkJWTConfig fails when bearer tokens are enabled without an issuer
+// and audience to check, or with an unreadable JWKS file.
+func checkJWTConfig() error {
+	if config.JWKSPath == "" {
+		return nil
+	}
+	if config.JWTIssuer == "" || config.JWTAudience == "" {
+		return errors.New("USERS_JWT_ISSUER and USERS_JWT_AUDIENCE are required with USERS_JWKS_FILE")
+	}
+	return newJWTVerifier(config.JWKSPath, config.JWTIssuer, config.JWTAudience).load()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"refactoring/userspb"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testIssuer   = "https://id.example.com/"
+	testAudience = "users-api"
+)
+
+// testIdP signs tokens like our identity provider, with keys published in
+// a JWKS file.
+type testIdP struct {
+	t    *testing.T
+	path string
+	keys map[string]jose.JSONWebKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{t: t, path: filepath.Join(t.TempDir(), "jwks.json"), keys: map[string]jose.JSONWebKey{}}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	idp.keys["rsa"] = jose.JSONWebKey{Key: rsaKey, KeyID: "rsa", Algorithm: string(jose.RS256), Use: "sig"}
+	idp.keys["ec"] = jose.JSONWebKey{Key: ecKey, KeyID: "ec", Algorithm: string(jose.ES256), Use: "sig"}
+	idp.publish("rsa", "ec")
+	return idp
+}
+
+// publish writes the public halves of the keys with kids to the JWKS file.
+func (idp *testIdP) publish(kids ...string) {
+	set := jose.JSONWebKeySet{}
+	for _, kid := range kids {
+		k := idp.keys[kid]
+		set.Keys = append(set.Keys, k.Public())
+	}
+	dat, err := json.Marshal(set)
+	require.NoError(idp.t, err)
+	require.NoError(idp.t, writeFileAtomic(idp.path, dat, 0644))
+}
+
+// sign returns a token signed with the key kid, claims override the
+// defaults of a valid token.
+func (idp *testIdP) sign(kid string, claims map[string]interface{}) string {
+	k := idp.keys[kid]
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(k.Algorithm), Key: k}, nil)
+	require.NoError(idp.t, err)
+
+	all := map[string]interface{}{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "alice",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"scope": "users:read",
+	}
+	for name, v := range claims {
+		if v == nil {
+			delete(all, name)
+			continue
+		}
+		all[name] = v
+	}
+	token, err := jwt.Signed(signer).Claims(all).Serialize()
+	require.NoError(idp.t, err)
+	return token
+}
+
+// swapPayload returns token with the claims of other.
+func swapPayload(token, other string) string {
+	parts, otherParts := strings.Split(token, "."), strings.Split(other, ".")
+	return parts[0] + "." + otherParts[1] + "." + parts[2]
+}
+
+func TestScopesRole(t *testing.T) {
+	tests := []struct {
+		scopes string
+		want   Role
+	}{
+		{"", ""},
+		{"openid profile", ""},
+		{"users:read", RoleReader},
+		{"openid users:write", RoleEditor},
+		{"users:admin users:read", RoleAdmin},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, scopesRole(tc.scopes), tc.scopes)
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	v := newJWTVerifier(idp.path, testIssuer, testAudience)
+
+	p, err := v.verify(idp.sign("rsa", map[string]interface{}{"scope": "openid users:write"}))
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "jwt:alice", Role: RoleEditor}, p)
+
+	p, err = v.verify(idp.sign("ec", map[string]interface{}{"aud": []string{"other", testAudience}}))
+	require.NoError(t, err)
+	assert.Equal(t, RoleReader, p.Role)
+
+	hmacSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0123456789abcdef0123456789abcdef")}, nil)
+	require.NoError(t, err)
+	hmacToken, err := jwt.Signed(hmacSigner).Claims(jwt.Claims{Issuer: testIssuer, Subject: "alice", Audience: jwt.Audience{testAudience}, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}).Serialize()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"garbage", "not.a.token"},
+		{"expired", idp.sign("rsa", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})},
+		{"without expiry", idp.sign("rsa", map[string]interface{}{"exp": nil})},
+		{"not yet valid", idp.sign("rsa", map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})},
+		{"other issuer", idp.sign("rsa", map[string]interface{}{"iss": "https://evil.example.com/"})},
+		{"other audience", idp.sign("ec", map[string]interface{}{"aud": "other"})},
+		{"without subject", idp.sign("ec", map[string]interface{}{"sub": nil})},
+		{"hmac", hmacToken},
+		{"tampered", swapPayload(idp.sign("rsa", nil), idp.sign("rsa", map[string]interface{}{"scope": "users:admin"}))},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := v.verify(tc.token)
+			assert.ErrorIs(t, err, InvalidToken)
+		})
+	}
+
+	t.Run("reloads rotated keys", func(t *testing.T) {
+		ecToken := idp.sign("ec", nil)
+		idp.publish("rsa")
+		_, err := v.verify(ecToken)
+		assert.ErrorIs(t, err, InvalidToken)
+		_, err = v.verify(idp.sign("rsa", nil))
+		assert.NoError(t, err)
+
+		// a broken file keeps the keys loaded before
+		require.NoError(t, ioutil.WriteFile(idp.path, []byte("{"), 0600))
+		_, err = v.verify(idp.sign("rsa", nil))
+		assert.NoError(t, err)
+	})
+}
+
+func TestBearerAuthorization(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+		},
+	})
+	idp := newTestIdP(t)
+	config.AuthRequired = true
+	config.JWKSPath, config.JWTIssuer, config.JWTAudience = idp.path, testIssuer, testAudience
+	require.NoError(t, checkJWTConfig())
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	reader := idp.sign("rsa", nil)
+	writer := idp.sign("ec", map[string]interface{}{"scope": "users:write"})
+	admin := idp.sign("rsa", map[string]interface{}{"scope": "users:admin"})
+	unscoped := idp.sign("rsa", map[string]interface{}{"scope": "openid"})
+	expired := idp.sign("rsa", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		authorization string
+		status        int
+	}{
+		{"reader lists", "GET", "/api/v1/users/", "", "Bearer " + reader, 200},
+		{"lowercase scheme", "GET", "/api/v1/users/1", "", "bearer " + reader, 200},
+		{"reader creates", "POST", "/api/v1/users/", `{"display_name":"Carol","email":"carol@email.com"}`, "Bearer " + reader, 403},
+		{"writer creates", "POST", "/api/v1/users/", `{"display_name":"Carol","email":"carol@email.com"}`, "Bearer " + writer, 201},
+		{"writer deletes", "DELETE", "/api/v1/users/2", "", "Bearer " + writer, 403},
+		{"admin deletes", "DELETE", "/api/v1/users/2", "", "Bearer " + admin, 200},
+		{"unscoped reads", "GET", "/api/v1/users/", "", "Bearer " + unscoped, 403},
+		{"expired", "GET", "/api/v1/users/", "", "Bearer " + expired, 401},
+		{"basic auth", "GET", "/api/v1/users/", "", "Basic YWxpY2U6c2VjcmV0", 401},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", tc.authorization)
+			resp, body := testRequest(t, ts, req)
+			require.Equal(t, tc.status, resp.StatusCode, string(body))
+		})
+	}
+
+	t.Run("invalid tokens are challenged", func(t *testing.T) {
+		req := mustRequest(t, "GET", ts.URL+"/api/v1/users/")
+		req.Header.Set("Authorization", "Bearer "+expired)
+		resp, _ := testRequest(t, ts, req)
+		assert.Equal(t, `Bearer error="invalid_token"`, resp.Header.Get("WWW-Authenticate"))
+	})
+
+	t.Run("subject is in the request context", func(t *testing.T) {
+		var got *Principal
+		h := authenticate(newAuthenticator(), renderAPIError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = principalFrom(r.Context())
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+writer)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		require.NotNil(t, got)
+		assert.Equal(t, "jwt:alice", got.Subject)
+	})
+}
+
+func TestBearerTokensDisabled(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	idp := newTestIdP(t)
+
+	_, err := newAuthenticator().principal("", "Bearer "+idp.sign("rsa", nil))
+	assert.ErrorIs(t, err, InvalidToken)
+
+	config.JWKSPath = idp.path
+	assert.Error(t, checkJWTConfig(), "issuer and audience are required")
+}
+
+func TestGRPCBearerAuthorization(t *testing.T) {
+	idp := newTestIdP(t)
+	// the server reads the config when it is created
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config.JWKSPath, config.JWTIssuer, config.JWTAudience = idp.path, testIssuer, testAudience
+
+	c := newGRPCTestClient(t, UserStore{
+		Increment: 1,
+		List:      UserList{1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}},
+	})
+	config.AuthRequired = true
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+idp.sign("ec", nil))
+	_, err := c.GetUser(ctx, &userspb.GetUserRequest{Id: 1})
+	assert.NoError(t, err)
+	_, err = c.DeleteUser(ctx, &userspb.DeleteUserRequest{Id: 1})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer nope")
+	_, err = c.GetUser(ctx, &userspb.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const ldifMediaType = "text/ldif"
+
+// ldifAttribute is an attribute value of an LDIF record. Names are lower
+// case and without options, so "cn;lang-en" is "cn".
+type ldifAttribute struct {
+	name  string
+	value string
+}
+
+// ldifModification is an add, delete or replace of a modify record.
+type ldifModification struct {
+	op     string
+	name   string
+	values []string
+}
+
+// ldifRecord is an RFC 2849 record. Content records, without a changetype,
+// are read as add records.
+type ldifRecord struct {
+	// line is the line the record starts on.
+	line       int
+	dn         string
+	changeType string
+
+	// attrs of add records
+	attrs []ldifAttribute
+	// mods of modify records
+	mods []ldifModification
+	// newRDN and newSuperior of modrdn records
+	newRDN      string
+	newSuperior string
+}
+
+// decodeLDIF reads LDIF into a list of records, it is only used by
+// importLDIF.
+func decodeLDIF(r io.Reader, v interface{}) error {
+	records, ok := v.(*[]ldifRecord)
+	if !ok {
+		return fmt.Errorf("ldif can only be decoded into LDIF records")
+	}
+	var err error
+	*records, err = readLDIF(r)
+	return err
+}
+
+// readLDIF reads the records of an LDIF file. Lines are unfolded like the
+// content lines of vCard, records are separated by blank lines.
+func readLDIF(r io.Reader) (records []ldifRecord, err error) {
+	lines, err := unfoldContentLines(r)
+	if err != nil {
+		return
+	}
+
+	var block []contentLine
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		rec, err := parseLDIFRecord(block, len(records) == 0)
+		block = nil
+		if err != nil || rec == nil {
+			return err
+		}
+		records = append(records, *rec)
+		return nil
+	}
+
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line.text, "#"):
+		case strings.TrimSpace(line.text) == "":
+			if err = flush(); err != nil {
+				return nil, err
+			}
+		default:
+			block = append(block, line)
+		}
+	}
+	if err = flush(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// parseLDIFRecord parses the lines of a record. The version line may only
+// precede the first record, a block holding nothing else returns nil.
+func parseLDIFRecord(block []contentLine, first bool) (*ldifRecord, error) {
+	at := func(i int) (ldifAttribute, error) {
+		a, err := parseLDIFLine(block[i].text)
+		if err != nil {
+			return a, fmt.Errorf("ldif: line %d: %w", block[i].number, err)
+		}
+		return a, nil
+	}
+
+	i := 0
+	a, err := at(i)
+	if err != nil {
+		return nil, err
+	}
+	if first && a.name == "version" {
+		if a.value != "1" {
+			return nil, fmt.Errorf("ldif: line %d: unsupported version %q", block[i].number, a.value)
+		}
+		if i++; i == len(block) {
+			return nil, nil
+		}
+		if a, err = at(i); err != nil {
+			return nil, err
+		}
+	}
+	if a.name != "dn" {
+		return nil, fmt.Errorf("ldif: line %d: record must start with dn, got %s", block[i].number, a.name)
+	}
+	rec := &ldifRecord{line: block[i].number, dn: strings.TrimSpace(a.value), changeType: "add"}
+	i++
+
+	// controls only matter to LDAP servers
+	for i < len(block) && strings.HasPrefix(strings.ToLower(block[i].text), "control:") {
+		i++
+	}
+	if i < len(block) {
+		if a, err = at(i); err != nil {
+			return nil, err
+		}
+		if a.name == "changetype" {
+			rec.changeType = strings.ToLower(a.value)
+			i++
+		}
+	}
+
+	switch rec.changeType {
+	case "add":
+		for ; i < len(block); i++ {
+			if a, err = at(i); err != nil {
+				return nil, err
+			}
+			rec.attrs = append(rec.attrs, a)
+		}
+
+	case "delete":
+		if i < len(block) {
+			return nil, fmt.Errorf("ldif: line %d: delete records have no attributes", block[i].number)
+		}
+
+	case "modrdn", "moddn":
+		rec.changeType = "modrdn"
+		for ; i < len(block); i++ {
+			if a, err = at(i); err != nil {
+				return nil, err
+			}
+			switch a.name {
+			case "newrdn":
+				rec.newRDN = strings.TrimSpace(a.value)
+			case "deleteoldrdn":
+				// users don't keep the attributes of RDNs
+			case "newsuperior":
+				rec.newSuperior = strings.TrimSpace(a.value)
+			default:
+				return nil, fmt.Errorf("ldif: line %d: unexpected %s in modrdn record", block[i].number, a.name)
+			}
+		}
+		if rec.newRDN == "" {
+			return nil, fmt.Errorf("ldif: line %d: modrdn record without newrdn", rec.line)
+		}
+
+	case "modify":
+		for i < len(block) {
+			if a, err = at(i); err != nil {
+				return nil, err
+			}
+			mod := ldifModification{op: a.name, name: attributeName(a.value)}
+			switch mod.op {
+			case "add", "delete", "replace":
+			default:
+				return nil, fmt.Errorf("ldif: line %d: unknown modification %s", block[i].number, a.name)
+			}
+			for i++; i < len(block) && block[i].text != "-"; i++ {
+				if a, err = at(i); err != nil {
+					return nil, err
+				}
+				if a.name != mod.name {
+					return nil, fmt.Errorf("ldif: line %d: %s in a modification of %s", block[i].number, a.name, mod.name)
+				}
+				mod.values = append(mod.values, a.value)
+			}
+			if i == len(block) {
+				return nil, fmt.Errorf("ldif: line %d: modification of %s isn't terminated by -", block[i-1].number, mod.name)
+			}
+			i++
+			rec.mods = append(rec.mods, mod)
+		}
+
+	default:
+		return nil, fmt.Errorf("ldif: line %d: unknown changetype %q", rec.line, rec.changeType)
+	}
+	return rec, nil
+}
+
+// parseLDIFLine parses "name: value", "name:: base64" and "name:< url",
+// the last one isn't supported.
+func parseLDIFLine(line string) (a ldifAttribute, err error) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return a, fmt.Errorf("missing ':' in %q", line)
+	}
+	a.name = attributeName(name)
+
+	switch {
+	case strings.HasPrefix(value, ":"):
+		dat, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return a, fmt.Errorf("invalid base64 value of %s: %w", a.name, err)
+		}
+		a.value = string(dat)
+	case strings.HasPrefix(value, "<"):
+		return a, fmt.Errorf("values read from URLs are not supported, see %s", a.name)
+	default:
+		a.value = strings.TrimLeft(value, " ")
+	}
+	return
+}
+
+// attributeName lower cases an attribute description and drops its
+// options.
+func attributeName(s string) string {
+	name, _, _ := strings.Cut(strings.TrimSpace(s), ";")
+	return strings.ToLower(name)
+}
+
+// splitDN splits a DN into its RDNs at unescaped commas.
+func splitDN(dn string) []string {
+	rdns := []string{}
+	start, escaped := 0, false
+	for i, r := range dn {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			rdns = append(rdns, strings.TrimSpace(dn[start:i]))
+			start = i + 1
+		}
+	}
+	return append(rdns, strings.TrimSpace(dn[start:]))
+}
+
+// normalizeDN makes DNs that differ only in case or in spaces around their
+// separators equal.
+func normalizeDN(dn string) string {
+	rdns := splitDN(dn)
+	for i, rdn := range rdns {
+		typ, value, _ := strings.Cut(rdn, "=")
+		rdns[i] = strings.ToLower(strings.TrimSpace(typ)) + "=" + strings.ToLower(strings.TrimSpace(value))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// rdnValue is the unescaped value of the first RDN of dn, as in "Ada
+// Lovelace" for "cn=Ada Lovelace,ou=people".
+func rdnValue(dn string) string {
+	_, value, _ := strings.Cut(splitDN(dn)[0], "=")
+	b := &strings.Builder{}
+	escaped := false
+	for _, r := range strings.TrimSpace(value) {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// renamedDN is the DN of an entry at dn after a modrdn record.
+func renamedDN(dn string, rec ldifRecord) string {
+	parent := rec.newSuperior
+	if parent == "" {
+		parent = strings.Join(splitDN(dn)[1:], ",")
+	}
+	if parent == "" {
+		return rec.newRDN
+	}
+	return rec.newRDN + "," + parent
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// ldifMapping lists the LDAP attributes User fields are read from, the
+// first attribute an entry has wins.
+type ldifMapping struct {
+	DisplayName []string
+	Email       []string
+}
+
+var defaultLDIFMapping = ldifMapping{
+	DisplayName: []string{"displayname", "cn"},
+	Email:       []string{"mail"},
+}
+
+// parseLDIFMapping parses mappings like "display_name=displayName,cn;
+// email=mail,userPrincipalName". Fields left out keep their default
+// attributes.
+func parseLDIFMapping(s string) (m ldifMapping, err error) {
+	m = defaultLDIFMapping
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		field, list, ok := strings.Cut(part, "=")
+		attrs := []string{}
+		for _, attr := range strings.Split(list, ",") {
+			if attr = attributeName(attr); attr != "" {
+				attrs = append(attrs, attr)
+			}
+		}
+		if !ok || len(attrs) == 0 {
+			return m, fmt.Errorf("%w: %q maps no attributes", InvalidLDIFMapping, part)
+		}
+
+		switch strings.TrimSpace(field) {
+		case "display_name":
+			m.DisplayName = attrs
+		case "email":
+			m.Email = attrs
+		default:
+			return m, fmt.Errorf("%w: unknown field %q", InvalidLDIFMapping, field)
+		}
+	}
+	return
+}
+
+// fields returns the display name and email of the attributes of an add
+// record.
+func (m ldifMapping) fields(attrs []ldifAttribute) (displayName, email string) {
+	first := func(names []string) string {
+		for _, name := range names {
+			for _, a := range attrs {
+				if a.name == name && strings.TrimSpace(a.value) != "" {
+					return strings.TrimSpace(a.value)
+				}
+			}
+		}
+		return ""
+	}
+	return first(m.DisplayName), first(m.Email)
+}
+
+// modifiedField applies the modifications of the attributes names map a
+// field to, to its value current. Only the modified attribute mapped first
+// counts, the values of the others aren't known.
+func modifiedField(names []string, mods []ldifModification, current string) string {
+	for _, name := range names {
+		found := false
+		value := current
+		for _, mod := range mods {
+			if mod.name != name {
+				continue
+			}
+			found = true
+			switch {
+			case mod.op != "delete" && len(mod.values) > 0:
+				value = strings.TrimSpace(mod.values[0])
+			case mod.op == "replace", len(mod.values) == 0:
+				value = ""
+			default:
+				// deleting values removes the field if it holds one of them
+				for _, v := range mod.values {
+					if strings.TrimSpace(v) == value {
+						value = ""
+					}
+				}
+			}
+		}
+		if found {
+			return value
+		}
+	}
+	return current
+}
+
+// Actions of LDIFEntryResult.
+const (
+	ldifCreated   = "created"
+	ldifUpdated   = "updated"
+	ldifLinked    = "linked"
+	ldifRenamed   = "renamed"
+	ldifDeleted   = "deleted"
+	ldifUnchanged = "unchanged"
+	ldifFailed    = "failed"
+)
+
+// LDIFEntryResult is the outcome of one record of an LDIF import.
+type LDIFEntryResult struct {
+	Line       int    `json:"line"`
+	DN         string `json:"dn"`
+	ChangeType string `json:"change_type"`
+	Action     string `json:"action"`
+	Id         uint   `json:"id,omitempty"`
+	// Changes lists the fields of the user the record changed.
+	Changes []string `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// LDIFSourceUser is a user imported from the entry DN.
+type LDIFSourceUser struct {
+	Id uint   `json:"id"`
+	DN string `json:"dn"`
+}
+
+// LDIFImportResponse is the reconciliation report of an LDIF import.
+type LDIFImportResponse struct {
+	DryRun    bool              `json:"dry_run"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Linked    int               `json:"linked"`
+	Renamed   int               `json:"renamed"`
+	Deleted   int               `json:"deleted"`
+	Unchanged int               `json:"unchanged"`
+	Failed    int               `json:"failed"`
+	Entries   []LDIFEntryResult `json:"entries"`
+	// NotInSource lists users imported before whose DN no record of this
+	// import mentions. When the import is a full export of the directory,
+	// they were removed from it.
+	NotInSource []LDIFSourceUser `json:"not_in_source"`
+}
+
+func (lr *LDIFImportResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+func (lr *LDIFImportResponse) add(result LDIFEntryResult) {
+	switch result.Action {
+	case ldifCreated:
+		lr.Created++
+	case ldifUpdated:
+		lr.Updated++
+	case ldifLinked:
+		lr.Linked++
+	case ldifRenamed:
+		lr.Renamed++
+	case ldifDeleted:
+		lr.Deleted++
+	case ldifUnchanged:
+		lr.Unchanged++
+	case ldifFailed:
+		lr.Failed++
+	}
+	lr.Entries = append(lr.Entries, result)
+}
+
+// ldifSync applies LDIF records to a loaded store, finding users by the DN
+// they were imported from.
+type ldifSync struct {
+	us      *UserStore
+	mapping ldifMapping
+	// dns maps normalized source DNs to users.
+	dns  map[string]uint
+	seen map[uint]bool
+	now  time.Time
+}
+
+// dbImportLDIF applies LDIF records to the users, or for a dry run only
+// reports what would change. Add records of DNs imported before update their
+// user instead of creating another one, so a directory can be imported again
+// and again. Records that fail, for example because their email is taken,
+// are reported and skipped, the others are applied and saved at once.
+func dbImportLDIF(ctx context.Context, records []ldifRecord, mapping ldifMapping, dryRun bool) (report *LDIFImportResponse, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	s := ldifSync{us: &us, mapping: mapping, dns: map[string]uint{}, seen: map[uint]bool{}, now: time.Now()}
+	for id, dn := range us.SourceDNs {
+		s.dns[normalizeDN(dn)] = id
+	}
+
+	report = &LDIFImportResponse{DryRun: dryRun, Entries: []LDIFEntryResult{}, NotInSource: []LDIFSourceUser{}}
+	for _, rec := range records {
+		result := LDIFEntryResult{Line: rec.line, DN: rec.dn, ChangeType: rec.changeType}
+		if err := s.apply(rec, &result); err != nil {
+			result.Action, result.Error = ldifFailed, err.Error()
+		}
+		report.add(result)
+	}
+
+	sourceUsers := map[uint]bool{}
+	for id := range us.SourceDNs {
+		sourceUsers[id] = true
+	}
+	for _, id := range sortedIds(sourceUsers) {
+		if !s.seen[id] {
+			report.NotInSource = append(report.NotInSource, LDIFSourceUser{Id: id, DN: us.SourceDNs[id]})
+		}
+	}
+
+	if dryRun || report.Created+report.Updated+report.Linked+report.Renamed+report.Deleted == 0 {
+		return
+	}
+	err = saveUserStore(ctx, us)
+	return
+}
+
+func (s ldifSync) apply(rec ldifRecord, result *LDIFEntryResult) error {
+	key := normalizeDN(rec.dn)
+	id, known := s.dns[key]
+	if known {
+		s.seen[id] = true
+		result.Id = id
+	}
+
+	switch rec.changeType {
+	case "add":
+		displayName, email := s.mapping.fields(rec.attrs)
+		if known {
+			return s.update(id, displayName, email, result)
+		}
+		return s.create(rec.dn, displayName, email, result)
+	}
+
+	if !known {
+		return fmt.Errorf("%w: no user was imported from this DN", UserNotFound)
+	}
+
+	switch rec.changeType {
+	case "modify":
+		u := s.us.List[id]
+		displayName := modifiedField(s.mapping.DisplayName, rec.mods, u.DisplayName)
+		email := modifiedField(s.mapping.Email, rec.mods, u.Email)
+		return s.update(id, displayName, email, result)
+
+	case "modrdn":
+		dn := renamedDN(rec.dn, rec)
+		if other, ok := s.dns[normalizeDN(dn)]; ok && other != id {
+			return fmt.Errorf("user %d was imported from %s", other, dn)
+		}
+		delete(s.dns, key)
+		s.dns[normalizeDN(dn)] = id
+		s.us.SourceDNs[id] = dn
+		result.Action, result.Changes = ldifRenamed, []string{"source_dn"}
+
+	case "delete":
+		removeUser(s.us, id)
+		delete(s.dns, key)
+		result.Action = ldifDeleted
+	}
+	return nil
+}
+
+// create adds a user for the entry dn, or links a user with the same email
+// that wasn't imported yet to it.
+func (s ldifSync) create(dn, displayName, email string, result *LDIFEntryResult) error {
+	if displayName == "" {
+		displayName = rdnValue(dn)
+	}
+	if err := checkEmail(email); err != nil {
+		return err
+	}
+
+	if email != "" {
+		for id, u := range s.us.List {
+			if u.Email == "" || emailLookupKey(u.Email) != emailLookupKey(email) {
+				continue
+			}
+			if _, imported := s.us.SourceDNs[id]; imported {
+				return EmailTaken
+			}
+			if err := s.update(id, displayName, email, result); err != nil {
+				return err
+			}
+			s.link(id, dn)
+			result.Action = ldifLinked
+			return nil
+		}
+	}
+
+	s.us.Increment++
+	id := s.us.Increment
+	s.us.List[id] = User{
+		CreatedAt:   s.now,
+		UpdatedAt:   s.now,
+		DisplayName: displayName,
+		Email:       email,
+		Status:      StatusActive,
+	}
+	s.link(id, dn)
+	result.Id, result.Action = id, ldifCreated
+	return nil
+}
+
+func (s ldifSync) link(id uint, dn string) {
+	if s.us.SourceDNs == nil {
+		s.us.SourceDNs = map[uint]string{}
+	}
+	s.us.SourceDNs[id] = dn
+	s.dns[normalizeDN(dn)] = id
+	s.seen[id] = true
+}
+
+// update sets the fields of the user id, a missing display name falls back
+// to the RDN of the entry.
+func (s ldifSync) update(id uint, displayName, email string, result *LDIFEntryResult) error {
+	if displayName == "" {
+		displayName = rdnValue(s.us.SourceDNs[id])
+	}
+	result.Id = id
+
+	u := s.us.List[id]
+	if u.DisplayName != displayName {
+		u.DisplayName = displayName
+		result.Changes = append(result.Changes, "display_name")
+	}
+	if u.Email != email {
+		if err := checkEmail(email); err != nil {
+			return err
+		}
+		if emailTaken(*s.us, email, id) {
+			return EmailTaken
+		}
+		u.Email = email
+		result.Changes = append(result.Changes, "email")
+	}
+
+	if len(result.Changes) == 0 {
+		result.Action = ldifUnchanged
+		return nil
+	}
+	u.UpdatedAt = s.now
+	s.us.List[id] = u
+	result.Action = ldifUpdated
+	return nil
+}
+
+// maxLDIFImportRecords and maxLDIFImportSize bound a single LDIF upload,
+// larger directories are imported with the import-ldif command.
+const (
+	maxLDIFImportRecords = 10 * maxImportEntries
+	maxLDIFImportSize    = 32 << 20
+)
+
+// importLDIF applies an LDIF file, sent as text/ldif, to the users and
+// answers with the reconciliation report. With dry_run=true nothing is
+// changed.
+func importLDIF(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid dry_run: %w", err)))
+			return
+		}
+	}
+
+	mapping, err := parseLDIFMapping(config.LDIFMapping)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLDIFImportSize)
+	records := []ldifRecord{}
+	if err := render.Decode(r, &records); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			render.Render(w, r, ErrTooLarge(fmt.Errorf("LDIF files of up to %d bytes can be imported at once", maxLDIFImportSize)))
+			return
+		}
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if len(records) == 0 {
+		render.Render(w, r, ErrInvalidRequest(errors.New("nothing to import")))
+		return
+	}
+	if len(records) > maxLDIFImportRecords {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("up to %d records can be imported at once", maxLDIFImportRecords)))
+		return
+	}
+
+	report, err := dbImportLDIF(r.Context(), records, mapping, dryRun)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	render.Render(w, r, report)
+}
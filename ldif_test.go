@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLDIF(t *testing.T) {
+	records, err := readLDIF(strings.NewReader(strings.Join([]string{
+		"version: 1",
+		"",
+		"# Ada",
+		"dn: uid=ada,ou=people,dc=example,dc=com",
+		"objectClass: inetOrgPerson",
+		"cn;lang-en: Ada Lovelace",
+		"displayName:: QWRhIEtpbmcsIENvdW50ZXNzIG9mIExvdmVsYWNl",
+		"mail: ada@email",
+		" .com",
+		"",
+		"",
+		"dn: uid=grace,ou=people,dc=example,dc=com",
+		"control: 1.2.840.113556.1.4.805 true",
+		"changetype: modify",
+		"replace: mail",
+		"mail: grace@email.com",
+		"-",
+		"delete: displayName",
+		"-",
+		"",
+		"dn: uid=bob,ou=people,dc=example,dc=com",
+		"changetype: moddn",
+		"newrdn: uid=robert",
+		"deleteoldrdn: 1",
+		"newsuperior: ou=alumni,dc=example,dc=com",
+		"",
+		"dn: uid=mallory,ou=people,dc=example,dc=com",
+		"changetype: delete",
+	}, "\n")))
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	assert.Equal(t, ldifRecord{
+		line:       4,
+		dn:         "uid=ada,ou=people,dc=example,dc=com",
+		changeType: "add",
+		attrs: []ldifAttribute{
+			{"objectclass", "inetOrgPerson"},
+			{"cn", "Ada Lovelace"},
+			{"displayname", "Ada King, Countess of Lovelace"},
+			{"mail", "ada@email.com"},
+		},
+	}, records[0])
+	assert.Equal(t, []ldifModification{
+		{op: "replace", name: "mail", values: []string{"grace@email.com"}},
+		{op: "delete", name: "displayname"},
+	}, records[1].mods)
+	assert.Equal(t, "modrdn", records[2].changeType)
+	assert.Equal(t, "uid=robert,ou=alumni,dc=example,dc=com", renamedDN(records[2].dn, records[2]))
+	assert.Equal(t, "delete", records[3].changeType)
+
+	for _, tc := range []struct{ name, ldif string }{
+		{"no dn", "cn: Ada\n"},
+		{"version later", "dn: cn=a\ncn: a\n\nversion: 1\n"},
+		{"unknown changetype", "dn: cn=a\nchangetype: rename\n"},
+		{"unterminated modification", "dn: cn=a\nchangetype: modify\nreplace: mail\nmail: a@email.com\n"},
+		{"mixed modification", "dn: cn=a\nchangetype: modify\nreplace: mail\ncn: a\n-\n"},
+		{"attributes of a delete", "dn: cn=a\nchangetype: delete\ncn: a\n"},
+		{"modrdn without newrdn", "dn: cn=a\nchangetype: modrdn\ndeleteoldrdn: 1\n"},
+		{"invalid base64", "dn: cn=a\ncn:: ***\n"},
+		{"url value", "dn: cn=a\njpegPhoto:< file:///tmp/a.jpg\n"},
+		{"not an attribute", "dn: cn=a\nAda Lovelace\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readLDIF(strings.NewReader(tc.ldif))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseLDIFMapping(t *testing.T) {
+	m, err := parseLDIFMapping("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultLDIFMapping, m)
+
+	m, err = parseLDIFMapping("email=mail, userPrincipalName")
+	require.NoError(t, err)
+	assert.Equal(t, ldifMapping{DisplayName: []string{"displayname", "cn"}, Email: []string{"mail", "userprincipalname"}}, m)
+
+	for _, s := range []string{"email", "email=", "phone=telephoneNumber"} {
+		_, err := parseLDIFMapping(s)
+		assert.ErrorIs(t, err, InvalidLDIFMapping, s)
+	}
+}
+
+func TestImportLDIF(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Jane", Email: "jane@email.com", Status: StatusActive},
+			2: {DisplayName: "Ada", Email: "ada@email.com", Status: StatusActive},
+		},
+	})
+	config.LDIFMapping = "display_name=displayName,cn;email=mail,userPrincipalName"
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	importLDIF := func(query, ldif string) LDIFImportResponse {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/import/ldif"+query, strings.NewReader(ldif))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", ldifMediaType)
+		resp, body := testRequest(t, ts, req)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		report := LDIFImportResponse{}
+		require.NoError(t, json.Unmarshal(body, &report))
+		return report
+	}
+	actions := func(report LDIFImportResponse) []string {
+		list := []string{}
+		for _, e := range report.Entries {
+			list = append(list, e.Action)
+		}
+		return list
+	}
+
+	export := strings.Join([]string{
+		"dn: uid=ada,ou=people,dc=example,dc=com",
+		"cn: Ada Lovelace",
+		"mail: ADA@email.com",
+		"",
+		"dn: uid=grace,ou=people,dc=example,dc=com",
+		"cn: Grace Hopper",
+		"userPrincipalName: grace@email.com",
+		"",
+		"dn: uid=jane,ou=people,dc=example,dc=com",
+		"cn: Jane Again",
+		"mail: jane@email.com",
+		"",
+		"dn: uid=bob,ou=people,dc=example,dc=com",
+		"mail: bob@email.com",
+	}, "\n")
+
+	t.Run("dry run", func(t *testing.T) {
+		report := importLDIF("?dry_run=true", export)
+		assert.True(t, report.DryRun)
+		assert.Equal(t, 2, report.Created)
+		assert.Equal(t, 2, report.Linked)
+		list, err := dbGetUserList(context.Background())
+		require.NoError(t, err)
+		assert.Len(t, *list, 2)
+	})
+
+	t.Run("first import", func(t *testing.T) {
+		report := importLDIF("", export)
+		// users with the email of an entry that weren't imported yet are
+		// linked to it
+		assert.Equal(t, []string{ldifLinked, ldifCreated, ldifLinked, ldifCreated}, actions(report))
+		assert.Equal(t, []string{"display_name", "email"}, report.Entries[0].Changes)
+		assert.Equal(t, uint(2), report.Entries[0].Id)
+		assert.Equal(t, uint(1), report.Entries[2].Id)
+
+		u, err := dbGetUser(context.Background(), 3)
+		require.NoError(t, err)
+		assert.Equal(t, "Grace Hopper", u.DisplayName)
+		assert.Equal(t, "grace@email.com", u.Email)
+		u, err = dbGetUser(context.Background(), 4)
+		require.NoError(t, err)
+		assert.Equal(t, "bob", u.DisplayName, "falls back to the RDN")
+	})
+
+	t.Run("importing again updates", func(t *testing.T) {
+		report := importLDIF("", strings.Replace(export, "cn: Grace Hopper", "cn: Grace Brewster Hopper", 1))
+		assert.Equal(t, []string{ldifUnchanged, ldifUpdated, ldifUnchanged, ldifUnchanged}, actions(report))
+		assert.Empty(t, report.NotInSource)
+
+		list, err := dbGetUserList(context.Background())
+		require.NoError(t, err)
+		assert.Len(t, *list, 4)
+	})
+
+	t.Run("change records", func(t *testing.T) {
+		report := importLDIF("", strings.Join([]string{
+			"dn: UID=Grace, OU=People, DC=example, DC=com",
+			"changetype: modify",
+			"replace: mail",
+			"mail: grace@navy.example",
+			"-",
+			"add: displayName",
+			"displayName: Rear Admiral Grace Hopper",
+			"-",
+			"",
+			"dn: uid=bob,ou=people,dc=example,dc=com",
+			"changetype: modify",
+			"replace: mail",
+			"mail: jane@email.com",
+			"-",
+			"",
+			"dn: uid=ada,ou=people,dc=example,dc=com",
+			"changetype: modrdn",
+			"newrdn: uid=countess",
+			"deleteoldrdn: 1",
+			"",
+			"dn: uid=jane,ou=people,dc=example,dc=com",
+			"changetype: delete",
+			"",
+			"dn: uid=nobody,ou=people,dc=example,dc=com",
+			"changetype: delete",
+		}, "\n"))
+		assert.Equal(t, []string{ldifUpdated, ldifFailed, ldifRenamed, ldifDeleted, ldifFailed}, actions(report))
+		assert.Equal(t, []string{"display_name", "email"}, report.Entries[0].Changes)
+		assert.Equal(t, EmailTaken.Error(), report.Entries[1].Error)
+		assert.Empty(t, report.NotInSource)
+
+		u, err := dbGetUser(context.Background(), 3)
+		require.NoError(t, err)
+		assert.Equal(t, "Rear Admiral Grace Hopper", u.DisplayName)
+		assert.Equal(t, "grace@navy.example", u.Email)
+		_, err = dbGetUser(context.Background(), 1)
+		assert.ErrorIs(t, err, UserNotFound)
+
+		us, err := getUserStore()
+		require.NoError(t, err)
+		assert.Equal(t, map[uint]string{
+			2: "uid=countess,ou=people,dc=example,dc=com",
+			3: "uid=grace,ou=people,dc=example,dc=com",
+			4: "uid=bob,ou=people,dc=example,dc=com",
+		}, us.SourceDNs)
+	})
+
+	t.Run("reconciliation", func(t *testing.T) {
+		report := importLDIF("", "dn: uid=countess,ou=people,dc=example,dc=com\ncn: Ada Lovelace\nmail: ADA@email.com\n")
+		assert.Equal(t, []string{ldifUnchanged}, actions(report))
+		assert.Equal(t, []LDIFSourceUser{
+			{Id: 3, DN: "uid=grace,ou=people,dc=example,dc=com"},
+			{Id: 4, DN: "uid=bob,ou=people,dc=example,dc=com"},
+		}, report.NotInSource)
+	})
+
+	t.Run("invalid imports", func(t *testing.T) {
+		for _, body := range []string{"", "cn: Ada\n"} {
+			req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/import/ldif", strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", ldifMediaType)
+			resp, _ := testRequest(t, ts, req)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+		}
+
+		tooMany := strings.Repeat("dn: uid=x,dc=example,dc=com\ncn: X\n\n", maxLDIFImportRecords+1)
+		tooLarge := strings.Repeat("description: "+strings.Repeat("x", 1000)+"\n", maxLDIFImportSize/1000)
+		for body, status := range map[string]int{tooMany: http.StatusBadRequest, tooLarge: http.StatusRequestEntityTooLarge} {
+			req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/import/ldif", strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", ldifMediaType)
+			resp, respBody := testRequest(t, ts, req)
+			assert.Equal(t, status, resp.StatusCode, string(respBody))
+		}
+
+		req := mustRequest(t, "GET", ts.URL+"/api/v1/users/2")
+		req.Header.Set("Accept", ldifMediaType)
+		resp, _ := testRequest(t, ts, req)
+		assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode, "ldif is only read")
+	})
+}
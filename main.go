@@ -1,59 +1,271 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
 )
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve prepares the configured store and serves the REST API on addr and the
+// gRPC API on grpcAddr, unless grpcAddr is empty.
+func serve(addr, grpcAddr string) error {
+	if err := checkJWTConfig(); err != nil {
+		return err
+	}
+
+	store, err := prepareStores()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	defer closeTenantStores()
+	db = store
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
 
 	setRoutes(r)
 
-	http.ListenAndServe(":3333", r)
+	if grpcAddr != "" {
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return err
+		}
+		gs := newGRPCServer()
+		defer gs.Stop()
+
+		go func() {
+			log.Infof("Serving gRPC on %s", grpcAddr)
+			if err := gs.Serve(lis); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	log.Infof("Listening on %s", addr)
+	return http.ListenAndServe(addr, r)
+}
+
+// prepareStores recovers, migrates and re-encrypts the default store and the
+// store of every tenant, then opens the default store. Tenant stores stay
+// open in tenantStores.
+func prepareStores() (Store, error) {
+	tenants, err := listTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.StoreBackend == backendJSON {
+		ctxs := []context.Context{context.Background()}
+		for _, name := range tenants {
+			ctxs = append(ctxs, withTenant(context.Background(), &tenant{name: name}))
+		}
+		for _, ctx := range ctxs {
+			if err := recoverUserStore(ctx); err != nil {
+				return nil, err
+			}
+			if err := migrateUserStore(storePathFrom(ctx)); err != nil {
+				return nil, err
+			}
+			if err := rotateStoreKey(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	store, err := openStore(config.StoreBackend, config.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := encryptStoredEmails(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+	for _, name := range tenants {
+		t, err := openTenant(name)
+		if err == nil {
+			err = encryptStoredEmails(t.store)
+		}
+		if err != nil {
+			store.Close()
+			closeTenantStores()
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+	}
+	return store, nil
 }
 
 func setRoutes(r *chi.Mux) {
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+	idempotencyKeys := newIdempotencyStore(config.IdempotencyPath, config.IdempotencyTTL)
+	reads, writes := newRateLimiters()
+	auth := newAuthenticator()
+	presence := newPresenceTracker(config.PresenceTimeout)
+	timeout := middleware.Timeout(config.RequestTimeout)
+
+	r.With(timeout).Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(time.Now().String()))
 	})
 
 	r.Route("/api", func(r chi.Router) {
+		r.Use(authenticate(auth, renderAPIError))
+
+		// GraphQL requests are all POSTs, they are limited by their
+		// operation instead. Mutations check roles in their resolvers.
+		graphqlRateLimit := rateLimitBy(graphqlQuery, reads, writes, renderAPIError)
+		r.With(timeout, graphqlRateLimit, requireRole(RoleReader)).Method(http.MethodPost, "/graphql", newGraphQLHandler())
+
 		r.Route("/v1", func(r chi.Router) {
-			r.Route("/users", func(r chi.Router) {
-				r.Get("/", searchUsers)
-				r.Post("/", createUser)
-
-				r.Route("/{id}", func(r chi.Router) {
-					r.Get("/", getUser)
-					r.Patch("/", updateUser)
-					r.Delete("/", deleteUser)
+			r.Use(rateLimit(reads, writes, renderAPIError))
+			r.Use(negotiateContent)
+
+			// presence streams stay open for as long as their clients
+			// listen, so they are mounted outside the request timeout
+			reader := requireRole(RoleReader)
+			r.With(reader).Get("/presence/stream", streamPresence(presence))
+			r.With(tenantScope(renderAPIError), reader).Get("/tenants/{tenant}/presence/stream", streamPresence(presence))
+
+			r.Group(func(r chi.Router) {
+				r.Use(timeout)
+
+				r.Route("/admin", func(r chi.Router) {
+					r.Use(requireRole(RoleAdmin))
+
+					r.Route("/backups", setBackupRoutes)
+					r.Route("/api-keys", setAPIKeyRoutes(auth.keys))
+					r.Route("/tenants", setTenantRoutes(auth.keys))
+				})
+
+				r.Route("/me", setMeRoutes(presence))
+				r.Route("/users", setUserRoutes(idempotencyKeys, presence))
+				r.Route("/groups", setGroupRoutes)
+				r.Route("/conferences", setConferenceRoutes)
+				r.Route("/presence", setPresenceRoutes(presence))
+
+				r.Route("/tenants/{tenant}", func(r chi.Router) {
+					r.Use(tenantScope(renderAPIError))
+
+					r.Route("/admin", func(r chi.Router) {
+						r.Use(requireRole(RoleAdmin))
+
+						r.Route("/backups", setBackupRoutes)
+					})
+
+					r.Route("/me", setMeRoutes(presence))
+					r.Route("/users", setUserRoutes(idempotencyKeys, presence))
+					r.Route("/groups", setGroupRoutes)
+					r.Route("/conferences", setConferenceRoutes)
+					r.Route("/presence", setPresenceRoutes(presence))
 				})
 			})
 		})
 	})
+
+	// SCIM clients expect the protocol at a root of its own, speaking
+	// scim+json rather than the formats negotiated below /api/v1
+	scim := func(r chi.Router) {
+		r.Use(timeout)
+		r.Use(authenticate(auth, renderSCIMMiddlewareError))
+		r.Use(rateLimit(reads, writes, renderSCIMMiddlewareError))
+
+		setSCIMRoutes(r)
+	}
+	r.Route("/scim/v2", scim)
+	r.Route("/tenants/{tenant}/scim/v2", func(r chi.Router) {
+		r.Use(tenantScope(renderSCIMMiddlewareError))
+		scim(r)
+	})
 	return
 }
 
+// setUserRoutes serves the users of the default store, or of a tenant when
+// mounted below tenantScope.
+func setUserRoutes(idempotencyKeys *idempotencyStore, presence *presenceTracker) func(r chi.Router) {
+	return func(r chi.Router) {
+		reader, editor, admin := requireRole(RoleReader), requireRole(RoleEditor), requireRole(RoleAdmin)
+
+		r.With(reader).Get("/", searchUsers)
+		r.With(editor, idempotencyKeys.idempotent).Post("/", createUser)
+		r.With(editor, idempotencyKeys.idempotent).Post("/import", importUsers)
+		r.With(admin).Post("/import/ldif", importLDIF)
+
+		r.With(editor).Post("/{id}:activate", setUserStatus(StatusActive))
+		r.With(editor).Post("/{id}:suspend", setUserStatus(StatusSuspended))
+		r.With(editor).Post("/{id}:deactivate", setUserStatus(StatusDeactivated))
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.With(reader).Get("/", getUser)
+			r.With(editor).Patch("/", updateUser)
+			r.With(admin).Delete("/", deleteUser)
+			r.With(reader).Get("/groups", getUserGroups)
+			r.With(reader).Get("/conferences", getUserConferences)
+			r.With(reader).Get("/conferences.ics", asCalendar(getUserConferences))
+			r.With(reader).Get("/presence", getPresence(presence, pathUser))
+			r.With(editor).Put("/presence", setPresence(presence, pathUser))
+			r.With(editor).Post("/presence:heartbeat", presenceHeartbeat(presence, pathUser))
+			r.Group(setContactRoutes)
+		})
+	}
+}
+
 func searchUsers(w http.ResponseWriter, r *http.Request) {
-	userList, err := dbGetUserList()
+	if email := r.URL.Query().Get("email"); email != "" {
+		searchUsersByEmail(w, r, email)
+		return
+	}
+
+	p, err := parsePage(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	userList, err := dbGetUserList(r.Context())
 	if err != nil {
 		render.Render(w, r, ErrInternal(err))
 		return
 	}
 
-	if err := render.RenderList(w, r, NewUsersResopnse(userList)); err != nil {
+	ids, more := p.apply(sortedUserIds(userList))
+	if more {
+		w.Header().Set("Link", p.nextLink(r, ids[len(ids)-1]))
+	}
+
+	if err := render.RenderList(w, r, NewUserListResponse(r.Context(), ids)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func searchUsersByEmail(w http.ResponseWriter, r *http.Request, email string) {
+	list := []render.Renderer{}
+
+	id, err := dbFindUserByEmail(r.Context(), email)
+	if err != nil && !errors.Is(err, UserNotFound) {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if err == nil {
+		list = append(list, NewUserResponse(r.Context(), id))
+	}
+
+	if err := render.RenderList(w, r, list); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -66,14 +278,23 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := dbCreateUser(request.DisplayName, request.Email)
+	id, err := dbCreateUser(r.Context(), request.DisplayName, request.Email, request.Status)
 	if err != nil {
+		if errors.Is(err, EmailTaken) {
+			render.Render(w, r, ErrConflict(err))
+			return
+		}
+		if errors.Is(err, InvalidEmail) {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
 		render.Render(w, r, ErrInternal(err))
 		return
 	}
 
 	render.Status(r, http.StatusCreated)
-	render.Render(w, r, NewUserResponse(id))
+	render.Render(w, r, NewUserResponse(r.Context(), id))
 }
 
 func getUser(w http.ResponseWriter, r *http.Request) {
@@ -83,7 +304,7 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := render.Render(w, r, NewUserResponse(id)); err != nil {
+	if err := render.Render(w, r, NewUserResponse(r.Context(), id)); err != nil {
 		if errors.Is(err, UserNotFound) {
 			render.Render(w, r, ErrNotFound(err))
 			return
@@ -107,11 +328,19 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := dbUpdateUser(id, request.DisplayName, request.Email); err != nil {
+	if err := dbUpdateUser(r.Context(), id, request.DisplayName, request.Email); err != nil {
 		if errors.Is(err, UserNotFound) {
 			render.Render(w, r, ErrNotFound(err))
 			return
 		}
+		if errors.Is(err, EmailTaken) {
+			render.Render(w, r, ErrConflict(err))
+			return
+		}
+		if errors.Is(err, InvalidEmail) {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
 
 		render.Render(w, r, ErrInternal(err))
 		return
@@ -127,7 +356,7 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := dbDeleteUser(id); err != nil {
+	if err := dbDeleteUser(r.Context(), id); err != nil {
 		if errors.Is(err, UserNotFound) {
 			render.Render(w, r, ErrNotFound(err))
 			return
@@ -139,3 +368,29 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 
 	render.Status(r, http.StatusNoContent)
 }
+
+func setUserStatus(status UserStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := parseUserId(r)
+		if err != nil {
+			render.Render(w, r, ErrInternal(err))
+			return
+		}
+
+		if err := dbSetUserStatus(r.Context(), id, status); err != nil {
+			if errors.Is(err, UserNotFound) {
+				render.Render(w, r, ErrNotFound(err))
+				return
+			}
+			if errors.Is(err, InvalidStatusTransition) {
+				render.Render(w, r, ErrConflict(err))
+				return
+			}
+
+			render.Render(w, r, ErrInternal(err))
+			return
+		}
+
+		render.Render(w, r, NewUserResponse(r.Context(), id))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -24,8 +25,14 @@ import (
 
 var r *chi.Mux
 
+// EndpointsTestSuite runs against every store backend, so it doubles as the
+// conformance suite for Store implementations.
 type EndpointsTestSuite struct {
 	suite.Suite
+	backend     string
+	store       Store
+	savedDB     Store
+	savedConfig Config
 }
 
 func TestMain(m *testing.M) {
@@ -48,14 +55,23 @@ func TestMain(m *testing.M) {
 }
 
 func TestEndpoints(t *testing.T) {
-	suite.Run(t, new(EndpointsTestSuite))
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			suite.Run(t, &EndpointsTestSuite{backend: backend})
+		})
+	}
 }
 
 func (suite *EndpointsTestSuite) SetupSuite() {
-	e := os.Rename("users.json", "_users.json")
-	if e != nil {
-		log.Fatal(e)
+	path := filepath.Join(suite.T().TempDir(), "users."+suite.backend)
+	store, err := openStore(suite.backend, path)
+	if err != nil {
+		log.Fatal(err)
 	}
+	suite.store = store
+	suite.savedDB = db
+	suite.savedConfig = config
+	config.AuthRequired = false
 
 	r = chi.NewRouter()
 
@@ -69,28 +85,15 @@ func (suite *EndpointsTestSuite) SetupSuite() {
 }
 
 func (suite *EndpointsTestSuite) TearDownSuite() {
-	e := os.Rename("_users.json", "users.json")
-	if e != nil {
-		log.Fatal(e)
-	}
+	db, config = suite.savedDB, suite.savedConfig
+	suite.store.Close()
 }
 
 func (suite *EndpointsTestSuite) SetupTest() {
-	f, err := os.Create("users.json")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
+	db = suite.store
 
 	userStore := UserStore{List: map[uint]User{}}
-	err = overwriteUserStore(userStore)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func (suite *EndpointsTestSuite) TearDownTest() {
-	err := os.Remove("users.json")
+	err := overwriteUserStore(userStore)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -114,7 +117,17 @@ func testRequest(t *testing.T, ts *httptest.Server, req *http.Request) (response
 }
 
 func (suite *EndpointsTestSuite) TestServer() {
-	go main()
+	if suite.backend != backendJSON {
+		suite.T().Skip("the server is started once, with the default backend")
+	}
+
+	dir := suite.T().TempDir()
+	config.StorePath = filepath.Join(dir, "users.json")
+	config.BackupDir = filepath.Join(dir, "backups")
+	config.IdempotencyPath = filepath.Join(dir, "idempotency.json")
+	config.APIKeysPath = filepath.Join(dir, "api_keys.json")
+	config.TenantsDir = filepath.Join(dir, "tenants")
+	go run([]string{"serve"}, ioutil.Discard, ioutil.Discard)
 
 	// give the server some time to start
 	time.Sleep(1 * time.Second)
@@ -149,6 +162,7 @@ func (suite *EndpointsTestSuite) TestSearchUsers() {
 						CreatedAt:   timeNow,
 						DisplayName: "Alice",
 						Email:       "alice@email.com",
+						Status:      StatusActive,
 					},
 				},
 			},
@@ -158,6 +172,7 @@ func (suite *EndpointsTestSuite) TestSearchUsers() {
 						CreatedAt:   timeNow,
 						DisplayName: "Alice",
 						Email:       "alice@email.com",
+						Status:      StatusActive,
 					},
 					Id: 1,
 				},
@@ -173,11 +188,13 @@ func (suite *EndpointsTestSuite) TestSearchUsers() {
 						CreatedAt:   timeNow,
 						DisplayName: "Alice",
 						Email:       "alice@email.com",
+						Status:      StatusActive,
 					},
 					2: User{
 						CreatedAt:   timeNow,
 						DisplayName: "Bob",
 						Email:       "bob@email.com",
+						Status:      StatusActive,
 					},
 				},
 			},
@@ -187,6 +204,7 @@ func (suite *EndpointsTestSuite) TestSearchUsers() {
 						CreatedAt:   timeNow,
 						DisplayName: "Alice",
 						Email:       "alice@email.com",
+						Status:      StatusActive,
 					},
 					Id: 1,
 				},
@@ -195,6 +213,7 @@ func (suite *EndpointsTestSuite) TestSearchUsers() {
 						CreatedAt:   timeNow,
 						DisplayName: "Bob",
 						Email:       "bob@email.com",
+						Status:      StatusActive,
 					},
 					Id: 2,
 				},
@@ -265,6 +284,7 @@ func (suite *EndpointsTestSuite) TestCreateUser() {
 						CreatedAt:   time.Time{},
 						DisplayName: "Alice",
 						Email:       "alice@email.com",
+						Status:      StatusActive,
 					},
 				},
 			},
@@ -274,6 +294,7 @@ func (suite *EndpointsTestSuite) TestCreateUser() {
 					CreatedAt:   time.Time{},
 					DisplayName: "Alice",
 					Email:       "alice@email.com",
+					Status:      StatusActive,
 				},
 				Id: 1,
 			},
@@ -312,7 +333,10 @@ func (suite *EndpointsTestSuite) TestCreateUser() {
 
 			assert.Equal(t, test.wantStatusCode, resp.StatusCode)
 
-			cmpOptions := cmpopts.IgnoreFields(User{}, "CreatedAt")
+			cmpOptions := cmp.Options{
+				cmpopts.IgnoreFields(User{}, "CreatedAt", "UpdatedAt"),
+				cmpopts.IgnoreFields(UserStore{}, "SchemaVersion"),
+			}
 			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
 				gotResponse := UserResponse{}
 
@@ -342,6 +366,7 @@ func (suite *EndpointsTestSuite) TestGetUser() {
 	userAlice := User{CreatedAt: time.Now(),
 		DisplayName: "Alice",
 		Email:       "alice@email.com",
+		Status:      StatusActive,
 	}
 	tests := []struct {
 		name             string
@@ -396,6 +421,9 @@ func (suite *EndpointsTestSuite) TestGetUser() {
 			log.Debug(string(body))
 
 			assert.Equal(t, test.wantStatusCode, resp.StatusCode)
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
 
 			gotUser := User{}
 			err = json.Unmarshal(body, &gotUser)
@@ -414,6 +442,7 @@ func (suite *EndpointsTestSuite) TestUpdateUser() {
 	userAlice := User{CreatedAt: time.Now(),
 		DisplayName: "Alice",
 		Email:       "alice@email.com",
+		Status:      StatusActive,
 	}
 
 	tests := []struct {
@@ -438,6 +467,7 @@ func (suite *EndpointsTestSuite) TestUpdateUser() {
 					1: {
 						DisplayName: "Alice1",
 						Email:       "alice1@email.com",
+						Status:      StatusActive,
 					},
 				},
 			},
@@ -460,6 +490,7 @@ func (suite *EndpointsTestSuite) TestUpdateUser() {
 					1: {
 						DisplayName: "Alice1",
 						Email:       "alice@email.com",
+						Status:      StatusActive,
 					},
 				},
 			},
@@ -540,7 +571,10 @@ func (suite *EndpointsTestSuite) TestUpdateUser() {
 				return
 			}
 
-			cmpOptions := cmpopts.IgnoreFields(User{}, "CreatedAt")
+			cmpOptions := cmp.Options{
+				cmpopts.IgnoreFields(User{}, "CreatedAt", "UpdatedAt"),
+				cmpopts.IgnoreFields(UserStore{}, "SchemaVersion"),
+			}
 			assert.True(t, cmp.Equal(test.wantUserStore, gotUserStore, cmpOptions), cmp.Diff(test.wantUserStore, gotUserStore, cmpOptions))
 
 		})
@@ -551,6 +585,7 @@ func (suite *EndpointsTestSuite) TestDeleteUser() {
 	userAlice := User{CreatedAt: time.Now(),
 		DisplayName: "Alice",
 		Email:       "alice@email.com",
+		Status:      StatusActive,
 	}
 
 	tests := []struct {
@@ -626,8 +661,129 @@ func (suite *EndpointsTestSuite) TestDeleteUser() {
 				return
 			}
 
-			cmpOptions := cmpopts.IgnoreFields(User{}, "CreatedAt")
+			cmpOptions := cmp.Options{
+				cmpopts.IgnoreFields(User{}, "CreatedAt", "UpdatedAt"),
+				cmpopts.IgnoreFields(UserStore{}, "SchemaVersion"),
+			}
 			assert.True(t, cmp.Equal(test.wantUserStore, gotUserStore, cmpOptions), cmp.Diff(test.wantUserStore, gotUserStore, cmpOptions))
 		})
 	}
 }
+
+func (suite *EndpointsTestSuite) TestSetUserStatus() {
+	userAlice := User{CreatedAt: time.Now(),
+		DisplayName: "Alice",
+		Email:       "alice@email.com",
+		Status:      StatusActive,
+	}
+
+	tests := []struct {
+		name           string
+		fixtureStatus  UserStatus
+		requestUserId  int
+		action         string
+		wantStatus     UserStatus
+		wantStatusCode int
+	}{
+		{
+			name:           "Suspend active user",
+			fixtureStatus:  StatusActive,
+			requestUserId:  1,
+			action:         "suspend",
+			wantStatus:     StatusSuspended,
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Activate suspended user",
+			fixtureStatus:  StatusSuspended,
+			requestUserId:  1,
+			action:         "activate",
+			wantStatus:     StatusActive,
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Activate invited user",
+			fixtureStatus:  StatusInvited,
+			requestUserId:  1,
+			action:         "activate",
+			wantStatus:     StatusActive,
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Deactivate invited user",
+			fixtureStatus:  StatusInvited,
+			requestUserId:  1,
+			action:         "deactivate",
+			wantStatus:     StatusDeactivated,
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Suspend invited user",
+			fixtureStatus:  StatusInvited,
+			requestUserId:  1,
+			action:         "suspend",
+			wantStatus:     StatusInvited,
+			wantStatusCode: 409,
+		},
+		{
+			name:           "Activate deactivated user",
+			fixtureStatus:  StatusDeactivated,
+			requestUserId:  1,
+			action:         "activate",
+			wantStatus:     StatusDeactivated,
+			wantStatusCode: 409,
+		},
+		{
+			name:           "Suspend non existent user",
+			fixtureStatus:  StatusActive,
+			requestUserId:  2,
+			action:         "suspend",
+			wantStatus:     StatusActive,
+			wantStatusCode: 404,
+		},
+	}
+
+	for _, test := range tests {
+		suite.T().Run(test.name, func(t *testing.T) {
+			fixtureUser := userAlice
+			fixtureUser.Status = test.fixtureStatus
+
+			//overwrite database file
+			err := overwriteUserStore(UserStore{Increment: 1, List: UserList{1: fixtureUser}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, err := http.NewRequest("POST",
+				ts.URL+"/api/v1/users/"+fmt.Sprint(test.requestUserId)+":"+test.action,
+				nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, body := testRequest(t, ts, req)
+
+			log.Debug(req.Method, req.URL)
+			log.Debug(resp.StatusCode)
+			log.Debug(string(body))
+
+			assert.Equal(t, test.wantStatusCode, resp.StatusCode)
+
+			gotUserStore, err := getUserStore()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			gotUser := gotUserStore.List[1]
+			assert.Equal(t, test.wantStatus, gotUser.Status)
+			if test.wantStatus != test.fixtureStatus {
+				assert.True(t, gotUser.UpdatedAt.After(fixtureUser.UpdatedAt))
+			}
+		})
+	}
+}
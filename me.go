@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// UpdateMeRequest is the part of their profile callers may change
+// themselves. Email and status are changed by editors through updateUser.
+type UpdateMeRequest struct {
+	DisplayName *string `json:"display_name,omitempty"`
+
+	// Email and Status are only decoded to reject them.
+	Email  *string     `json:"email,omitempty"`
+	Status *UserStatus `json:"status,omitempty"`
+}
+
+func (u *UpdateMeRequest) Bind(r *http.Request) error {
+	if u.Email != nil || u.Status != nil {
+		return errors.New("only display_name can be changed, ask an administrator to change email or status")
+	}
+	return nil
+}
+
+// linkedUserId returns the id of the user the caller of a request is
+// linked to, by the user id of their API key or the email of their token.
+func linkedUserId(ctx context.Context) (uint, error) {
+	p := principalFrom(ctx)
+	if p == nil {
+		return 0, Unauthenticated
+	}
+	// user ids and emails are only unique within a tenant
+	if p.Tenant != tenantFrom(ctx) {
+		return 0, fmt.Errorf("%w: the credentials are not valid for this tenant", Forbidden)
+	}
+	if p.UserID != 0 {
+		return p.UserID, nil
+	}
+	if p.Email != "" {
+		id, err := dbFindUserByEmail(ctx, p.Email)
+		if errors.Is(err, UserNotFound) {
+			return 0, NoLinkedUser
+		}
+		return id, err
+	}
+	return 0, NoLinkedUser
+}
+
+// renderLinkedUserError renders errors of linkedUserId and of looking up
+// the linked user.
+func renderLinkedUserError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, Unauthenticated):
+		render.Render(w, r, ErrUnauthorized(err))
+	case errors.Is(err, NoLinkedUser), errors.Is(err, Forbidden):
+		render.Render(w, r, ErrForbidden(err))
+	case errors.Is(err, UserNotFound):
+		render.Render(w, r, ErrNotFound(err))
+	default:
+		render.Render(w, r, ErrInternal(err))
+	}
+}
+
+// setMeRoutes serves the profile and the presence of the caller. They need
+// no role, any caller linked to a user may read and set them.
+func setMeRoutes(presence *presenceTracker) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/", getMe)
+		r.Patch("/", updateMe)
+
+		r.Get("/presence", getPresence(presence, linkedUser))
+		r.Put("/presence", setPresence(presence, linkedUser))
+		r.Post("/presence:heartbeat", presenceHeartbeat(presence, linkedUser))
+	}
+}
+
+func getMe(w http.ResponseWriter, r *http.Request) {
+	id, err := linkedUserId(r.Context())
+	if err != nil {
+		renderLinkedUserError(w, r, err)
+		return
+	}
+
+	if err := render.Render(w, r, NewUserResponse(r.Context(), id)); err != nil {
+		if errors.Is(err, UserNotFound) {
+			renderLinkedUserError(w, r, err)
+			return
+		}
+
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func updateMe(w http.ResponseWriter, r *http.Request) {
+	id, err := linkedUserId(r.Context())
+	if err != nil {
+		renderLinkedUserError(w, r, err)
+		return
+	}
+
+	request := UpdateMeRequest{}
+	if err := render.Bind(r, &request); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	user, err := dbGetUser(r.Context(), id)
+	if err != nil {
+		renderLinkedUserError(w, r, err)
+		return
+	}
+	switch user.Status {
+	case StatusSuspended, StatusDeactivated:
+		render.Render(w, r, ErrForbidden(fmt.Errorf("%w: %s users can't change their profile", Forbidden, user.Status)))
+		return
+	}
+
+	if err := dbUpdateUser(r.Context(), id, request.DisplayName, nil); err != nil {
+		renderLinkedUserError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, NewUserResponse(r.Context(), id))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMe(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 3,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusSuspended},
+		},
+	})
+	idp := newTestIdP(t)
+	config.JWKSPath, config.JWTIssuer, config.JWTAudience = idp.path, testIssuer, testAudience
+
+	keys := newAPIKeyStore(config.APIKeysPath)
+	issue := func(role Role, userId uint) string {
+		_, token, err := keys.issue(APIKey{Name: "me", Role: role, UserID: userId})
+		require.NoError(t, err)
+		return token
+	}
+	alice := "X-API-Key: " + issue(RoleReader, 1)
+	bob := "X-API-Key: " + issue(RoleReader, 2)
+	unlinked := "X-API-Key: " + issue(RoleAdmin, 0)
+	gone := "X-API-Key: " + issue(RoleReader, 3)
+	aliceToken := "Authorization: Bearer " + idp.sign("ec", map[string]interface{}{"email": "alice@email.com", "email_verified": true, "scope": "openid"})
+	unclaimedToken := "Authorization: Bearer " + idp.sign("ec", map[string]interface{}{"email": "alice@email.com", "scope": "openid"})
+	unverifiedToken := "Authorization: Bearer " + idp.sign("ec", map[string]interface{}{"email": "alice@email.com", "email_verified": false})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		header   string
+		status   int
+		wantName string
+	}{
+		{"anonymous", "GET", "", "", 401, ""},
+		{"get", "GET", "", alice, 200, "Alice"},
+		{"get by token email", "GET", "", aliceToken, 200, "Alice"},
+		{"unverified token email", "GET", "", unverifiedToken, 403, ""},
+		{"token email without email_verified", "GET", "", unclaimedToken, 403, ""},
+		{"unlinked key", "GET", "", unlinked, 403, ""},
+		{"linked user deleted", "GET", "", gone, 404, ""},
+		{"update display name", "PATCH", `{"display_name":"Alicia"}`, alice, 200, "Alicia"},
+		{"update email", "PATCH", `{"email":"mallory@email.com"}`, alice, 400, ""},
+		{"update status", "PATCH", `{"status":"active"}`, bob, 400, ""},
+		{"update while suspended", "PATCH", `{"display_name":"Robert"}`, bob, 403, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL+"/api/v1/me", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if name, value, ok := strings.Cut(tc.header, ": "); ok {
+				req.Header.Set(name, value)
+			}
+			resp, body := testRequest(t, ts, req)
+			require.Equal(t, tc.status, resp.StatusCode, string(body))
+
+			if tc.wantName != "" {
+				user := UserResponse{}
+				require.NoError(t, json.Unmarshal(body, &user))
+				assert.Equal(t, tc.wantName, user.DisplayName)
+			}
+		})
+	}
+
+	u, err := dbGetUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@email.com", u.Email)
+}
+
+func TestIssueAPIKeyForUser(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 1,
+		List:      UserList{1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	issue := func(body string) (*http.Response, []byte) {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/admin/api-keys/", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, ts, req)
+	}
+
+	resp, body := issue(`{"name":"alice","role":"reader","user_id":1}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	key := APIKeyResponse{}
+	require.NoError(t, json.Unmarshal(body, &key))
+	assert.Equal(t, uint(1), key.UserID)
+
+	resp, _ = issue(`{"name":"ghost","role":"reader","user_id":2}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// currentSchemaVersion is the version of the store file format this binary
+// reads and writes. Bump it together with a new entry in migrations.
+const currentSchemaVersion = 6
+
+type storeDocument map[string]json.RawMessage
+
+// migration upgrades a store document by exactly one schema version.
+type migration func(doc storeDocument) error
+
+// migrations[i] upgrades a document from schema version i to i+1.
+// Files written before schema_version was introduced are version 0.
+var migrations = []migration{
+	migrateAddUserStatus,
+	bumpSchemaVersion, // groups
+	bumpSchemaVersion, // conferences
+	bumpSchemaVersion, // address books
+	bumpSchemaVersion, // external ids
+	bumpSchemaVersion, // source DNs
+}
+
+// migrateUserStore upgrades the store file at path to currentSchemaVersion.
+// The original file is copied next to it before any change is written.
+func migrateUserStore(path string) (err error) {
+	f, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	plain, err := openStoreData(f)
+	if err != nil {
+		return
+	}
+
+	dat, version, err := migrateDocument(plain)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if version == currentSchemaVersion {
+		return
+	}
+
+	backup := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102T150405"))
+	if err = ioutil.WriteFile(backup, f, 0644); err != nil {
+		return
+	}
+	log.Infof("Migrating %s from schema version %d to %d, backup saved to %s",
+		path, version, currentSchemaVersion, backup)
+
+	if dat, err = sealStoreData(dat); err != nil {
+		return
+	}
+	return writeFileAtomic(path, dat, 0644)
+}
+
+// migrateDocument upgrades a plain JSON store document to
+// currentSchemaVersion and reports the version it started from. The upgraded
+// document gets a fresh checksum.
+func migrateDocument(plain []byte) (dat []byte, from int, err error) {
+	doc := storeDocument{}
+	if err = json.Unmarshal(plain, &doc); err != nil {
+		return
+	}
+
+	from, err = doc.schemaVersion()
+	if err != nil {
+		return
+	}
+	if from > currentSchemaVersion {
+		return nil, from, fmt.Errorf("%w: document has version %d, this binary supports up to %d",
+			StoreVersionTooNew, from, currentSchemaVersion)
+	}
+	if from == currentSchemaVersion {
+		return plain, from, nil
+	}
+
+	for version := from; version < currentSchemaVersion; version++ {
+		if err = migrations[version](doc); err != nil {
+			return nil, from, fmt.Errorf("migration to schema version %d: %w", version+1, err)
+		}
+		if doc["schema_version"], err = json.Marshal(version + 1); err != nil {
+			return
+		}
+	}
+
+	// the checksum covers the document as it was before the migrations
+	delete(doc, "checksum")
+	if dat, err = json.Marshal(doc); err != nil {
+		return
+	}
+	sf := storeFile{}
+	if err = json.Unmarshal(dat, &sf); err != nil {
+		return
+	}
+	if doc["checksum"], err = json.Marshal(storeChecksum(sf)); err != nil {
+		return
+	}
+	dat, err = json.Marshal(doc)
+	return
+}
+
+func (doc storeDocument) schemaVersion() (version int, err error) {
+	raw, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	err = json.Unmarshal(raw, &version)
+	return
+}
+
+// migrateAddUserStatus sets status and updated_at on users created before
+// those fields existed.
+func migrateAddUserStatus(doc storeDocument) (err error) {
+	list := map[string]map[string]json.RawMessage{}
+	if raw, ok := doc["list"]; ok {
+		if err = json.Unmarshal(raw, &list); err != nil {
+			return
+		}
+	}
+
+	for _, u := range list {
+		if _, ok := u["status"]; !ok {
+			u["status"] = json.RawMessage(`"` + StatusActive + `"`)
+		}
+		if _, ok := u["updated_at"]; !ok {
+			u["updated_at"] = u["created_at"]
+		}
+	}
+
+	doc["list"], err = json.Marshal(list)
+	return
+}
+
+// bumpSchemaVersion is the migration for versions that only add optional
+// data, which older stores simply don't have. The version still changes, so
+// older binaries refuse stores they would silently drop the new data from.
+func bumpSchemaVersion(doc storeDocument) error { return nil }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaVersionMatchesMigrations(t *testing.T) {
+	assert.Equal(t, len(migrations), currentSchemaVersion)
+}
+
+func TestMigrateUserStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		storeFile   string
+		wantErr     error
+		wantBackup  bool
+		wantVersion int
+		wantStatus  UserStatus
+	}{
+		{
+			name:        "Legacy store",
+			storeFile:   `{"increment":1,"list":{"1":{"created_at":"2021-10-14T19:40:42+03:00","display_name":"Alice"}}}`,
+			wantBackup:  true,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusActive,
+		},
+		{
+			name:        "Store without groups",
+			storeFile:   `{"schema_version":1,"increment":1,"list":{"1":{"display_name":"Alice","status":"suspended"}}}`,
+			wantBackup:  true,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusSuspended,
+		},
+		{
+			name:        "Store without conferences",
+			storeFile:   `{"schema_version":2,"increment":1,"list":{"1":{"display_name":"Alice","status":"suspended"}}}`,
+			wantBackup:  true,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusSuspended,
+		},
+		{
+			name:        "Store without address books",
+			storeFile:   `{"schema_version":3,"increment":1,"list":{"1":{"display_name":"Alice","status":"suspended"}}}`,
+			wantBackup:  true,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusSuspended,
+		},
+		{
+			name:        "Store without external ids",
+			storeFile:   `{"schema_version":4,"increment":1,"list":{"1":{"display_name":"Alice","status":"suspended"}}}`,
+			wantBackup:  true,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusSuspended,
+		},
+		{
+			name:        "Store without source DNs",
+			storeFile:   `{"schema_version":5,"increment":1,"list":{"1":{"display_name":"Alice","status":"suspended"}}}`,
+			wantBackup:  true,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusSuspended,
+		},
+		{
+			name:        "Current store",
+			storeFile:   `{"schema_version":6,"increment":1,"list":{"1":{"display_name":"Alice","status":"suspended"}}}`,
+			wantBackup:  false,
+			wantVersion: currentSchemaVersion,
+			wantStatus:  StatusSuspended,
+		},
+		{
+			name:        "Store from a newer binary",
+			storeFile:   `{"schema_version":1000,"increment":0,"list":{}}`,
+			wantErr:     StoreVersionTooNew,
+			wantBackup:  false,
+			wantVersion: 1000,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "users.json")
+			require.NoError(t, ioutil.WriteFile(path, []byte(test.storeFile), 0644))
+
+			err := migrateUserStore(path)
+			assert.True(t, errors.Is(err, test.wantErr), "got error %v", err)
+
+			backups, err := filepath.Glob(path + ".v*.bak")
+			require.NoError(t, err)
+			if test.wantBackup {
+				require.Len(t, backups, 1)
+				backup, err := ioutil.ReadFile(backups[0])
+				require.NoError(t, err)
+				assert.Equal(t, test.storeFile, string(backup))
+			} else {
+				assert.Empty(t, backups)
+			}
+
+			f, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			us := UserStore{}
+			require.NoError(t, json.Unmarshal(f, &us))
+			assert.Equal(t, test.wantVersion, us.SchemaVersion)
+			if test.wantStatus != "" {
+				assert.Equal(t, test.wantStatus, us.List[1].Status)
+			}
+		})
+	}
+}
+
+func TestMigrateChecksummedStore(t *testing.T) {
+	sf := storeFile{
+		UserStore: UserStore{SchemaVersion: 5, Increment: 1},
+		List:      map[uint]storedUser{1: {User: User{DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive}}},
+	}
+	sf.Checksum = storeChecksum(sf)
+	dat, err := json.Marshal(sf)
+	require.NoError(t, err)
+
+	t.Run("store file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.json")
+		require.NoError(t, ioutil.WriteFile(path, dat, 0644))
+		require.NoError(t, migrateUserStore(path))
+
+		f, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		us, err := decodeUserStore(f)
+		require.NoError(t, err)
+		assert.Equal(t, currentSchemaVersion, us.SchemaVersion)
+		assert.Equal(t, "Alice", us.List[1].DisplayName)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		useTempStore(t, UserStore{List: UserList{}})
+		path := filepath.Join(t.TempDir(), "export.json")
+		require.NoError(t, ioutil.WriteFile(path, dat, 0644))
+
+		n, err := importStore(path, false)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		us, err := getUserStore()
+		require.NoError(t, err)
+		assert.Equal(t, "Alice", us.List[1].DisplayName)
+	})
+}
@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/go-chi/render"
 )
 
 type CreateUserRequest struct {
-	DisplayName string `json:"display_name"`
-	Email       string `json:"email"`
+	DisplayName string     `json:"display_name"`
+	Email       string     `json:"email"`
+	Status      UserStatus `json:"status,omitempty"`
 }
 
-func (c *CreateUserRequest) Bind(r *http.Request) error { return nil }
+func (c *CreateUserRequest) Bind(r *http.Request) error {
+	switch c.Status {
+	case "":
+		c.Status = StatusActive
+	case StatusInvited, StatusActive:
+	default:
+		return fmt.Errorf("%w: new users can only be %q or %q", InvalidStatus, StatusInvited, StatusActive)
+	}
+	return nil
+}
 
 type UpdateUserRequest struct {
 	DisplayName *string `json:"display_name,omitempty"`
@@ -32,19 +45,32 @@ func (ur *UserResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func NewUserResponse(id uint) *UserResponse {
+func NewUserResponse(ctx context.Context, id uint) *UserResponse {
 	resp := &UserResponse{Id: id}
-	if user, _ := dbGetUser(id); user != nil {
+	if user, _ := dbGetUser(ctx, id); user != nil {
 		resp.User = user
 	}
 
 	return resp
 }
 
-func NewUsersResopnse(userList *UserList) []render.Renderer {
+func NewUsersResopnse(ctx context.Context, userList *UserList) []render.Renderer {
+	return NewUserListResponse(ctx, sortedUserIds(userList))
+}
+
+func NewUserListResponse(ctx context.Context, ids []uint) []render.Renderer {
 	list := []render.Renderer{}
-	for k := range *userList {
-		list = append(list, NewUserResponse(k))
+	for _, k := range ids {
+		list = append(list, NewUserResponse(ctx, k))
 	}
 	return list
 }
+
+func sortedUserIds(userList *UserList) []uint {
+	ids := make([]uint, 0, len(*userList))
+	for k := range *userList {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Responses and request bodies are available in several formats. Every
+// format other than JSON is produced from the JSON encoding of a value, so
+// field names and order stay the same across formats.
+func init() {
+	render.Respond = respond
+	render.Decode = decode
+}
+
+type format struct {
+	name string
+	// mediaTypes the format is known by, the first one is sent in responses.
+	mediaTypes []string
+	// represents reports whether the format can encode v, nil if it can
+	// encode anything.
+	represents func(v interface{}) bool
+	encode     func(w io.Writer, v interface{}) error
+	// decode is nil for formats only used in responses.
+	decode func(r io.Reader, v interface{}) error
+}
+
+// formats in order of preference when the client accepts any of them.
+var formats = []*format{
+	{
+		name:       "json",
+		mediaTypes: []string{"application/json"},
+		encode:     encodeJSON,
+		decode:     render.DecodeJSON,
+	},
+	{
+		name:       "xml",
+		mediaTypes: []string{"application/xml", "text/xml"},
+		encode:     encodeXML,
+		decode:     decodeXML,
+	},
+	{
+		name:       "yaml",
+		mediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		encode:     encodeYAML,
+		decode:     decodeYAML,
+	},
+	{
+		name:       "msgpack",
+		mediaTypes: []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		encode:     encodeMsgpack,
+		decode:     decodeMsgpack,
+	},
+	{
+		name:       "csv",
+		mediaTypes: []string{"text/csv"},
+		represents: isList,
+		encode:     encodeCSV,
+		decode:     decodeCSV,
+	},
+	{
+		name:       "icalendar",
+		mediaTypes: []string{calendarMediaType},
+		represents: isCalendar,
+		encode:     encodeCalendar,
+	},
+	{
+		name:       "vcard",
+		mediaTypes: []string{vcardMediaType, "text/x-vcard"},
+		represents: isVCard,
+		encode:     encodeVCard,
+		decode:     decodeVCard,
+	},
+	{
+		name:       "ldif",
+		mediaTypes: []string{ldifMediaType, "application/ldif", "text/x-ldif"},
+		// only read by importLDIF
+		represents: func(v interface{}) bool { return false },
+		decode:     decodeLDIF,
+	},
+	{
+		name:       "event-stream",
+		mediaTypes: []string{eventStreamMediaType},
+		// only written by streaming handlers, see streamPresence
+		represents: func(v interface{}) bool { return false },
+	},
+}
+
+// isList reports whether v is a list, for formats that can't represent a
+// single object.
+func isList(v interface{}) bool {
+	return reflect.ValueOf(v).Kind() == reflect.Slice
+}
+
+// negotiateContent rejects requests whose Accept header matches none of the
+// formats with 406 and request bodies in an unknown format with 415.
+func negotiateContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(acceptedFormats(r)) == 0 {
+			render.Render(w, r, ErrNotAcceptable(fmt.Errorf("%w: %s", NotAcceptable, r.Header.Get("Accept"))))
+			return
+		}
+		if _, err := requestFormat(r); err != nil {
+			render.Render(w, r, ErrUnsupportedMediaType(err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptedFormats returns the formats matching the Accept header, most
+// preferred first. A missing header accepts every format.
+func acceptedFormats(r *http.Request) []*format {
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return formats
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	accepted := []*format{}
+	seen := map[*format]bool{}
+	for _, mr := range ranges {
+		for _, f := range formats {
+			if !seen[f] && f.matches(mr.mediaType) {
+				seen[f] = true
+				accepted = append(accepted, f)
+			}
+		}
+	}
+	return accepted
+}
+
+func (f *format) matches(mediaRange string) bool {
+	if mediaRange == "*/*" {
+		return true
+	}
+	for _, mt := range f.mediaTypes {
+		if mt == mediaRange {
+			return true
+		}
+		if strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(mediaRange, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFormat returns the format of the request body, JSON when no
+// Content-Type is given.
+func requestFormat(r *http.Request) (*format, error) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return formats[0], nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err == nil {
+		for _, f := range formats {
+			for _, mt := range f.mediaTypes {
+				if mt == mediaType && f.decode != nil {
+					return f, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", UnsupportedMediaType, header)
+}
+
+func decode(r *http.Request, v interface{}) error {
+	f, err := requestFormat(r)
+	if err != nil {
+		return err
+	}
+	return f.decode(r.Body, v)
+}
+
+// respond writes v in the most preferred accepted format able to represent
+// it. Errors fall back to JSON rather than being lost.
+func respond(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var f *format
+	for _, accepted := range acceptedFormats(r) {
+		if accepted.represents == nil || accepted.represents(v) {
+			f = accepted
+			break
+		}
+	}
+	if f == nil {
+		if _, ok := v.(*ErrResponse); !ok {
+			render.Render(w, r, ErrNotAcceptable(fmt.Errorf("%w: %s", NotAcceptable, r.Header.Get("Accept"))))
+			return
+		}
+		f = formats[0]
+	}
+
+	buf := &bytes.Buffer{}
+	if err := f.encode(buf, v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := f.mediaTypes[0]
+	if f.name != "msgpack" {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	if status, ok := r.Context().Value(render.StatusCtxKey).(int); ok {
+		w.WriteHeader(status)
+	}
+	w.Write(buf.Bytes())
+}
+
+func encodeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(true)
+	return enc.Encode(v)
+}
+
+// object is a decoded JSON object that keeps the order of its fields.
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// toGeneric returns the JSON encoding of v as an object, []interface{},
+// string, json.Number, bool or nil.
+func toGeneric(v interface{}) (interface{}, error) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(dat))
+	dec.UseNumber()
+	return decodeGeneric(dec)
+}
+
+func decodeGeneric(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+
+	switch delim {
+	case '{':
+		o := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeGeneric(dec)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, field{key.(string), value})
+		}
+		_, err = dec.Token()
+		return o, err
+	default:
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeGeneric(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+}
+
+// fromGeneric stores a decoded request body in v as if it had been sent as
+// JSON.
+func fromGeneric(g interface{}, v interface{}) error {
+	dat, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dat, v)
+}
+
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	dat, _ := json.Marshal(v)
+	return string(dat)
+}
+
+// xmlName derives element names from the type of v: a UserResponse is
+// written as <user>, a list of them as <users>.
+func xmlName(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		if rv.Len() == 0 {
+			return "list"
+		}
+		return xmlName(rv.Index(0).Interface()) + "s"
+	}
+
+	name := strings.TrimSuffix(reflect.Indirect(rv).Type().Name(), "Response")
+	if name == "Err" {
+		return "error"
+	}
+	if name == "" {
+		return "item"
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+func encodeXML(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+
+	itemName := "item"
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.Len() > 0 {
+		itemName = xmlName(rv.Index(0).Interface())
+	}
+
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := writeXMLElement(enc, xmlName(v), itemName, g); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func writeXMLElement(enc *xml.Encoder, name, itemName string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case object:
+		for _, f := range v {
+			if err := writeXMLElement(enc, f.key, "item", f.value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXMLElement(enc, itemName, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(scalarString(v))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// decodeXML reads an element tree, elements with children become objects
+// and the text of the others their value.
+func decodeXML(r io.Reader, v interface{}) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			g, err := readXMLElement(dec, start)
+			if err != nil {
+				return err
+			}
+			return fromGeneric(g, v)
+		}
+	}
+}
+
+func readXMLElement(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	o := object{}
+	text := &strings.Builder{}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			value, err := readXMLElement(dec, tok)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, field{tok.Name.Local, value})
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			if len(o) > 0 {
+				return o, nil
+			}
+			return text.String(), nil
+		}
+	}
+}
+
+func encodeYAML(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(yamlNode(g)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func yamlNode(v interface{}) *yaml.Node {
+	switch v := v.(type) {
+	case object:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for _, f := range v {
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.key}, yamlNode(f.value))
+		}
+		return n
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range v {
+			n.Content = append(n.Content, yamlNode(item))
+		}
+		return n
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	case json.Number:
+		tag := "!!float"
+		if _, err := v.Int64(); err == nil {
+			tag = "!!int"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: v.String()}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: scalarString(v)}
+}
+
+func decodeYAML(r io.Reader, v interface{}) error {
+	var g interface{}
+	if err := yaml.NewDecoder(r).Decode(&g); err != nil {
+		return err
+	}
+	return fromGeneric(g, v)
+}
+
+func encodeMsgpack(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+	return writeMsgpack(msgpack.NewEncoder(w), g)
+}
+
+func writeMsgpack(enc *msgpack.Encoder, v interface{}) error {
+	switch v := v.(type) {
+	case object:
+		if err := enc.EncodeMapLen(len(v)); err != nil {
+			return err
+		}
+		for _, f := range v {
+			if err := enc.EncodeString(f.key); err != nil {
+				return err
+			}
+			if err := writeMsgpack(enc, f.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		if err := enc.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := writeMsgpack(enc, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return enc.EncodeInt(i)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat64(f)
+	}
+	return enc.Encode(v)
+}
+
+func decodeMsgpack(r io.Reader, v interface{}) error {
+	var g interface{}
+	if err := msgpack.NewDecoder(r).Decode(&g); err != nil {
+		return err
+	}
+	return fromGeneric(g, v)
+}
+
+// encodeCSV writes a list of objects with one column per field, nested
+// values are written as JSON.
+func encodeCSV(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+	list, ok := g.([]interface{})
+	if !ok {
+		return fmt.Errorf("csv can only represent lists")
+	}
+
+	header := []string{}
+	columns := map[string]int{}
+	for _, item := range list {
+		o, _ := item.(object)
+		for _, f := range o {
+			if _, ok := columns[f.key]; !ok {
+				columns[f.key] = len(header)
+				header = append(header, f.key)
+			}
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, item := range list {
+		record := make([]string, len(header))
+		o, _ := item.(object)
+		for _, f := range o {
+			record[columns[f.key]] = scalarString(f.value)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// decodeCSV reads a header and a single record into an object of strings.
+func decodeCSV(r io.Reader, v interface{}) error {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) != 2 {
+		return fmt.Errorf("csv request body must hold a header and exactly one record")
+	}
+
+	o := object{}
+	for i, key := range records[0] {
+		o = append(o, field{key, records[1][i]})
+	}
+	return fromGeneric(o, v)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+func newNegotiationTestServer(t *testing.T) *httptest.Server {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob, Jr.", Email: "bob@email.com", Status: StatusInvited},
+		},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestResponseFormats(t *testing.T) {
+	ts := newNegotiationTestServer(t)
+
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		status      int
+		contentType string
+		check       func(t *testing.T, body []byte)
+	}{
+		{
+			name: "json by default", path: "/api/v1/users/1", accept: "",
+			status: 200, contentType: "application/json; charset=utf-8",
+			check: func(t *testing.T, body []byte) {
+				u := UserResponse{}
+				require.NoError(t, json.Unmarshal(body, &u))
+				assert.Equal(t, "Alice", u.DisplayName)
+			},
+		},
+		{
+			name: "xml user", path: "/api/v1/users/1", accept: "application/xml",
+			status: 200, contentType: "application/xml; charset=utf-8",
+			check: func(t *testing.T, body []byte) {
+				u := struct {
+					XMLName     xml.Name `xml:"user"`
+					Id          uint     `xml:"id"`
+					DisplayName string   `xml:"display_name"`
+				}{}
+				require.NoError(t, xml.Unmarshal(body, &u))
+				assert.Equal(t, uint(1), u.Id)
+				assert.Equal(t, "Alice", u.DisplayName)
+			},
+		},
+		{
+			name: "xml list", path: "/api/v1/users/", accept: "text/xml",
+			status: 200, contentType: "application/xml; charset=utf-8",
+			check: func(t *testing.T, body []byte) {
+				l := struct {
+					XMLName xml.Name `xml:"users"`
+					Users   []struct {
+						Id uint `xml:"id"`
+					} `xml:"user"`
+				}{}
+				require.NoError(t, xml.Unmarshal(body, &l))
+				require.Len(t, l.Users, 2)
+				assert.Equal(t, uint(2), l.Users[1].Id)
+			},
+		},
+		{
+			name: "csv list", path: "/api/v1/users/", accept: "text/csv",
+			status: 200, contentType: "text/csv; charset=utf-8",
+			check: func(t *testing.T, body []byte) {
+				lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+				require.Len(t, lines, 3)
+				assert.Equal(t, "created_at,updated_at,display_name,email,status,id", lines[0])
+				assert.True(t, strings.HasSuffix(lines[2], `,"Bob, Jr.",bob@email.com,invited,2`), lines[2])
+			},
+		},
+		{
+			name: "yaml user", path: "/api/v1/users/2", accept: "application/yaml",
+			status: 200, contentType: "application/yaml; charset=utf-8",
+			check: func(t *testing.T, body []byte) {
+				u := map[string]interface{}{}
+				require.NoError(t, yaml.Unmarshal(body, &u))
+				assert.Equal(t, "Bob, Jr.", u["display_name"])
+				assert.Equal(t, 2, u["id"])
+			},
+		},
+		{
+			name: "msgpack user", path: "/api/v1/users/2", accept: "application/msgpack",
+			status: 200, contentType: "application/msgpack",
+			check: func(t *testing.T, body []byte) {
+				u := map[string]interface{}{}
+				require.NoError(t, msgpack.Unmarshal(body, &u))
+				assert.Equal(t, "invited", u["status"])
+				assert.EqualValues(t, 2, u["id"])
+			},
+		},
+		{
+			name: "preferred format by quality", path: "/api/v1/users/1", accept: "application/json;q=0.5, application/yaml",
+			status: 200, contentType: "application/yaml; charset=utf-8",
+		},
+		{
+			name: "csv falls back to next accepted format for single users", path: "/api/v1/users/1", accept: "text/csv, application/json;q=0.1",
+			status: 200, contentType: "application/json; charset=utf-8",
+		},
+		{
+			name: "csv only for single user", path: "/api/v1/users/1", accept: "text/csv",
+			status: 406, contentType: "application/json; charset=utf-8",
+		},
+		{
+			name: "errors in the accepted format", path: "/api/v1/users/42", accept: "application/xml",
+			status: 404, contentType: "application/xml; charset=utf-8",
+		},
+		{
+			name: "errors fall back to json", path: "/api/v1/users/42", accept: "text/csv",
+			status: 404, contentType: "application/json; charset=utf-8",
+		},
+		{
+			name: "wildcard", path: "/api/v1/users/1", accept: "text/*",
+			status: 200, contentType: "application/xml; charset=utf-8",
+		},
+		{
+			name: "unsupported format", path: "/api/v1/users/1", accept: "image/png",
+			status: 406, contentType: "application/json; charset=utf-8",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := mustRequest(t, "GET", ts.URL+tc.path)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			resp, body := testRequest(t, ts, req)
+			assert.Equal(t, tc.status, resp.StatusCode, string(body))
+			assert.Equal(t, tc.contentType, resp.Header.Get("Content-Type"))
+			if tc.check != nil {
+				tc.check(t, body)
+			}
+		})
+	}
+}
+
+func TestRequestFormats(t *testing.T) {
+	msgpackBody, err := msgpack.Marshal(map[string]string{"display_name": "Carol", "email": "carol@email.com"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"json", "application/json", []byte(`{"display_name":"Carol","email":"carol@email.com"}`), 201},
+		{"xml", "application/xml", []byte(`<user><display_name>Carol</display_name><email>carol@email.com</email></user>`), 201},
+		{"yaml", "application/yaml", []byte("display_name: Carol\nemail: carol@email.com\n"), 201},
+		{"csv", "text/csv", []byte("display_name,email\nCarol,carol@email.com\n"), 201},
+		{"msgpack", "application/msgpack", msgpackBody, 201},
+		{"unsupported", "text/plain", []byte("Carol"), 415},
+		{"malformed", "application/yaml", []byte("display_name: [Carol"), 400},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newNegotiationTestServer(t)
+
+			req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/", bytes.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tc.contentType)
+			resp, body := testRequest(t, ts, req)
+			require.Equal(t, tc.status, resp.StatusCode, string(body))
+
+			if tc.status == 201 {
+				u := UserResponse{}
+				require.NoError(t, json.Unmarshal(body, &u))
+				assert.Equal(t, "Carol", u.DisplayName)
+				assert.Equal(t, "carol@email.com", u.Email)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// presenceSubscriberBuffer is how many events a stream may fall behind
+// before it is disconnected.
+const presenceSubscriberBuffer = 64
+
+type PresenceState string
+
+const (
+	PresenceOnline  PresenceState = "online"
+	PresenceAway    PresenceState = "away"
+	PresenceBusy    PresenceState = "busy"
+	PresenceInCall  PresenceState = "in-call"
+	PresenceOffline PresenceState = "offline"
+)
+
+func (s PresenceState) Valid() bool {
+	switch s {
+	case PresenceOnline, PresenceAway, PresenceBusy, PresenceInCall, PresenceOffline:
+		return true
+	}
+	return false
+}
+
+// Presence is what a messaging client shows next to a user. Users nobody
+// set a presence for are offline.
+type Presence struct {
+	State   PresenceState `json:"state"`
+	Message string        `json:"message,omitempty"`
+	// MessageExpiresAt is when Message is cleared.
+	MessageExpiresAt *time.Time `json:"message_expires_at,omitempty"`
+	// ExpiresAt is when State falls back to offline unless a heartbeat
+	// arrives first.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type presenceKey struct {
+	tenant string
+	userId uint
+}
+
+// presenceEvent is a change of the presence of a user, published to the
+// subscribers of their tenant.
+type presenceEvent struct {
+	userId   uint
+	presence Presence
+}
+
+type presenceSubscriber struct {
+	tenant string
+	// events is closed when the subscriber falls behind.
+	events chan presenceEvent
+}
+
+type presenceEntry struct {
+	presence Presence
+	// offline and clearMessage fire at ExpiresAt and MessageExpiresAt.
+	offline      *time.Timer
+	clearMessage *time.Timer
+}
+
+// presenceTracker keeps presence in memory: it changes too often to be
+// written to the store, and everyone is offline after a restart anyway.
+type presenceTracker struct {
+	mu          sync.Mutex
+	timeout     time.Duration
+	entries     map[presenceKey]*presenceEntry
+	subscribers map[*presenceSubscriber]bool
+}
+
+// newPresenceTracker returns a tracker setting users offline timeout after
+// their last heartbeat.
+func newPresenceTracker(timeout time.Duration) *presenceTracker {
+	return &presenceTracker{
+		timeout:     timeout,
+		entries:     map[presenceKey]*presenceEntry{},
+		subscribers: map[*presenceSubscriber]bool{},
+	}
+}
+
+func (pt *presenceTracker) get(key presenceKey) Presence {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if e, ok := pt.entries[key]; ok {
+		return e.presence
+	}
+	return Presence{State: PresenceOffline}
+}
+
+// set replaces the presence of a user and counts as a heartbeat.
+func (pt *presenceTracker) set(key presenceKey, state PresenceState, message string, messageExpiresAt *time.Time) Presence {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	e := pt.entry(key)
+	now := time.Now()
+	e.presence = Presence{State: state, UpdatedAt: &now}
+	if message != "" {
+		e.presence.Message = message
+		e.presence.MessageExpiresAt = messageExpiresAt
+	}
+
+	stopTimer(&e.clearMessage)
+	if e.presence.MessageExpiresAt != nil {
+		e.clearMessage = pt.afterFunc(e.presence.MessageExpiresAt.Sub(now), key, e, func() {
+			e.presence.Message, e.presence.MessageExpiresAt = "", nil
+		})
+	}
+	pt.resetOffline(key, e, now)
+
+	pt.publish(key, e)
+	return e.presence
+}
+
+// heartbeat keeps a user in their state for another timeout.
+func (pt *presenceTracker) heartbeat(key presenceKey) Presence {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	e, ok := pt.entries[key]
+	if !ok {
+		return Presence{State: PresenceOffline}
+	}
+	pt.resetOffline(key, e, time.Now())
+	return e.presence
+}
+
+func (pt *presenceTracker) resetOffline(key presenceKey, e *presenceEntry, now time.Time) {
+	stopTimer(&e.offline)
+	e.presence.ExpiresAt = nil
+	if e.presence.State == PresenceOffline {
+		pt.dropIfIdle(key, e)
+		return
+	}
+
+	expiresAt := now.Add(pt.timeout)
+	e.presence.ExpiresAt = &expiresAt
+	e.offline = pt.afterFunc(pt.timeout, key, e, func() {
+		e.presence.State, e.presence.ExpiresAt = PresenceOffline, nil
+	})
+}
+
+// afterFunc runs change on e after d and publishes it, unless e was
+// replaced or the timer stopped in the meantime.
+func (pt *presenceTracker) afterFunc(d time.Duration, key presenceKey, e *presenceEntry, change func()) *time.Timer {
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		pt.mu.Lock()
+		defer pt.mu.Unlock()
+
+		if pt.entries[key] != e || e.offline != t && e.clearMessage != t {
+			return
+		}
+		if e.offline == t {
+			e.offline = nil
+		} else {
+			e.clearMessage = nil
+		}
+		change()
+		now := time.Now()
+		e.presence.UpdatedAt = &now
+		pt.publish(key, e)
+		pt.dropIfIdle(key, e)
+	})
+	return t
+}
+
+func (pt *presenceTracker) entry(key presenceKey) *presenceEntry {
+	e, ok := pt.entries[key]
+	if !ok {
+		e = &presenceEntry{}
+		pt.entries[key] = e
+	}
+	return e
+}
+
+// dropIfIdle forgets offline users without a message, they look the same
+// as users nobody set a presence for.
+func (pt *presenceTracker) dropIfIdle(key presenceKey, e *presenceEntry) {
+	if e.presence.State == PresenceOffline && e.presence.Message == "" {
+		stopTimer(&e.clearMessage)
+		delete(pt.entries, key)
+	}
+}
+
+func stopTimer(t **time.Timer) {
+	if *t != nil {
+		(*t).Stop()
+		*t = nil
+	}
+}
+
+func (pt *presenceTracker) subscribe(tenant string) *presenceSubscriber {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	s := &presenceSubscriber{tenant: tenant, events: make(chan presenceEvent, presenceSubscriberBuffer)}
+	pt.subscribers[s] = true
+	return s
+}
+
+func (pt *presenceTracker) unsubscribe(s *presenceSubscriber) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if pt.subscribers[s] {
+		delete(pt.subscribers, s)
+		close(s.events)
+	}
+}
+
+// publish sends the presence of e to the subscribers of its tenant. Those
+// too far behind are disconnected rather than silently missing changes.
+func (pt *presenceTracker) publish(key presenceKey, e *presenceEntry) {
+	event := presenceEvent{userId: key.userId, presence: e.presence}
+	for s := range pt.subscribers {
+		if s.tenant != key.tenant {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			delete(pt.subscribers, s)
+			close(s.events)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	eventStreamMediaType     = "text/event-stream"
+	maxPresenceMessageLength = 100
+	// presenceKeepAlive is how often idle streams get a comment, so proxies
+	// don't close them.
+	presenceKeepAlive = 30 * time.Second
+)
+
+type SetPresenceRequest struct {
+	State            PresenceState `json:"state"`
+	Message          string        `json:"message,omitempty"`
+	MessageExpiresAt *time.Time    `json:"message_expires_at,omitempty"`
+}
+
+func (s *SetPresenceRequest) Bind(r *http.Request) error {
+	if !s.State.Valid() {
+		return fmt.Errorf("state must be one of %s, %s, %s, %s or %s",
+			PresenceOnline, PresenceAway, PresenceBusy, PresenceInCall, PresenceOffline)
+	}
+	if utf8.RuneCountInString(s.Message) > maxPresenceMessageLength {
+		return fmt.Errorf("message can't be longer than %d characters", maxPresenceMessageLength)
+	}
+	if s.MessageExpiresAt != nil {
+		if s.Message == "" {
+			return errors.New("message_expires_at needs a message")
+		}
+		if !s.MessageExpiresAt.After(time.Now()) {
+			return errors.New("message_expires_at must be in the future")
+		}
+	}
+	return nil
+}
+
+type PresenceResponse struct {
+	UserId uint `json:"user_id"`
+	Presence
+}
+
+func (pr *PresenceResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+// presenceUser resolves the user a presence route is for, rendering an
+// error if there is none.
+type presenceUser func(w http.ResponseWriter, r *http.Request) (id uint, ok bool)
+
+// pathUser is the user in the {id} of the path.
+func pathUser(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := parseUserId(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return 0, false
+	}
+	if _, err := dbGetUser(r.Context(), id); err != nil {
+		if errors.Is(err, UserNotFound) {
+			render.Render(w, r, ErrNotFound(err))
+			return 0, false
+		}
+
+		render.Render(w, r, ErrInternal(err))
+		return 0, false
+	}
+	return id, true
+}
+
+// linkedUser is the user linked to the caller, see linkedUserId.
+func linkedUser(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := linkedUserId(r.Context())
+	if err == nil {
+		_, err = dbGetUser(r.Context(), id)
+	}
+	if err != nil {
+		renderLinkedUserError(w, r, err)
+		return 0, false
+	}
+	return id, true
+}
+
+// setPresenceRoutes serves the presence of many users at once as a list.
+// The stream of changes, streamPresence, is mounted by setRoutes.
+func setPresenceRoutes(pt *presenceTracker) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Use(requireRole(RoleReader))
+
+		r.Get("/", listPresence(pt))
+	}
+}
+
+func getPresence(pt *presenceTracker, user presenceUser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := user(w, r)
+		if !ok {
+			return
+		}
+
+		p := pt.get(presenceKey{tenantFrom(r.Context()), id})
+		render.Render(w, r, &PresenceResponse{UserId: id, Presence: p})
+	}
+}
+
+func setPresence(pt *presenceTracker, user presenceUser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := SetPresenceRequest{}
+		if err := render.Bind(r, &request); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		id, ok := user(w, r)
+		if !ok {
+			return
+		}
+
+		p := pt.set(presenceKey{tenantFrom(r.Context()), id}, request.State, request.Message, request.MessageExpiresAt)
+		render.Render(w, r, &PresenceResponse{UserId: id, Presence: p})
+	}
+}
+
+// presenceHeartbeat keeps a user in their current state, clients send it
+// more often than the heartbeat timeout while they are connected.
+func presenceHeartbeat(pt *presenceTracker, user presenceUser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := user(w, r)
+		if !ok {
+			return
+		}
+
+		p := pt.heartbeat(presenceKey{tenantFrom(r.Context()), id})
+		render.Render(w, r, &PresenceResponse{UserId: id, Presence: p})
+	}
+}
+
+// parsePresenceIds reads the comma separated ?ids= of presence lookups.
+func parsePresenceIds(r *http.Request) ([]uint, error) {
+	v := r.URL.Query().Get("ids")
+	if v == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(v, ",")
+	if len(parts) > maxPageLimit {
+		return nil, fmt.Errorf("up to %d ids can be looked up at once", maxPageLimit)
+	}
+	ids := make([]uint, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q in ids", part)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// listPresence returns the presence of the users in ?ids=, ids of users
+// that don't exist are left out.
+func listPresence(pt *presenceTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, err := parsePresenceIds(r)
+		if err == nil && len(ids) == 0 {
+			err = errors.New("ids is required")
+		}
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		userList, err := dbGetUserList(r.Context())
+		if err != nil {
+			render.Render(w, r, ErrInternal(err))
+			return
+		}
+
+		tenant := tenantFrom(r.Context())
+		list := []render.Renderer{}
+		seen := map[uint]bool{}
+		for _, id := range ids {
+			if _, ok := (*userList)[id]; !ok || seen[id] {
+				continue
+			}
+			seen[id] = true
+			list = append(list, &PresenceResponse{UserId: id, Presence: pt.get(presenceKey{tenant, id})})
+		}
+
+		if err := render.RenderList(w, r, list); err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+	}
+}
+
+// streamPresence sends presence changes as server-sent events named
+// "presence", with a PresenceResponse as data. With ?ids= only changes of
+// those users are sent, starting with their current presence.
+func streamPresence(pt *presenceTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, err := parsePresenceIds(r)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		filter := map[uint]bool{}
+		for _, id := range ids {
+			filter[id] = true
+		}
+
+		tenant := tenantFrom(r.Context())
+		sub := pt.subscribe(tenant)
+		defer pt.unsubscribe(sub)
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", eventStreamMediaType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(id uint, p Presence) error {
+			dat, err := json.Marshal(&PresenceResponse{UserId: id, Presence: p})
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: presence\ndata: %s\n\n", dat); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		for _, id := range ids {
+			if err := send(id, pt.get(presenceKey{tenant, id})); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		keepAlive := time.NewTicker(presenceKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			case event, ok := <-sub.events:
+				if !ok {
+					return
+				}
+				if len(filter) > 0 && !filter[event.userId] {
+					continue
+				}
+				if err := send(event.userId, event.presence); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
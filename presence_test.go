@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresence(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+		},
+	})
+	config.PresenceTimeout = 300 * time.Millisecond
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, ts, req)
+	}
+	presence := func(path string) PresenceResponse {
+		resp, body := request("GET", path, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		p := PresenceResponse{}
+		require.NoError(t, json.Unmarshal(body, &p))
+		return p
+	}
+
+	assert.Equal(t, PresenceOffline, presence("/users/1/presence").State)
+
+	t.Run("invalid requests", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			method string
+			path   string
+			body   string
+			status int
+		}{
+			{"unknown state", "PUT", "/users/1/presence", `{"state":"sleeping"}`, 400},
+			{"message too long", "PUT", "/users/1/presence", `{"state":"busy","message":"` + strings.Repeat("x", 101) + `"}`, 400},
+			{"expiry without message", "PUT", "/users/1/presence", `{"state":"busy","message_expires_at":"2999-01-01T00:00:00Z"}`, 400},
+			{"expired message", "PUT", "/users/1/presence", `{"state":"busy","message":"x","message_expires_at":"2001-01-01T00:00:00Z"}`, 400},
+			{"unknown user", "PUT", "/users/42/presence", `{"state":"online"}`, 404},
+			{"heartbeat of unknown user", "POST", "/users/42/presence:heartbeat", ``, 404},
+			{"lookup without ids", "GET", "/presence/", ``, 400},
+			{"lookup with invalid ids", "GET", "/presence/?ids=1,x", ``, 400},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, body := request(tc.method, tc.path, tc.body)
+				assert.Equal(t, tc.status, resp.StatusCode, string(body))
+			})
+		}
+	})
+
+	t.Run("heartbeats keep users online", func(t *testing.T) {
+		resp, body := request("PUT", "/users/1/presence", `{"state":"in-call","message":"Weekly sync"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+		for i := 0; i < 4; i++ {
+			time.Sleep(100 * time.Millisecond)
+			resp, _ := request("POST", "/users/1/presence:heartbeat", "")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+		p := presence("/users/1/presence")
+		assert.Equal(t, PresenceInCall, p.State)
+		assert.Equal(t, "Weekly sync", p.Message)
+		require.NotNil(t, p.ExpiresAt)
+
+		// the message outlives the state
+		assert.Eventually(t, func() bool { return presence("/users/1/presence").State == PresenceOffline }, 2*time.Second, 20*time.Millisecond)
+		p = presence("/users/1/presence")
+		assert.Equal(t, "Weekly sync", p.Message)
+		assert.Nil(t, p.ExpiresAt)
+	})
+
+	t.Run("messages expire", func(t *testing.T) {
+		expiresAt := time.Now().Add(100 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+		resp, body := request("PUT", "/users/2/presence", `{"state":"busy","message":"Focus time","message_expires_at":"`+expiresAt+`"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+		assert.Eventually(t, func() bool { return presence("/users/2/presence").Message == "" }, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, PresenceBusy, presence("/users/2/presence").State)
+	})
+
+	t.Run("bulk lookup", func(t *testing.T) {
+		resp, _ := request("PUT", "/users/2/presence", `{"state":"away"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, body := request("GET", "/presence/?ids=2,42,1,2", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		list := []PresenceResponse{}
+		require.NoError(t, json.Unmarshal(body, &list))
+		require.Len(t, list, 2)
+		assert.Equal(t, uint(2), list[0].UserId)
+		assert.Equal(t, PresenceAway, list[0].State)
+		assert.Equal(t, uint(1), list[1].UserId)
+		assert.Equal(t, PresenceOffline, list[1].State)
+	})
+}
+
+func TestPresenceStream(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+		},
+	})
+	config.AuthRequired = true
+	config.PresenceTimeout = 200 * time.Millisecond
+	// streams stay open past the timeout of other requests
+	config.RequestTimeout = 100 * time.Millisecond
+	keys := newAPIKeyStore(config.APIKeysPath)
+	_, alice, err := keys.issue(APIKey{Name: "alice", Role: RoleReader, UserID: 1})
+	require.NoError(t, err)
+	_, bob, err := keys.issue(APIKey{Name: "bob", Role: RoleReader, UserID: 2})
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	setMine := func(token, body string) {
+		req, err := http.NewRequest("PUT", ts.URL+"/api/v1/me/presence", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(apiKeyHeader, token)
+		resp, respBody := testRequest(t, ts, req)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(respBody))
+	}
+
+	req := mustRequest(t, "GET", ts.URL+"/api/v1/presence/stream?ids=1")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(apiKeyHeader, bob)
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan PresenceResponse, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				p := PresenceResponse{}
+				if json.Unmarshal([]byte(data), &p) == nil {
+					events <- p
+				}
+			}
+		}
+	}()
+	next := func() PresenceResponse {
+		select {
+		case p := <-events:
+			return p
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "no presence event")
+		}
+		return PresenceResponse{}
+	}
+
+	// the current presence first
+	assert.Equal(t, PresenceResponse{UserId: 1, Presence: Presence{State: PresenceOffline}}, next())
+
+	// Bob isn't followed
+	setMine(bob, `{"state":"online"}`)
+	setMine(alice, `{"state":"busy","message":"Deploying"}`)
+	p := next()
+	assert.Equal(t, uint(1), p.UserId)
+	assert.Equal(t, PresenceBusy, p.State)
+	assert.Equal(t, "Deploying", p.Message)
+
+	// without heartbeats Alice goes offline
+	p = next()
+	assert.Equal(t, uint(1), p.UserId)
+	assert.Equal(t, PresenceOffline, p.State)
+
+	time.Sleep(3 * config.RequestTimeout)
+	setMine(alice, `{"state":"online"}`)
+	p = next()
+	assert.Equal(t, uint(1), p.UserId)
+	assert.Equal(t, PresenceOnline, p.State)
+}
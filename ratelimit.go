@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeyHeader    = "X-API-Key"
+	rateLimitWindow = time.Minute
+	// maxRateLimitBuckets bounds memory use, full buckets are dropped once
+	// it is reached as they behave like new ones. When none is full, new
+	// clients share the overflow bucket.
+	maxRateLimitBuckets = 10000
+	rateLimitOverflow   = "overflow"
+)
+
+// rateLimiter is a token bucket per client: each client may send up to
+// limit requests at once, and regains limit tokens per rateLimitWindow.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	rate    float64 // tokens per second
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		rate:    float64(limit) / rateLimitWindow.Seconds(),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// rateLimitResult describes the bucket of a client after a request.
+type rateLimitResult struct {
+	allowed   bool
+	remaining int
+	// reset is when the bucket is full again.
+	reset time.Duration
+	// retryAfter is when the next request is allowed, if this one wasn't.
+	retryAfter time.Duration
+}
+
+func (l *rateLimiter) allow(key string) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxRateLimitBuckets {
+		l.dropFullBuckets(now)
+		if len(l.buckets) >= maxRateLimitBuckets {
+			key = rateLimitOverflow
+			b, ok = l.buckets[key]
+		}
+	}
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.limit), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	res := rateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = l.duration(1 - b.tokens)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = l.duration(float64(l.limit) - b.tokens)
+	return res
+}
+
+// duration returns how long refilling tokens takes.
+func (l *rateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) dropFullBuckets(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= float64(l.limit) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the client of a request: by the authenticated
+// principal, so authenticate has to run first, or by IP address for
+// anonymous callers. RealIP has to run first for clients behind proxies.
+func rateLimitKey(ctx context.Context, remoteAddr string) string {
+	if p := principalFrom(ctx); p != nil {
+		return "principal:" + p.Subject
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit applies the reads limiter to safe methods and the writes
+// limiter to all others. A nil limiter doesn't limit.
+func rateLimit(reads, writes *rateLimiter, renderError errorRenderer) func(http.Handler) http.Handler {
+	return rateLimitBy(safeMethod, reads, writes, renderError)
+}
+
+func safeMethod(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// rateLimitBy is rateLimit for APIs where the method doesn't tell reads
+// from writes: isRead decides which limiter a request counts against.
+func rateLimitBy(isRead func(r *http.Request) bool, reads, writes *rateLimiter, renderError errorRenderer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := writes
+			if isRead(r) {
+				l = reads
+			}
+			if l == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			res := l.allow(rateLimitKey(r.Context(), r.RemoteAddr))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.reset)))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.limit, int(rateLimitWindow.Seconds())))
+
+			if !res.allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.retryAfter)))
+				renderError(w, r, RateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// newRateLimiters returns the limiters configured for reads and writes, nil
+// for those that are disabled.
+func newRateLimiters() (reads, writes *rateLimiter) {
+	if config.RateLimitReads > 0 {
+		reads = newRateLimiter(config.RateLimitReads)
+	}
+	if config.RateLimitWrites > 0 {
+		writes = newRateLimiter(config.RateLimitWrites)
+	}
+	return
+}
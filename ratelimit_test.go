@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(60)
+	l.now = func() time.Time { return now }
+
+	for i := 59; i >= 0; i-- {
+		res := l.allow("a")
+		require.True(t, res.allowed)
+		assert.Equal(t, i, res.remaining)
+	}
+
+	res := l.allow("a")
+	assert.False(t, res.allowed)
+	assert.Equal(t, time.Second, res.retryAfter)
+	assert.Equal(t, time.Minute, res.reset)
+
+	assert.True(t, l.allow("b").allowed, "clients have separate buckets")
+
+	now = now.Add(time.Second)
+	assert.True(t, l.allow("a").allowed)
+	assert.False(t, l.allow("a").allowed)
+
+	now = now.Add(time.Hour)
+	res = l.allow("a")
+	assert.True(t, res.allowed)
+	assert.Equal(t, 59, res.remaining, "buckets don't fill beyond the limit")
+}
+
+func TestRateLimiterBound(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(60)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		require.True(t, l.allow(fmt.Sprint("client-", i)).allowed)
+	}
+	assert.Equal(t, 59, l.allow("new").remaining)
+	assert.Equal(t, 58, l.allow("another").remaining, "new clients share a bucket while none is full")
+	assert.Len(t, l.buckets, maxRateLimitBuckets+1)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, 59, l.allow("another").remaining, "full buckets make room")
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.RateLimitReads = 3
+	config.RateLimitWrites = 1
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, body := testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/users/"))
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		assert.Equal(t, "3", resp.Header.Get("RateLimit-Limit"))
+		assert.Equal(t, "3;w=60", resp.Header.Get("RateLimit-Policy"))
+	}
+
+	resp, body := testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/users/"))
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "20", resp.Header.Get("Retry-After"))
+	errResp := ErrResponse{}
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, RateLimited.Error(), errResp.ErrorText)
+
+	resp, body = testRequest(t, ts, mustRequest(t, "POST", ts.URL+"/api/v1/admin/backups/"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode, "writes have their own limit: %s", body)
+	resp, _ = testRequest(t, ts, mustRequest(t, "POST", ts.URL+"/api/v1/admin/backups/"))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	_, token, err := newAPIKeyStore(config.APIKeysPath).issue(APIKey{Name: "script", Role: RoleReader})
+	require.NoError(t, err)
+	req := mustRequest(t, "GET", ts.URL+"/api/v1/users/")
+	req.Header.Set(apiKeyHeader, token)
+	resp, _ = testRequest(t, ts, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "clients with an API key are limited separately")
+
+	req = mustRequest(t, "GET", ts.URL+"/api/v1/users/")
+	req.Header.Set(apiKeyHeader, apiKeyPrefix+"random_key")
+	resp, _ = testRequest(t, ts, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "unknown keys are rejected before they get a bucket")
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.RateLimitReads, config.RateLimitWrites = 0, 0
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/users/"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("RateLimit-Limit"))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRecurrencePeriods stops the expansion of rules whose periods never
+// produce an occurrence, like a yearly rule on February 29th with an
+// interval skipping every leap year.
+const maxRecurrencePeriods = 100000
+
+// recurrence is a parsed RFC 5545 RRULE. Only what meeting series need is
+// supported: FREQ, INTERVAL, COUNT, UNTIL and, on weekly rules, BYDAY with
+// plain weekdays.
+type recurrence struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	byDay    []time.Weekday
+}
+
+var rruleWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// parseRecurrence parses a rule like "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10",
+// with or without the "RRULE:" prefix.
+func parseRecurrence(rule string) (*recurrence, error) {
+	invalid := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%w: "+format, append([]interface{}{InvalidRecurrence}, a...)...)
+	}
+
+	rc := &recurrence{interval: 1}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.ToUpper(name)
+		if !ok || value == "" {
+			return nil, invalid("expected NAME=VALUE, got %q", part)
+		}
+		if seen[name] {
+			return nil, invalid("%s is given twice", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			rc.freq = strings.ToUpper(value)
+			switch rc.freq {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+			default:
+				return nil, invalid("unsupported FREQ %s", value)
+			}
+		case "INTERVAL":
+			if rc.interval, err = strconv.Atoi(value); err != nil || rc.interval < 1 {
+				return nil, invalid("INTERVAL must be a positive number")
+			}
+		case "COUNT":
+			if rc.count, err = strconv.Atoi(value); err != nil || rc.count < 1 {
+				return nil, invalid("COUNT must be a positive number")
+			}
+		case "UNTIL":
+			if rc.until, err = time.Parse("20060102T150405Z", value); err != nil {
+				if rc.until, err = time.Parse("20060102", value); err != nil {
+					return nil, invalid("UNTIL must be a UTC date-time like 20261231T235959Z or a date")
+				}
+				rc.until = rc.until.Add(24*time.Hour - time.Second)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(value), ",") {
+				wd := weekdayIndex(day)
+				if wd < 0 {
+					return nil, invalid("unsupported BYDAY %s", day)
+				}
+				if !containsWeekday(rc.byDay, wd) {
+					rc.byDay = append(rc.byDay, wd)
+				}
+			}
+		default:
+			return nil, invalid("unsupported rule part %s", name)
+		}
+	}
+
+	switch {
+	case rc.freq == "":
+		return nil, invalid("FREQ is required")
+	case rc.count > 0 && !rc.until.IsZero():
+		return nil, invalid("COUNT and UNTIL can't be combined")
+	case len(rc.byDay) > 0 && rc.freq != "WEEKLY":
+		return nil, invalid("BYDAY is only supported with FREQ=WEEKLY")
+	}
+	// weeks start on Monday
+	sort.Slice(rc.byDay, func(i, j int) bool { return (rc.byDay[i]+6)%7 < (rc.byDay[j]+6)%7 })
+	return rc, nil
+}
+
+func weekdayIndex(day string) time.Weekday {
+	for i, d := range rruleWeekdays {
+		if d == day {
+			return time.Weekday(i)
+		}
+	}
+	return -1
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the rule in canonical form, which is how it is stored.
+func (rc *recurrence) String() string {
+	parts := []string{"FREQ=" + rc.freq}
+	if rc.interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rc.interval))
+	}
+	if rc.count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rc.count))
+	}
+	if !rc.until.IsZero() {
+		parts = append(parts, "UNTIL="+rc.until.UTC().Format("20060102T150405Z"))
+	}
+	if len(rc.byDay) > 0 {
+		days := make([]string, len(rc.byDay))
+		for i, d := range rc.byDay {
+			days[i] = rruleWeekdays[d]
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// each calls yield with the start of every occurrence of a series starting
+// at start, in order, until yield returns false or the rule ends. A nil rule
+// has start as its only occurrence. Occurrences before start are skipped,
+// as are monthly and yearly ones on days a month doesn't have.
+func (rc *recurrence) each(start time.Time, yield func(time.Time) bool) {
+	if rc == nil {
+		yield(start)
+		return
+	}
+
+	n := 0
+	weekStart := start.AddDate(0, 0, -int((start.Weekday()+6)%7))
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		step := rc.interval * period
+		var candidates []time.Time
+		switch rc.freq {
+		case "DAILY":
+			candidates = []time.Time{start.AddDate(0, 0, step)}
+		case "WEEKLY":
+			if len(rc.byDay) == 0 {
+				candidates = []time.Time{start.AddDate(0, 0, 7*step)}
+				break
+			}
+			for _, d := range rc.byDay {
+				candidates = append(candidates, weekStart.AddDate(0, 0, 7*step+int((d+6)%7)))
+			}
+		case "MONTHLY":
+			candidates = []time.Time{start.AddDate(0, step, 0)}
+		case "YEARLY":
+			candidates = []time.Time{start.AddDate(step, 0, 0)}
+		}
+
+		for _, t := range candidates {
+			if t.Before(start) || t.Day() != start.Day() && (rc.freq == "MONTHLY" || rc.freq == "YEARLY") {
+				continue
+			}
+			if !rc.until.IsZero() && t.After(rc.until) || rc.count > 0 && n >= rc.count {
+				return
+			}
+			n++
+			if !yield(t) {
+				return
+			}
+		}
+	}
+}
+
+// occurrence is a single meeting of a conference.
+type occurrence struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// expandOccurrences returns the occurrences of a series starting at start,
+// each lasting duration, that overlap [from, to).
+func expandOccurrences(start time.Time, duration time.Duration, rc *recurrence, from, to time.Time) []occurrence {
+	list := []occurrence{}
+	rc.each(start, func(t time.Time) bool {
+		if !t.Before(to) {
+			return false
+		}
+		if end := t.Add(duration); end.After(from) {
+			list = append(list, occurrence{Start: t, End: end})
+		}
+		return true
+	})
+	return list
+}
+
+// overlap returns the first occurrence in b overlapping one in a, both
+// sorted by start.
+func overlap(a, b []occurrence) (occurrence, bool) {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case !a[i].End.After(b[j].Start):
+			i++
+		case !b[j].End.After(a[i].Start):
+			j++
+		default:
+			return b[j], true
+		}
+	}
+	return occurrence{}, false
+}
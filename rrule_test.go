@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	tests := []struct {
+		rule      string
+		canonical string
+		wantErr   bool
+	}{
+		{rule: "FREQ=DAILY", canonical: "FREQ=DAILY"},
+		{rule: "RRULE:freq=weekly;byday=fr,mo;INTERVAL=2", canonical: "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR"},
+		{rule: "FREQ=MONTHLY;COUNT=3", canonical: "FREQ=MONTHLY;COUNT=3"},
+		{rule: "FREQ=YEARLY;UNTIL=20301231", canonical: "FREQ=YEARLY;UNTIL=20301231T235959Z"},
+		{rule: "FREQ=DAILY;UNTIL=20261231T100000Z", canonical: "FREQ=DAILY;UNTIL=20261231T100000Z"},
+		{rule: "", wantErr: true},
+		{rule: "INTERVAL=2", wantErr: true},
+		{rule: "FREQ=HOURLY", wantErr: true},
+		{rule: "FREQ=DAILY;FREQ=WEEKLY", wantErr: true},
+		{rule: "FREQ=DAILY;INTERVAL=0", wantErr: true},
+		{rule: "FREQ=DAILY;COUNT=2;UNTIL=20301231", wantErr: true},
+		{rule: "FREQ=DAILY;BYDAY=MO", wantErr: true},
+		{rule: "FREQ=WEEKLY;BYDAY=1MO", wantErr: true},
+		{rule: "FREQ=WEEKLY;BYMONTH=1", wantErr: true},
+		{rule: "FREQ=DAILY;UNTIL=tomorrow", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.rule, func(t *testing.T) {
+			rc, err := parseRecurrence(tc.rule)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, InvalidRecurrence)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.canonical, rc.String())
+		})
+	}
+}
+
+func TestExpandOccurrences(t *testing.T) {
+	day := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2026, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	// Monday, October 19th 2026
+	start := day(time.October, 19, 9)
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		rule     string
+		from, to time.Time
+		want     []time.Time
+	}{
+		{
+			name: "single event", start: start,
+			from: day(time.October, 1, 0), to: day(time.November, 1, 0),
+			want: []time.Time{start},
+		},
+		{
+			name: "single event out of range", start: start,
+			from: day(time.October, 20, 0), to: day(time.November, 1, 0),
+		},
+		{
+			name: "daily with count", start: start, rule: "FREQ=DAILY;COUNT=3",
+			from: day(time.October, 1, 0), to: day(time.November, 1, 0),
+			want: []time.Time{start, day(time.October, 20, 9), day(time.October, 21, 9)},
+		},
+		{
+			name: "ongoing occurrence at the start of the range", start: start, rule: "FREQ=DAILY",
+			from: day(time.October, 20, 9).Add(30 * time.Minute), to: day(time.October, 21, 9),
+			want: []time.Time{day(time.October, 20, 9)},
+		},
+		{
+			name: "weekdays until", start: start, rule: "FREQ=WEEKLY;BYDAY=TU,TH;UNTIL=20261029T000000Z",
+			from: day(time.October, 1, 0), to: day(time.December, 1, 0),
+			want: []time.Time{day(time.October, 20, 9), day(time.October, 22, 9), day(time.October, 27, 9)},
+		},
+		{
+			name: "every other week", start: start, rule: "FREQ=WEEKLY;INTERVAL=2",
+			from: day(time.November, 1, 0), to: day(time.December, 1, 0),
+			want: []time.Time{day(time.November, 2, 9), day(time.November, 16, 9), day(time.November, 30, 9)},
+		},
+		{
+			name: "monthly skips short months", start: time.Date(2027, time.January, 31, 9, 0, 0, 0, time.UTC), rule: "FREQ=MONTHLY;COUNT=3",
+			from: day(time.January, 1, 0), to: time.Date(2028, time.January, 1, 0, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2027, time.January, 31, 9, 0, 0, 0, time.UTC),
+				time.Date(2027, time.March, 31, 9, 0, 0, 0, time.UTC),
+				time.Date(2027, time.May, 31, 9, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "yearly", start: start, rule: "FREQ=YEARLY",
+			from: day(time.November, 1, 0), to: time.Date(2028, time.November, 1, 0, 0, 0, 0, time.UTC),
+			want: []time.Time{time.Date(2027, time.October, 19, 9, 0, 0, 0, time.UTC), time.Date(2028, time.October, 19, 9, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var rc *recurrence
+			if tc.rule != "" {
+				var err error
+				rc, err = parseRecurrence(tc.rule)
+				require.NoError(t, err)
+			}
+
+			got := []time.Time{}
+			for _, o := range expandOccurrences(tc.start, time.Hour, rc, tc.from, tc.to) {
+				assert.Equal(t, time.Hour, o.End.Sub(o.Start))
+				got = append(got, o.Start)
+			}
+			if tc.want == nil {
+				tc.want = []time.Time{}
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
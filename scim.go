@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scimMediaType     = "application/scim+json"
+	scimUserSchema    = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema    = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchOpSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema   = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// scimUser is a User as the SCIM core schema sees it. userName is the email
+// of the user, emails only mirrors it. Users without an email get the
+// placeholder userName "user-<id>".
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	Id          string      `json:"id,omitempty"`
+	ExternalId  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *scimName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	// Active is nil when a client leaves it out, which means active.
+	Active *bool     `json:"active,omitempty"`
+	Meta   *scimMeta `json:"meta,omitempty"`
+}
+
+func scimPlaceholderUserName(id uint) string {
+	return fmt.Sprintf("user-%d", id)
+}
+
+// newSCIMUser represents the user id, whose location is base/Users/<id>.
+func newSCIMUser(id uint, u User, externalId, base string) scimUser {
+	// only active users are active, the others can't sign in
+	active := u.Status == StatusActive
+	su := scimUser{
+		Schemas:     []string{scimUserSchema},
+		Id:          strconv.FormatUint(uint64(id), 10),
+		ExternalId:  externalId,
+		UserName:    u.Email,
+		Name:        &scimName{Formatted: u.DisplayName},
+		DisplayName: u.DisplayName,
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.UpdatedAt,
+			Location:     fmt.Sprintf("%s/Users/%d", base, id),
+		},
+	}
+	if u.Email == "" {
+		su.UserName = scimPlaceholderUserName(id)
+	} else {
+		su.Emails = []scimEmail{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	return su
+}
+
+// scimFields are the attributes of a user a SCIM client manages.
+type scimFields struct {
+	DisplayName string
+	Email       string
+	Active      bool
+	ExternalId  string
+}
+
+// fields maps su onto the user id, zero for a new user. The display name
+// falls back to the parts of name, then to userName.
+func (su scimUser) fields(id uint) (f scimFields, err error) {
+	userName := strings.TrimSpace(su.UserName)
+	if userName == "" {
+		return f, fmt.Errorf("%w: userName is required", InvalidSCIMValue)
+	}
+	if id == 0 || userName != scimPlaceholderUserName(id) {
+		f.Email = userName
+	}
+
+	f.DisplayName = strings.TrimSpace(su.DisplayName)
+	if f.DisplayName == "" && su.Name != nil {
+		f.DisplayName = strings.TrimSpace(su.Name.Formatted)
+		if f.DisplayName == "" {
+			f.DisplayName = strings.TrimSpace(su.Name.GivenName + " " + su.Name.FamilyName)
+		}
+	}
+	if f.DisplayName == "" {
+		f.DisplayName = userName
+	}
+
+	f.Active = su.Active == nil || *su.Active
+	f.ExternalId = strings.TrimSpace(su.ExternalId)
+	return
+}
+
+// provisionedStatus is the status of a user in current after a SCIM client
+// sets it active or not. Deactivating suspends an active user and leaves
+// the others as they are.
+func provisionedStatus(current UserStatus, active bool) (UserStatus, error) {
+	switch {
+	case active && current != StatusActive:
+		return StatusActive, checkStatusTransition(current, StatusActive)
+	case !active && current == StatusActive:
+		return StatusSuspended, nil
+	}
+	return current, nil
+}
+
+func setExternalId(us *UserStore, id uint, externalId string) {
+	if externalId == "" {
+		delete(us.ExternalIds, id)
+		return
+	}
+	if us.ExternalIds == nil {
+		us.ExternalIds = map[uint]string{}
+	}
+	us.ExternalIds[id] = externalId
+}
+
+// dbGetSCIMUsers returns the users and their external ids at once, so lists
+// are consistent.
+func dbGetSCIMUsers(ctx context.Context) (list UserList, externalIds map[uint]string, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+	return us.List, us.ExternalIds, nil
+}
+
+func dbGetSCIMUser(ctx context.Context, id uint) (user *User, externalId string, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	u, ok := us.List[id]
+	if !ok {
+		return nil, "", UserNotFound
+	}
+	return &u, us.ExternalIds[id], nil
+}
+
+// dbProvisionUser creates a user for a SCIM client. Users created inactive
+// are invited.
+func dbProvisionUser(ctx context.Context, f scimFields) (id uint, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	if err = checkEmail(f.Email); err != nil {
+		return
+	}
+	if emailTaken(us, f.Email, 0) {
+		return 0, EmailTaken
+	}
+
+	status := StatusActive
+	if !f.Active {
+		status = StatusInvited
+	}
+
+	us.Increment++
+	now := time.Now()
+	id = us.Increment
+	us.List[id] = User{
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		DisplayName: f.DisplayName,
+		Email:       f.Email,
+		Status:      status,
+	}
+	setExternalId(&us, id, f.ExternalId)
+
+	err = saveUserStore(ctx, us)
+
+	return
+}
+
+// dbReprovisionUser replaces the attributes a SCIM client manages.
+func dbReprovisionUser(ctx context.Context, id uint, f scimFields) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	us, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	u, ok := us.List[id]
+	if !ok {
+		return UserNotFound
+	}
+	if err = checkEmail(f.Email); err != nil {
+		return
+	}
+	if emailTaken(us, f.Email, id) {
+		return EmailTaken
+	}
+	if u.Status, err = provisionedStatus(u.Status, f.Active); err != nil {
+		return
+	}
+
+	u.DisplayName = f.DisplayName
+	u.Email = f.Email
+	u.UpdatedAt = time.Now()
+	us.List[id] = u
+	setExternalId(&us, id, f.ExternalId)
+
+	err = saveUserStore(ctx, us)
+
+	return
+}
+
+// scimPatchOperation is an operation of a PatchOp request. Without a path,
+// the value is an object of the attributes to add or replace.
+type scimPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+// patch applies the operations to su. They are applied to its JSON
+// representation, so paths follow the attribute names of the schema.
+func (su scimUser) patch(ops []scimPatchOperation) (scimUser, error) {
+	dat, err := json.Marshal(su)
+	if err != nil {
+		return su, err
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(dat, &res); err != nil {
+		return su, err
+	}
+
+	for _, op := range ops {
+		if err := applySCIMPatch(res, op); err != nil {
+			return su, err
+		}
+	}
+
+	// some clients, Azure AD among them, send booleans as strings
+	if k := scimKey(res, "active"); k != "" {
+		if s, ok := res[k].(string); ok {
+			active, err := strconv.ParseBool(strings.ToLower(s))
+			if err != nil {
+				return su, fmt.Errorf("%w: active must be a boolean", InvalidSCIMValue)
+			}
+			res[k] = active
+		}
+	}
+
+	if dat, err = json.Marshal(res); err != nil {
+		return su, err
+	}
+	patched := scimUser{}
+	if err := json.Unmarshal(dat, &patched); err != nil {
+		return su, fmt.Errorf("%w: %v", InvalidSCIMValue, err)
+	}
+
+	// the display name is derived from a changed name, as on create
+	if patched.Name != nil && !reflect.DeepEqual(patched.Name, su.Name) {
+		if patched.DisplayName == su.DisplayName {
+			patched.DisplayName = ""
+		}
+		if su.Name != nil && patched.Name.Formatted == su.Name.Formatted {
+			patched.Name.Formatted = ""
+		}
+	}
+	return patched, nil
+}
+
+func applySCIMPatch(res map[string]interface{}, op scimPatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	switch kind {
+	case "add", "replace", "remove":
+	default:
+		return fmt.Errorf("%w: unknown op %q", InvalidPatch, op.Op)
+	}
+
+	if op.Path == "" {
+		attrs, ok := op.Value.(map[string]interface{})
+		if kind == "remove" || !ok {
+			return fmt.Errorf("%w: %s without a path needs an object value", InvalidPatch, kind)
+		}
+		for path, value := range attrs {
+			if err := applySCIMPatch(res, scimPatchOperation{Op: kind, Path: path, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	attr, filter, sub, err := parseSCIMPatchPath(op.Path)
+	if err != nil {
+		return err
+	}
+	if filter == nil {
+		target := res
+		if len(attr) == 2 {
+			nested, _ := res[scimKeyOr(res, attr[0])].(map[string]interface{})
+			if nested == nil {
+				if kind == "remove" {
+					return nil
+				}
+				nested = map[string]interface{}{}
+			}
+			res[scimKeyOr(res, attr[0])] = nested
+			target = nested
+		}
+		patchSCIMValue(target, attr[len(attr)-1], kind, op.Value)
+		return nil
+	}
+
+	// attr[filter] and attr[filter].sub patch the matching values
+	k := scimKeyOr(res, attr[0])
+	values, _ := res[k].([]interface{})
+	kept := []interface{}{}
+	for _, v := range values {
+		item, ok := v.(map[string]interface{})
+		if !ok || !filter.match(item) {
+			kept = append(kept, v)
+			continue
+		}
+		switch {
+		case sub != "":
+			patchSCIMValue(item, sub, kind, op.Value)
+		case kind == "remove":
+			continue
+		default:
+			if value, ok := op.Value.(map[string]interface{}); ok {
+				for vk, vv := range value {
+					item[scimKeyOr(item, vk)] = vv
+				}
+			}
+		}
+		kept = append(kept, item)
+	}
+	res[k] = kept
+	return nil
+}
+
+// patchSCIMValue adds, replaces or removes the attribute name of res.
+// Adding to a multi-valued attribute appends to it.
+func patchSCIMValue(res map[string]interface{}, name, kind string, value interface{}) {
+	k := scimKeyOr(res, name)
+	switch kind {
+	case "remove":
+		delete(res, k)
+	case "add":
+		if existing, ok := res[k].([]interface{}); ok {
+			if values, ok := value.([]interface{}); ok {
+				res[k] = append(existing, values...)
+				return
+			}
+		}
+		res[k] = value
+	default:
+		res[k] = value
+	}
+}
+
+// parseSCIMPatchPath parses "attr", "attr.sub", "attr[filter]" and
+// "attr[filter].sub".
+func parseSCIMPatchPath(path string) (attr []string, filter scimFilter, sub string, err error) {
+	open := strings.IndexByte(path, '[')
+	if open < 0 {
+		attr = scimAttrPath(path)
+		if len(attr) > 2 || !isSCIMAttrPath(path) {
+			return nil, nil, "", fmt.Errorf("%w: invalid path %q", InvalidPatch, path)
+		}
+		return
+	}
+
+	end := strings.LastIndexByte(path, ']')
+	if end < open {
+		return nil, nil, "", fmt.Errorf("%w: invalid path %q", InvalidPatch, path)
+	}
+	attr = scimAttrPath(path[:open])
+	if len(attr) != 1 || !isSCIMAttrPath(path[:open]) {
+		return nil, nil, "", fmt.Errorf("%w: invalid path %q", InvalidPatch, path)
+	}
+	if filter, err = parseSCIMFilter(path[open+1 : end]); err != nil {
+		return
+	}
+	if rest := path[end+1:]; rest != "" {
+		if !strings.HasPrefix(rest, ".") || !isSCIMAttrPath(rest[1:]) {
+			return nil, nil, "", fmt.Errorf("%w: invalid path %q", InvalidPatch, path)
+		}
+		sub = rest[1:]
+	}
+	return
+}
+
+// scimKey returns the key of res matching name case-insensitively, or ""
+// if there is none.
+func scimKey(res map[string]interface{}, name string) string {
+	for k := range res {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return ""
+}
+
+func scimKeyOr(res map[string]interface{}, name string) string {
+	if k := scimKey(res, name); k != "" {
+		return k
+	}
+	return name
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// scimDefaultCount is how many resources a list returns without a count.
+const scimDefaultCount = 100
+
+// scimError is the error response of RFC 7644, section 3.12.
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+func newSCIMList(resources []interface{}) scimListResponse {
+	return scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// writeSCIM writes v as application/scim+json. SCIM clients don't take part
+// in the content negotiation of the API, so render is not used.
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimMediaType+"; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(true)
+	enc.Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType string, err error) {
+	writeSCIM(w, status, scimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   err.Error(),
+	})
+}
+
+// renderSCIMError maps errors of the SCIM handlers to their status and
+// scimType.
+func renderSCIMError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, Unauthenticated), errors.Is(err, InvalidAPIKey), errors.Is(err, InvalidToken):
+		writeSCIMError(w, http.StatusUnauthorized, "", err)
+	case errors.Is(err, Forbidden):
+		writeSCIMError(w, http.StatusForbidden, "", err)
+	case errors.Is(err, RateLimited):
+		writeSCIMError(w, http.StatusTooManyRequests, "", err)
+	case errors.Is(err, InvalidTenant), errors.Is(err, TenantNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", TenantNotFound)
+	case errors.Is(err, UserNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", err)
+	case errors.Is(err, EmailTaken):
+		writeSCIMError(w, http.StatusConflict, "uniqueness", err)
+	case errors.Is(err, InvalidFilter):
+		writeSCIMError(w, http.StatusBadRequest, "invalidFilter", err)
+	case errors.Is(err, InvalidPatch):
+		writeSCIMError(w, http.StatusBadRequest, "invalidPath", err)
+	case errors.Is(err, InvalidSCIMValue), errors.Is(err, InvalidEmail), errors.Is(err, InvalidStatusTransition):
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", err)
+	default:
+		// don't send error text over the wire as it may contain sensitive
+		// information
+		log.Error(err)
+		writeSCIMError(w, http.StatusInternalServerError, "", errors.New(http.StatusText(http.StatusInternalServerError)))
+	}
+}
+
+// renderSCIMMiddlewareError is renderSCIMError for the middlewares in front
+// of the SCIM API.
+func renderSCIMMiddlewareError(w http.ResponseWriter, r *http.Request, err error) {
+	renderSCIMError(w, err)
+}
+
+// setSCIMRoutes serves the SCIM 2.0 protocol of RFC 7644 for users, so
+// identity providers like Okta or Azure AD can provision them. Identity
+// providers send API keys as bearer tokens.
+func setSCIMRoutes(r chi.Router) {
+	reader := requireRoleRendering(RoleReader, renderSCIMMiddlewareError)
+	editor := requireRoleRendering(RoleEditor, renderSCIMMiddlewareError)
+	admin := requireRoleRendering(RoleAdmin, renderSCIMMiddlewareError)
+
+	// the discovery endpoints describe the service, not its data
+	r.Get("/ServiceProviderConfig", getSCIMServiceProviderConfig)
+	r.Get("/Schemas", getSCIMSchemas)
+	r.Get("/Schemas/{schemaId}", getSCIMSchema)
+	r.Get("/ResourceTypes", getSCIMResourceTypes)
+	r.Get("/ResourceTypes/{typeId}", getSCIMResourceType)
+
+	r.Route("/Users", func(r chi.Router) {
+		r.With(reader).Get("/", listSCIMUsers)
+		r.With(editor).Post("/", createSCIMUser)
+		r.With(reader).Get("/{id}", getSCIMUser)
+		r.With(editor).Put("/{id}", replaceSCIMUser)
+		r.With(editor).Patch("/{id}", patchSCIMUser)
+		r.With(admin).Delete("/{id}", deleteSCIMUser)
+	})
+}
+
+// scimBase is the URL SCIM resources of the request are located below,
+// with the tenant prefix when there is one.
+func scimBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	path := r.URL.Path
+	if i := strings.Index(path, "/scim/v2"); i >= 0 {
+		path = path[:i+len("/scim/v2")]
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// parseSCIMId parses the id of a user. Ids that can't be ours are unknown
+// rather than invalid.
+func parseSCIMId(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil || id == 0 {
+		return 0, UserNotFound
+	}
+	return uint(id), nil
+}
+
+func decodeSCIMBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", InvalidSCIMValue, err)
+	}
+	return nil
+}
+
+// listSCIMUsers lists users matching filter, paginated by the 1-based
+// startIndex and count.
+func listSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter scimFilter
+	if v := q.Get("filter"); v != "" {
+		var err error
+		if filter, err = parseSCIMFilter(v); err != nil {
+			renderSCIMError(w, err)
+			return
+		}
+	}
+
+	startIndex, count := 1, scimDefaultCount
+	if v := q.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", fmt.Errorf("invalid startIndex: %w", err))
+			return
+		}
+		// values below 1 are interpreted as 1
+		startIndex = max(n, 1)
+	}
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", fmt.Errorf("invalid count: %w", err))
+			return
+		}
+		count = min(max(n, 0), maxPageLimit)
+	}
+
+	list, externalIds, err := dbGetSCIMUsers(r.Context())
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	base := scimBase(r)
+	matches := []interface{}{}
+	for _, id := range sortedUserIds(&list) {
+		su := newSCIMUser(id, list[id], externalIds[id], base)
+		if filter != nil {
+			res, err := scimResource(su)
+			if err != nil {
+				renderSCIMError(w, err)
+				return
+			}
+			if !filter.match(res) {
+				continue
+			}
+		}
+		matches = append(matches, su)
+	}
+
+	resp := newSCIMList(matches)
+	resp.StartIndex = startIndex
+	page := []interface{}{}
+	if startIndex <= len(matches) {
+		page = matches[startIndex-1 : min(startIndex-1+count, len(matches))]
+	}
+	resp.Resources, resp.ItemsPerPage = page, len(page)
+
+	writeSCIM(w, http.StatusOK, resp)
+}
+
+// scimResource is the JSON object of su that filters are matched against.
+func scimResource(su scimUser) (map[string]interface{}, error) {
+	dat, err := json.Marshal(su)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{}
+	return res, json.Unmarshal(dat, &res)
+}
+
+func getSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseSCIMId(r)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	u, externalId, err := dbGetSCIMUser(r.Context(), id)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	writeSCIM(w, http.StatusOK, newSCIMUser(id, *u, externalId, scimBase(r)))
+}
+
+func createSCIMUser(w http.ResponseWriter, r *http.Request) {
+	su := scimUser{}
+	if err := decodeSCIMBody(r, &su); err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	f, err := su.fields(0)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	id, err := dbProvisionUser(r.Context(), f)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	writeSCIMUser(w, r, id, http.StatusCreated)
+}
+
+func replaceSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseSCIMId(r)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	su := scimUser{}
+	if err := decodeSCIMBody(r, &su); err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	f, err := su.fields(id)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	if err := dbReprovisionUser(r.Context(), id, f); err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	writeSCIMUser(w, r, id, http.StatusOK)
+}
+
+// patchSCIMUser applies a PatchOp to the current representation of the
+// user and replaces the user with the result.
+func patchSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseSCIMId(r)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	request := scimPatchRequest{}
+	if err := decodeSCIMBody(r, &request); err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	if len(request.Operations) == 0 {
+		renderSCIMError(w, fmt.Errorf("%w: no operations", InvalidPatch))
+		return
+	}
+
+	u, externalId, err := dbGetSCIMUser(r.Context(), id)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	su, err := newSCIMUser(id, *u, externalId, scimBase(r)).patch(request.Operations)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+	f, err := su.fields(id)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	if err := dbReprovisionUser(r.Context(), id, f); err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	writeSCIMUser(w, r, id, http.StatusOK)
+}
+
+func deleteSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseSCIMId(r)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	if err := dbDeleteUser(r.Context(), id); err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSCIMUser answers with the stored user id, which has its Location.
+func writeSCIMUser(w http.ResponseWriter, r *http.Request, id uint, status int) {
+	u, externalId, err := dbGetSCIMUser(r.Context(), id)
+	if err != nil {
+		renderSCIMError(w, err)
+		return
+	}
+
+	su := newSCIMUser(id, *u, externalId, scimBase(r))
+	w.Header().Set("Location", su.Meta.Location)
+	writeSCIM(w, status, su)
+}
+
+func getSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	unsupported := map[string]bool{"supported": false}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":          []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"documentationUri": "https://datatracker.ietf.org/doc/html/rfc7644",
+		"patch":            map[string]bool{"supported": true},
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": maxPageLimit},
+		"changePassword":   unsupported,
+		"sort":             unsupported,
+		"etag":             unsupported,
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "An API key or a JWT sent as a bearer token",
+			"primary":     true,
+		}},
+		"meta": map[string]string{
+			"resourceType": "ServiceProviderConfig",
+			"location":     scimBase(r) + "/ServiceProviderConfig",
+		},
+	})
+}
+
+// scimAttribute describes an attribute of a schema.
+type scimAttribute struct {
+	Name          string          `json:"name"`
+	Type          string          `json:"type"`
+	SubAttributes []scimAttribute `json:"subAttributes,omitempty"`
+	MultiValued   bool            `json:"multiValued"`
+	Description   string          `json:"description"`
+	Required      bool            `json:"required"`
+	CaseExact     bool            `json:"caseExact"`
+	Mutability    string          `json:"mutability"`
+	Returned      string          `json:"returned"`
+	Uniqueness    string          `json:"uniqueness"`
+}
+
+func scimStringAttribute(name, description, mutability string) scimAttribute {
+	return scimAttribute{Name: name, Type: "string", Description: description, Mutability: mutability, Returned: "default", Uniqueness: "none"}
+}
+
+// scimUserAttributes are the attributes of the core User schema this
+// service supports.
+func scimUserAttributes() []scimAttribute {
+	userName := scimStringAttribute("userName", "The email of the user.", "readWrite")
+	userName.Required, userName.Uniqueness = true, "server"
+
+	externalId := scimStringAttribute("externalId", "The id of the user at the client.", "readWrite")
+	externalId.CaseExact = true
+
+	return []scimAttribute{
+		userName,
+		externalId,
+		{
+			Name: "name", Type: "complex", Description: "The name of the user, it sets displayName when that is missing.",
+			Mutability: "readWrite", Returned: "default", Uniqueness: "none",
+			SubAttributes: []scimAttribute{
+				scimStringAttribute("formatted", "The full name.", "readWrite"),
+				scimStringAttribute("givenName", "The given name.", "writeOnly"),
+				scimStringAttribute("familyName", "The family name.", "writeOnly"),
+			},
+		},
+		scimStringAttribute("displayName", "The display name of the user.", "readWrite"),
+		{
+			Name: "emails", Type: "complex", MultiValued: true, Description: "The email of the user, as set by userName.",
+			Mutability: "readOnly", Returned: "default", Uniqueness: "none",
+			SubAttributes: []scimAttribute{
+				scimStringAttribute("value", "The email.", "readOnly"),
+				scimStringAttribute("type", "Always work.", "readOnly"),
+				{Name: "primary", Type: "boolean", Description: "Always true.", Mutability: "readOnly", Returned: "default"},
+			},
+		},
+		{
+			Name: "active", Type: "boolean", Description: "Whether the user is active, inactive users are suspended.",
+			Mutability: "readWrite", Returned: "default",
+		},
+	}
+}
+
+func scimUserSchemaResource(base string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+		"id":          scimUserSchema,
+		"name":        "User",
+		"description": "User Account",
+		"attributes":  scimUserAttributes(),
+		"meta": map[string]string{
+			"resourceType": "Schema",
+			"location":     base + "/Schemas/" + scimUserSchema,
+		},
+	}
+}
+
+func scimUserResourceType(base string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+		"id":          "User",
+		"name":        "User",
+		"endpoint":    "/Users",
+		"description": "User Account",
+		"schema":      scimUserSchema,
+		"meta": map[string]string{
+			"resourceType": "ResourceType",
+			"location":     base + "/ResourceTypes/User",
+		},
+	}
+}
+
+func getSCIMSchemas(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, http.StatusOK, newSCIMList([]interface{}{scimUserSchemaResource(scimBase(r))}))
+}
+
+func getSCIMSchema(w http.ResponseWriter, r *http.Request) {
+	if chi.URLParam(r, "schemaId") != scimUserSchema {
+		writeSCIMError(w, http.StatusNotFound, "", errors.New("Schema not found"))
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUserSchemaResource(scimBase(r)))
+}
+
+func getSCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, http.StatusOK, newSCIMList([]interface{}{scimUserResourceType(scimBase(r))}))
+}
+
+func getSCIMResourceType(w http.ResponseWriter, r *http.Request) {
+	if chi.URLParam(r, "typeId") != "User" {
+		writeSCIMError(w, http.StatusNotFound, "", errors.New("Resource type not found"))
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUserResourceType(scimBase(r)))
+}
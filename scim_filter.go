@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// scimFilter is a parsed RFC 7644 filter expression, matched against the
+// JSON representation of a resource.
+type scimFilter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type (
+	scimAnd struct{ left, right scimFilter }
+	scimOr  struct{ left, right scimFilter }
+	scimNot struct{ filter scimFilter }
+	// scimCompare is "attr op value", or "attr pr" with a nil value.
+	scimCompare struct {
+		path  []string
+		op    string
+		value interface{}
+	}
+	// scimValuePath is "attr[filter]", matching resources with a value of
+	// the multi-valued attr matching filter.
+	scimValuePath struct {
+		attr   string
+		filter scimFilter
+	}
+)
+
+func (f scimAnd) match(res map[string]interface{}) bool {
+	return f.left.match(res) && f.right.match(res)
+}
+func (f scimOr) match(res map[string]interface{}) bool {
+	return f.left.match(res) || f.right.match(res)
+}
+func (f scimNot) match(res map[string]interface{}) bool { return !f.filter.match(res) }
+
+func (f scimValuePath) match(res map[string]interface{}) bool {
+	for _, v := range scimValues(res, []string{f.attr}) {
+		if sub, ok := v.(map[string]interface{}); ok && f.filter.match(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f scimCompare) match(res map[string]interface{}) bool {
+	values := scimValues(res, f.path)
+	if f.op == "pr" || f.value == nil {
+		present := false
+		for _, v := range values {
+			if v != nil && v != "" {
+				present = true
+			}
+		}
+		// RFC 7644 treats null and absent values alike
+		return present == (f.op != "eq")
+	}
+	for _, v := range values {
+		// complex values are compared by their value sub-attribute, as
+		// in emails co "@example.com"
+		if sub, ok := v.(map[string]interface{}); ok {
+			v = sub["value"]
+		}
+		if scimCompareValue(v, f.op, f.value, scimCaseExact(f.path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimCaseExact reports whether values of the attribute at path are
+// compared case-sensitively, see the caseExact characteristic of RFC 7643.
+func scimCaseExact(path []string) bool {
+	switch strings.ToLower(path[0]) {
+	case "id", "externalid":
+		return true
+	}
+	return false
+}
+
+// scimValues returns the values at path in res, flattening multi-valued
+// attributes. Attribute names are case-insensitive.
+func scimValues(res map[string]interface{}, path []string) []interface{} {
+	var v interface{}
+	found := false
+	for k, val := range res {
+		if strings.EqualFold(k, path[0]) {
+			v, found = val, true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	values := []interface{}{v}
+	if list, ok := v.([]interface{}); ok {
+		values = list
+	}
+	if len(path) == 1 {
+		return values
+	}
+
+	nested := []interface{}{}
+	for _, item := range values {
+		if sub, ok := item.(map[string]interface{}); ok {
+			nested = append(nested, scimValues(sub, path[1:])...)
+		}
+	}
+	return nested
+}
+
+func scimCompareValue(v interface{}, op string, want interface{}, caseExact bool) bool {
+	switch want := want.(type) {
+	case bool:
+		got, ok := v.(bool)
+		if !ok {
+			return op == "ne"
+		}
+		switch op {
+		case "eq":
+			return got == want
+		case "ne":
+			return got != want
+		}
+		return false
+	case float64:
+		got, ok := v.(float64)
+		if !ok {
+			return op == "ne"
+		}
+		return scimOrder(op, compareFloats(got, want))
+	case string:
+		got, ok := v.(string)
+		if !ok {
+			return op == "ne"
+		}
+		if gt, err := time.Parse(time.RFC3339Nano, got); err == nil {
+			if wt, err := time.Parse(time.RFC3339Nano, want); err == nil {
+				return scimOrder(op, gt.Compare(wt))
+			}
+		}
+		if !caseExact {
+			got, want = strings.ToLower(got), strings.ToLower(want)
+		}
+		switch op {
+		case "co":
+			return strings.Contains(got, want)
+		case "sw":
+			return strings.HasPrefix(got, want)
+		case "ew":
+			return strings.HasSuffix(got, want)
+		}
+		return scimOrder(op, strings.Compare(got, want))
+	}
+	return false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// scimOrder applies the ordering operators to the result of a comparison.
+func scimOrder(op string, cmp int) bool {
+	switch op {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	}
+	return false
+}
+
+var scimCompareOps = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+// parseSCIMFilter parses a filter:
+//
+//	filter    = or
+//	or        = and *("or" and)
+//	and       = unary *("and" unary)
+//	unary     = "not" "(" filter ")" / "(" filter ")" / attrExp / valuePath
+//	attrExp   = attrPath "pr" / attrPath compareOp compValue
+//	valuePath = attrPath "[" filter "]"
+//
+// Attribute paths may be prefixed with the URN of their schema.
+func parseSCIMFilter(s string) (scimFilter, error) {
+	tokens, err := scimTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", InvalidFilter, p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+type scimToken struct {
+	text string
+	// quoted is set for string values, whose text is unquoted.
+	quoted bool
+}
+
+func scimTokens(s string) ([]scimToken, error) {
+	tokens := []scimToken{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimToken{text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string", InvalidFilter)
+			}
+			var text string
+			if err := json.Unmarshal([]byte(s[i:end+1]), &text); err != nil {
+				return nil, fmt.Errorf("%w: invalid string %s", InvalidFilter, s[i:end+1])
+			}
+			tokens = append(tokens, scimToken{text: text, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t()[]\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, scimToken{text: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []scimToken
+	pos    int
+}
+
+func (p *scimFilterParser) peek() (scimToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return scimToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword consumes the next token if it is the unquoted word kw.
+func (p *scimFilterParser) keyword(kw string) bool {
+	if t, ok := p.peek(); ok && !t.quoted && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scimFilterParser) expect(text string) error {
+	if !p.keyword(text) {
+		return fmt.Errorf("%w: expected %q", InvalidFilter, text)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) or() (scimFilter, error) {
+	f, err := p.and()
+	for err == nil && p.keyword("or") {
+		var right scimFilter
+		if right, err = p.and(); err == nil {
+			f = scimOr{f, right}
+		}
+	}
+	return f, err
+}
+
+func (p *scimFilterParser) and() (scimFilter, error) {
+	f, err := p.unary()
+	for err == nil && p.keyword("and") {
+		var right scimFilter
+		if right, err = p.unary(); err == nil {
+			f = scimAnd{f, right}
+		}
+	}
+	return f, err
+}
+
+func (p *scimFilterParser) unary() (scimFilter, error) {
+	if p.keyword("not") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return scimNot{f}, p.expect(")")
+	}
+	if p.keyword("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	return p.attrExp()
+}
+
+func (p *scimFilterParser) attrExp() (scimFilter, error) {
+	t, ok := p.peek()
+	if !ok || t.quoted || !isSCIMAttrPath(t.text) {
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected end of filter", InvalidFilter)
+		}
+		return nil, fmt.Errorf("%w: expected an attribute, got %q", InvalidFilter, t.text)
+	}
+	p.pos++
+	path := scimAttrPath(t.text)
+
+	if p.keyword("[") {
+		if len(path) != 1 {
+			return nil, fmt.Errorf("%w: sub-attributes can't be filtered", InvalidFilter)
+		}
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return scimValuePath{attr: path[0], filter: f}, p.expect("]")
+	}
+	if p.keyword("pr") {
+		return scimCompare{path: path, op: "pr"}, nil
+	}
+
+	op, ok := p.peek()
+	if !ok || op.quoted || !scimCompareOps[strings.ToLower(op.text)] {
+		return nil, fmt.Errorf("%w: expected an operator after %s", InvalidFilter, t.text)
+	}
+	p.pos++
+	value, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a value after %s", InvalidFilter, op.text)
+	}
+	p.pos++
+
+	f := scimCompare{path: path, op: strings.ToLower(op.text)}
+	if value.quoted {
+		f.value = value.text
+		return f, nil
+	}
+	switch strings.ToLower(value.text) {
+	case "true":
+		f.value = true
+	case "false":
+		f.value = false
+	case "null":
+		if f.op != "eq" && f.op != "ne" {
+			return nil, fmt.Errorf("%w: null can only be compared with eq or ne", InvalidFilter)
+		}
+	default:
+		n := json.Number(value.text)
+		v, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid value %q", InvalidFilter, value.text)
+		}
+		f.value = v
+	}
+	if _, isString := f.value.(string); !isString && (f.op == "co" || f.op == "sw" || f.op == "ew") {
+		return nil, fmt.Errorf("%w: %s needs a string", InvalidFilter, f.op)
+	}
+	return f, nil
+}
+
+func isSCIMAttrPath(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(":._-$", r) {
+			return false
+		}
+	}
+	return s != "" && unicode.IsLetter(rune(s[0]))
+}
+
+// scimAttrPath splits "name.formatted" into its attributes, dropping the
+// schema URN of fully qualified paths.
+func scimAttrPath(s string) []string {
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		s = s[i+1:]
+	}
+	return strings.Split(s, ".")
+}
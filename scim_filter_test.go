@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSCIMFilter(t *testing.T) {
+	res := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "7",
+		"externalId": "00uAbC",
+		"userName": "Ada@Email.com",
+		"name": {"formatted": "Ada Lovelace"},
+		"displayName": "Ada Lovelace",
+		"emails": [{"value": "ada@email.com", "type": "work", "primary": true}],
+		"active": true,
+		"meta": {"created": "2026-10-18T12:30:00Z"}
+	}`), &res))
+
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "ada@email.com"`, true},
+		{`USERNAME EQ "ada@email.com"`, true},
+		{`userName ne "ada@email.com"`, false},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "ada@email.com"`, true},
+		{`externalId eq "00uAbC"`, true},
+		{`externalId eq "00uabc"`, false},
+		{`id eq "7"`, true},
+		{`emails co "@email.com"`, true},
+		{`emails.value ew ".org"`, false},
+		{`displayName sw "ada"`, true},
+		{`name.formatted co "love"`, true},
+		{`emails[type eq "work" and primary eq true]`, true},
+		{`emails[type eq "home"]`, false},
+		{`active eq true and not (displayName eq "Bob")`, true},
+		{`active eq false or (userName pr and title pr)`, false},
+		{`title pr or displayName pr`, true},
+		{`title eq null`, true},
+		{`meta.created gt "2026-10-18T00:00:00Z"`, true},
+		{`meta.created le "2026-10-18T12:30:00.000Z"`, true},
+		{`meta.created lt "2026-10-18T12:30:00+02:00"`, false},
+		{`displayName eq "Ada \"the\" Lovelace"`, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.filter, func(t *testing.T) {
+			f, err := parseSCIMFilter(tc.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tc.match, f.match(res))
+		})
+	}
+
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName is "ada"`,
+		`userName eq "ada`,
+		`(userName eq "ada"`,
+		`userName eq "ada")`,
+		`not userName eq "ada"`,
+		`active co true`,
+		`userName eq ada`,
+		`emails[type eq "work"`,
+		`"userName" eq "ada"`,
+	} {
+		t.Run("invalid "+filter, func(t *testing.T) {
+			_, err := parseSCIMFilter(filter)
+			assert.True(t, errors.Is(err, InvalidFilter), "%v", err)
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scimExchange is a recorded SCIM request and the response it expects.
+// Expected bodies match any response holding them, "*" matches any value
+// and "*suffix" any string ending in suffix.
+type scimExchange struct {
+	Name    string `json:"name"`
+	Request struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		Body   json.RawMessage `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers"`
+		Body    interface{}       `json:"body"`
+	} `json:"response"`
+}
+
+// TestSCIMConformance replays the requests identity providers sent while
+// provisioning, recorded in testdata/scim.
+func TestSCIMConformance(t *testing.T) {
+	files, err := filepath.Glob("testdata/scim/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			dat, err := os.ReadFile(file)
+			require.NoError(t, err)
+			exchanges := []scimExchange{}
+			require.NoError(t, json.Unmarshal(dat, &exchanges))
+
+			useTempStore(t, UserStore{
+				Increment: 1,
+				List:      UserList{1: {DisplayName: "Jane", Email: "jane@email.com", Status: StatusActive}},
+			})
+			config.AuthRequired = true
+			_, token, err := newAPIKeyStore(config.APIKeysPath).issue(APIKey{Name: "idp", Role: RoleAdmin})
+			require.NoError(t, err)
+
+			router := chi.NewRouter()
+			setRoutes(router)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			for _, ex := range exchanges {
+				path, query, _ := strings.Cut(ex.Request.Path, "?")
+				values, err := url.ParseQuery(query)
+				require.NoError(t, err, ex.Name)
+				u := ts.URL + "/scim/v2" + path
+				if len(values) > 0 {
+					u += "?" + values.Encode()
+				}
+
+				req, err := http.NewRequest(ex.Request.Method, u, bytes.NewReader(ex.Request.Body))
+				require.NoError(t, err, ex.Name)
+				req.Header.Set("Accept", scimMediaType)
+				req.Header.Set("Content-Type", scimMediaType)
+				req.Header.Set("Authorization", "Bearer "+token)
+				resp, body := testRequest(t, ts, req)
+
+				require.Equal(t, ex.Response.Status, resp.StatusCode, "%s: %s", ex.Name, body)
+				for name, want := range ex.Response.Headers {
+					assert.True(t, scimMatches(want, resp.Header.Get(name)), "%s: %s is %q", ex.Name, name, resp.Header.Get(name))
+				}
+				if ex.Response.Body == nil {
+					continue
+				}
+				var got interface{}
+				require.NoError(t, json.Unmarshal(body, &got), ex.Name)
+				if !scimMatches(ex.Response.Body, got) {
+					t.Errorf("%s: response %s doesn't match %s", ex.Name, body, mustJSON(t, ex.Response.Body))
+				}
+			}
+		})
+	}
+}
+
+func scimMatches(want, got interface{}) bool {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		obj, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range want {
+			if gv, ok := obj[k]; !ok || !scimMatches(v, gv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		list, ok := got.([]interface{})
+		if !ok || len(list) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !scimMatches(want[i], list[i]) {
+				return false
+			}
+		}
+		return true
+	case string:
+		if want == "*" {
+			return got != nil
+		}
+		if suffix, ok := strings.CutPrefix(want, "*"); ok {
+			s, _ := got.(string)
+			return strings.HasSuffix(s, suffix)
+		}
+	}
+	return fmt.Sprint(want) == fmt.Sprint(got)
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	dat, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(dat)
+}
+
+func TestSCIMAccess(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 1,
+		List:      UserList{1: {DisplayName: "Jane", Email: "jane@email.com", Status: StatusDeactivated}},
+	})
+	config.AuthRequired = true
+	keys := newAPIKeyStore(config.APIKeysPath)
+	issue := func(spec APIKey) string {
+		_, token, err := keys.issue(spec)
+		require.NoError(t, err)
+		return token
+	}
+	admin := issue(APIKey{Name: "ops", Role: RoleAdmin})
+	reader := issue(APIKey{Name: "audit", Role: RoleReader})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, token, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", scimMediaType)
+		if strings.HasPrefix(path, "/api/") {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return testRequest(t, ts, req)
+	}
+
+	resp, body := request("GET", "/scim/v2/Users", "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, string(body), scimErrorSchema)
+
+	resp, _ = request("POST", "/scim/v2/Users", reader, `{"userName":"ada@email.com"}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body = request("GET", "/scim/v2/Users", "uk_1_wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, string(body), scimErrorSchema)
+
+	resp, body = request("GET", "/tenants/nowhere/scim/v2/Users", admin, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), scimErrorSchema)
+
+	t.Run("deactivated users stay inactive", func(t *testing.T) {
+		resp, body := request("PATCH", "/scim/v2/Users/1", admin, `{"Operations":[{"op":"replace","path":"active","value":true}]}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(body), `"scimType":"invalidValue"`)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		for _, name := range []string{"ada", "bob", "carol"} {
+			resp, body := request("POST", "/scim/v2/Users", admin, `{"userName":"`+name+`@email.com","active":false}`)
+			require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+		}
+		u, err := dbGetUser(context.Background(), 2)
+		require.NoError(t, err)
+		assert.Equal(t, StatusInvited, u.Status)
+		assert.Equal(t, "ada@email.com", u.DisplayName)
+
+		resp, body := request("GET", "/scim/v2/Users?startIndex=2&count=2", reader, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		list := scimListResponse{}
+		require.NoError(t, json.Unmarshal(body, &list))
+		assert.Equal(t, 4, list.TotalResults)
+		assert.Equal(t, 2, list.StartIndex)
+		assert.Equal(t, 2, list.ItemsPerPage)
+		assert.Equal(t, "2", list.Resources[0].(map[string]interface{})["id"])
+
+		resp, body = request("GET", "/scim/v2/Users?startIndex=9", reader, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.Unmarshal(body, &list))
+		assert.Equal(t, 4, list.TotalResults)
+		assert.Empty(t, list.Resources)
+	})
+
+	t.Run("tenants", func(t *testing.T) {
+		resp, body := request("POST", "/api/v1/admin/tenants/", admin, `{"name":"acme"}`)
+		require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+		acme := issue(APIKey{Name: "acme", Role: RoleEditor, Tenant: "acme"})
+
+		resp, body = request("POST", "/tenants/acme/scim/v2/Users", acme, `{"userName":"jane@email.com"}`)
+		require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+		assert.Equal(t, ts.URL+"/tenants/acme/scim/v2/Users/1", resp.Header.Get("Location"))
+
+		resp, _ = request("GET", "/scim/v2/Users", acme, "")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp, _ = request("GET", "/tenants/acme/scim/v2/Users", admin, "")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestSCIMErrors(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.RateLimitReads = 1
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/scim/v2/Users"))
+	resp, body := testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/scim/v2/Users"))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, string(body), scimErrorSchema)
+
+	// internal errors aren't sent to clients
+	w := httptest.NewRecorder()
+	renderSCIMError(w, errors.New("open /var/lib/users/users.json: permission denied"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), scimErrorSchema)
+	assert.NotContains(t, w.Body.String(), "/var/lib")
+}
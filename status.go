@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+type UserStatus string
+
+const (
+	StatusInvited     UserStatus = "invited"
+	StatusActive      UserStatus = "active"
+	StatusSuspended   UserStatus = "suspended"
+	StatusDeactivated UserStatus = "deactivated"
+)
+
+// statusTransitions lists statuses a user may move to from a given status.
+// Deactivated is terminal.
+var statusTransitions = map[UserStatus][]UserStatus{
+	StatusInvited:   {StatusActive, StatusDeactivated},
+	StatusActive:    {StatusSuspended, StatusDeactivated},
+	StatusSuspended: {StatusActive, StatusDeactivated},
+}
+
+func (s UserStatus) Valid() bool {
+	switch s {
+	case StatusInvited, StatusActive, StatusSuspended, StatusDeactivated:
+		return true
+	}
+	return false
+}
+
+func (s UserStatus) CanTransitionTo(to UserStatus) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func checkStatusTransition(from, to UserStatus) error {
+	if !from.CanTransitionTo(to) {
+		return fmt.Errorf("%w: cannot change status from %q to %q", InvalidStatusTransition, from, to)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Store persists a UserStore. Every backend must behave identically, which
+// the endpoint test suite checks by running against each of them.
+type Store interface {
+	// Load returns the stored users, an empty store if nothing was saved yet.
+	Load() (UserStore, error)
+	// Save replaces the stored users with us. Database backends only write
+	// the rows that differ from what is stored.
+	Save(us UserStore) error
+	// FindUserByEmail returns the id of the user with the given email
+	// without decrypting stored emails, or UserNotFound.
+	FindUserByEmail(email string) (uint, error)
+	// PlaintextEmails counts the users whose email is stored unencrypted.
+	PlaintextEmails() (int, error)
+	Close() error
+}
+
+const (
+	backendJSON   = "json"
+	backendSQLite = "sqlite"
+	backendBolt   = "bolt"
+)
+
+var storeBackends = []string{backendJSON, backendSQLite, backendBolt}
+
+// db is the store used by request handlers and commands.
+var db Store = &jsonStore{path: config.StorePath}
+
+func openStore(backend, path string) (Store, error) {
+	switch backend {
+	case backendJSON:
+		return &jsonStore{path: path}, nil
+	case backendSQLite:
+		return openSQLiteStore(path)
+	case backendBolt:
+		return openBoltStore(path)
+	}
+	return nil, fmt.Errorf("unknown store backend %q, expected one of %s", backend, strings.Join(storeBackends, ", "))
+}
+
+// parseStoreLocation splits a "backend:path" pair as accepted by the
+// migrate-store command.
+func parseStoreLocation(s string) (backend, path string, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid store location %q, expected backend:path", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// migrateStore copies all users from src to dst. The destination has to be
+// empty unless force is set, in which case its contents are replaced.
+func migrateStore(src, dst Store, force bool) (n int, err error) {
+	us, err := src.Load()
+	if err != nil {
+		return
+	}
+
+	return len(us.List), replaceStore(dst, us, force)
+}
+
+// replaceStore saves us to dst, refusing to overwrite existing users unless
+// force is set.
+func replaceStore(dst Store, us UserStore, force bool) error {
+	existing, err := dst.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !force && (len(existing.List) > 0 || existing.Increment > 0) {
+		return StoreNotEmpty
+	}
+
+	return dst.Save(us)
+}
+
+// jsonStore keeps the whole UserStore in a single JSON file.
+type jsonStore struct {
+	path string
+}
+
+func (s *jsonStore) Load() (us UserStore, err error) {
+	f, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return
+	}
+	return decodeUserStore(f)
+}
+
+func (s *jsonStore) Save(us UserStore) (err error) {
+	dat, err := encodeUserStore(us)
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(s.path, dat, 0644)
+}
+
+func (s *jsonStore) FindUserByEmail(email string) (id uint, err error) {
+	f, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return
+	}
+	sf, err := decodeStoreFile(f)
+	if err != nil {
+		return
+	}
+
+	want := emailLookupKey(email)
+	for id, su := range sf.List {
+		if storedUserEmailKey(su) == want {
+			return id, nil
+		}
+	}
+	return 0, UserNotFound
+}
+
+func (s *jsonStore) PlaintextEmails() (n int, err error) {
+	f, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	sf, err := decodeStoreFile(f)
+	if err != nil {
+		return
+	}
+
+	for _, su := range sf.List {
+		if su.Email != "" && !strings.HasPrefix(su.Email, encryptedFieldPrefix) {
+			n++
+		}
+	}
+	return
+}
+
+func (s *jsonStore) Close() error { return nil }
+
+// diffRows calls put for the entries of next that are missing from prev or
+// differ from it, and del for the ids only prev has.
+func diffRows[V any](prev, next map[uint]V, put func(id uint, v V) error, del func(id uint) error) error {
+	for id, v := range next {
+		if old, ok := prev[id]; ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		if err := put(id, v); err != nil {
+			return err
+		}
+	}
+	for id := range prev {
+		if _, ok := next[id]; !ok {
+			if err := del(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storedUserEmailKey returns the key a stored user is found by email with,
+// see emailLookupKey.
+func storedUserEmailKey(su storedUser) string {
+	if su.EmailIndex != "" {
+		return su.EmailIndex
+	}
+	if su.Email == "" || strings.HasPrefix(su.Email, encryptedFieldPrefix) {
+		return ""
+	}
+	// stored before field encryption was enabled
+	return emailLookupKey(su.Email)
+}
+
+func encodeStoredUser(u User) (su storedUser, err error) {
+	su = storedUser{User: u, EmailIndex: emailIndex(u.Email)}
+	su.Email, err = encryptEmail(u.Email)
+	return
+}
+
+func decodeStoredUser(su storedUser) (u User, err error) {
+	u = su.User
+	u.Email, err = decryptEmail(su.Email)
+	return
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltMetaBucket         = []byte("meta")
+	boltUsersBucket        = []byte("users")
+	boltEmailIndexBucket   = []byte("users_email_index")
+	boltGroupsBucket       = []byte("groups")
+	boltConferencesBucket  = []byte("conferences")
+	boltAddressBooksBucket = []byte("address_books")
+	boltExternalIdsBucket  = []byte("external_ids")
+	boltSourceDNsBucket    = []byte("source_dns")
+)
+
+// boltStore keeps users in a bbolt database, one JSON encoded storedUser
+// per key in the users bucket, and groups, conferences and address books the
+// same way in buckets of their own. External ids and source DNs are stored
+// as plain strings.
+type boltStore struct {
+	db   *bolt.DB
+	path string
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	boltDB, err := openBoltDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltMetaBucket, boltUsersBucket, boltEmailIndexBucket, boltGroupsBucket, boltConferencesBucket, boltAddressBooksBucket, boltExternalIdsBucket, boltSourceDNsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltDB.Close()
+		return nil, err
+	}
+	return &boltStore{db: boltDB, path: path}, nil
+}
+
+func openBoltDB(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+func (s *boltStore) Load() (us UserStore, err error) {
+	err = s.db.View(func(tx *bolt.Tx) (err error) {
+		us, err = loadBoltStore(tx)
+		return
+	})
+	return
+}
+
+func loadBoltStore(tx *bolt.Tx) (us UserStore, err error) {
+	us.List = UserList{}
+
+	meta := tx.Bucket(boltMetaBucket)
+	if us.SchemaVersion, err = boltMetaInt(meta, "schema_version"); err != nil {
+		return
+	}
+	if us.SchemaVersion > currentSchemaVersion {
+		return us, StoreVersionTooNew
+	}
+	increment, err := boltMetaInt(meta, "increment")
+	if err != nil {
+		return
+	}
+	us.Increment = uint(increment)
+	groupIncrement, err := boltMetaInt(meta, "group_increment")
+	if err != nil {
+		return
+	}
+	us.GroupIncrement = uint(groupIncrement)
+	conferenceIncrement, err := boltMetaInt(meta, "conference_increment")
+	if err != nil {
+		return
+	}
+	us.ConferenceIncrement = uint(conferenceIncrement)
+
+	err = tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) (err error) {
+		su := storedUser{}
+		if err = json.Unmarshal(v, &su); err != nil {
+			return
+		}
+		us.List[uint(binary.BigEndian.Uint64(k))], err = decodeStoredUser(su)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Bucket(boltGroupsBucket).ForEach(func(k, v []byte) (err error) {
+		g := Group{}
+		if err = json.Unmarshal(v, &g); err != nil {
+			return
+		}
+		if us.Groups == nil {
+			us.Groups = GroupList{}
+		}
+		us.Groups[uint(binary.BigEndian.Uint64(k))] = g
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Bucket(boltConferencesBucket).ForEach(func(k, v []byte) (err error) {
+		c := Conference{}
+		if err = json.Unmarshal(v, &c); err != nil {
+			return
+		}
+		if us.Conferences == nil {
+			us.Conferences = ConferenceList{}
+		}
+		us.Conferences[uint(binary.BigEndian.Uint64(k))] = c
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Bucket(boltAddressBooksBucket).ForEach(func(k, v []byte) (err error) {
+		ab := AddressBook{}
+		if err = json.Unmarshal(v, &ab); err != nil {
+			return
+		}
+		if us.AddressBooks == nil {
+			us.AddressBooks = map[uint]AddressBook{}
+		}
+		us.AddressBooks[uint(binary.BigEndian.Uint64(k))] = ab
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Bucket(boltExternalIdsBucket).ForEach(func(k, v []byte) error {
+		if us.ExternalIds == nil {
+			us.ExternalIds = map[uint]string{}
+		}
+		us.ExternalIds[uint(binary.BigEndian.Uint64(k))] = string(v)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Bucket(boltSourceDNsBucket).ForEach(func(k, v []byte) error {
+		if us.SourceDNs == nil {
+			us.SourceDNs = map[uint]string{}
+		}
+		us.SourceDNs[uint(binary.BigEndian.Uint64(k))] = string(v)
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) Save(us UserStore) error {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		prev, err := loadBoltStore(tx)
+		if err != nil {
+			return
+		}
+
+		meta := tx.Bucket(boltMetaBucket)
+		for _, m := range []struct {
+			key        string
+			prev, next uint
+		}{
+			{"schema_version", uint(prev.SchemaVersion), currentSchemaVersion},
+			{"increment", prev.Increment, us.Increment},
+			{"group_increment", prev.GroupIncrement, us.GroupIncrement},
+			{"conference_increment", prev.ConferenceIncrement, us.ConferenceIncrement},
+		} {
+			if m.prev == m.next {
+				continue
+			}
+			if err = meta.Put([]byte(m.key), []byte(strconv.FormatUint(uint64(m.next), 10))); err != nil {
+				return
+			}
+		}
+
+		if fieldKeys.aead != nil {
+			// emails stored before field encryption was enabled are
+			// rewritten encrypted
+			plain, err := boltPlaintextEmailIds(tx)
+			if err != nil {
+				return err
+			}
+			for _, id := range plain {
+				prev.List[id] = User{}
+			}
+		}
+		users, emailIndex := tx.Bucket(boltUsersBucket), tx.Bucket(boltEmailIndexBucket)
+		// dropIndex removes the index entry of the stored user id, unless
+		// another user took its email over already
+		dropIndex := func(id uint) error {
+			v := users.Get(boltKey(id))
+			if v == nil {
+				return nil
+			}
+			su := storedUser{}
+			if err := json.Unmarshal(v, &su); err != nil {
+				return err
+			}
+			key := []byte(storedUserEmailKey(su))
+			if len(key) == 0 || !bytes.Equal(emailIndex.Get(key), boltKey(id)) {
+				return nil
+			}
+			return emailIndex.Delete(key)
+		}
+		err = diffRows(prev.List, us.List, func(id uint, u User) error {
+			su, err := encodeStoredUser(u)
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(su)
+			if err != nil {
+				return err
+			}
+			if err = dropIndex(id); err != nil {
+				return err
+			}
+			if err = users.Put(boltKey(id), v); err != nil {
+				return err
+			}
+			if key := storedUserEmailKey(su); key != "" {
+				return emailIndex.Put([]byte(key), boltKey(id))
+			}
+			return nil
+		}, func(id uint) error {
+			if err := dropIndex(id); err != nil {
+				return err
+			}
+			return users.Delete(boltKey(id))
+		})
+		if err != nil {
+			return
+		}
+
+		if err = diffRows(prev.Groups, us.Groups, boltPutJSON[Group](tx, boltGroupsBucket), boltDeleter(tx, boltGroupsBucket)); err != nil {
+			return
+		}
+		if err = diffRows(prev.Conferences, us.Conferences, boltPutJSON[Conference](tx, boltConferencesBucket), boltDeleter(tx, boltConferencesBucket)); err != nil {
+			return
+		}
+		if err = diffRows(prev.AddressBooks, us.AddressBooks, boltPutJSON[AddressBook](tx, boltAddressBooksBucket), boltDeleter(tx, boltAddressBooksBucket)); err != nil {
+			return
+		}
+		if err = diffRows(prev.ExternalIds, us.ExternalIds, boltPutString(tx, boltExternalIdsBucket), boltDeleter(tx, boltExternalIdsBucket)); err != nil {
+			return
+		}
+		return diffRows(prev.SourceDNs, us.SourceDNs, boltPutString(tx, boltSourceDNsBucket), boltDeleter(tx, boltSourceDNsBucket))
+	})
+}
+
+// boltPutJSON, boltPutString and boltDeleter write single entries of a
+// bucket for diffRows.
+func boltPutJSON[V any](tx *bolt.Tx, bucket []byte) func(id uint, v V) error {
+	return func(id uint, v V) error {
+		dat, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucket).Put(boltKey(id), dat)
+	}
+}
+
+func boltPutString(tx *bolt.Tx, bucket []byte) func(id uint, v string) error {
+	return func(id uint, v string) error {
+		return tx.Bucket(bucket).Put(boltKey(id), []byte(v))
+	}
+}
+
+func boltDeleter(tx *bolt.Tx, bucket []byte) func(id uint) error {
+	return func(id uint) error {
+		return tx.Bucket(bucket).Delete(boltKey(id))
+	}
+}
+
+func (s *boltStore) FindUserByEmail(email string) (id uint, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltEmailIndexBucket).Get([]byte(emailLookupKey(email)))
+		if v == nil {
+			return UserNotFound
+		}
+		id = uint(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) PlaintextEmails() (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		ids, err := boltPlaintextEmailIds(tx)
+		n = len(ids)
+		return err
+	})
+	return
+}
+
+func boltPlaintextEmailIds(tx *bolt.Tx) (ids []uint, err error) {
+	err = tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+		su := storedUser{}
+		if err := json.Unmarshal(v, &su); err != nil {
+			return err
+		}
+		if su.Email != "" && !strings.HasPrefix(su.Email, encryptedFieldPrefix) {
+			ids = append(ids, uint(binary.BigEndian.Uint64(k)))
+		}
+		return nil
+	})
+	return
+}
+
+// Compact copies the live data into a fresh file and swaps it in, bolt never
+// shrinks its file on its own.
+func (s *boltStore) Compact() (err error) {
+	tmp := s.path + ".compact"
+	dst, err := openBoltDB(tmp)
+	if err != nil {
+		return
+	}
+	if err = bolt.Compact(dst, s.db, 0); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return
+	}
+	if err = dst.Close(); err != nil {
+		return
+	}
+
+	if err = s.db.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return
+	}
+	s.db, err = openBoltDB(s.path)
+	return
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
+
+func boltKey(id uint) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+func boltMetaInt(meta *bolt.Bucket, key string) (int, error) {
+	v := meta.Get([]byte(key))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
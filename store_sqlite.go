@@ -0,0 +1,754 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS users (
+	id           INTEGER PRIMARY KEY,
+	created_at   TEXT NOT NULL,
+	updated_at   TEXT NOT NULL,
+	display_name TEXT NOT NULL,
+	email        TEXT NOT NULL,
+	email_index  TEXT NOT NULL,
+	status       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS users_email_index ON users (email_index);
+CREATE TABLE IF NOT EXISTS groups (
+	id          INTEGER PRIMARY KEY,
+	created_at  TEXT NOT NULL,
+	updated_at  TEXT NOT NULL,
+	name        TEXT NOT NULL,
+	description TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS group_members (
+	group_id INTEGER NOT NULL,
+	user_id  INTEGER NOT NULL,
+	PRIMARY KEY (group_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS group_subgroups (
+	group_id    INTEGER NOT NULL,
+	subgroup_id INTEGER NOT NULL,
+	PRIMARY KEY (group_id, subgroup_id)
+);
+CREATE TABLE IF NOT EXISTS conferences (
+	id         INTEGER PRIMARY KEY,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	title      TEXT NOT NULL,
+	owner_id   INTEGER NOT NULL,
+	starts_at  TEXT NOT NULL,
+	ends_at    TEXT NOT NULL,
+	recurrence TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS conference_participants (
+	conference_id INTEGER NOT NULL,
+	user_id       INTEGER NOT NULL,
+	PRIMARY KEY (conference_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS contacts (
+	user_id    INTEGER NOT NULL,
+	contact_id INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	nickname   TEXT NOT NULL,
+	favorite   INTEGER NOT NULL,
+	PRIMARY KEY (user_id, contact_id)
+);
+CREATE TABLE IF NOT EXISTS contact_labels (
+	user_id    INTEGER NOT NULL,
+	contact_id INTEGER NOT NULL,
+	label      TEXT NOT NULL,
+	PRIMARY KEY (user_id, contact_id, label)
+);
+CREATE TABLE IF NOT EXISTS contact_requests (
+	user_id    INTEGER NOT NULL,
+	from_id    INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (user_id, from_id)
+);
+CREATE TABLE IF NOT EXISTS blocked_users (
+	user_id    INTEGER NOT NULL,
+	blocked_id INTEGER NOT NULL,
+	PRIMARY KEY (user_id, blocked_id)
+);
+CREATE TABLE IF NOT EXISTS external_ids (
+	user_id     INTEGER PRIMARY KEY,
+	external_id TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS source_dns (
+	user_id INTEGER PRIMARY KEY,
+	dn      TEXT NOT NULL
+);
+`
+
+// sqliteStore keeps users in a SQLite database, one row per user.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	sqlDB, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sqlDB.Exec(sqliteSchema); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: sqlDB}, nil
+}
+
+// sqliteQuerier is implemented by both *sql.DB and *sql.Tx, Save reads what
+// is stored in its transaction.
+type sqliteQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqliteStore) Load() (UserStore, error) {
+	return loadSQLiteStore(s.db)
+}
+
+func loadSQLiteStore(q sqliteQuerier) (us UserStore, err error) {
+	us.List = UserList{}
+
+	if us.SchemaVersion, err = sqliteMetaInt(q, "schema_version"); err != nil {
+		return
+	}
+	if us.SchemaVersion > currentSchemaVersion {
+		return us, StoreVersionTooNew
+	}
+	increment, err := sqliteMetaInt(q, "increment")
+	if err != nil {
+		return
+	}
+	us.Increment = uint(increment)
+
+	rows, err := q.Query(`SELECT id, created_at, updated_at, display_name, email, status FROM users`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id                   uint
+			createdAt, updatedAt string
+			su                   storedUser
+		)
+		if err = rows.Scan(&id, &createdAt, &updatedAt, &su.DisplayName, &su.Email, &su.Status); err != nil {
+			return
+		}
+		if su.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return
+		}
+		if su.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+			return
+		}
+		if us.List[id], err = decodeStoredUser(su); err != nil {
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if err = loadSQLiteGroups(q, &us); err != nil {
+		return
+	}
+	if err = loadSQLiteConferences(q, &us); err != nil {
+		return
+	}
+	if err = loadSQLiteAddressBooks(q, &us); err != nil {
+		return
+	}
+	if err = loadSQLiteExternalIds(q, &us); err != nil {
+		return
+	}
+	err = loadSQLiteSourceDNs(q, &us)
+	return
+}
+
+func loadSQLiteGroups(q sqliteQuerier, us *UserStore) (err error) {
+	increment, err := sqliteMetaInt(q, "group_increment")
+	if err != nil {
+		return
+	}
+	us.GroupIncrement = uint(increment)
+
+	rows, err := q.Query(`SELECT id, created_at, updated_at, name, description FROM groups`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id                   uint
+			createdAt, updatedAt string
+			g                    Group
+		)
+		if err = rows.Scan(&id, &createdAt, &updatedAt, &g.Name, &g.Description); err != nil {
+			return
+		}
+		if g.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return
+		}
+		if g.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+			return
+		}
+		if us.Groups == nil {
+			us.Groups = GroupList{}
+		}
+		us.Groups[id] = g
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, rel := range []struct {
+		query string
+		add   func(g *Group, id uint)
+	}{
+		{`SELECT group_id, user_id FROM group_members ORDER BY group_id, user_id`, func(g *Group, id uint) { g.Members = append(g.Members, id) }},
+		{`SELECT group_id, subgroup_id FROM group_subgroups ORDER BY group_id, subgroup_id`, func(g *Group, id uint) { g.Subgroups = append(g.Subgroups, id) }},
+	} {
+		if err = loadSQLiteGroupRelation(q, us, rel.query, rel.add); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func loadSQLiteGroupRelation(q sqliteQuerier, us *UserStore, query string, add func(g *Group, id uint)) error {
+	rows, err := q.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupId, id uint
+		if err := rows.Scan(&groupId, &id); err != nil {
+			return err
+		}
+		g := us.Groups[groupId]
+		add(&g, id)
+		us.Groups[groupId] = g
+	}
+	return rows.Err()
+}
+
+func loadSQLiteConferences(q sqliteQuerier, us *UserStore) (err error) {
+	increment, err := sqliteMetaInt(q, "conference_increment")
+	if err != nil {
+		return
+	}
+	us.ConferenceIncrement = uint(increment)
+
+	rows, err := q.Query(`SELECT id, created_at, updated_at, title, owner_id, starts_at, ends_at, recurrence FROM conferences`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id uint
+			c  Conference
+		)
+		times := make([]string, 4)
+		if err = rows.Scan(&id, &times[0], &times[1], &c.Title, &c.Owner, &times[2], &times[3], &c.Recurrence); err != nil {
+			return
+		}
+		for i, t := range []*time.Time{&c.CreatedAt, &c.UpdatedAt, &c.Start, &c.End} {
+			if *t, err = time.Parse(time.RFC3339Nano, times[i]); err != nil {
+				return
+			}
+		}
+		if us.Conferences == nil {
+			us.Conferences = ConferenceList{}
+		}
+		us.Conferences[id] = c
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	participants, err := q.Query(`SELECT conference_id, user_id FROM conference_participants ORDER BY conference_id, user_id`)
+	if err != nil {
+		return
+	}
+	defer participants.Close()
+
+	for participants.Next() {
+		var conferenceId, userId uint
+		if err = participants.Scan(&conferenceId, &userId); err != nil {
+			return
+		}
+		c := us.Conferences[conferenceId]
+		c.Participants = append(c.Participants, userId)
+		us.Conferences[conferenceId] = c
+	}
+	return participants.Err()
+}
+
+func loadSQLiteAddressBooks(q sqliteQuerier, us *UserStore) (err error) {
+	book := func(userId uint) AddressBook {
+		if us.AddressBooks == nil {
+			us.AddressBooks = map[uint]AddressBook{}
+		}
+		return us.AddressBooks[userId]
+	}
+
+	rows, err := q.Query(`SELECT user_id, contact_id, created_at, updated_at, nickname, favorite FROM contacts`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			userId, contactId    uint
+			createdAt, updatedAt string
+			c                    Contact
+		)
+		if err = rows.Scan(&userId, &contactId, &createdAt, &updatedAt, &c.Nickname, &c.Favorite); err != nil {
+			return
+		}
+		if c.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return
+		}
+		if c.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+			return
+		}
+		ab := book(userId)
+		if ab.Contacts == nil {
+			ab.Contacts = ContactList{}
+		}
+		ab.Contacts[contactId] = c
+		us.AddressBooks[userId] = ab
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	labels, err := q.Query(`SELECT user_id, contact_id, label FROM contact_labels ORDER BY user_id, contact_id, label`)
+	if err != nil {
+		return
+	}
+	defer labels.Close()
+
+	for labels.Next() {
+		var (
+			userId, contactId uint
+			label             string
+		)
+		if err = labels.Scan(&userId, &contactId, &label); err != nil {
+			return
+		}
+		c := us.AddressBooks[userId].Contacts[contactId]
+		c.Labels = append(c.Labels, label)
+		us.AddressBooks[userId].Contacts[contactId] = c
+	}
+	if err = labels.Err(); err != nil {
+		return
+	}
+
+	requests, err := q.Query(`SELECT user_id, from_id, created_at FROM contact_requests`)
+	if err != nil {
+		return
+	}
+	defer requests.Close()
+
+	for requests.Next() {
+		var (
+			userId, fromId uint
+			createdAt      string
+			at             time.Time
+		)
+		if err = requests.Scan(&userId, &fromId, &createdAt); err != nil {
+			return
+		}
+		if at, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return
+		}
+		ab := book(userId)
+		if ab.Requests == nil {
+			ab.Requests = map[uint]time.Time{}
+		}
+		ab.Requests[fromId] = at
+		us.AddressBooks[userId] = ab
+	}
+	if err = requests.Err(); err != nil {
+		return
+	}
+
+	blocked, err := q.Query(`SELECT user_id, blocked_id FROM blocked_users ORDER BY user_id, blocked_id`)
+	if err != nil {
+		return
+	}
+	defer blocked.Close()
+
+	for blocked.Next() {
+		var userId, blockedId uint
+		if err = blocked.Scan(&userId, &blockedId); err != nil {
+			return
+		}
+		ab := book(userId)
+		ab.Blocked = append(ab.Blocked, blockedId)
+		us.AddressBooks[userId] = ab
+	}
+	return blocked.Err()
+}
+
+func loadSQLiteExternalIds(q sqliteQuerier, us *UserStore) error {
+	rows, err := q.Query(`SELECT user_id, external_id FROM external_ids`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			userId     uint
+			externalId string
+		)
+		if err := rows.Scan(&userId, &externalId); err != nil {
+			return err
+		}
+		if us.ExternalIds == nil {
+			us.ExternalIds = map[uint]string{}
+		}
+		us.ExternalIds[userId] = externalId
+	}
+	return rows.Err()
+}
+
+func loadSQLiteSourceDNs(q sqliteQuerier, us *UserStore) error {
+	rows, err := q.Query(`SELECT user_id, dn FROM source_dns`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			userId uint
+			dn     string
+		)
+		if err := rows.Scan(&userId, &dn); err != nil {
+			return err
+		}
+		if us.SourceDNs == nil {
+			us.SourceDNs = map[uint]string{}
+		}
+		us.SourceDNs[userId] = dn
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) Save(us UserStore) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	prev, err := loadSQLiteStore(tx)
+	if err != nil {
+		return
+	}
+
+	meta := map[string][2]uint{
+		"schema_version":       {uint(prev.SchemaVersion), currentSchemaVersion},
+		"increment":            {prev.Increment, us.Increment},
+		"group_increment":      {prev.GroupIncrement, us.GroupIncrement},
+		"conference_increment": {prev.ConferenceIncrement, us.ConferenceIncrement},
+	}
+	for k, v := range meta {
+		if v[0] == v[1] {
+			continue
+		}
+		if _, err = tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value`, k, strconv.FormatUint(uint64(v[1]), 10)); err != nil {
+			return
+		}
+	}
+
+	if fieldKeys.aead != nil {
+		// emails stored before field encryption was enabled are rewritten
+		// encrypted
+		plain, err := sqlitePlaintextEmailIds(tx)
+		if err != nil {
+			return err
+		}
+		for _, id := range plain {
+			prev.List[id] = User{}
+		}
+	}
+	err = diffRows(prev.List, us.List, func(id uint, u User) error {
+		su, err := encodeStoredUser(u)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO users
+			(id, created_at, updated_at, display_name, email, email_index, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				created_at = excluded.created_at,
+				updated_at = excluded.updated_at,
+				display_name = excluded.display_name,
+				email = excluded.email,
+				email_index = excluded.email_index,
+				status = excluded.status`,
+			id,
+			su.CreatedAt.Format(time.RFC3339Nano),
+			su.UpdatedAt.Format(time.RFC3339Nano),
+			su.DisplayName,
+			su.Email,
+			storedUserEmailKey(su),
+			su.Status,
+		)
+		return err
+	}, sqliteDeleter(tx, `DELETE FROM users WHERE id = ?`))
+	if err != nil {
+		return
+	}
+
+	if err = saveSQLiteGroups(tx, prev.Groups, us.Groups); err != nil {
+		return
+	}
+	if err = saveSQLiteConferences(tx, prev.Conferences, us.Conferences); err != nil {
+		return
+	}
+	if err = saveSQLiteAddressBooks(tx, prev.AddressBooks, us.AddressBooks); err != nil {
+		return
+	}
+	err = diffRows(prev.ExternalIds, us.ExternalIds, func(id uint, externalId string) error {
+		_, err := tx.Exec(`INSERT INTO external_ids (user_id, external_id) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET external_id = excluded.external_id`, id, externalId)
+		return err
+	}, sqliteDeleter(tx, `DELETE FROM external_ids WHERE user_id = ?`))
+	if err != nil {
+		return
+	}
+	err = diffRows(prev.SourceDNs, us.SourceDNs, func(id uint, dn string) error {
+		_, err := tx.Exec(`INSERT INTO source_dns (user_id, dn) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET dn = excluded.dn`, id, dn)
+		return err
+	}, sqliteDeleter(tx, `DELETE FROM source_dns WHERE user_id = ?`))
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// sqliteDeleter returns a function running the statement query, which
+// deletes the rows of one id, for diffRows.
+func sqliteDeleter(tx *sql.Tx, query string, more ...string) func(id uint) error {
+	return func(id uint) error {
+		for _, q := range append([]string{query}, more...) {
+			if _, err := tx.Exec(q, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// saveSQLiteGroups writes the groups that differ from prev. The members and
+// subgroups of a changed group are replaced.
+func saveSQLiteGroups(tx *sql.Tx, prev, groups GroupList) error {
+	deleteRelations := sqliteDeleter(tx,
+		`DELETE FROM group_members WHERE group_id = ?`,
+		`DELETE FROM group_subgroups WHERE group_id = ?`)
+
+	return diffRows(prev, groups, func(id uint, g Group) error {
+		if _, err := tx.Exec(`INSERT INTO groups (id, created_at, updated_at, name, description) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				created_at = excluded.created_at,
+				updated_at = excluded.updated_at,
+				name = excluded.name,
+				description = excluded.description`,
+			id,
+			g.CreatedAt.Format(time.RFC3339Nano),
+			g.UpdatedAt.Format(time.RFC3339Nano),
+			g.Name,
+			g.Description,
+		); err != nil {
+			return err
+		}
+		if err := deleteRelations(id); err != nil {
+			return err
+		}
+		for _, uid := range g.Members {
+			if _, err := tx.Exec(`INSERT INTO group_members (group_id, user_id) VALUES (?, ?)`, id, uid); err != nil {
+				return err
+			}
+		}
+		for _, sub := range g.Subgroups {
+			if _, err := tx.Exec(`INSERT INTO group_subgroups (group_id, subgroup_id) VALUES (?, ?)`, id, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, sqliteDeleter(tx,
+		`DELETE FROM groups WHERE id = ?`,
+		`DELETE FROM group_members WHERE group_id = ?`,
+		`DELETE FROM group_subgroups WHERE group_id = ?`))
+}
+
+// saveSQLiteConferences writes the conferences that differ from prev, the
+// same way as saveSQLiteGroups.
+func saveSQLiteConferences(tx *sql.Tx, prev, conferences ConferenceList) error {
+	return diffRows(prev, conferences, func(id uint, c Conference) error {
+		if _, err := tx.Exec(`INSERT INTO conferences
+			(id, created_at, updated_at, title, owner_id, starts_at, ends_at, recurrence)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				created_at = excluded.created_at,
+				updated_at = excluded.updated_at,
+				title = excluded.title,
+				owner_id = excluded.owner_id,
+				starts_at = excluded.starts_at,
+				ends_at = excluded.ends_at,
+				recurrence = excluded.recurrence`,
+			id,
+			c.CreatedAt.Format(time.RFC3339Nano),
+			c.UpdatedAt.Format(time.RFC3339Nano),
+			c.Title,
+			c.Owner,
+			c.Start.Format(time.RFC3339Nano),
+			c.End.Format(time.RFC3339Nano),
+			c.Recurrence,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM conference_participants WHERE conference_id = ?`, id); err != nil {
+			return err
+		}
+		for _, uid := range c.Participants {
+			if _, err := tx.Exec(`INSERT INTO conference_participants (conference_id, user_id) VALUES (?, ?)`, id, uid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, sqliteDeleter(tx,
+		`DELETE FROM conferences WHERE id = ?`,
+		`DELETE FROM conference_participants WHERE conference_id = ?`))
+}
+
+// saveSQLiteAddressBooks replaces the rows of the address books that differ
+// from prev.
+func saveSQLiteAddressBooks(tx *sql.Tx, prev, books map[uint]AddressBook) error {
+	deleteBook := sqliteDeleter(tx,
+		`DELETE FROM contacts WHERE user_id = ?`,
+		`DELETE FROM contact_labels WHERE user_id = ?`,
+		`DELETE FROM contact_requests WHERE user_id = ?`,
+		`DELETE FROM blocked_users WHERE user_id = ?`)
+
+	return diffRows(prev, books, func(userId uint, ab AddressBook) error {
+		if err := deleteBook(userId); err != nil {
+			return err
+		}
+		for contactId, c := range ab.Contacts {
+			if _, err := tx.Exec(`INSERT INTO contacts
+				(user_id, contact_id, created_at, updated_at, nickname, favorite)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				userId,
+				contactId,
+				c.CreatedAt.Format(time.RFC3339Nano),
+				c.UpdatedAt.Format(time.RFC3339Nano),
+				c.Nickname,
+				c.Favorite,
+			); err != nil {
+				return err
+			}
+			for _, label := range c.Labels {
+				if _, err := tx.Exec(`INSERT INTO contact_labels (user_id, contact_id, label) VALUES (?, ?, ?)`, userId, contactId, label); err != nil {
+					return err
+				}
+			}
+		}
+		for fromId, at := range ab.Requests {
+			if _, err := tx.Exec(`INSERT INTO contact_requests (user_id, from_id, created_at) VALUES (?, ?, ?)`,
+				userId, fromId, at.Format(time.RFC3339Nano)); err != nil {
+				return err
+			}
+		}
+		for _, blockedId := range ab.Blocked {
+			if _, err := tx.Exec(`INSERT INTO blocked_users (user_id, blocked_id) VALUES (?, ?)`, userId, blockedId); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, deleteBook)
+}
+
+func (s *sqliteStore) FindUserByEmail(email string) (id uint, err error) {
+	err = s.db.QueryRow(`SELECT id FROM users WHERE email_index = ? LIMIT 1`, emailLookupKey(email)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, UserNotFound
+	}
+	return
+}
+
+func (s *sqliteStore) PlaintextEmails() (int, error) {
+	ids, err := sqlitePlaintextEmailIds(s.db)
+	return len(ids), err
+}
+
+func sqlitePlaintextEmailIds(q sqliteQuerier) (ids []uint, err error) {
+	rows, err := q.Query(`SELECT id FROM users WHERE email != '' AND substr(email, 1, ?) != ?`,
+		len(encryptedFieldPrefix), encryptedFieldPrefix)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Compact rebuilds the database file without unused pages.
+func (s *sqliteStore) Compact() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
+
+func sqliteMetaInt(q sqliteQuerier, key string) (int, error) {
+	var v string
+	err := q.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMigrateStoreCommand(t *testing.T) {
+	dir := t.TempDir()
+	us := UserStore{
+		Increment: 3,
+		List: UserList{
+			1: {CreatedAt: time.Now(), UpdatedAt: time.Now(), DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+			3: {CreatedAt: time.Now(), UpdatedAt: time.Now(), DisplayName: "Bob", Email: "bob@email.com", Status: StatusSuspended},
+		},
+		GroupIncrement: 2,
+		Groups: GroupList{
+			1: {CreatedAt: time.Now(), UpdatedAt: time.Now(), Name: "engineering", Members: []uint{1}, Subgroups: []uint{2}},
+			2: {CreatedAt: time.Now(), UpdatedAt: time.Now(), Name: "backend", Description: "APIs", Members: []uint{1, 3}},
+		},
+		ConferenceIncrement: 1,
+		Conferences: ConferenceList{
+			1: {
+				CreatedAt: time.Now(), UpdatedAt: time.Now(), Title: "Standup", Owner: 1, Participants: []uint{3},
+				Start: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC), End: time.Date(2026, 10, 19, 9, 15, 0, 0, time.UTC),
+				Recurrence: "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR",
+			},
+		},
+		AddressBooks: map[uint]AddressBook{
+			1: {
+				Contacts: ContactList{3: {CreatedAt: time.Now(), UpdatedAt: time.Now(), Nickname: "Bobby", Labels: []string{"family", "work"}, Favorite: true}},
+			},
+			3: {
+				Requests: map[uint]time.Time{1: time.Now()},
+				Blocked:  []uint{1},
+			},
+		},
+		ExternalIds: map[uint]string{1: "00u1abcd", 3: "f0b2-3c"},
+		SourceDNs:   map[uint]string{1: "uid=alice,ou=people,dc=example,dc=com"},
+	}
+	src := &jsonStore{path: filepath.Join(dir, "users.json")}
+	require.NoError(t, src.Save(us))
+
+	locations := []string{
+		"json:" + src.path,
+		"sqlite:" + filepath.Join(dir, "users.sqlite"),
+		"bolt:" + filepath.Join(dir, "users.bolt"),
+	}
+	for i := 1; i < len(locations); i++ {
+		stdout, stderr := &strings.Builder{}, &strings.Builder{}
+		code := runMigrateStoreCommand([]string{locations[i-1], locations[i]}, stdout, stderr)
+		require.Equal(t, exitOK, code, stderr.String())
+		assert.Equal(t, "copied 2 users\n", stdout.String())
+	}
+
+	backend, path, err := parseStoreLocation(locations[len(locations)-1])
+	require.NoError(t, err)
+	dst, err := openStore(backend, path)
+	require.NoError(t, err)
+	got, err := dst.Load()
+	require.NoError(t, err)
+	require.NoError(t, dst.Close())
+	assert.Empty(t, cmp.Diff(us, got, cmpopts.IgnoreFields(UserStore{}, "SchemaVersion")))
+
+	stdout, stderr := &strings.Builder{}, &strings.Builder{}
+	assert.Equal(t, exitError, runMigrateStoreCommand(locations[:2], stdout, stderr))
+	assert.Contains(t, stderr.String(), StoreNotEmpty.Error())
+	assert.Equal(t, exitOK, runMigrateStoreCommand(append([]string{"-force"}, locations[:2]...), stdout, stderr))
+}
+
+func TestFindUserByEmail(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			useFieldKey(t)
+			store, err := openStore(backend, filepath.Join(t.TempDir(), "users."+backend))
+			require.NoError(t, err)
+			defer store.Close()
+
+			require.NoError(t, store.Save(UserStore{
+				Increment: 2,
+				List: UserList{
+					1: {DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+					2: {DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+				},
+			}))
+
+			id, err := store.FindUserByEmail(" BOB@email.com")
+			require.NoError(t, err)
+			assert.Equal(t, uint(2), id)
+
+			_, err = store.FindUserByEmail("carol@email.com")
+			assert.ErrorIs(t, err, UserNotFound)
+		})
+	}
+}
+
+func TestStoreSaveChanges(t *testing.T) {
+	// storedEmail returns the ciphertext of the email of user id, which
+	// changes whenever the user is written again.
+	storedEmail := func(t *testing.T, store Store, id uint) (email string) {
+		switch s := store.(type) {
+		case *sqliteStore:
+			require.NoError(t, s.db.QueryRow(`SELECT email FROM users WHERE id = ?`, id).Scan(&email))
+		case *boltStore:
+			require.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+				su := storedUser{}
+				err := json.Unmarshal(tx.Bucket(boltUsersBucket).Get(boltKey(id)), &su)
+				email = su.Email
+				return err
+			}))
+		}
+		return
+	}
+
+	for _, backend := range []string{backendSQLite, backendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			useFieldKey(t)
+			store, err := openStore(backend, filepath.Join(t.TempDir(), "users."+backend))
+			require.NoError(t, err)
+			defer store.Close()
+
+			now := time.Now().UTC()
+			us := UserStore{
+				Increment: 3,
+				List: UserList{
+					1: {CreatedAt: now, UpdatedAt: now, DisplayName: "Alice", Email: "alice@email.com", Status: StatusActive},
+					2: {CreatedAt: now, UpdatedAt: now, DisplayName: "Bob", Email: "bob@email.com", Status: StatusActive},
+					3: {CreatedAt: now, UpdatedAt: now, DisplayName: "Carol", Email: "carol@email.com", Status: StatusActive},
+				},
+				GroupIncrement: 2,
+				Groups: GroupList{
+					1: {CreatedAt: now, UpdatedAt: now, Name: "engineering", Members: []uint{1, 2}, Subgroups: []uint{2}},
+					2: {CreatedAt: now, UpdatedAt: now, Name: "backend", Members: []uint{3}},
+				},
+				AddressBooks: map[uint]AddressBook{1: {Blocked: []uint{3}}},
+				ExternalIds:  map[uint]string{1: "a", 2: "b"},
+			}
+			require.NoError(t, store.Save(us))
+			alice := storedEmail(t, store, 1)
+
+			us, err = store.Load()
+			require.NoError(t, err)
+			bob, carol := us.List[2], us.List[3]
+			bob.Email, carol.Email = carol.Email, bob.Email
+			us.List[2], us.List[3] = bob, carol
+			us.Increment = 4
+			us.List[4] = User{CreatedAt: now, UpdatedAt: now, DisplayName: "Dave", Status: StatusInvited}
+			g := us.Groups[1]
+			g.Members = []uint{1}
+			us.Groups[1] = g
+			delete(us.Groups, 2)
+			delete(us.AddressBooks, 1)
+			us.ExternalIds[2] = "c"
+			delete(us.ExternalIds, 1)
+			require.NoError(t, store.Save(us))
+
+			got, err := store.Load()
+			require.NoError(t, err)
+			assert.Empty(t, cmp.Diff(us, got, cmpopts.IgnoreFields(UserStore{}, "SchemaVersion"), cmpopts.EquateEmpty()))
+			assert.Equal(t, alice, storedEmail(t, store, 1), "unchanged users aren't written again")
+			for email, want := range map[string]uint{"alice@email.com": 1, "bob@email.com": 3, "carol@email.com": 2} {
+				id, err := store.FindUserByEmail(email)
+				require.NoError(t, err)
+				assert.Equal(t, want, id, email)
+			}
+
+			delete(us.List, 3)
+			require.NoError(t, store.Save(us))
+			_, err = store.FindUserByEmail("bob@email.com")
+			assert.ErrorIs(t, err, UserNotFound)
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+)
+
+// tenantNameRe restricts tenant names to what is safe in URLs and file
+// names.
+var tenantNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// tenant is a customer organization with its own users, kept in a store
+// of its own in config.TenantsDir. Tenant stores use the backend of the
+// default store and go through the same startup checks, see prepareStores.
+type tenant struct {
+	name  string
+	store Store
+}
+
+// tenantStores keeps the stores of tenants open between requests, by path.
+// Database backends are expensive to open and bolt locks its file.
+var tenantStores = struct {
+	sync.Mutex
+	open map[string]Store
+}{open: map[string]Store{}}
+
+type tenantCtxKey struct{}
+
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, t)
+}
+
+// tenantFrom returns the name of the tenant a request is for, empty for
+// requests on the default store.
+func tenantFrom(ctx context.Context) string {
+	if t, _ := ctx.Value(tenantCtxKey{}).(*tenant); t != nil {
+		return t.name
+	}
+	return ""
+}
+
+// storeFrom returns the store of the tenant a request is for, the default
+// store db otherwise. Every db* function goes through it, so handlers can't
+// reach the users of another tenant.
+func storeFrom(ctx context.Context) Store {
+	if t, _ := ctx.Value(tenantCtxKey{}).(*tenant); t != nil {
+		return t.store
+	}
+	return db
+}
+
+// storePathFrom returns the path of the store of the tenant of ctx, see
+// storeFrom.
+func storePathFrom(ctx context.Context) string {
+	if t, _ := ctx.Value(tenantCtxKey{}).(*tenant); t != nil {
+		return tenantStorePath(t.name)
+	}
+	return config.StorePath
+}
+
+// backupDirFrom returns where the snapshots of the store of the tenant of
+// ctx are kept, a directory of its own below config.BackupDir for tenants.
+func backupDirFrom(ctx context.Context) string {
+	if t, _ := ctx.Value(tenantCtxKey{}).(*tenant); t != nil {
+		return filepath.Join(config.BackupDir, "tenants", t.name)
+	}
+	return config.BackupDir
+}
+
+func tenantStorePath(name string) string {
+	return filepath.Join(config.TenantsDir, name+"."+config.StoreBackend)
+}
+
+func checkTenantName(name string) error {
+	if !tenantNameRe.MatchString(name) {
+		return fmt.Errorf("%w: %q, use up to 63 lowercase letters, digits and dashes", InvalidTenant, name)
+	}
+	return nil
+}
+
+func openTenant(name string) (*tenant, error) {
+	if err := checkTenantName(name); err != nil {
+		return nil, err
+	}
+	tenantStores.Lock()
+	defer tenantStores.Unlock()
+
+	path := tenantStorePath(name)
+	if store, ok := tenantStores.open[path]; ok {
+		return &tenant{name: name, store: store}, nil
+	}
+	// database backends would create a missing file
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, TenantNotFound
+		}
+		return nil, err
+	}
+	store, err := openStore(config.StoreBackend, path)
+	if err != nil {
+		return nil, err
+	}
+	tenantStores.open[path] = store
+	return &tenant{name: name, store: store}, nil
+}
+
+// closeTenantStores closes the stores openTenant kept open.
+func closeTenantStores() {
+	tenantStores.Lock()
+	defer tenantStores.Unlock()
+
+	for path, store := range tenantStores.open {
+		if err := store.Close(); err != nil {
+			log.Errorf("Closing tenant store %s: %v", path, err)
+		}
+		delete(tenantStores.open, path)
+	}
+}
+
+// createTenant provisions an empty store for a new tenant.
+func createTenant(name string) error {
+	if err := checkTenantName(name); err != nil {
+		return err
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	tenantStores.Lock()
+	defer tenantStores.Unlock()
+
+	path := tenantStorePath(name)
+	if _, err := os.Stat(path); err == nil {
+		return TenantExists
+	}
+	if err := os.MkdirAll(config.TenantsDir, 0755); err != nil {
+		return err
+	}
+	store, err := openStore(config.StoreBackend, path)
+	if err != nil {
+		return err
+	}
+	if err := store.Save(UserStore{List: UserList{}}); err != nil {
+		store.Close()
+		return err
+	}
+	tenantStores.open[path] = store
+	return nil
+}
+
+// deleteTenant removes the store of a tenant with all its users.
+func deleteTenant(name string) error {
+	if err := checkTenantName(name); err != nil {
+		return err
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	tenantStores.Lock()
+	defer tenantStores.Unlock()
+
+	path := tenantStorePath(name)
+	if store, ok := tenantStores.open[path]; ok {
+		delete(tenantStores.open, path)
+		if err := store.Close(); err != nil {
+			return err
+		}
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return TenantNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// what sqlite keeps next to its file
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listTenants returns the names of all tenants, sorted.
+func listTenants() ([]string, error) {
+	files, err := ioutil.ReadDir(config.TenantsDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), "."+config.StoreBackend)
+		if f.Mode().IsRegular() && name != f.Name() && tenantNameRe.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// tenantScope serves requests on the store of the {tenant} in their path.
+func tenantScope(renderError errorRenderer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, err := openTenant(chi.URLParam(r, "tenant"))
+			if err != nil {
+				renderError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), t)))
+		})
+	}
+}
+
+type CreateTenantRequest struct {
+	Name string `json:"name"`
+}
+
+func (c *CreateTenantRequest) Bind(r *http.Request) error {
+	return checkTenantName(c.Name)
+}
+
+type TenantResponse struct {
+	Name string `json:"name"`
+}
+
+func (tr *TenantResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+func NewTenantListResponse(names []string) []render.Renderer {
+	list := []render.Renderer{}
+	for _, name := range names {
+		list = append(list, &TenantResponse{Name: name})
+	}
+	return list
+}
+
+// setTenantRoutes provisions and deletes tenants. Deleting a tenant revokes
+// the API keys bound to it, so they don't return to a tenant created later
+// with the same name.
+func setTenantRoutes(keys *apiKeyStore) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			names, err := listTenants()
+			if err != nil {
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+
+			if err := render.RenderList(w, r, NewTenantListResponse(names)); err != nil {
+				render.Render(w, r, ErrRender(err))
+				return
+			}
+		})
+
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			request := CreateTenantRequest{}
+			if err := render.Bind(r, &request); err != nil {
+				render.Render(w, r, ErrInvalidRequest(err))
+				return
+			}
+
+			if err := createTenant(request.Name); err != nil {
+				if errors.Is(err, TenantExists) {
+					render.Render(w, r, ErrConflict(err))
+					return
+				}
+
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+
+			render.Status(r, http.StatusCreated)
+			render.Render(w, r, &TenantResponse{Name: request.Name})
+		})
+
+		r.Delete("/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+			name := chi.URLParam(r, "tenant")
+			if err := deleteTenant(name); err != nil {
+				if errors.Is(err, InvalidTenant) || errors.Is(err, TenantNotFound) {
+					render.Render(w, r, ErrNotFound(TenantNotFound))
+					return
+				}
+
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+			if err := keys.revokeTenant(name); err != nil {
+				log.Errorf("Revoking API keys of tenant %s: %v", name, err)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
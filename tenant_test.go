@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	useTempStore(t, UserStore{
+		Increment: 1,
+		List:      UserList{1: {DisplayName: "Default", Email: "alice@email.com", Status: StatusActive}},
+	})
+	config.AuthRequired = true
+	keys := newAPIKeyStore(config.APIKeysPath)
+	issue := func(spec APIKey) string {
+		_, token, err := keys.issue(spec)
+		require.NoError(t, err)
+		return token
+	}
+	admin := issue(APIKey{Name: "ops", Role: RoleAdmin})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, body, token string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(apiKeyHeader, token)
+		return testRequest(t, ts, req)
+	}
+	getUser := func(path, token string) (int, UserResponse) {
+		resp, body := request("GET", path, "", token)
+		u := UserResponse{}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.Unmarshal(body, &u))
+		}
+		return resp.StatusCode, u
+	}
+
+	for _, name := range []string{"acme", "globex"} {
+		resp, body := request("POST", "/api/v1/admin/tenants/", `{"name":"`+name+`"}`, admin)
+		require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	}
+	acme := issue(APIKey{Name: "acme", Role: RoleAdmin, Tenant: "acme", UserID: 1})
+	globex := issue(APIKey{Name: "globex", Role: RoleAdmin, Tenant: "globex"})
+
+	// the same email and the same ids in both tenants
+	resp, body := request("POST", "/api/v1/tenants/acme/users/", `{"display_name":"Acme Alice","email":"alice@email.com"}`, acme)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	resp, body = request("POST", "/api/v1/tenants/globex/users/", `{"display_name":"Globex Alice","email":"alice@email.com"}`, globex)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	created := UserResponse{}
+	require.NoError(t, json.Unmarshal(body, &created))
+	assert.Equal(t, uint(1), created.Id, "tenants count ids independently")
+
+	status, u := getUser("/api/v1/tenants/acme/users/1", acme)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Acme Alice", u.DisplayName)
+	status, u = getUser("/api/v1/tenants/globex/users/1", globex)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Globex Alice", u.DisplayName)
+	status, u = getUser("/api/v1/tenants/acme/me", acme)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Acme Alice", u.DisplayName)
+
+	t.Run("changes stay within a tenant", func(t *testing.T) {
+		resp, _ := request("PATCH", "/api/v1/tenants/acme/users/1", `{"display_name":"Acme Alicia"}`, acme)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp, _ = request("POST", "/api/v1/tenants/acme/users/1:suspend", "", acme)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, u := getUser("/api/v1/tenants/globex/users/1", globex)
+		assert.Equal(t, "Globex Alice", u.DisplayName)
+		assert.Equal(t, StatusActive, u.Status)
+		_, u = getUser("/api/v1/users/1", admin)
+		assert.Equal(t, "Default", u.DisplayName)
+
+		resp, body := request("GET", "/api/v1/tenants/globex/users/?email=alice@email.com", "", globex)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, string(body), "Globex Alice")
+		assert.NotContains(t, string(body), "Acme")
+	})
+
+	t.Run("keys are bound to their tenant", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			method string
+			path   string
+			token  string
+			status int
+		}{
+			{"other tenant", "GET", "/api/v1/tenants/globex/users/1", acme, 403},
+			{"other tenant's list", "GET", "/api/v1/tenants/globex/users/", acme, 403},
+			{"delete in other tenant", "DELETE", "/api/v1/tenants/acme/users/1", globex, 403},
+			{"other tenant's me", "GET", "/api/v1/tenants/globex/me", acme, 403},
+			{"default store", "GET", "/api/v1/users/1", acme, 403},
+			{"default me", "GET", "/api/v1/me", acme, 403},
+			{"graphql", "POST", "/api/graphql", acme, 403},
+			{"admin endpoints", "GET", "/api/v1/admin/tenants/", acme, 403},
+			{"unrestricted key on a tenant", "GET", "/api/v1/tenants/acme/users/1", admin, 403},
+			{"unknown tenant", "GET", "/api/v1/tenants/initech/users/", admin, 404},
+			{"invalid tenant", "GET", "/api/v1/tenants/..%2Fusers/users/", admin, 404},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, body := request(tc.method, tc.path, "", tc.token)
+				assert.Equal(t, tc.status, resp.StatusCode, string(body))
+			})
+		}
+
+		_, u := getUser("/api/v1/tenants/acme/users/1", acme)
+		assert.Equal(t, "Acme Alicia", u.DisplayName)
+	})
+
+	t.Run("idempotency keys are per tenant", func(t *testing.T) {
+		create := func(tenant, token string) *http.Response {
+			req, err := http.NewRequest("POST", ts.URL+"/api/v1/tenants/"+tenant+"/users/", strings.NewReader(`{"display_name":"Bob","email":"bob@email.com"}`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(apiKeyHeader, token)
+			req.Header.Set(idempotencyKeyHeader, "create-bob")
+			resp, _ := testRequest(t, ts, req)
+			return resp
+		}
+		assert.Equal(t, http.StatusCreated, create("acme", acme).StatusCode)
+		resp := create("globex", globex)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(idempotentReplayedHeader))
+	})
+
+	t.Run("provisioning", func(t *testing.T) {
+		resp, _ := request("POST", "/api/v1/admin/tenants/", `{"name":"acme"}`, admin)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		resp, _ = request("POST", "/api/v1/admin/tenants/", `{"name":"../etc"}`, admin)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp, body := request("GET", "/api/v1/admin/tenants/", "", admin)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `[{"name":"acme"},{"name":"globex"}]`, string(body))
+
+		resp, _ = request("DELETE", "/api/v1/admin/tenants/globex", "", admin)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp, _ = request("DELETE", "/api/v1/admin/tenants/globex", "", admin)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// its keys don't return with a tenant of the same name
+		resp, _ = request("POST", "/api/v1/admin/tenants/", `{"name":"globex"}`, admin)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		resp, _ = request("GET", "/api/v1/tenants/globex/users/", "", globex)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		resp, body = request("GET", "/api/v1/tenants/globex/users/", "", issue(APIKey{Name: "new", Role: RoleReader, Tenant: "globex"}))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `[]`, string(body))
+	})
+}
+
+func TestTenantBearerTokens(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	require.NoError(t, createTenant("acme"))
+	idp := newTestIdP(t)
+	config.AuthRequired = true
+	config.JWKSPath, config.JWTIssuer, config.JWTAudience = idp.path, testIssuer, testAudience
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	token := idp.sign("rsa", map[string]interface{}{"tenant": "acme"})
+	for path, want := range map[string]int{
+		"/api/v1/tenants/acme/users/": http.StatusOK,
+		"/api/v1/users/":              http.StatusForbidden,
+	} {
+		req := mustRequest(t, "GET", ts.URL+path)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, body := testRequest(t, ts, req)
+		assert.Equal(t, want, resp.StatusCode, "%s: %s", path, body)
+	}
+}
+
+func TestTenantStoreBackend(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	config.StoreBackend = backendBolt
+	t.Cleanup(closeTenantStores)
+
+	require.NoError(t, createTenant("acme"))
+	assert.FileExists(t, filepath.Join(config.TenantsDir, "acme.bolt"))
+	names, err := listTenants()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme"}, names)
+
+	tn, err := openTenant("acme")
+	require.NoError(t, err)
+	ctx := withTenant(context.Background(), tn)
+	id, err := dbCreateUser(ctx, "Acme Alice", "alice@email.com", StatusActive)
+	require.NoError(t, err)
+	u, err := dbGetUser(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Acme Alice", u.DisplayName)
+
+	require.NoError(t, deleteTenant("acme"))
+	assert.NoFileExists(t, filepath.Join(config.TenantsDir, "acme.bolt"))
+	_, err = openTenant("acme")
+	assert.ErrorIs(t, err, TenantNotFound)
+}
+
+func TestPrepareTenantStores(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+	t.Cleanup(closeTenantStores)
+	require.NoError(t, os.MkdirAll(config.TenantsDir, 0755))
+	path := filepath.Join(config.TenantsDir, "acme.json")
+	legacy := `{"increment":1,"list":{"1":{"created_at":"2021-10-14T19:40:42+03:00","display_name":"Alice"}}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(legacy), 0644))
+
+	store, err := prepareStores()
+	require.NoError(t, err)
+	defer store.Close()
+
+	tn, err := openTenant("acme")
+	require.NoError(t, err)
+	us, err := tn.store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, currentSchemaVersion, us.SchemaVersion)
+	assert.Equal(t, StatusActive, us.List[1].Status)
+
+	t.Run("corrupted tenant stores are recovered from their backups", func(t *testing.T) {
+		b, err := createBackup(withTenant(context.Background(), tn))
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(config.BackupDir, "tenants", "acme", b.Name))
+		closeTenantStores()
+		require.NoError(t, ioutil.WriteFile(path, []byte(`{"increment":`), 0644))
+
+		store, err := prepareStores()
+		require.NoError(t, err)
+		defer store.Close()
+
+		tn, err := openTenant("acme")
+		require.NoError(t, err)
+		us, err := tn.store.Load()
+		require.NoError(t, err)
+		assert.Equal(t, "Alice", us.List[1].DisplayName)
+	})
+}
+
+func TestTenantBackups(t *testing.T) {
+	useTempStore(t, UserStore{Increment: 1, List: UserList{1: {DisplayName: "Default", Email: "alice@email.com", Status: StatusActive}}})
+	t.Cleanup(closeTenantStores)
+	require.NoError(t, createTenant("acme"))
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	req := mustRequest(t, "POST", ts.URL+"/api/v1/tenants/acme/admin/backups/")
+	resp, body := testRequest(t, ts, req)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+	b := Backup{}
+	require.NoError(t, json.Unmarshal(body, &b))
+
+	dat, err := readBackup(withTenant(context.Background(), &tenant{name: "acme"}), b.Name)
+	require.NoError(t, err)
+	us, err := decodeUserStore(dat)
+	require.NoError(t, err)
+	assert.Empty(t, us.List, "the backup holds the users of the tenant")
+
+	resp, body = testRequest(t, ts, mustRequest(t, "GET", ts.URL+"/api/v1/admin/backups/"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, string(body), "tenant backups aren't listed with the default store")
+}
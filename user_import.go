@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// maxImportEntries is how many users a single import can create, and
+// maxImportSize how large its body may be.
+const (
+	maxImportEntries = maxPageLimit
+	maxImportSize    = 4 << 20
+)
+
+// UserImportResult is the outcome of one entry of an import.
+type UserImportResult struct {
+	// Index is the position of the entry in the import, starting at 0.
+	Index       int    `json:"index"`
+	Id          uint   `json:"id,omitempty"`
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type UserImportResponse struct {
+	Created int                `json:"created"`
+	Failed  int                `json:"failed"`
+	Results []UserImportResult `json:"results"`
+}
+
+func (ur *UserImportResponse) Render(w http.ResponseWriter, r *http.Request) error { return nil }
+
+// importUsers creates a user for each entry of a list of CreateUserRequest,
+// usually a multi-entry .vcf file sent as text/vcard. Entries that fail, for
+// example because their email is taken, are reported without stopping the
+// others. The rest are created in a single write, so an import that fails
+// with an error has created no one and can be retried as a whole.
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	requests := []CreateUserRequest{}
+	if err := render.Decode(r, &requests); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			render.Render(w, r, ErrTooLarge(fmt.Errorf("up to %d bytes can be imported at once", maxImportSize)))
+			return
+		}
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if len(requests) == 0 {
+		render.Render(w, r, ErrInvalidRequest(errors.New("nothing to import")))
+		return
+	}
+	if len(requests) > maxImportEntries {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("up to %d users can be imported at once", maxImportEntries)))
+		return
+	}
+
+	results := make([]UserImportResult, len(requests))
+	for i := range requests {
+		request := &requests[i]
+		results[i] = UserImportResult{Index: i, DisplayName: request.DisplayName, Email: request.Email}
+
+		err := request.Bind(r)
+		if err == nil && request.DisplayName == "" {
+			err = errors.New("display name is required")
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	if err := dbImportUsers(r.Context(), requests, results); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	resp := &UserImportResponse{Results: results}
+	for _, result := range results {
+		if result.Error != "" {
+			resp.Failed++
+		} else {
+			resp.Created++
+		}
+	}
+	render.Render(w, r, resp)
+}
+
+// dbImportUsers creates a user for each request whose result has no error
+// yet and sets its id. Emails that are taken, by a user or by an earlier
+// request, fail with EmailTaken in the result instead. All users are saved
+// at once, or none if saving fails.
+func dbImportUsers(ctx context.Context, requests []CreateUserRequest, results []UserImportResult) (err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	s, err := loadUserStore(ctx)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	created := 0
+	for i, request := range requests {
+		if results[i].Error != "" {
+			continue
+		}
+		if err := checkEmail(request.Email); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if emailTaken(s, request.Email, 0) {
+			results[i].Error = EmailTaken.Error()
+			continue
+		}
+
+		s.Increment++
+		s.List[s.Increment] = User{
+			CreatedAt:   now,
+			UpdatedAt:   now,
+			DisplayName: request.DisplayName,
+			Email:       request.Email,
+			Status:      request.Status,
+		}
+		results[i].Id = s.Increment
+		created++
+	}
+
+	if created == 0 {
+		return
+	}
+	return saveUserStore(ctx, s)
+}
@@ -0,0 +1,5 @@
+// Package userspb holds the protobuf definition of the gRPC UserService and
+// the code generated from it.
+package userspb
+
+//go:generate protoc -I . --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative users.proto
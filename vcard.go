@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	vcardMediaType = "text/vcard"
+	vcardProductId = calendarProductId
+)
+
+// isVCard reports whether v is a user or a list of them, which is all the
+// vCard format can represent.
+func isVCard(v interface{}) bool {
+	switch v := v.(type) {
+	case *UserResponse:
+		return true
+	case []render.Renderer:
+		for _, item := range v {
+			if _, ok := item.(*UserResponse); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// encodeVCard writes users as RFC 6350 vCards, one after the other. vCard
+// shares the content line format of iCalendar, so calendarWriter folds and
+// escapes them.
+func encodeVCard(w io.Writer, v interface{}) error {
+	var users []*UserResponse
+	switch v := v.(type) {
+	case *UserResponse:
+		users = append(users, v)
+	case []render.Renderer:
+		for _, item := range v {
+			users = append(users, item.(*UserResponse))
+		}
+	default:
+		return fmt.Errorf("vcard can only represent users")
+	}
+
+	cw := &calendarWriter{w: w}
+	for _, u := range users {
+		cw.line("BEGIN:VCARD")
+		cw.line("VERSION:4.0")
+		cw.line("PRODID:" + vcardProductId)
+		cw.line(fmt.Sprintf("UID:user-%d", u.Id))
+		cw.line("KIND:individual")
+		cw.line("FN:" + calendarText(u.DisplayName))
+		if u.Email != "" {
+			cw.line("EMAIL:" + calendarText(u.Email))
+		}
+		cw.line("REV:" + calendarTime(u.UpdatedAt))
+		cw.line("END:VCARD")
+	}
+	return cw.err
+}
+
+// vcardProperty is a content line of a vCard, without its group.
+type vcardProperty struct {
+	name   string
+	params map[string][]string
+	value  string
+}
+
+// decodeVCard reads vCards 3.0 or 4.0 into CreateUserRequest fields: FN, or
+// N when FN is missing, is the display name and the preferred EMAIL the
+// email. A list is decoded into slices, anything else takes exactly one
+// card.
+func decodeVCard(r io.Reader, v interface{}) error {
+	cards, err := readVCards(r)
+	if err != nil {
+		return err
+	}
+
+	list := []interface{}{}
+	for _, card := range cards {
+		list = append(list, vcardUser(card))
+	}
+	if reflect.Indirect(reflect.ValueOf(v)).Kind() == reflect.Slice {
+		return fromGeneric(list, v)
+	}
+	if len(list) != 1 {
+		return fmt.Errorf("vcard request body must hold exactly one card, got %d", len(list))
+	}
+	return fromGeneric(list[0], v)
+}
+
+func vcardUser(card []vcardProperty) object {
+	var fn, n, email string
+	emailPref := 0
+	for _, p := range card {
+		switch p.name {
+		case "FN":
+			if fn == "" {
+				fn = vcardText(p.value)
+			}
+		case "N":
+			n = vcardName(p.value)
+		case "EMAIL":
+			if pref := vcardPref(p); email == "" || pref > emailPref {
+				email, emailPref = vcardText(p.value), pref
+			}
+		}
+	}
+	if fn == "" {
+		fn = n
+	}
+	return object{{"display_name", strings.TrimSpace(fn)}, {"email", strings.TrimSpace(email)}}
+}
+
+// vcardPref ranks properties by preference: PREF=1 (4.0) and TYPE=pref (3.0)
+// are preferred the most, properties without either the least.
+func vcardPref(p vcardProperty) int {
+	for _, t := range p.params["TYPE"] {
+		if strings.EqualFold(t, "pref") {
+			return 100
+		}
+	}
+	for _, v := range p.params["PREF"] {
+		var pref int
+		if _, err := fmt.Sscan(v, &pref); err == nil && pref >= 1 && pref <= 100 {
+			return 101 - pref
+		}
+	}
+	return 0
+}
+
+// vcardName turns "Family;Given;Additional;Prefixes;Suffixes" into a
+// display name.
+func vcardName(value string) string {
+	parts := splitVCardValue(value, ';')
+	for len(parts) < 5 {
+		parts = append(parts, "")
+	}
+	words := []string{}
+	// prefixes, given, additional and family names, then suffixes
+	for _, i := range []int{3, 1, 2, 0, 4} {
+		for _, word := range splitVCardValue(parts[i], ',') {
+			if word = strings.TrimSpace(vcardText(word)); word != "" {
+				words = append(words, word)
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// splitVCardValue splits a structured value at unescaped seps, leaving the
+// escapes in the parts.
+func splitVCardValue(value string, sep rune) []string {
+	parts := []string{}
+	b := &strings.Builder{}
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			b.WriteRune('\\')
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == sep:
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return append(parts, b.String())
+}
+
+var vcardTextUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+func vcardText(s string) string {
+	return vcardTextUnescaper.Replace(s)
+}
+
+// readVCards reads the cards of a vCard stream as lists of properties.
+func readVCards(r io.Reader) (cards [][]vcardProperty, err error) {
+	lines, err := unfoldContentLines(r)
+	if err != nil {
+		return
+	}
+
+	var card []vcardProperty
+	for _, line := range lines {
+		if strings.TrimSpace(line.text) == "" {
+			continue
+		}
+		p, err := parseContentLine(line.text)
+		if err != nil {
+			return nil, fmt.Errorf("vcard: line %d: %w", line.number, err)
+		}
+		switch {
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VCARD"):
+			if card != nil {
+				return nil, fmt.Errorf("vcard: line %d: BEGIN:VCARD inside a card", line.number)
+			}
+			card = []vcardProperty{}
+		case p.name == "END" && strings.EqualFold(p.value, "VCARD"):
+			if card == nil {
+				return nil, fmt.Errorf("vcard: line %d: END:VCARD outside a card", line.number)
+			}
+			cards = append(cards, card)
+			card = nil
+		case card == nil:
+			return nil, fmt.Errorf("vcard: line %d: %s outside a card", line.number, p.name)
+		default:
+			card = append(card, p)
+		}
+	}
+	if card != nil {
+		return nil, fmt.Errorf("vcard: missing END:VCARD")
+	}
+	return
+}
+
+// contentLine is an unfolded content line and the number of the line it
+// starts on.
+type contentLine struct {
+	number int
+	text   string
+}
+
+// unfoldContentLines joins lines starting with a space or a tab to the
+// previous one. Both CRLF and bare LF line endings are accepted.
+func unfoldContentLines(r io.Reader) ([]contentLine, error) {
+	lines := []contentLine{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		lines = append(lines, contentLine{n, text})
+	}
+	return lines, scanner.Err()
+}
+
+// parseContentLine parses "[group.]NAME[;param=value[,value]...]:value".
+func parseContentLine(line string) (p vcardProperty, err error) {
+	colon := -1
+	quoted := false
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return p, fmt.Errorf("missing ':' in %q", line)
+	}
+	p.value = line[colon+1:]
+
+	parts := strings.Split(line[:colon], ";")
+	p.name = strings.ToUpper(parts[0])
+	if dot := strings.LastIndexByte(p.name, '.'); dot >= 0 {
+		p.name = p.name[dot+1:]
+	}
+	if p.name == "" {
+		return p, fmt.Errorf("missing property name in %q", line)
+	}
+
+	p.params = map[string][]string{}
+	for _, param := range parts[1:] {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			// vCard 3.0 allows bare types, as in EMAIL;INTERNET;PREF
+			name, value = "TYPE", param
+		}
+		name = strings.ToUpper(name)
+		for _, v := range strings.Split(value, ",") {
+			p.params[name] = append(p.params[name], strings.Trim(v, `"`))
+		}
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVCard(t *testing.T) {
+	updatedAt := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	useTempStore(t, UserStore{
+		Increment: 2,
+		List: UserList{
+			1: {UpdatedAt: updatedAt, DisplayName: "Doe, Jane; PhD", Email: "jane@email.com", Status: StatusActive},
+			2: {UpdatedAt: updatedAt, DisplayName: "Bob", Status: StatusActive},
+		},
+	})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(method, path, header, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if method == "GET" {
+			req.Header.Set("Accept", header)
+		} else {
+			req.Header.Set("Content-Type", header)
+		}
+		return testRequest(t, ts, req)
+	}
+
+	t.Run("export", func(t *testing.T) {
+		resp, body := request("GET", "/users/1", "text/vcard", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		assert.Equal(t, "text/vcard; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, strings.Join([]string{
+			"BEGIN:VCARD",
+			"VERSION:4.0",
+			"PRODID:" + calendarProductId,
+			"UID:user-1",
+			"KIND:individual",
+			`FN:Doe\, Jane\; PhD`,
+			"EMAIL:jane@email.com",
+			"REV:20261018T123000Z",
+			"END:VCARD",
+			"",
+		}, "\r\n"), string(body))
+
+		resp, body = request("GET", "/users/", "text/vcard", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		assert.Equal(t, 2, strings.Count(string(body), "BEGIN:VCARD"))
+		assert.Contains(t, string(body), "UID:user-2\r\nKIND:individual\r\nFN:Bob\r\nREV:")
+
+		// only users are cards
+		resp, _ = request("GET", "/presence/?ids=1", "text/vcard", "")
+		assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		vcf := strings.Join([]string{
+			"BEGIN:VCARD",
+			"VERSION:3.0",
+			"N:Lovelace;Ada;King;Countess;",
+			"EMAIL;TYPE=INTERNET:ada@home.example",
+			"EMAIL;TYPE=INTERNET,pref:ada@email.com",
+			"END:VCARD",
+			"BEGIN:VCARD",
+			"VERSION:4.0",
+			"item1.FN:Grace Brewster Murray Hop",
+			" per",
+			"EMAIL;PREF=2:grace@home.example",
+			"EMAIL;PREF=1:grace@email.com",
+			"END:VCARD",
+			"BEGIN:VCARD",
+			"VERSION:4.0",
+			"FN:Jane again",
+			"EMAIL:JANE@email.com",
+			"END:VCARD",
+			"BEGIN:VCARD",
+			"VERSION:4.0",
+			"EMAIL:nameless@email.com",
+			"END:VCARD",
+		}, "\r\n")
+		resp, body := request("POST", "/users/import", "text/vcard", vcf)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+		report := UserImportResponse{}
+		require.NoError(t, json.Unmarshal(body, &report))
+		assert.Equal(t, 2, report.Created)
+		assert.Equal(t, 2, report.Failed)
+		require.Len(t, report.Results, 4)
+		assert.Equal(t, UserImportResult{Index: 0, Id: 3, DisplayName: "Countess Ada King Lovelace", Email: "ada@email.com"}, report.Results[0])
+		assert.Equal(t, UserImportResult{Index: 1, Id: 4, DisplayName: "Grace Brewster Murray Hopper", Email: "grace@email.com"}, report.Results[1])
+		assert.Equal(t, EmailTaken.Error(), report.Results[2].Error)
+		assert.Equal(t, "display name is required", report.Results[3].Error)
+
+		u, err := dbGetUser(context.Background(), 4)
+		require.NoError(t, err)
+		assert.Equal(t, StatusActive, u.Status)
+	})
+
+	t.Run("create from a single card", func(t *testing.T) {
+		resp, body := request("POST", "/users", "text/vcard", "BEGIN:VCARD\nVERSION:4.0\nFN:Carol\nEND:VCARD\n")
+		require.Equal(t, http.StatusCreated, resp.StatusCode, string(body))
+		assert.Contains(t, string(body), `"display_name":"Carol"`)
+	})
+
+	t.Run("invalid imports", func(t *testing.T) {
+		tests := []struct {
+			name string
+			body string
+		}{
+			{"empty", ""},
+			{"unterminated", "BEGIN:VCARD\r\nFN:Ada\r\n"},
+			{"outside a card", "FN:Ada\r\n"},
+			{"nested", "BEGIN:VCARD\r\nBEGIN:VCARD\r\n"},
+			{"not a content line", "BEGIN:VCARD\r\nAda Lovelace\r\nEND:VCARD\r\n"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, body := request("POST", "/users/import", "text/vcard", tc.body)
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode, string(body))
+			})
+		}
+	})
+}
+
+// failingSaveStore is a store that can't be written to.
+type failingSaveStore struct{ Store }
+
+func (s failingSaveStore) Save(us UserStore) error { return errors.New("disk full") }
+
+func TestImportUsersAtOnce(t *testing.T) {
+	useTempStore(t, UserStore{List: UserList{}})
+
+	router := chi.NewRouter()
+	setRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	request := func(body string) (*http.Response, []byte) {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/users/import", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, ts, req)
+	}
+
+	resp, body := request(`[{"display_name":"Ada","email":"ada@email.com"},{"display_name":"Ada again","email":"ADA@email.com"}]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	report := UserImportResponse{}
+	require.NoError(t, json.Unmarshal(body, &report))
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, EmailTaken.Error(), report.Results[1].Error)
+
+	store := db
+	db = failingSaveStore{store}
+	resp, body = request(`[{"display_name":"Grace"},{"display_name":"Carol"}]`)
+	db = store
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode, string(body))
+
+	us, err := getUserStore()
+	require.NoError(t, err)
+	assert.Len(t, us.List, 1, "a failed import creates no one")
+
+	resp, body = request(`[{"display_name":"` + strings.Repeat("x", maxImportSize) + `"}]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, string(body))
+}